@@ -2,6 +2,12 @@
 
 CONFIG_PATH="/homeassistant/rclone.conf"
 
+# standalone the scheduler loads its own config and sets up the rclone config from it
+if [ -z "${SUPERVISOR_TOKEN:-}" ]; then
+  bashio::log.info "Running standalone without the Home Assistant Supervisor"
+  exit 0
+fi
+
 # backwards compatible with config directory
 ln -s "/homeassistant" "/config" \
     || bashio::log.warning "Failed linking common directory: /config"
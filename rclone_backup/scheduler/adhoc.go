@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/jcwillox/emerald"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// blockedCommands are rclone subcommands that never exit or need a terminal
+var blockedCommands = []string{"mount", "nfsmount", "serve", "rcd", "ncdu", "config", "selfupdate", "bisync", "test"}
+
+// ExecRequest is the request body of the ad-hoc command endpoint
+type ExecRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// flushWriter flushes each write so output is streamed to the client
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
+
+// HandleExec runs an rclone subcommand and streams its combined output,
+// the exit code is sent as the X-Exit-Code trailer
+func HandleExec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// unlike other endpoints this is never open to unauthenticated requests
+	if !tokens.Enabled() {
+		http.Error(w, "ad-hoc commands require an admin api token to be configured", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var req ExecRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Command = strings.TrimSpace(req.Command)
+	if req.Command == "" || strings.HasPrefix(req.Command, "-") {
+		http.Error(w, "command is required", http.StatusBadRequest)
+		return
+	}
+	if ArrayContains(blockedCommands, req.Command) {
+		http.Error(w, "command '"+req.Command+"' cannot be run through the api", http.StatusBadRequest)
+		return
+	}
+	if ArrayContains(destructiveCommands, req.Command) && !RequireConfirmation(w, r, "rclone "+req.Command) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	args := append([]string{req.Command}, req.Args...)
+	Infoln("running ad-hoc command", emerald.Yellow+"rclone "+strings.Join(args, " "))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", "X-Exit-Code")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	// the command is killed if the client disconnects
+	out := flushWriter{w, flusher}
+	cmd := exec.CommandContext(r.Context(), RcloneBinary(), args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		code = -1
+		_, _ = out.Write([]byte(err.Error() + "\n"))
+	}
+	w.Header().Set("X-Exit-Code", strconv.Itoa(code))
+}
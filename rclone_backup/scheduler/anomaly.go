@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// SizeAnomalyWindow is the number of previous successful runs averaged
+	SizeAnomalyWindow = 5
+	// SizeAnomalyMinRuns is the number of previous runs required before checking
+	SizeAnomalyMinRuns = 3
+)
+
+type SizeAnomalyEventData struct {
+	Name      string  `json:"name"`
+	Bytes     int64   `json:"bytes"`
+	Average   int64   `json:"average"`
+	Percent   float64 `json:"percent"`
+	Threshold float64 `json:"threshold"`
+	Note      string  `json:"note,omitempty"`
+}
+
+// CheckSizeAnomaly warns when a successful run transferred far less than the
+// recent average, which usually means the source was empty or unmounted
+func CheckSizeAnomaly(job JobConfig, record RunRecord) {
+	if job.SizeAnomaly <= 0 || !IsSuccess(record.State) {
+		return
+	}
+	var total int64
+	count := 0
+	for _, run := range history.Runs(job.Index) {
+		if run.ID == record.ID || !IsSuccess(run.State) || run.Bytes <= 0 {
+			continue
+		}
+		total += run.Bytes
+		count++
+		if count == SizeAnomalyWindow {
+			break
+		}
+	}
+	if count < SizeAnomalyMinRuns {
+		return
+	}
+	average := total / int64(count)
+	percent := float64(record.Bytes) / float64(average) * 100
+	if percent >= job.SizeAnomaly {
+		return
+	}
+
+	name := JobName(job)
+	msg := fmt.Sprintf("%s transferred %s, only %s%% of the recent average of %s; the source may be empty or unmounted",
+		name, FormatBytes(record.Bytes), FormatPercent(percent), FormatBytes(average))
+	if job.Note != "" {
+		msg += " (note: " + job.Note + ")"
+	}
+	Warnln(msg)
+	Notify(fmt.Sprintf("size_anomaly_%d", job.Index), "Rclone Backup: suspiciously small backup", msg)
+	FireEvent(EventSizeAnomaly, SizeAnomalyEventData{
+		Name: job.Name, Bytes: record.Bytes, Average: average, Percent: percent, Threshold: job.SizeAnomaly, Note: job.Note,
+	})
+}
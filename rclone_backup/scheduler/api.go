@@ -1,70 +1,1326 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const apiPort = "8098"
 
 // JobSummary is the API view of a job for listing
 type JobSummary struct {
-	Index    int    `json:"index"`
-	Name     string `json:"name"`
-	Schedule string `json:"schedule"`
-	Command  string `json:"command,omitempty"`
-	Run      string `json:"run,omitempty"`
-	Type     string `json:"type"` // "rclone" or "run"
+	Index    int        `json:"index"`
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	Command  string     `json:"command,omitempty"`
+	Run      string     `json:"run,omitempty"`
+	Type     string     `json:"type"` // "rclone", "run", "steps" or "restore_test"
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	Warnings []string   `json:"warnings,omitempty"`
+}
+
+// jobSummarySorts are the fields /api/jobs can be sorted by
+var jobSummarySorts = ListSorts[JobSummary]{
+	"index":    func(a, b JobSummary) int { return a.Index - b.Index },
+	"name":     func(a, b JobSummary) int { return compareNames(a.Name, b.Name) },
+	"type":     func(a, b JobSummary) int { return strings.Compare(a.Type, b.Type) },
+	"next_run": func(a, b JobSummary) int { return compareTimes(a.NextRun, b.NextRun) },
+}
+
+// JobSummaryCard is the compact view of a job for dashboard cards
+type JobSummaryCard struct {
+	Index       int        `json:"index"`
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+	Progress    string     `json:"progress,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	ErrorClass  string     `json:"error_class,omitempty"`
+	Paused      string     `json:"paused,omitempty"`       // reason the job is paused
+	Snoozed     *time.Time `json:"snoozed,omitempty"`      // the scheduled run that is skipped
+	Postponed   *time.Time `json:"postponed,omitempty"`    // when the snoozed run happens instead
+	FailedFiles int        `json:"failed_files,omitempty"` // files of the last run that can be retried
+	SLABreached bool       `json:"sla_breached,omitempty"` // the last success is older than the job's max_age
+	Warnings    []string   `json:"warnings,omitempty"`
+	RunWarnings []string   `json:"run_warnings,omitempty"` // problems of the last run that did not fail it
+}
+
+// jobCardSorts are the fields /api/summary can be sorted by
+var jobCardSorts = ListSorts[JobSummaryCard]{
+	"index":    func(a, b JobSummaryCard) int { return a.Index - b.Index },
+	"name":     func(a, b JobSummaryCard) int { return compareNames(a.Name, b.Name) },
+	"state":    func(a, b JobSummaryCard) int { return strings.Compare(a.State, b.State) },
+	"last_run": func(a, b JobSummaryCard) int { return compareTimes(a.LastRun, b.LastRun) },
+	"next_run": func(a, b JobSummaryCard) int { return compareTimes(a.NextRun, b.NextRun) },
+}
+
+// runSorts are the fields the history of a job can be sorted by, it is newest first by default
+var runSorts = ListSorts[RunRecord]{
+	"start":    func(a, b RunRecord) int { return a.Start.Compare(b.Start) },
+	"duration": func(a, b RunRecord) int { return cmp.Compare(a.End.Sub(a.Start), b.End.Sub(b.Start)) },
+	"bytes":    func(a, b RunRecord) int { return cmp.Compare(a.Bytes, b.Bytes) },
+	"files":    func(a, b RunRecord) int { return cmp.Compare(a.Files, b.Files) },
+	"state":    func(a, b RunRecord) int { return strings.Compare(a.State, b.State) },
+}
+
+// maxModifiedEntries bounds the responses whose last change is remembered, it is cleared when full
+const maxModifiedEntries = 512
+
+// responseVersion is the ETag of the last response to a URL and when it changed to it
+type responseVersion struct {
+	etag     string
+	modified time.Time
+}
+
+// modifiedTimes remembers when the response to each URL last changed, for the Last-Modified header
+var modifiedTimes = struct {
+	mu       sync.Mutex
+	versions map[string]responseVersion
+}{versions: make(map[string]responseVersion)}
+
+// lastModified returns when the response to a URL changed to the one with the ETag, to the second as the header
+// has no more precision
+func lastModified(uri string, etag string) time.Time {
+	modifiedTimes.mu.Lock()
+	defer modifiedTimes.mu.Unlock()
+	version, ok := modifiedTimes.versions[uri]
+	if !ok || version.etag != etag {
+		if len(modifiedTimes.versions) >= maxModifiedEntries {
+			clear(modifiedTimes.versions)
+		}
+		version = responseVersion{etag: etag, modified: time.Now().UTC().Truncate(time.Second)}
+		modifiedTimes.versions[uri] = version
+	}
+	return version.modified
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag, weakly compared
+func etagMatches(header string, etag string) bool {
+	for _, match := range strings.Split(header, ",") {
+		match = strings.TrimSpace(match)
+		if match == "*" || strings.TrimPrefix(match, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSONWithETag encodes v as JSON and responds with 304 when the client's copy matches, by its ETag or, for
+// clients that only send If-Modified-Since, by when the response last changed
+func WriteJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	modified := lastModified(r.URL.RequestURI(), etag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		// If-Modified-Since is ignored when the client has an ETag
+		if etagMatches(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func writeAccepted(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte(`{"status":"accepted"}`))
+}
+
+// writeSavedConfig answers a request that saved the config with its validation, 422 when it was invalid, and
+// restarts the addon if asked to
+func writeSavedConfig(w http.ResponseWriter, validation ConfigValidation, err error, restart bool) {
+	if errors.Is(err, ErrInvalidConfig) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(validation)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if restart {
+		if err := RestartAddon(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(validation)
 }
 
 // StartAPIServer starts the HTTP server for the jobs API and UI in a goroutine
-func StartAPIServer(runnables []func()) {
+func StartAPIServer() {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/api/jobs", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/jobs", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
+		query, err := ParseListQuery(r, jobSummarySorts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		list := make([]JobSummary, 0, len(config.Jobs))
 		for i, job := range config.Jobs {
 			schedule := job.Schedule
 			if schedule == "" {
 				schedule = "(on demand / startup)"
 			}
-			summary := JobSummary{Index: i, Name: job.Name, Schedule: schedule}
-			if job.Run != "" {
+			summary := JobSummary{Index: i, Name: job.Name, Schedule: schedule, NextRun: NextRun(i), Warnings: job.Warnings}
+			if len(job.Steps) > 0 {
+				summary.Type = "steps"
+			} else if job.Run != "" {
 				summary.Run = job.Run
 				summary.Type = "run"
+			} else if job.Command == CommandRestoreTest {
+				summary.Type = CommandRestoreTest
 			} else {
 				summary.Command = job.Command
 				summary.Type = "rclone"
 			}
-			list = append(list, summary)
+			if MatchesFilter(r, "type", summary.Type) && MatchesFilter(r, "status", statuses.Get(i).State) {
+				list = append(list, summary)
+			}
+		}
+		WriteJSONWithETag(w, r, Page(w, list, query, jobSummarySorts))
+	}))
+
+	// authenticated before the index is looked up so unauthenticated requests can't tell which jobs exist,
+	// actions that need a higher scope check it again
+	mux.HandleFunc("/api/jobs/", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		// /api/jobs/N/<action> or /api/jobs/N
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/", 2)
+		index, err := strconv.Atoi(parts[0])
+		if err != nil || index < 0 || index >= len(config.Jobs) {
+			http.Error(w, "invalid job index", http.StatusBadRequest)
+			return
+		}
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+
+		switch {
+		case r.Method == http.MethodGet && action == "status":
+			RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+				WriteJSONWithETag(w, r, statuses.Get(index))
+			})(w, r)
+		case r.Method == http.MethodGet && action == "history":
+			RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+				query, err := ParseListQuery(r, runSorts)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				runs := make([]RunRecord, 0)
+				for _, run := range history.Runs(index) {
+					if MatchesFilter(r, "status", run.State) && MatchesFilter(r, "trigger", run.Trigger) {
+						runs = append(runs, run)
+					}
+				}
+				WriteJSONWithETag(w, r, Page(w, runs, query, runSorts))
+			})(w, r)
+		case r.Method == http.MethodGet && action == "diff":
+			RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+				diff, err := DiffRuns(index, r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(diff)
+			})(w, r)
+		case r.Method == http.MethodGet && strings.HasPrefix(action, "runs/"):
+			// runs/<id>/artifacts, runs/<id>/artifacts/<name>, runs/<id>/bundle, runs/<id>/log or runs/<id>/speed
+			RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+				path := strings.Split(action, "/")
+				if len(path) == 3 && path[2] == "bundle" {
+					// buffer the zip so errors can still be returned as a status
+					var buf bytes.Buffer
+					if err := WriteRunBundle(&buf, index, path[1]); errors.Is(err, ErrNoArtifacts) {
+						http.Error(w, err.Error(), http.StatusNotFound)
+						return
+					} else if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					name := strconv.Itoa(index) + "_" + path[1] + ".zip"
+					w.Header().Set("Content-Type", "application/zip")
+					w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+					_, _ = w.Write(buf.Bytes())
+					return
+				}
+				if len(path) == 3 && path[2] == "log" {
+					ServeRunLog(w, r, index, path[1])
+					return
+				}
+				if len(path) == 3 && path[2] == "speed" {
+					samples, err := RunSpeed(index, path[1])
+					if errors.Is(err, ErrNoSpeedSamples) {
+						http.Error(w, err.Error(), http.StatusNotFound)
+						return
+					} else if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					WriteJSONWithETag(w, r, samples)
+					return
+				}
+				if len(path) < 3 || len(path) > 4 || path[2] != "artifacts" {
+					http.NotFound(w, r)
+					return
+				}
+				if len(path) == 3 {
+					artifacts, err := ListArtifacts(index, path[1])
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					w.Header().Set("Content-Type", "application/json")
+					_ = json.NewEncoder(w).Encode(artifacts)
+					return
+				}
+				file, err := ArtifactPath(index, path[1], path[3])
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if stat, err := os.Stat(file); err != nil || stat.IsDir() {
+					http.Error(w, "artifact not found", http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Disposition", `attachment; filename="`+path[3]+`"`)
+				http.ServeFile(w, r, file)
+			})(w, r)
+		case r.Method == http.MethodGet && action == "trash":
+			RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+				job := config.Jobs[index]
+				if !job.Trash.Enabled {
+					http.Error(w, "job has no trash", http.StatusNotFound)
+					return
+				}
+				// ?entry= lists the files trashed by one run
+				entry := r.URL.Query().Get("entry")
+				list := make([]TrashEntry, 0)
+				for _, destination := range JobDestinations(job) {
+					entries, err := ListTrash(r.Context(), job, destination)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadGateway)
+						return
+					}
+					for _, e := range entries {
+						if entry != "" && e.Entry != entry {
+							continue
+						}
+						if entry != "" {
+							e.Files, _ = ListTrashFiles(r.Context(), job, destination, e.Entry)
+						}
+						list = append(list, e)
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(list)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "trash/restore":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				if !RequireConfirmation(w, r, "restoring from the trash of "+JobName(config.Jobs[index])) {
+					return
+				}
+				var restore TrashRestore
+				if err := json.NewDecoder(r.Body).Decode(&restore); err != nil {
+					http.Error(w, "invalid request body", http.StatusBadRequest)
+					return
+				}
+				if !config.Jobs[index].Trash.Enabled {
+					http.Error(w, "job has no trash", http.StatusNotFound)
+					return
+				}
+				if err := RestoreTrash(r.Context(), config.Jobs[index], restore); errors.Is(err, ErrNotInTrash) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "retention/preview":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				// the body is optional, rules to preview instead of the configured ones
+				var overrides RetentionOverrides
+				if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil && !errors.Is(err, io.EOF) {
+					http.Error(w, "invalid request body", http.StatusBadRequest)
+					return
+				}
+				job, err := overrides.Apply(config.Jobs[index])
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				previews, err := PreviewRetention(r.Context(), job)
+				if errors.Is(err, ErrNoRetention) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(previews)
+			})(w, r)
+		case r.Method == http.MethodGet && action == "schedule-once":
+			RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(onceRuns.List(index))
+			})(w, r)
+		case r.Method == http.MethodPost && action == "schedule-once":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					At   string `json:"at"`
+					Note string `json:"note"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, "invalid request body", http.StatusBadRequest)
+					return
+				}
+				at, err := ParseRunTime(body.At)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				run, err := onceRuns.Add(config.Jobs[index], at, body.Note)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				_ = json.NewEncoder(w).Encode(run)
+			})(w, r)
+		case r.Method == http.MethodDelete && strings.HasPrefix(action, "schedule-once/"):
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				if !onceRuns.Cancel(index, strings.TrimPrefix(action, "schedule-once/")) {
+					http.Error(w, "planned run not found", http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})(w, r)
+		case r.Method == http.MethodPost && (action == "run" || action == ""):
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				overrides, err := DecodeRunOverrides(r)
+				if err != nil {
+					http.Error(w, "invalid request body", http.StatusBadRequest)
+					return
+				}
+				job, err := overrides.Apply(config.Jobs[index])
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				job.Trigger = TriggerManual
+				go RunTracked(job)
+				writeAccepted(w)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "cancel":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				if !statuses.Cancel(index) {
+					http.Error(w, "job is not running", http.StatusConflict)
+					return
+				}
+				writeAccepted(w)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "pause":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				pauses.Pause(config.Jobs[index], "paused through the api")
+				writeAccepted(w)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "resume":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				if !pauses.Resume(index) {
+					http.Error(w, "job is not paused", http.StatusConflict)
+					return
+				}
+				writeAccepted(w)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "snooze":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				var duration time.Duration
+				if value := r.URL.Query().Get("duration"); value != "" {
+					d, err := ParseAge(value)
+					if err != nil || d <= 0 {
+						http.Error(w, "invalid duration '"+value+"'", http.StatusBadRequest)
+						return
+					}
+					duration = d
+				}
+				snoozed, err := snoozes.Snooze(config.Jobs[index], duration)
+				if errors.Is(err, ErrNotScheduled) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(snoozed)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "unsnooze":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				if !snoozes.Unsnooze(index) {
+					http.Error(w, "job is not snoozed", http.StatusConflict)
+					return
+				}
+				writeAccepted(w)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "retry-failed":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				job, ok := statuses.RetryFailedFilesJob(index)
+				if !ok {
+					http.Error(w, "last run of job has no failed files to retry", http.StatusConflict)
+					return
+				}
+				job.Trigger = TriggerRetry
+				go RunTracked(job)
+				writeAccepted(w)
+			})(w, r)
+		case r.Method == http.MethodPost && action == "retry":
+			RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+				job, ok := statuses.RetryJob(index)
+				if !ok {
+					http.Error(w, "last run of job did not fail", http.StatusConflict)
+					return
+				}
+				job.Trigger = TriggerRetry
+				go RunTracked(job)
+				writeAccepted(w)
+			})(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/exec", RequireScope(ScopeAdmin, HandleExec))
+
+	mux.HandleFunc("/api/rclone", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(GetRcloneInfo())
+	}))
+
+	mux.HandleFunc("/api/capabilities", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(GetCapabilities())
+	}))
+
+	mux.HandleFunc("/api/health", RequireScope(ScopeViewer, HandleHealth))
+	mux.HandleFunc("/api/health/live", HandleProbe(Liveness))
+	mux.HandleFunc("/api/health/ready", HandleProbe(Readiness))
+
+	mux.HandleFunc("/api/grpc/scheduler.proto", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(SchedulerProto))
+	}))
+
+	mux.HandleFunc("/api/logs/search", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		search := LogSearch{Query: query.Get("q")}
+		var err error
+		if job := query.Get("job"); job != "" {
+			index, err := strconv.Atoi(job)
+			if err != nil || index < 0 || index >= len(config.Jobs) {
+				http.Error(w, "invalid job index", http.StatusBadRequest)
+				return
+			}
+			search.Job = &index
+		}
+		if search.Since, err = ParseLogTime(query.Get("since"), false); err != nil {
+			http.Error(w, "invalid since, use a date such as 2024-07-01 or a timestamp", http.StatusBadRequest)
+			return
+		}
+		if search.Until, err = ParseLogTime(query.Get("until"), true); err != nil {
+			http.Error(w, "invalid until, use a date such as 2024-07-31 or a timestamp", http.StatusBadRequest)
+			return
+		}
+		if limit := query.Get("limit"); limit != "" {
+			if search.Limit, err = strconv.Atoi(limit); err != nil {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		matches, truncated, err := SearchLogs(search)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"matches": matches, "truncated": truncated})
+	}))
+
+	mux.HandleFunc("/api/calendar", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		days := DefaultCalendarDays
+		if value := r.URL.Query().Get("days"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 31 {
+				http.Error(w, "days must be between 1 and 31", http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(GetCalendar(days))
+	}))
+
+	mux.HandleFunc("/api/quota", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(GetQuotas())
+	}))
+
+	mux.HandleFunc("/api/circuits", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(breaker.Circuits())
+	}))
+
+	mux.HandleFunc("/api/circuits/", RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+		remote, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/circuits/"), "/")
+		if r.Method != http.MethodPost || action != "reset" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !strings.HasSuffix(remote, ":") {
+			remote += ":"
+		}
+		if !breaker.Reset(remote) {
+			http.NotFound(w, r)
+			return
+		}
+		writeAccepted(w)
+	}))
+
+	mux.HandleFunc("/api/hostkeys", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		keys, err := ListHostKeys(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(keys)
+	}))
+
+	mux.HandleFunc("/api/hostkeys/", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		remote, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/hostkeys/"), "/")
+		remote = remoteName(remote)
+		switch {
+		case r.Method == http.MethodPost && action == "pin":
+			keys, err := PinHostKeys(r.Context(), remote)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(keys)
+		case r.Method == http.MethodPost && action == "check":
+			settings := RemoteConfigOf(remote)
+			if settings == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if err := CheckServer(r.Context(), *settings); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeAccepted(w)
+		case r.Method == http.MethodDelete && action == "":
+			removed, err := UnpinHostKeys(r.Context(), remote)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			if !removed {
+				http.NotFound(w, r)
+				return
+			}
+			writeAccepted(w)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/pacing", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(pacing.List())
+	}))
+
+	mux.HandleFunc("/api/pacing/", RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+		remote, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/pacing/"), "/")
+		if r.Method != http.MethodPost || action != "reset" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !strings.HasSuffix(remote, ":") {
+			remote += ":"
+		}
+		if !pacing.Reset(remote) {
+			http.NotFound(w, r)
+			return
+		}
+		writeAccepted(w)
+	}))
+
+	mux.HandleFunc("/api/staging", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(staging.Usage())
+	}))
+
+	mux.HandleFunc("/api/stats/remotes", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		period := r.URL.Query().Get("period")
+		if period != "" && period != "day" && period != "month" {
+			http.Error(w, "period must be day or month", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(traffic.List(r.URL.Query().Get("remote"), period != "day"))
+	}))
+
+	mux.HandleFunc("/api/drive/accounts", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(driveAccounts.List())
+	}))
+
+	mux.HandleFunc("/api/drive/shared", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		remote := r.URL.Query().Get("remote")
+		if remote == "" {
+			http.Error(w, "remote is required", http.StatusBadRequest)
+			return
+		}
+		drives, err := ListSharedDrives(r.Context(), remote)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(drives)
+	}))
+
+	mux.HandleFunc("/api/glacier/status", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target := r.URL.Query().Get("path")
+		if !strings.Contains(target, ":") {
+			http.Error(w, "path must be a remote path", http.StatusBadRequest)
+			return
+		}
+		objects, err := GlacierStatus(r.Context(), target, r.URL.Query().Get("file") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(objects)
+	}))
+
+	mux.HandleFunc("/api/glacier/restore", RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var restore GlacierRestore
+		if err := json.NewDecoder(r.Body).Decode(&restore); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !strings.Contains(restore.Path, ":") {
+			http.Error(w, "path must be a remote path", http.StatusBadRequest)
+			return
+		}
+		if restore.Priority != "" && !ArrayContains(glacierPriorities, restore.Priority) {
+			http.Error(w, "priority must be one of "+strings.Join(glacierPriorities, ", "), http.StatusBadRequest)
+			return
+		}
+		if err := StartGlacierRestore(r.Context(), restore.Path, restore.File, restore.Days, restore.Priority); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeAccepted(w)
+	}))
+
+	mux.HandleFunc("/api/costs", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = time.Now().Format("2006-01")
+		} else if _, err := time.Parse("2006-01", month); err != nil {
+			http.Error(w, "month must look like 2024-07", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(EstimateCosts(month))
+	}))
+
+	mux.HandleFunc("/api/budget", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(budget.Usage())
+	}))
+
+	mux.HandleFunc("/api/queue", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(runQueue.List())
+	}))
+
+	mux.HandleFunc("/api/queue/", RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/queue/"), "/")
+		if r.Method != http.MethodPost || action != "prioritize" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !runQueue.Prioritize(id) {
+			http.Error(w, "run is not waiting in the queue", http.StatusNotFound)
+			return
+		}
+		writeAccepted(w)
+	}))
+
+	mux.HandleFunc("/api/catalog", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(catalog.Folders())
+	}))
+
+	mux.HandleFunc("/api/catalog/refresh", RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		go catalog.Refresh()
+		writeAccepted(w)
+	}))
+
+	mux.HandleFunc("/api/dedupe", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(dedupe.Reports())
+	}))
+
+	mux.HandleFunc("/api/dedupe/refresh", RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		go dedupe.Refresh()
+		writeAccepted(w)
+	}))
+
+	mux.HandleFunc("/api/dedupe/resolve", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !RequireConfirmation(w, r, "resolving duplicates") {
+			return
+		}
+		var body struct {
+			Path string `json:"path"`
+			Name string `json:"name"`
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dedupe.Resolve(body.Path, body.Name, body.Mode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("/api/selftest", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(selfTests.Report())
+	}))
+
+	mux.HandleFunc("/api/selftest/run", RequireScope(ScopeOperator, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var paths []string
+		var err error
+		if remote := r.URL.Query().Get("remote"); remote != "" {
+			var path string
+			path, err = SelfTestPathOf(remote)
+			paths = []string{path}
+		} else {
+			paths, err = SelfTestPaths()
+		}
+		if errors.Is(err, ErrUnknownRemote) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := selfTests.Start(paths); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeAccepted(w)
+	}))
+
+	mux.HandleFunc("/api/summary", RequireScope(ScopeViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query, err := ParseListQuery(r, jobCardSorts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cards := make([]JobSummaryCard, 0, len(config.Jobs))
+		for i, job := range config.Jobs {
+			status := statuses.Get(i)
+			if !MatchesFilter(r, "status", status.State) {
+				continue
+			}
+			name := job.Name
+			if name == "" {
+				name = "Job " + strconv.Itoa(i)
+			}
+			card := JobSummaryCard{
+				Index:       i,
+				Name:        name,
+				State:       status.State,
+				NextRun:     NextRun(i),
+				Progress:    status.Progress,
+				LastError:   status.LastError,
+				ErrorClass:  status.ErrorClass,
+				Warnings:    job.Warnings,
+				RunWarnings: status.Warnings,
+			}
+			for _, target := range status.FailedFiles {
+				card.FailedFiles += len(target.Files)
+			}
+			if status.Paused != nil {
+				card.Paused = status.Paused.Reason
+			}
+			if snoozed := snoozes.Get(i); snoozed != nil {
+				card.Snoozed = &snoozed.Skip
+				card.Postponed = snoozed.Postponed
+			}
+			card.SLABreached = status.SLABreached != nil
+			if status.LastEnd != nil {
+				card.LastRun = status.LastEnd
+			} else {
+				card.LastRun = status.LastStart
+			}
+			cards = append(cards, card)
+		}
+		WriteJSONWithETag(w, r, Page(w, cards, query, jobCardSorts))
+	}))
+
+	mux.HandleFunc("/api/tokens", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			_ = json.NewEncoder(w).Encode(tokens.List())
+		case http.MethodPost:
+			var req struct {
+				Name  string `json:"name"`
+				Scope string `json:"scope"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			secret, err := tokens.Create(req.Name, req.Scope)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			Infoln("created api token", "'"+req.Name+"'", "with scope", req.Scope)
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(map[string]string{"name": req.Name, "scope": req.Scope, "token": secret})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/tokens/", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/api/tokens/")
+		err := tokens.Delete(name)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "token not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Infoln("deleted api token", "'"+name+"'")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("/api/config", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			format := r.URL.Query().Get("format")
+			data, err := ReadConfig(format)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if format == "yaml" {
+				w.Header().Set("Content-Type", "application/yaml")
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			if !RequireTokens(w, "saving the config") {
+				return
+			}
+			restart := r.URL.Query().Get("restart") == "1"
+			if restart && !HasSupervisor() {
+				http.Error(w, ErrNoRestart.Error(), http.StatusConflict)
+				return
+			}
+			if !RequireConfirmation(w, r, "saving the config") {
+				return
+			}
+			text, err := io.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+			if err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			validation, err := SaveConfig(text, ConfigVersion{Source: VersionAPI, Token: requestTokenName(r)})
+			writeSavedConfig(w, validation, err, restart)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/config/validate", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		text, err := io.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+		if err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		validation, _ := ValidateConfig(text)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(validation)
+	}))
+
+	mux.HandleFunc("/api/config/versions", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(configVersions.List())
+	}))
+
+	mux.HandleFunc("/api/config/versions/", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		rest, rollback := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/config/versions/"), "/rollback")
+		id, err := strconv.Atoi(rest)
+		if err != nil {
+			http.Error(w, "invalid version", http.StatusBadRequest)
+			return
+		}
+		version, err := configVersions.Get(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		switch {
+		case !rollback && r.Method == http.MethodGet:
+			format := r.URL.Query().Get("format")
+			data, err := FormatConfig(version.Options, format)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if format == "yaml" {
+				w.Header().Set("Content-Type", "application/yaml")
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			_, _ = w.Write(data)
+		case rollback && r.Method == http.MethodPost:
+			if !RequireTokens(w, "rolling back the config") {
+				return
+			}
+			restart := r.URL.Query().Get("restart") == "1"
+			if restart && !HasSupervisor() {
+				http.Error(w, ErrNoRestart.Error(), http.StatusConflict)
+				return
+			}
+			if !RequireConfirmation(w, r, "rolling back the config to version "+rest) {
+				return
+			}
+			validation, err := RollbackConfig(id, requestTokenName(r))
+			writeSavedConfig(w, validation, err, restart)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/wizard", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(GetWizardInfo())
+		case http.MethodPost:
+			if !RequireTokens(w, "the setup wizard") {
+				return
+			}
+			restart := r.URL.Query().Get("restart") == "1"
+			if restart && !HasSupervisor() {
+				http.Error(w, ErrNoRestart.Error(), http.StatusConflict)
+				return
+			}
+			if !RequireConfirmation(w, r, "adding a job with the setup wizard") {
+				return
+			}
+			var job WizardJob
+			if err := json.NewDecoder(io.LimitReader(r.Body, maxConfigSize)).Decode(&job); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := job.Check(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			validation, err := AddWizardJob(job, requestTokenName(r))
+			writeSavedConfig(w, validation, err, restart)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/remotes/oauth", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(OAuthBackends)
+		case http.MethodPost:
+			if !RequireTokens(w, "adding remotes") {
+				return
+			}
+			var req struct {
+				Name    string `json:"name"`
+				Backend string `json:"backend"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			session, err := StartOAuth(req.Name, req.Backend)
+			if errors.Is(err, ErrInlineRcloneConf) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(session)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/remotes/oauth/", RequireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/remotes/oauth/")
+		if !RequireTokens(w, "adding remotes") {
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			var req struct {
+				Response string `json:"response"` // the address the browser was sent to, or a token
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, maxConfigSize)).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			result, err := CompleteOAuth(r.Context(), id, req.Response)
+			if errors.Is(err, ErrNoOAuthSession) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(result)
+		case http.MethodDelete:
+			if err := CancelOAuth(id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
-		_ = json.NewEncoder(w).Encode(list)
+	}))
+
+	mux.HandleFunc("/selftest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(selfTestPageHTML))
 	})
 
-	mux.HandleFunc("/api/jobs/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		// /api/jobs/N/run or /api/jobs/N
-		path := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
-		path = strings.TrimSuffix(path, "/run")
-		index, err := strconv.Atoi(path)
-		if err != nil || index < 0 || index >= len(runnables) {
-			http.Error(w, "invalid job index", http.StatusBadRequest)
-			return
-		}
-		go runnables[index]()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusAccepted)
-		_, _ = w.Write([]byte(`{"status":"accepted"}`))
+	mux.HandleFunc("/remotes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(remotesPageHTML))
+	})
+
+	mux.HandleFunc("/setup", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(wizardPageHTML))
+	})
+
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(configPageHTML))
+	})
+
+	mux.HandleFunc("/i18n.js", HandleI18nScript)
+	mux.HandleFunc("/manifest.json", HandleWebManifest)
+	mux.HandleFunc("/sw.js", HandleServiceWorker)
+	mux.HandleFunc("/icon.png", HandleIcon)
+	mux.HandleFunc("/favicon.ico", HandleIcon)
+
+	mux.HandleFunc("/catalog", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(catalogPageHTML))
+	})
+
+	mux.HandleFunc("/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(duplicatesPageHTML))
+	})
+
+	mux.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(changesPageHTML))
+	})
+
+	mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(logsPageHTML))
+	})
+
+	mux.HandleFunc("/speed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(speedPageHTML))
+	})
+
+	mux.HandleFunc("/calendar", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(calendarPageHTML))
 	})
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -76,9 +1332,25 @@ func StartAPIServer(runnables []func()) {
 		_, _ = w.Write([]byte(jobsPageHTML))
 	})
 
+	if config.APISocket != "" {
+		ServeSocket(config.APISocket, mux)
+	}
+	if config.NoAPIPort {
+		// the Supervisor watchdog and the docker health check still need the probes
+		probes := http.NewServeMux()
+		probes.HandleFunc("/api/health/live", HandleProbe(Liveness))
+		probes.HandleFunc("/api/health/ready", HandleProbe(Readiness))
+		go func() {
+			Infoln("only serving the health probes on port", apiPort)
+			if err := http.ListenAndServe(":"+apiPort, probes); err != nil && err != http.ErrServerClosed {
+				Errorln("health probe server error:", err)
+			}
+		}()
+		return
+	}
 	go func() {
 		Infoln("Jobs API listening on port", apiPort)
-		if err := http.ListenAndServe(":"+apiPort, mux); err != nil && err != http.ErrServerClosed {
+		if err := http.ListenAndServe(":"+apiPort, WithCORS(config.CORS, mux)); err != nil && err != http.ErrServerClosed {
 			Errorln("Jobs API server error:", err)
 		}
 	}()
@@ -90,6 +1362,10 @@ const jobsPageHTML = `<!DOCTYPE html>
   <meta charset="utf-8">
   <meta name="viewport" content="width=device-width, initial-scale=1">
   <title>Rclone Backup – Jobs</title>
+  <link rel="icon" href="/icon.png">
+  <link rel="manifest" href="/manifest.json">
+  <meta name="theme-color" content="#0277bd">
+  <script src="/i18n.js"></script>
   <style>
     body { font-family: system-ui, sans-serif; margin: 1rem; max-width: 800px; }
     h1 { font-size: 1.25rem; }
@@ -97,53 +1373,1920 @@ const jobsPageHTML = `<!DOCTYPE html>
     .job-name { font-weight: 600; min-width: 140px; }
     .job-schedule { color: #666; font-size: 0.9rem; }
     .job-type { font-size: 0.85rem; color: #444; }
-    button { padding: 0.35rem 0.75rem; cursor: pointer; background: #03a9f4; color: #fff; border: none; border-radius: 4px; }
-    button:hover { background: #0288d1; }
+    button { padding: 0.35rem 0.75rem; cursor: pointer; background: #0277bd; color: #fff; border: none; border-radius: 4px; }
+    button:hover { background: #01579b; }
     button:disabled { background: #ccc; cursor: not-allowed; }
     .error { color: #c62828; margin-top: 0.5rem; }
+    .job-warning { color: #e65100; font-size: 0.85rem; cursor: help; }
+    .job-state { font-size: 0.85rem; margin-left: auto; }
+    .job-note { width: 10rem; padding: 0.3rem; font-size: 0.85rem; border: 1px solid #ccc; border-radius: 4px; }
+    .state-running { color: #0288d1; }
+    .state-success { color: #2e7d32; }
+    .state-failed, .state-cancelled { color: #c62828; }
+    .state-suspicious, .state-degraded, .state-interrupted { color: #e65100; }
+    .state-warning { color: #9a6700; }
+    button.secondary { background: #616161; }
+    button.secondary:hover { background: #424242; }
+    .settings { color: #666; font-size: 0.85rem; }
+    .job:focus-visible, button:focus-visible, a:focus-visible, input:focus-visible, select:focus-visible, summary:focus-visible { outline: 3px solid #01579b; outline-offset: 2px; }
+    .visually-hidden { position: absolute; width: 1px; height: 1px; overflow: hidden; clip: rect(0 0 0 0); white-space: nowrap; }
+    kbd { font-family: inherit; padding: 0 0.3rem; border: 1px solid #ccc; border-radius: 3px; background: #fafafa; }
+    #pull { height: 0; overflow: hidden; text-align: center; color: #666; font-size: 0.85rem; line-height: 3rem; transition: height 0.2s; }
+    .compact-only { display: none; }
+    body.compact { margin: 0.5rem; overflow-x: hidden; }
+    .compact .compact-only { display: block; }
+    .compact .job { flex-wrap: wrap; gap: 0.4rem 0.5rem; touch-action: pan-y; transition: transform 0.2s, background 0.2s; }
+    .compact .job.swiping { transition: none; }
+    .compact .job.swipe-run { background: #c8e6c9; }
+    .compact .job.swipe-cancel { background: #ffcdd2; }
+    .compact .job-name { min-width: 0; flex: 1 1 auto; }
+    .compact .job-schedule, .compact .job-type { font-size: 0.8rem; }
+    .compact .job-state { margin-left: 0; flex-basis: 100%; }
+    .compact .job-note { flex: 1 1 8rem; width: auto; }
+    .compact button { padding: 0.5rem 0.75rem; }
   </style>
 </head>
 <body>
-  <h1>Jobs</h1>
-  <p>Run a job now (logs appear in the addon log).</p>
-  <div id="jobs"></div>
-  <p class="error" id="err" style="display:none;"></p>
+  <div id="pull" aria-hidden="true"></div>
+  <main>
+  <h1 id="jobs-title" data-i18n>Jobs</h1>
+  <p data-i18n>Run, cancel or retry a job and follow its output on the <a href="/logs">logs</a> page. See the <a href="/catalog">catalog</a> for the backups on each remote and <a href="/duplicates">duplicates</a> found on them, or compare the <a href="/changes">changes</a> between two runs and the <a href="/speed">speed</a> of each. The <a href="/calendar">calendar</a> shows when jobs are scheduled. Change the options of the addon on the <a href="/config">config</a> page and add rclone <a href="/remotes">remotes</a> by signing in to them. Check that every remote works end to end with the <a href="/selftest">self-test</a>.</p>
+  <p class="settings"><label><span data-i18n>Language</span> <select id="language"></select></label>
+    <label><input type="checkbox" id="compact"> <span data-i18n>Compact layout</span></label></p>
+  <p class="settings compact-only" data-i18n>Swipe a job to the right to run it or to the left to cancel it, pull down to refresh.</p>
+  <details class="settings">
+    <summary data-i18n>Keyboard shortcuts</summary>
+    <p data-i18n><kbd>↑</kbd> <kbd>↓</kbd> or <kbd>k</kbd> <kbd>j</kbd> move between jobs, <kbd>Home</kbd> and <kbd>End</kbd> go to the first and last job, <kbd>r</kbd> runs the selected job, <kbd>c</kbd> cancels it, <kbd>n</kbd> edits its note and <kbd>l</kbd> opens its logs.</p>
+  </details>
+  <p class="settings" id="setup" style="display:none;" data-i18n>No backup is set up yet. <a href="/setup">Set up your first backup</a> in a few steps.</p>
+  <div id="jobs" role="list" aria-labelledby="jobs-title"></div>
+  <p class="error" id="err" role="alert" style="display:none;"></p>
+  <div id="announce" class="visually-hidden" aria-live="polite"></div>
+  <p class="settings" id="offline" role="status" style="display:none;"></p>
+  </main>
   <script>
     const el = document.getElementById('jobs');
     const errEl = document.getElementById('err');
+    const announceEl = document.getElementById('announce');
+    const rows = {};
+    languageSelect(document.getElementById('language'));
+    const offlineEl = document.getElementById('offline');
+    // the service worker keeps the last job list and summary for when the addon can't be reached
+    if ('serviceWorker' in navigator) navigator.serviceWorker.register('/sw.js').catch(() => {});
+    function cached(r) {
+      const at = r.headers.get('X-Cached-At');
+      offlineEl.textContent = at ? tr('Offline, showing the state of {time}', { time: new Date(at).toLocaleString(language) }) : '';
+      offlineEl.style.display = at ? 'block' : 'none';
+      return r;
+    }
+    const compactEl = document.getElementById('compact');
+    const pullEl = document.getElementById('pull');
+    // compact on phones unless changed in the settings, which the browser remembers
+    compactEl.checked = localStorage.getItem('compact') ? localStorage.getItem('compact') === '1' : matchMedia('(max-width: 600px)').matches;
+    document.body.classList.toggle('compact', compactEl.checked);
+    compactEl.onchange = () => {
+      localStorage.setItem('compact', compactEl.checked ? '1' : '0');
+      document.body.classList.toggle('compact', compactEl.checked);
+    };
     function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
-    fetch('/api/jobs')
-      .then(r => r.ok ? r.json() : Promise.reject(new Error('Failed to load jobs')))
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    // only admins can use the setup wizard, others don't see it
+    api('/api/wizard')
+      .then(r => r.ok ? r.json() : {})
+      .then(info => { if (info.needed) document.getElementById('setup').style.display = 'block'; })
+      .catch(() => {});
+    api('/api/jobs')
+      .then(r => cached(r).ok ? r.json() : Promise.reject(new Error(tr('Failed to load jobs'))))
       .then(jobs => {
         jobs.forEach(j => {
           const div = document.createElement('div');
           div.className = 'job';
+          div.dataset.index = j.index;
+          div.setAttribute('role', 'listitem');
+          div.setAttribute('aria-labelledby', 'job-name-' + j.index);
+          // only one job is in the tab order, the arrow keys move between them
+          div.tabIndex = el.children.length ? -1 : 0;
           const name = document.createElement('span');
           name.className = 'job-name';
-          name.textContent = j.name || ('Job ' + j.index);
+          name.id = 'job-name-' + j.index;
+          name.textContent = j.name || tr('Job {index}', { index: j.index });
           const sched = document.createElement('span');
           sched.className = 'job-schedule';
           sched.textContent = j.schedule;
           const typ = document.createElement('span');
           typ.className = 'job-type';
-          typ.textContent = j.type === 'run' ? ('run: ' + (j.run && j.run.length > 40 ? j.run.slice(0, 40) + '…' : j.run)) : ('rclone ' + j.command);
-          const btn = document.createElement('button');
-          btn.textContent = 'Run now';
-          btn.onclick = () => {
-            btn.disabled = true;
-            fetch('/api/jobs/' + j.index + '/run', { method: 'POST' })
-              .then(r => r.ok ? null : Promise.reject(new Error('Request failed')))
-              .then(() => { setTimeout(() => btn.disabled = false, 2000); })
-              .catch(e => { showErr(e.message); btn.disabled = false; });
-          };
+          typ.textContent = j.type === 'steps' ? tr('pipeline') : j.type === 'restore_test' ? tr('restore test') : j.type === 'run' ? ('run: ' + (j.run && j.run.length > 40 ? j.run.slice(0, 40) + '…' : j.run)) : ('rclone ' + j.command);
+          const state = document.createElement('span');
+          state.className = 'job-state';
+          const stateDetail = document.createElement('span');
+          stateDetail.className = 'visually-hidden';
+          const note = document.createElement('input');
+          note.className = 'job-note';
+          note.placeholder = tr('Note (optional)');
+          note.setAttribute('aria-label', tr('Note (optional)'));
+          note.setAttribute('aria-describedby', name.id);
+          const btn = button('Run now', 'run', '', () => note.value ? JSON.stringify({ note: note.value }) : undefined);
+          const cancel = button('Cancel', 'cancel', 'secondary');
+          const retry = button('Retry', 'retry', 'secondary');
+          const resume = button('Resume', 'resume', 'secondary');
+          const snooze = button('Snooze', () => {
+            const d = prompt(tr('Skip the next scheduled run, or postpone it by a duration (e.g. 6h)'), '');
+            return d === null ? null : 'snooze' + (d ? '?duration=' + encodeURIComponent(d) : '');
+          }, 'secondary');
+          const unsnooze = button('Unsnooze', 'unsnooze', 'secondary');
+          const retryFailed = button('Retry failed files', 'retry-failed', 'secondary');
+          function button(label, action, cls, body) {
+            const b = document.createElement('button');
+            b.textContent = tr(label);
+            b.setAttribute('aria-describedby', name.id);
+            if (cls) b.className = cls;
+            b.onclick = () => {
+              const a = typeof action === 'function' ? action() : action;
+              if (a === null) return;
+              // disabling the button drops its focus, it is given back by the next refresh
+              rows[j.index].restoreFocus = document.activeElement === b;
+              b.disabled = true;
+              api('/api/jobs/' + j.index + '/' + a, { method: 'POST', body: body ? body() : undefined })
+                .then(r => r.ok ? null : r.text().then(t => Promise.reject(new Error(t || tr('Request failed')))))
+                .then(() => { if (body) note.value = ''; setTimeout(() => { b.disabled = false; refresh(); }, 1000); })
+                .catch(e => { showErr(e.message); b.disabled = false; b.focus(); });
+            };
+            return b;
+          }
+          swipe(div, () => rows[j.index]);
+          const logs = document.createElement('a');
+          logs.href = '/logs?job=' + j.index;
+          logs.textContent = tr('Logs');
+          logs.setAttribute('aria-describedby', name.id);
+          rows[j.index] = { div, name: name.textContent, state, stateDetail, note, btn, cancel, retry, retryFailed, resume, snooze, unsnooze, logs };
           div.appendChild(name);
           div.appendChild(sched);
           div.appendChild(typ);
+          if (j.warnings && j.warnings.length) {
+            const warn = document.createElement('span');
+            warn.className = 'job-warning';
+            warn.textContent = '⚠ ' + tr(j.warnings.length === 1 ? '{count} warning' : '{count} warnings', { count: j.warnings.length });
+            warn.title = j.warnings.join('\n');
+            const detail = document.createElement('span');
+            detail.className = 'visually-hidden';
+            detail.textContent = ': ' + j.warnings.join('; ');
+            warn.appendChild(detail);
+            div.appendChild(warn);
+          }
+          div.appendChild(state);
+          div.appendChild(stateDetail);
+          div.appendChild(note);
           div.appendChild(btn);
+          div.appendChild(cancel);
+          div.appendChild(retry);
+          div.appendChild(retryFailed);
+          div.appendChild(resume);
+          div.appendChild(snooze);
+          div.appendChild(unsnooze);
+          div.appendChild(logs);
           el.appendChild(div);
         });
+        refresh();
+        setInterval(refresh, 5000);
+      })
+      .catch(e => showErr(e.message));
+    // swipe moves a job along with the finger, released far enough to the right it runs the job and to the left it
+    // cancels it
+    function swipe(div, row) {
+      let start = null;
+      let dx = 0;
+      const reset = () => {
+        start = null;
+        div.classList.remove('swiping', 'swipe-run', 'swipe-cancel');
+        div.style.transform = '';
+      };
+      div.addEventListener('touchstart', e => {
+        if (!document.body.classList.contains('compact') || e.touches.length > 1 || e.target.tagName === 'INPUT') return;
+        start = { x: e.touches[0].clientX, y: e.touches[0].clientY };
+        dx = 0;
+      }, { passive: true });
+      div.addEventListener('touchmove', e => {
+        if (!start) return;
+        dx = e.touches[0].clientX - start.x;
+        if (Math.abs(e.touches[0].clientY - start.y) > Math.abs(dx)) { reset(); return; }
+        div.classList.add('swiping');
+        div.classList.toggle('swipe-run', dx > 80 && visible(row().btn));
+        div.classList.toggle('swipe-cancel', dx < -80 && visible(row().cancel));
+        div.style.transform = 'translateX(' + dx + 'px)';
+      }, { passive: true });
+      div.addEventListener('touchend', () => {
+        if (!start) return;
+        const b = dx > 80 ? row().btn : dx < -80 ? row().cancel : null;
+        reset();
+        if (visible(b)) b.click();
+      });
+      div.addEventListener('touchcancel', reset);
+    }
+    // pulling down at the top of the page reloads the state of the jobs
+    let pullStart = null;
+    document.addEventListener('touchstart', e => {
+      pullStart = window.scrollY === 0 ? { x: e.touches[0].clientX, y: e.touches[0].clientY } : null;
+    }, { passive: true });
+    document.addEventListener('touchmove', e => {
+      if (!pullStart) return;
+      const dy = e.touches[0].clientY - pullStart.y;
+      if (dy < Math.abs(e.touches[0].clientX - pullStart.x)) { pullEl.style.height = '0'; return; }
+      pullEl.style.height = Math.min(dy / 2, 48) + 'px';
+      pullEl.textContent = tr(dy > 120 ? 'Release to refresh' : 'Pull to refresh');
+    }, { passive: true });
+    document.addEventListener('touchend', e => {
+      if (!pullStart) return;
+      const dy = e.changedTouches[0].clientY - pullStart.y;
+      const pulled = dy > 120 && dy > Math.abs(e.changedTouches[0].clientX - pullStart.x);
+      pullStart = null;
+      if (!pulled) { pullEl.style.height = '0'; return; }
+      pullEl.textContent = tr('Refreshing…');
+      refresh().finally(() => { pullEl.style.height = '0'; });
+    });
+    function announce(text) { announceEl.textContent = text; }
+    function visible(e) { return e && e.offsetParent !== null && !e.disabled; }
+    function focusRow(div) {
+      el.querySelectorAll('.job').forEach(d => { d.tabIndex = d === div ? 0 : -1; });
+      div.focus();
+    }
+    el.addEventListener('focusin', e => {
+      const div = e.target.closest('.job');
+      if (div) el.querySelectorAll('.job').forEach(d => { d.tabIndex = d === div ? 0 : -1; });
+    });
+    el.addEventListener('keydown', e => {
+      if (e.altKey || e.ctrlKey || e.metaKey) return;
+      const items = [...el.querySelectorAll('.job')];
+      const current = items.findIndex(d => d.contains(e.target));
+      if (current < 0) return;
+      const row = rows[items[current].dataset.index];
+      const press = b => { if (visible(b)) b.click(); };
+      if (e.target === row.note) {
+        // Enter runs the job with the note, Escape goes back to the job
+        if (e.key === 'Enter') press(row.btn);
+        else if (e.key === 'Escape') focusRow(row.div);
+        return;
+      }
+      switch (e.key) {
+        case 'ArrowDown': case 'j': focusRow(items[Math.min(current + 1, items.length - 1)]); break;
+        case 'ArrowUp': case 'k': focusRow(items[Math.max(current - 1, 0)]); break;
+        case 'Home': focusRow(items[0]); break;
+        case 'End': focusRow(items[items.length - 1]); break;
+        case 'r': press(row.btn); break;
+        case 'c': press(row.cancel); break;
+        case 'n': if (visible(row.note)) row.note.focus(); break;
+        case 'l': location.href = row.logs.href; break;
+        default: return;
+      }
+      e.preventDefault();
+    });
+    function refresh() {
+      return api('/api/summary')
+        .then(r => cached(r).ok ? r.json() : Promise.reject(new Error(tr('Failed to load job status'))))
+        .then(cards => cards.forEach(c => {
+          const row = rows[c.index];
+          if (!row) return;
+          if (row.lastState && row.lastState !== c.state) announce(tr('{job}: {state}', { job: row.name, state: tr(c.state) }));
+          row.lastState = c.state;
+          // the focused button may be hidden below, e.g. Run now once the job runs
+          const focused = row.div.contains(document.activeElement) ? document.activeElement : null;
+          row.state.className = 'job-state state-' + c.state;
+          row.state.textContent = tr(c.state) + (c.progress ? ' – ' + c.progress : '') + (c.paused ? ' (' + tr('paused') + ')' : '') + (c.snoozed ? ' (' + tr('snoozed') + ')' : '');
+          const snoozed = !c.snoozed ? '' : c.postponed ? tr('run at {time} postponed to {until}', { time: new Date(c.snoozed).toLocaleString(language), until: new Date(c.postponed).toLocaleString(language) }) :
+            tr('run at {time} is skipped', { time: new Date(c.snoozed).toLocaleString(language) });
+          row.state.title = [c.paused, snoozed, c.last_error].concat(c.run_warnings || []).filter(Boolean).join('\n');
+          row.stateDetail.textContent = row.state.title.split('\n').join('; ');
+          const running = c.state === 'running';
+          row.btn.style.display = running ? 'none' : '';
+          row.note.style.display = running ? 'none' : '';
+          row.cancel.style.display = running ? '' : 'none';
+          row.retry.style.display = ['failed', 'cancelled', 'interrupted', 'suspicious'].includes(c.state) ? '' : 'none';
+          row.resume.style.display = c.paused ? '' : 'none';
+          row.snooze.style.display = c.next_run && !c.snoozed ? '' : 'none';
+          row.unsnooze.style.display = c.snoozed ? '' : 'none';
+          row.retryFailed.style.display = ['failed', 'warning'].includes(c.state) && c.failed_files ? '' : 'none';
+          row.retryFailed.title = c.failed_files ? tr('{count} files', { count: c.failed_files }) : '';
+          if ((focused && !visible(focused)) || (row.restoreFocus && document.activeElement === document.body)) {
+            const next = [row.cancel, row.btn, row.retry].find(visible);
+            if (next) next.focus(); else focusRow(row.div);
+          }
+          row.restoreFocus = false;
+        }))
+        .catch(e => showErr(e.message));
+    }
+  </script>
+</body>
+</html>
+`
+
+const catalogPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Catalog</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 900px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    h2 { font-size: 1.1rem; margin: 1.5rem 0 0.25rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    table { width: 100%; border-collapse: collapse; font-size: 0.9rem; margin-top: 0.5rem; }
+    th, td { text-align: left; padding: 0.3rem 0.5rem; border-bottom: 1px solid #eee; }
+    td.size { text-align: right; white-space: nowrap; }
+    button { padding: 0.35rem 0.75rem; cursor: pointer; background: #03a9f4; color: #fff; border: none; border-radius: 4px; }
+    button:hover { background: #0288d1; }
+    button:disabled { background: #ccc; cursor: not-allowed; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Catalog</h1>
+  <p data-i18n>Backups found on each remote when they were last indexed. <a href="/">Back to jobs</a></p>
+  <button id="refresh" data-i18n>Refresh now</button>
+  <div id="folders"></div>
+  <p class="error" id="err" style="display:none;"></p>
+  <script>
+    const el = document.getElementById('folders');
+    const errEl = document.getElementById('err');
+    const refreshBtn = document.getElementById('refresh');
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        if (r.status === 428) {
+          const code = prompt(tr('Confirmation code (see the addon log or your notifications)'));
+          if (code) return api(path, Object.assign({}, opts, { headers: Object.assign({}, opts.headers, { 'X-Confirm-Code': code }) }));
+        }
+        return r;
+      });
+    }
+    function size(bytes) {
+      const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+      let i = 0;
+      while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+      return bytes.toFixed(i ? 2 : 0) + ' ' + units[i];
+    }
+    function cell(row, text, cls) {
+      const td = document.createElement('td');
+      td.textContent = text;
+      if (cls) td.className = cls;
+      row.appendChild(td);
+    }
+    function load() {
+      api('/api/catalog')
+        .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load catalog'))))
+        .then(folders => {
+          el.textContent = '';
+          if (!folders.length) el.textContent = tr('Nothing has been indexed yet.');
+          folders.forEach(f => {
+            const h = document.createElement('h2');
+            h.textContent = f.path;
+            const meta = document.createElement('div');
+            meta.className = f.error ? 'error' : 'meta';
+            meta.textContent = f.error || (tr('{count} files, {size}', { count: f.count, size: size(f.size) }) + (f.jobs ? ' – ' + f.jobs.join(', ') : '') + ' – ' +
+              tr('indexed {time}', { time: new Date(f.indexed).toLocaleString(language) }));
+            el.appendChild(h);
+            el.appendChild(meta);
+            if (!f.entries.length) return;
+            const table = document.createElement('table');
+            const head = document.createElement('tr');
+            ['Name', 'Modified', 'Size'].forEach(t => { const th = document.createElement('th'); th.textContent = tr(t); head.appendChild(th); });
+            table.appendChild(head);
+            f.entries.forEach(e => {
+              const row = document.createElement('tr');
+              cell(row, e.path + (e.is_dir ? '/' : '') + (e.archive === 'full' ? ' (' + tr('full') + ')' : e.archive === 'incremental' ? ' (' + tr('incremental of {base}', { base: e.base.split('/').pop() }) + ')' : ''));
+              cell(row, new Date(e.modified).toLocaleString(language));
+              cell(row, e.is_dir ? '' : size(e.size), 'size');
+              table.appendChild(row);
+            });
+            el.appendChild(table);
+          });
+        })
+        .catch(e => showErr(e.message));
+    }
+    refreshBtn.onclick = () => {
+      refreshBtn.disabled = true;
+      api('/api/catalog/refresh', { method: 'POST' })
+        .then(r => r.ok ? null : Promise.reject(new Error(tr('Failed to refresh catalog'))))
+        .then(() => setTimeout(() => { refreshBtn.disabled = false; load(); }, 3000))
+        .catch(e => { showErr(e.message); refreshBtn.disabled = false; });
+    };
+    load();
+  </script>
+</body>
+</html>
+`
+
+const duplicatesPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Duplicates</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 900px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    h2 { font-size: 1.1rem; margin: 1.5rem 0 0.25rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    table { width: 100%; border-collapse: collapse; font-size: 0.9rem; margin-top: 0.5rem; }
+    th, td { text-align: left; padding: 0.3rem 0.5rem; border-bottom: 1px solid #eee; vertical-align: top; }
+    td.size { text-align: right; white-space: nowrap; }
+    button { padding: 0.35rem 0.75rem; cursor: pointer; background: #03a9f4; color: #fff; border: none; border-radius: 4px; }
+    button:hover { background: #0288d1; }
+    button:disabled { background: #ccc; cursor: not-allowed; }
+    select { padding: 0.3rem; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Duplicates</h1>
+  <p data-i18n>Files with the same name in the same folder, found when the remotes were last checked. <a href="/">Back to jobs</a></p>
+  <button id="refresh" data-i18n>Check now</button>
+  <div id="reports"></div>
+  <p class="error" id="err" style="display:none;"></p>
+  <script>
+    const el = document.getElementById('reports');
+    const errEl = document.getElementById('err');
+    const refreshBtn = document.getElementById('refresh');
+    const modes = ['newest', 'oldest', 'largest', 'smallest', 'first', 'rename'];
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    function size(bytes) {
+      const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+      let i = 0;
+      while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+      return bytes.toFixed(i ? 2 : 0) + ' ' + units[i];
+    }
+    function cell(row, text, cls) {
+      const td = document.createElement('td');
+      td.textContent = text;
+      if (cls) td.className = cls;
+      row.appendChild(td);
+      return td;
+    }
+    function resolveCell(row, path, name) {
+      const td = cell(row, '');
+      const mode = document.createElement('select');
+      modes.forEach(m => { const o = document.createElement('option'); o.value = m; o.textContent = tr('keep ' + m); mode.appendChild(o); });
+      const btn = document.createElement('button');
+      btn.textContent = tr('Resolve');
+      btn.onclick = () => {
+        if (mode.value !== 'rename' && !confirm(tr('Delete all but one copy of {name}?', { name: name }))) return;
+        btn.disabled = true;
+        api('/api/dedupe/resolve', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ path: path, name: name, mode: mode.value }) })
+          .then(r => r.ok ? load() : r.text().then(t => Promise.reject(new Error(t || tr('Failed to resolve duplicates')))))
+          .catch(e => { showErr(e.message); btn.disabled = false; });
+      };
+      td.appendChild(mode);
+      td.appendChild(btn);
+    }
+    function load() {
+      api('/api/dedupe')
+        .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load duplicates'))))
+        .then(reports => {
+          el.textContent = '';
+          if (!reports.length) el.textContent = tr('Nothing has been checked yet.');
+          reports.forEach(d => {
+            const h = document.createElement('h2');
+            h.textContent = d.path;
+            const meta = document.createElement('div');
+            meta.className = d.error ? 'error' : 'meta';
+            meta.textContent = d.error || (tr('{count} duplicated files, {size} wasted', { count: d.groups.length, size: size(d.wasted) }) + ' – ' +
+              tr('checked {time}', { time: new Date(d.checked).toLocaleString(language) }));
+            el.appendChild(h);
+            el.appendChild(meta);
+            if (!d.groups.length) return;
+            const table = document.createElement('table');
+            const head = document.createElement('tr');
+            ['Name', 'Copies', 'Wasted', ''].forEach(t => { const th = document.createElement('th'); th.textContent = tr(t); head.appendChild(th); });
+            table.appendChild(head);
+            d.groups.forEach(g => {
+              const row = document.createElement('tr');
+              cell(row, g.name);
+              cell(row, g.files.map(f => size(f.size) + ', ' + f.modified.split('.')[0]).join('\n')).style.whiteSpace = 'pre-line';
+              cell(row, size(g.wasted), 'size');
+              resolveCell(row, d.path, g.name);
+              table.appendChild(row);
+            });
+            el.appendChild(table);
+          });
+        })
+        .catch(e => showErr(e.message));
+    }
+    refreshBtn.onclick = () => {
+      refreshBtn.disabled = true;
+      api('/api/dedupe/refresh', { method: 'POST' })
+        .then(r => r.ok ? null : Promise.reject(new Error(tr('Failed to check for duplicates'))))
+        .then(() => setTimeout(() => { refreshBtn.disabled = false; load(); }, 3000))
+        .catch(e => { showErr(e.message); refreshBtn.disabled = false; });
+    };
+    load();
+  </script>
+</body>
+</html>
+`
+
+const changesPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Changes</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 900px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    h2 { font-size: 1.1rem; margin: 1.5rem 0 0.25rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    table { width: 100%; border-collapse: collapse; font-size: 0.9rem; margin-top: 0.5rem; }
+    th, td { text-align: left; padding: 0.3rem 0.5rem; border-bottom: 1px solid #eee; }
+    td.size { text-align: right; white-space: nowrap; }
+    select { padding: 0.3rem; margin-right: 0.5rem; }
+    .added { color: #2e7d32; }
+    .removed { color: #c62828; }
+    .changed { color: #e65100; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Changes</h1>
+  <p data-i18n>Files added, removed and changed on the destinations between two runs of a job with <code>manifest</code> enabled. <a href="/">Back to jobs</a></p>
+  <div>
+    <select id="job"></select>
+    <select id="from"></select>
+    <select id="to"></select>
+  </div>
+  <div id="diff"></div>
+  <p class="error" id="err" style="display:none;"></p>
+  <script>
+    const jobEl = document.getElementById('job');
+    const fromEl = document.getElementById('from');
+    const toEl = document.getElementById('to');
+    const el = document.getElementById('diff');
+    const errEl = document.getElementById('err');
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    function size(bytes) {
+      const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+      let i = 0;
+      while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+      return bytes.toFixed(i ? 2 : 0) + ' ' + units[i];
+    }
+    function cell(row, text, cls) {
+      const td = document.createElement('td');
+      td.textContent = text;
+      if (cls) td.className = cls;
+      row.appendChild(td);
+    }
+    function option(select, value, text) {
+      const o = document.createElement('option');
+      o.value = value;
+      o.textContent = text;
+      select.appendChild(o);
+    }
+    function section(title, cls, changes) {
+      const h = document.createElement('h2');
+      h.className = cls;
+      h.textContent = tr(title) + ' (' + changes.length + ')';
+      el.appendChild(h);
+      if (!changes.length) return;
+      const table = document.createElement('table');
+      const head = document.createElement('tr');
+      ['Destination', 'Name', 'Modified', 'Size'].forEach(t => { const th = document.createElement('th'); th.textContent = tr(t); head.appendChild(th); });
+      table.appendChild(head);
+      changes.forEach(c => {
+        const f = c.after || c.before;
+        const row = document.createElement('tr');
+        cell(row, c.destination);
+        cell(row, c.path);
+        cell(row, new Date(f.modified).toLocaleString(language));
+        cell(row, c.before && c.after ? size(c.before.size) + ' → ' + size(c.after.size) : size(f.size), 'size');
+        table.appendChild(row);
+      });
+      el.appendChild(table);
+    }
+    function loadDiff() {
+      el.textContent = '';
+      errEl.style.display = 'none';
+      if (!fromEl.value || !toEl.value) { el.textContent = tr('This job needs two runs with a manifest to compare.'); return; }
+      api('/api/jobs/' + jobEl.value + '/diff?from=' + encodeURIComponent(fromEl.value) + '&to=' + encodeURIComponent(toEl.value))
+        .then(r => r.ok ? r.json() : r.text().then(t => Promise.reject(new Error(t || tr('Failed to compare runs')))))
+        .then(d => {
+          section('Added', 'added', d.added);
+          section('Removed', 'removed', d.removed);
+          section('Changed', 'changed', d.changed);
+        })
+        .catch(e => showErr(e.message));
+    }
+    function loadRuns() {
+      api('/api/jobs/' + jobEl.value + '/history')
+        .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load job history'))))
+        .then(runs => {
+          fromEl.textContent = '';
+          toEl.textContent = '';
+          runs.filter(run => run.manifest).forEach(run => {
+            const text = new Date(run.start).toLocaleString(language) + ' – ' + tr(run.state) + (run.note ? ' – ' + run.note : '');
+            option(fromEl, run.id, tr('From {run}', { run: text }));
+            option(toEl, run.id, tr('To {run}', { run: text }));
+          });
+          if (fromEl.options.length > 1) fromEl.selectedIndex = 1;
+          if (fromEl.options.length < 2) { fromEl.value = ''; toEl.value = ''; }
+          loadDiff();
+        })
+        .catch(e => showErr(e.message));
+    }
+    api('/api/jobs')
+      .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load jobs'))))
+      .then(jobs => {
+        jobs.forEach(j => option(jobEl, j.index, j.name || tr('Job {index}', { index: j.index })));
+        const index = new URLSearchParams(location.search).get('job');
+        if (index !== null) jobEl.value = index;
+        if (jobs.length) loadRuns();
+      })
+      .catch(e => showErr(e.message));
+    jobEl.onchange = loadRuns;
+    fromEl.onchange = loadDiff;
+    toEl.onchange = loadDiff;
+  </script>
+</body>
+</html>
+`
+
+const speedPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Speed</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 900px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    select { padding: 0.3rem; margin-right: 0.5rem; }
+    svg { width: 100%; height: 300px; margin-top: 1rem; }
+    .axis { stroke: #ccc; }
+    .label { fill: #666; font-size: 11px; }
+    .line { fill: none; stroke: #03a9f4; stroke-width: 1.5; }
+    .throttled { fill: #c62828; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Speed</h1>
+  <p data-i18n>Transfer speed during a run of a job, red marks show when the provider throttled requests. <a href="/">Back to jobs</a></p>
+  <div>
+    <select id="job"></select>
+    <select id="run"></select>
+  </div>
+  <svg id="chart" viewBox="0 0 900 300" preserveAspectRatio="none"></svg>
+  <p class="meta" id="meta"></p>
+  <p class="error" id="err" style="display:none;"></p>
+  <script>
+    const jobEl = document.getElementById('job');
+    const runEl = document.getElementById('run');
+    const chart = document.getElementById('chart');
+    const metaEl = document.getElementById('meta');
+    const errEl = document.getElementById('err');
+    const svg = 'http://www.w3.org/2000/svg';
+    let timer = null;
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    function size(bytes) {
+      const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+      let i = 0;
+      while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+      return bytes.toFixed(i ? 2 : 0) + ' ' + units[i];
+    }
+    function option(select, value, text) {
+      const o = document.createElement('option');
+      o.value = value;
+      o.textContent = text;
+      select.appendChild(o);
+    }
+    function add(name, attrs, text) {
+      const el = document.createElementNS(svg, name);
+      Object.keys(attrs).forEach(k => el.setAttribute(k, attrs[k]));
+      if (text) el.textContent = text;
+      chart.appendChild(el);
+    }
+    function draw(samples) {
+      chart.textContent = '';
+      metaEl.textContent = '';
+      if (samples.length < 2) { metaEl.textContent = tr('Not enough speed samples to draw, rclone reports its stats every minute unless the job uses the rc engine.'); return; }
+      const start = new Date(samples[0].time).getTime();
+      const span = Math.max(new Date(samples[samples.length - 1].time).getTime() - start, 1);
+      const max = Math.max(...samples.map(s => s.speed), 1);
+      const x = s => 50 + (new Date(s.time).getTime() - start) / span * 840;
+      const y = s => 280 - s.speed / max * 260;
+      add('line', { x1: 50, y1: 280, x2: 890, y2: 280, class: 'axis' });
+      add('line', { x1: 50, y1: 20, x2: 50, y2: 280, class: 'axis' });
+      add('text', { x: 0, y: 25, class: 'label' }, size(max) + '/s');
+      add('text', { x: 0, y: 280, class: 'label' }, '0');
+      add('text', { x: 50, y: 295, class: 'label' }, new Date(start).toLocaleTimeString(language));
+      add('text', { x: 820, y: 295, class: 'label' }, new Date(start + span).toLocaleTimeString(language));
+      add('polyline', { points: samples.map(s => x(s) + ',' + y(s)).join(' '), class: 'line' });
+      samples.filter(s => s.throttled).forEach(s => add('circle', { cx: x(s), cy: y(s), r: 4, class: 'throttled' }));
+      const avg = samples.reduce((sum, s) => sum + s.speed, 0) / samples.length;
+      metaEl.textContent = tr('{count} samples, average {average}/s, peak {peak}/s, {throttled} throttled', {
+        count: samples.length, average: size(avg), peak: size(max), throttled: samples.filter(s => s.throttled).length });
+    }
+    function loadSpeed() {
+      clearTimeout(timer);
+      errEl.style.display = 'none';
+      if (!runEl.value) { chart.textContent = ''; metaEl.textContent = tr('This job has no runs yet.'); return; }
+      api('/api/jobs/' + jobEl.value + '/runs/' + encodeURIComponent(runEl.value) + '/speed')
+        .then(r => r.ok ? r.json() : r.text().then(t => Promise.reject(new Error(t || tr('Failed to load speed samples')))))
+        .then(samples => {
+          draw(samples);
+          // the current run keeps being sampled
+          if (runEl.selectedOptions[0].dataset.running) timer = setTimeout(loadSpeed, 5000);
+        })
+        .catch(e => { chart.textContent = ''; showErr(e.message); });
+    }
+    function loadRuns() {
+      Promise.all([
+        api('/api/jobs/' + jobEl.value + '/status').then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load job status')))),
+        api('/api/jobs/' + jobEl.value + '/history').then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load job history')))),
+      ])
+        .then(([status, runs]) => {
+          runEl.textContent = '';
+          if (status.state === 'running' && status.run_id) {
+            option(runEl, status.run_id, tr('Current run – started {time}', { time: new Date(status.last_start).toLocaleString(language) }));
+            runEl.options[0].dataset.running = '1';
+          }
+          runs.forEach(run => option(runEl, run.id, new Date(run.start).toLocaleString(language) + ' – ' + tr(run.state) + ', ' + size(run.bytes) + (run.note ? ' – ' + run.note : '')));
+          const id = new URLSearchParams(location.search).get('run');
+          if (id !== null && [...runEl.options].some(o => o.value === id)) runEl.value = id;
+          loadSpeed();
+        })
+        .catch(e => showErr(e.message));
+    }
+    api('/api/jobs')
+      .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load jobs'))))
+      .then(jobs => {
+        jobs.forEach(j => option(jobEl, j.index, j.name || tr('Job {index}', { index: j.index })));
+        const index = new URLSearchParams(location.search).get('job');
+        if (index !== null) jobEl.value = index;
+        if (jobs.length) loadRuns();
+      })
+      .catch(e => showErr(e.message));
+    jobEl.onchange = loadRuns;
+    runEl.onchange = loadSpeed;
+  </script>
+</body>
+</html>
+`
+
+const logsPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Logs</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 1100px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    .controls { display: flex; flex-wrap: wrap; align-items: center; gap: 0.5rem; }
+    select, input[type=search] { padding: 0.3rem; }
+    input[type=search] { width: 14rem; }
+    button { padding: 0.35rem 0.75rem; cursor: pointer; background: #03a9f4; color: #fff; border: none; border-radius: 4px; }
+    button:hover { background: #0288d1; }
+    #log { background: #263238; color: #eceff1; font-size: 0.8rem; padding: 0.5rem; height: 70vh; overflow: auto; margin-top: 0.5rem; border-radius: 4px; white-space: pre-wrap; word-break: break-all; }
+    #log .line-error { color: #ff8a80; }
+    #log .line-warning { color: #ffd180; }
+    #log .line-outcome { color: #b9f6ca; font-weight: 600; }
+    #log .hidden { display: none; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Logs</h1>
+  <p data-i18n>The output of each run of a job, kept for the <code>log_retention</code>. Follow a running job to see its output as it is logged. <a href="/">Back to jobs</a></p>
+  <div class="controls">
+    <select id="job"></select>
+    <select id="run"></select>
+    <input type="search" id="filter" placeholder="Filter lines" data-i18n>
+    <label><input type="checkbox" id="errors"> <span data-i18n>Errors only</span></label>
+    <label><input type="checkbox" id="follow" checked> <span data-i18n>Follow</span></label>
+    <button id="download" data-i18n>Download</button>
+  </div>
+  <div id="log"></div>
+  <p class="meta" id="meta"></p>
+  <p class="error" id="err" style="display:none;"></p>
+  <script>
+    const jobEl = document.getElementById('job');
+    const runEl = document.getElementById('run');
+    const filterEl = document.getElementById('filter');
+    const errorsEl = document.getElementById('errors');
+    const followEl = document.getElementById('follow');
+    const logEl = document.getElementById('log');
+    const metaEl = document.getElementById('meta');
+    const errEl = document.getElementById('err');
+    let reader = null;
+    let partial = '';
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    function option(select, value, text) {
+      const o = document.createElement('option');
+      o.value = value;
+      o.textContent = text;
+      select.appendChild(o);
+    }
+    function kind(text) {
+      if (/\b(ERROR|CRITICAL)\b|Failed to|failed:/.test(text)) return 'error';
+      if (/\b(NOTICE|WARNING|WARN)\b|Trying again|Rate limited/.test(text)) return 'warning';
+      if (/^run \w+ in /.test(text)) return 'outcome';
+      return '';
+    }
+    function show(line) {
+      const query = filterEl.value.toLowerCase();
+      const hidden = (query && !line.textContent.toLowerCase().includes(query)) || (errorsEl.checked && line.dataset.kind !== 'error');
+      line.classList.toggle('hidden', hidden);
+    }
+    function append(text) {
+      const lines = (partial + text).split('\n');
+      partial = lines.pop();
+      const bottom = logEl.scrollHeight - logEl.scrollTop - logEl.clientHeight < 40;
+      lines.forEach(t => {
+        const line = document.createElement('div');
+        line.textContent = t;
+        line.dataset.kind = kind(t);
+        if (line.dataset.kind) line.className = 'line-' + line.dataset.kind;
+        show(line);
+        logEl.appendChild(line);
+      });
+      if (followEl.checked && bottom) logEl.scrollTop = logEl.scrollHeight;
+      const shown = logEl.querySelectorAll('div:not(.hidden)').length;
+      metaEl.textContent = tr('{count} lines', { count: logEl.children.length }) + (shown < logEl.children.length ? ', ' + tr('{count} shown', { count: shown }) : '') + ', ' +
+        tr('{count} errors', { count: logEl.querySelectorAll('[data-kind=error]').length });
+    }
+    function logPath(query) {
+      return '/api/jobs/' + jobEl.value + '/runs/' + encodeURIComponent(runEl.value) + '/log' + (query || '');
+    }
+    function loadLog() {
+      if (reader) { reader.cancel(); reader = null; }
+      logEl.textContent = '';
+      metaEl.textContent = '';
+      partial = '';
+      errEl.style.display = 'none';
+      if (!runEl.value) { metaEl.textContent = tr('This job has no runs yet.'); return; }
+      const running = runEl.selectedOptions[0].dataset.running && followEl.checked;
+      api(logPath(running ? '?follow=1' : ''))
+        .then(r => r.ok ? r : r.text().then(t => Promise.reject(new Error(t || tr('Failed to load the log')))))
+        .then(r => {
+          const current = r.body.getReader();
+          reader = current;
+          const decoder = new TextDecoder();
+          function read() {
+            return current.read().then(({ done, value }) => {
+              if (done) {
+                if (partial) append('\n');
+                if (reader === current && running) loadRuns(runEl.value);
+                return;
+              }
+              append(decoder.decode(value, { stream: true }));
+              return read();
+            });
+          }
+          return read();
+        })
+        .catch(e => { if (e.name !== 'AbortError') showErr(e.message); });
+    }
+    function loadRuns(selected) {
+      Promise.all([
+        api('/api/jobs/' + jobEl.value + '/status').then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load job status')))),
+        api('/api/jobs/' + jobEl.value + '/history').then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load job history')))),
+      ])
+        .then(([status, runs]) => {
+          runEl.textContent = '';
+          if (status.state === 'running' && status.run_id) {
+            option(runEl, status.run_id, tr('Current run – started {time}', { time: new Date(status.last_start).toLocaleString(language) }));
+            runEl.options[0].dataset.running = '1';
+          }
+          runs.forEach(run => option(runEl, run.id, new Date(run.start).toLocaleString(language) + ' – ' + tr(run.state) + (run.note ? ' – ' + run.note : '')));
+          const id = selected || new URLSearchParams(location.search).get('run');
+          if (id && [...runEl.options].some(o => o.value === id)) runEl.value = id;
+          loadLog();
+        })
+        .catch(e => showErr(e.message));
+    }
+    document.getElementById('download').onclick = () => {
+      if (!runEl.value) return;
+      api(logPath('?download=1'))
+        .then(r => r.ok ? r.blob() : Promise.reject(new Error(tr('Failed to download the log'))))
+        .then(blob => {
+          const a = document.createElement('a');
+          a.href = URL.createObjectURL(blob);
+          a.download = jobEl.value + '_' + runEl.value + '.log';
+          a.click();
+          URL.revokeObjectURL(a.href);
+        })
+        .catch(e => showErr(e.message));
+    };
+    filterEl.oninput = () => { logEl.querySelectorAll('div').forEach(show); append(''); };
+    errorsEl.onchange = filterEl.oninput;
+    followEl.onchange = () => { if (runEl.selectedOptions[0] && runEl.selectedOptions[0].dataset.running) loadLog(); };
+    api('/api/jobs')
+      .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load jobs'))))
+      .then(jobs => {
+        jobs.forEach(j => option(jobEl, j.index, j.name || tr('Job {index}', { index: j.index })));
+        const index = new URLSearchParams(location.search).get('job');
+        if (index !== null) jobEl.value = index;
+        if (jobs.length) loadRuns();
+      })
+      .catch(e => showErr(e.message));
+    jobEl.onchange = () => loadRuns();
+    runEl.onchange = loadLog;
+  </script>
+</body>
+</html>
+`
+
+const calendarPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Calendar</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 1100px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    h2 { font-size: 1.1rem; margin: 1.5rem 0 0.25rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    .day { display: flex; align-items: center; margin: 0.25rem 0; }
+    .label { width: 7rem; flex: none; font-size: 0.85rem; }
+    .track { position: relative; flex: 1; height: 2rem; background: #f5f5f5; border-radius: 3px; overflow: hidden; }
+    .hours { display: flex; margin-left: 7rem; color: #666; font-size: 0.75rem; }
+    .hours span { flex: 1; }
+    .run { position: absolute; top: 0.2rem; bottom: 0.2rem; min-width: 3px; border-radius: 2px; opacity: 0.8; }
+    .run.paused { opacity: 0.25; }
+    .run.once { outline: 2px dashed #333; }
+    .run.snoozed { opacity: 0.25; text-decoration: line-through; }
+    .run.pileup { outline: 2px solid #c62828; }
+    .legend span { display: inline-block; margin: 0.2rem 0.75rem 0.2rem 0; font-size: 0.85rem; }
+    .legend i { display: inline-block; width: 0.8rem; height: 0.8rem; margin-right: 0.3rem; border-radius: 2px; vertical-align: middle; }
+    li { margin: 0.2rem 0; }
+    .warn { color: #c62828; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Calendar</h1>
+  <p data-i18n>Scheduled runs of the next 7 days, the width of a run is how long its last successful run took. Jobs run one at a time, so runs starting together wait for each other. <a href="/">Back to jobs</a></p>
+  <div class="legend" id="legend"></div>
+  <div class="hours"><span>00:00</span><span>06:00</span><span>12:00</span><span>18:00</span></div>
+  <div id="days"></div>
+  <h2 data-i18n>Pile-ups</h2>
+  <p class="meta" data-i18n>Minutes in which several jobs are scheduled to start.</p>
+  <ul id="pileups"></ul>
+  <p class="error" id="err" style="display:none;"></p>
+  <script>
+    const daysEl = document.getElementById('days');
+    const pileupsEl = document.getElementById('pileups');
+    const legendEl = document.getElementById('legend');
+    const errEl = document.getElementById('err');
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    function color(job) { return 'hsl(' + ((job * 137) % 360) + ', 60%, 45%)'; }
+    function name(run) { return run.name || tr('Job {index}', { index: run.job }); }
+    function dayKey(d) { return d.getFullYear() + '-' + d.getMonth() + '-' + d.getDate(); }
+    function time(d) { return d.toLocaleTimeString(language, { hour: '2-digit', minute: '2-digit' }); }
+    api('/api/calendar')
+      .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load calendar'))))
+      .then(c => {
+        const names = {};
+        c.runs.forEach(run => { names[run.job] = name(run); });
+        Object.keys(names).forEach(job => {
+          const span = document.createElement('span');
+          const swatch = document.createElement('i');
+          swatch.style.background = color(job);
+          span.appendChild(swatch);
+          span.appendChild(document.createTextNode(names[job]));
+          legendEl.appendChild(span);
+        });
+        const piled = {};
+        c.pileups.forEach(p => { piled[new Date(p.start).getTime()] = true; });
+        const tracks = {};
+        const start = new Date(c.from);
+        for (let i = 0; i <= 7; i++) {
+          const day = new Date(start.getFullYear(), start.getMonth(), start.getDate() + i);
+          if (day > new Date(c.until)) break;
+          const row = document.createElement('div');
+          row.className = 'day';
+          const label = document.createElement('div');
+          label.className = 'label';
+          label.textContent = day.toLocaleDateString(language, { weekday: 'short', month: 'short', day: 'numeric' });
+          const track = document.createElement('div');
+          track.className = 'track';
+          row.appendChild(label);
+          row.appendChild(track);
+          daysEl.appendChild(row);
+          tracks[dayKey(day)] = track;
+        }
+        c.runs.forEach(run => {
+          const d = new Date(run.start);
+          const track = tracks[dayKey(d)];
+          if (!track) return;
+          const minutes = d.getHours() * 60 + d.getMinutes();
+          const el = document.createElement('div');
+          el.className = 'run' + (run.paused ? ' paused' : '') + (run.once ? ' once' : '') + (run.snoozed ? ' snoozed' : '');
+          const minute = new Date(d.getFullYear(), d.getMonth(), d.getDate(), d.getHours(), d.getMinutes());
+          if (piled[minute.getTime()]) el.className += ' pileup';
+          el.style.left = (minutes / 1440 * 100) + '%';
+          el.style.width = Math.min((run.duration || 0) / 864, 100) + '%';
+          el.style.background = color(run.job);
+          el.title = tr('{job} at {time}', { job: name(run), time: time(d) }) + (run.duration ? ', ' + tr('took {minutes} min last time', { minutes: Math.round(run.duration / 60) }) : '') +
+            (run.paused ? ' (' + tr('paused') + ')' : '') + (run.once ? ' (' + tr('planned once') + ')' : '') + (run.snoozed ? ' (' + tr('snoozed') + ')' : '');
+          track.appendChild(el);
+        });
+        if (!c.pileups.length) {
+          const li = document.createElement('li');
+          li.textContent = tr('No jobs start at the same time.');
+          pileupsEl.appendChild(li);
+        }
+        c.pileups.forEach(p => {
+          const d = new Date(p.start);
+          const li = document.createElement('li');
+          if (p.jobs.length > 2) li.className = 'warn';
+          li.textContent = d.toLocaleDateString(language, { weekday: 'short', month: 'short', day: 'numeric' }) + ' ' + time(d) + ' – ' + tr('{count} jobs', { count: p.jobs.length }) + ': ' + p.jobs.map(j => names[j]).join(', ');
+          pileupsEl.appendChild(li);
+        });
+      })
+      .catch(e => showErr(e.message));
+  </script>
+</body>
+</html>
+`
+
+const configPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Config</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 1100px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    .controls { display: flex; flex-wrap: wrap; align-items: center; gap: 0.5rem; }
+    select { padding: 0.3rem; }
+    button { padding: 0.35rem 0.75rem; cursor: pointer; background: #03a9f4; color: #fff; border: none; border-radius: 4px; }
+    button:hover { background: #0288d1; }
+    button:disabled { background: #ccc; cursor: not-allowed; }
+    button.secondary { background: #757575; }
+    .editor { display: flex; height: 65vh; margin-top: 0.5rem; border: 1px solid #ccc; border-radius: 4px; overflow: hidden; }
+    .editor pre, .editor textarea { margin: 0; padding: 0.5rem; font-family: ui-monospace, monospace; font-size: 0.85rem; line-height: 1.4; }
+    #gutter { min-width: 3rem; text-align: right; color: #999; background: #f5f5f5; overflow: hidden; user-select: none; }
+    #gutter .line-error { color: #fff; background: #c62828; }
+    #gutter .line-warning { color: #000; background: #ffd180; }
+    #text { flex: 1; border: none; resize: none; outline: none; white-space: pre; overflow: auto; }
+    #problems { padding-left: 1.2rem; }
+    #problems li { margin: 0.3rem 0; }
+    #problems a { color: inherit; }
+    .problem-error { color: #c62828; }
+    .problem-warning { color: #e65100; }
+    .saved { color: #2e7d32; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+    h2 { font-size: 1.2rem; margin-top: 1.5rem; }
+    #versions { list-style: none; padding: 0; }
+    #versions li { display: flex; flex-wrap: wrap; align-items: center; gap: 0.5rem; padding: 0.4rem 0; border-bottom: 1px solid #eee; }
+    #versions .version { flex: 1; }
+  </style>
+</head>
+<body>
+  <h1 id="config-title" data-i18n>Config</h1>
+  <p data-i18n>The options of the addon as YAML or JSON. They are checked as you type the way the addon checks them at startup and used once the addon restarts. Each saved version is kept so a bad edit can be rolled back. <a href="/">Back to jobs</a></p>
+  <div class="controls">
+    <select id="format" aria-label="Format">
+      <option value="yaml">YAML</option>
+      <option value="json">JSON</option>
+    </select>
+    <button id="validate" data-i18n>Validate</button>
+    <button id="save" data-i18n>Save</button>
+    <button id="restart" class="secondary" data-i18n>Save and restart</button>
+    <span class="meta" id="meta" role="status"></span>
+  </div>
+  <div class="editor">
+    <pre id="gutter" aria-hidden="true"></pre>
+    <textarea id="text" spellcheck="false" aria-labelledby="config-title" aria-describedby="problems"></textarea>
+  </div>
+  <ul id="problems"></ul>
+  <p class="error" id="err" role="alert" style="display:none;"></p>
+  <h2 data-i18n>Versions</h2>
+  <ul id="versions"></ul>
+  <script>
+    const formatEl = document.getElementById('format');
+    const textEl = document.getElementById('text');
+    const gutterEl = document.getElementById('gutter');
+    const problemsEl = document.getElementById('problems');
+    const metaEl = document.getElementById('meta');
+    const errEl = document.getElementById('err');
+    const saveBtn = document.getElementById('save');
+    const restartBtn = document.getElementById('restart');
+    const versionsEl = document.getElementById('versions');
+    let problems = [];
+    let checks = 0;
+    let timer = null;
+    let dirty = false;
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        if (r.status === 428) {
+          const code = prompt(tr('Confirmation code (see the addon log or your notifications)'));
+          if (code) return api(path, Object.assign({}, opts, { headers: Object.assign({}, opts.headers, { 'X-Confirm-Code': code }) }));
+        }
+        return r;
+      });
+    }
+    // the gutter numbers the lines and marks those with problems
+    function drawGutter() {
+      const lines = {};
+      problems.forEach(p => { if (p.line && (!lines[p.line] || p.severity === 'error')) lines[p.line] = p; });
+      gutterEl.textContent = '';
+      const count = textEl.value.split('\n').length;
+      for (let i = 1; i <= count; i++) {
+        const line = document.createElement('span');
+        line.textContent = i + '\n';
+        if (lines[i]) { line.className = 'line-' + lines[i].severity; line.title = lines[i].message; }
+        gutterEl.appendChild(line);
+      }
+      gutterEl.scrollTop = textEl.scrollTop;
+    }
+    function goToLine(n) {
+      const lines = textEl.value.split('\n');
+      const start = lines.slice(0, n - 1).reduce((sum, l) => sum + l.length + 1, 0);
+      textEl.focus();
+      textEl.setSelectionRange(start, start + (lines[n - 1] || '').length);
+      textEl.scrollTop = Math.max((n - 5) * parseFloat(getComputedStyle(textEl).lineHeight), 0);
+    }
+    function show(v) {
+      problems = v.problems || [];
+      problemsEl.textContent = '';
+      problems.forEach(p => {
+        const li = document.createElement('li');
+        li.className = 'problem-' + p.severity;
+        const text = (p.severity === 'error' ? tr('Error') : tr('Warning')) + ': ' + p.message;
+        if (p.line) {
+          const a = document.createElement('a');
+          a.href = '#';
+          a.textContent = tr('Line {line}', { line: p.line }) + ' – ' + text;
+          a.onclick = e => { e.preventDefault(); goToLine(p.line); };
+          li.appendChild(a);
+        } else {
+          li.textContent = text;
+        }
+        problemsEl.appendChild(li);
+      });
+      const errors = problems.filter(p => p.severity === 'error').length;
+      metaEl.className = 'meta';
+      metaEl.textContent = v.valid ? tr('Valid, {jobs} jobs, {warnings} warnings', { jobs: v.jobs, warnings: problems.length }) :
+        tr('{errors} errors, {warnings} warnings', { errors: errors, warnings: problems.length - errors });
+      saveBtn.disabled = restartBtn.disabled = !v.valid;
+      drawGutter();
+    }
+    function validate() {
+      clearTimeout(timer);
+      const check = ++checks;
+      metaEl.className = 'meta';
+      metaEl.textContent = tr('Checking…');
+      return api('/api/config/validate', { method: 'POST', body: textEl.value })
+        .then(r => r.ok ? r.json() : r.text().then(t => Promise.reject(new Error(t || tr('Failed to check the config')))))
+        // only the latest check is shown while typing
+        .then(v => { if (check === checks) show(v); })
+        .catch(e => showErr(e.message));
+    }
+    function load() {
+      errEl.style.display = 'none';
+      return api('/api/config?format=' + formatEl.value)
+        .then(r => r.ok ? r.text() : Promise.reject(new Error(tr('Failed to load the config'))))
+        .then(text => { textEl.value = text; dirty = false; return validate(); })
+        .catch(e => showErr(e.message));
+    }
+    function describe(v) {
+      const parts = [tr('Version {id}', { id: v.id }), new Date(v.time).toLocaleString(language)];
+      if (v.source === 'startup') parts.push(tr('Changed before the addon started'));
+      else if (v.source === 'rollback') parts.push(tr('Rolled back to version {id}', { id: v.restored }));
+      else if (v.source === 'wizard') parts.push(tr('A job was added with the setup wizard'));
+      else parts.push(v.token ? tr('Saved with the token {token}', { token: v.token }) : tr('Saved'));
+      parts.push(tr('{count} jobs', { count: v.jobs }));
+      return parts.join(' – ');
+    }
+    function button(text, onclick) {
+      const b = document.createElement('button');
+      b.className = 'secondary';
+      b.textContent = text;
+      b.onclick = onclick;
+      return b;
+    }
+    function loadVersions() {
+      api('/api/config/versions')
+        .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load the versions'))))
+        .then(versions => {
+          versionsEl.textContent = '';
+          versions.forEach((v, i) => {
+            const li = document.createElement('li');
+            const label = document.createElement('span');
+            label.className = 'version';
+            label.textContent = describe(v);
+            li.appendChild(label);
+            const show = button(tr('Show'), () => showVersion(v));
+            show.setAttribute('aria-label', tr('Show') + ' – ' + tr('Version {id}', { id: v.id }));
+            li.appendChild(show);
+            // the newest version is the saved config
+            if (i > 0) {
+              const back = button(tr('Roll back'), () => rollback(v));
+              back.setAttribute('aria-label', tr('Roll back') + ' – ' + tr('Version {id}', { id: v.id }));
+              li.appendChild(back);
+            }
+            versionsEl.appendChild(li);
+          });
+        })
+        .catch(e => showErr(e.message));
+    }
+    function showVersion(v) {
+      if (dirty && !confirm(tr('Discard your changes?'))) return;
+      errEl.style.display = 'none';
+      api('/api/config/versions/' + v.id + '?format=' + formatEl.value)
+        .then(r => r.ok ? r.text() : Promise.reject(new Error(tr('Failed to load the config'))))
+        // shown as an edit, saving it makes it the config again
+        .then(text => { textEl.value = text; dirty = true; validate(); })
+        .catch(e => showErr(e.message));
+    }
+    function rollback(v) {
+      if (!confirm(tr('Roll back to version {id}?', { id: v.id }))) return;
+      errEl.style.display = 'none';
+      api('/api/config/versions/' + v.id + '/rollback', { method: 'POST' })
+        .then(r => {
+          if (r.status === 422) return r.json().then(v => { show(v); return Promise.reject(new Error(tr('The config was not saved, it has errors'))); });
+          return r.ok ? r.json() : r.text().then(t => Promise.reject(new Error(t || tr('Failed to roll back the config'))));
+        })
+        .then(() => load())
+        .then(() => {
+          loadVersions();
+          metaEl.className = 'saved';
+          metaEl.textContent = tr('Rolled back to version {id}, restart the addon to use it', { id: v.id });
+        })
+        .catch(e => showErr(e.message));
+    }
+    function save(restart) {
+      errEl.style.display = 'none';
+      saveBtn.disabled = restartBtn.disabled = true;
+      api('/api/config' + (restart ? '?restart=1' : ''), { method: 'PUT', body: textEl.value })
+        .then(r => {
+          if (r.status === 422) return r.json().then(v => { show(v); return Promise.reject(new Error(tr('The config was not saved, it has errors'))); });
+          return r.ok ? r.json() : r.text().then(t => Promise.reject(new Error(t || tr('Failed to save the config'))));
+        })
+        .then(v => {
+          show(v);
+          dirty = false;
+          metaEl.className = 'saved';
+          metaEl.textContent = restart ? tr('Saved, the addon is restarting to use the new options') : tr('Saved, restart the addon to use the new options');
+          loadVersions();
+        })
+        .catch(e => { showErr(e.message); saveBtn.disabled = restartBtn.disabled = false; });
+    }
+    textEl.oninput = () => {
+      dirty = true;
+      drawGutter();
+      clearTimeout(timer);
+      timer = setTimeout(validate, 1500);
+    };
+    textEl.onscroll = () => { gutterEl.scrollTop = textEl.scrollTop; };
+    formatEl.onchange = () => {
+      if (dirty && !confirm(tr('Discard your changes?'))) { formatEl.value = formatEl.value === 'yaml' ? 'json' : 'yaml'; return; }
+      load();
+    };
+    document.getElementById('validate').onclick = validate;
+    saveBtn.onclick = () => save(false);
+    restartBtn.onclick = () => save(true);
+    window.onbeforeunload = e => { if (dirty) e.preventDefault(); };
+    // a standalone scheduler can't restart itself and keeps a yaml config as yaml
+    api('/api/capabilities')
+      .then(r => r.ok ? r.json() : {})
+      .then(c => {
+        if (c.standalone) restartBtn.style.display = 'none';
+        if (c.config_format === 'yaml') formatEl.value = 'yaml';
+      })
+      .catch(() => {})
+      .then(() => load());
+    loadVersions();
+  </script>
+</body>
+</html>
+`
+
+// wizardPageHTML guides through setting up the first backup job, step by step
+const wizardPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Setup</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 700px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    fieldset { border: 1px solid #ccc; border-radius: 6px; padding: 1rem; margin: 1rem 0; }
+    legend { font-weight: 600; padding: 0 0.3rem; }
+    label { display: block; margin: 0.5rem 0; }
+    input[type=text], select { padding: 0.35rem; font-size: 1rem; }
+    input[type=text] { width: 100%; box-sizing: border-box; }
+    .meta { color: #666; font-size: 0.85rem; }
+    .steps { color: #666; font-size: 0.9rem; }
+    .controls { display: flex; gap: 0.5rem; }
+    button { padding: 0.5rem 1rem; cursor: pointer; background: #0277bd; color: #fff; border: none; border-radius: 4px; font-size: 1rem; }
+    button:hover { background: #01579b; }
+    button:disabled { background: #ccc; cursor: not-allowed; }
+    button.secondary { background: #616161; }
+    button:focus-visible, input:focus-visible, select:focus-visible, a:focus-visible { outline: 3px solid #01579b; outline-offset: 2px; }
+    dl { display: grid; grid-template-columns: max-content 1fr; gap: 0.3rem 1rem; }
+    dt { font-weight: 600; }
+    dd { margin: 0; }
+    .done { color: #2e7d32; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Set up a backup</h1>
+  <p data-i18n>Answer a few questions to create a backup job. You can change everything later on the <a href="/config">config</a> page. <a href="/">Back to jobs</a></p>
+  <p class="meta" id="existing" style="display:none;" data-i18n>Backups are already set up, this adds another job.</p>
+  <p class="steps" id="progress" role="status"></p>
+  <form id="wizard">
+    <fieldset class="step">
+      <legend data-i18n>Where should the backups go?</legend>
+      <label><span data-i18n>Remote</span><br><select id="remote"></select></label>
+      <p class="meta" id="no-remotes" style="display:none;" data-i18n>No rclone remotes are configured yet. <a href="/remotes">Add one</a> by signing in to Google Drive, Dropbox or OneDrive, or with <code>rclone config</code> and the <code>config_path</code> option, then reload this page.</p>
+      <label><span data-i18n>Folder on the remote</span><input type="text" id="path" value="Home Assistant"></label>
+    </fieldset>
+    <fieldset class="step">
+      <legend data-i18n>What should be backed up?</legend>
+      <div id="sources"></div>
+      <label><span data-i18n>Other folder</span><input type="text" id="other" placeholder="/share/documents"></label>
+    </fieldset>
+    <fieldset class="step">
+      <legend data-i18n>When should it run?</legend>
+      <label><input type="radio" name="when" value="daily" checked> <span data-i18n>Every day</span></label>
+      <label><input type="radio" name="when" value="weekly"> <span data-i18n>Every week on</span> <select id="weekday"></select></label>
+      <label><span data-i18n>At</span> <input type="time" id="time" value="03:00"></label>
+      <label><input type="radio" name="when" value="cron"> <span data-i18n>Cron schedule</span> <input type="text" id="cron" placeholder="0 3 * * *"></label>
+    </fieldset>
+    <fieldset class="step">
+      <legend data-i18n>What should happen to files you delete?</legend>
+      <label><input type="radio" name="command" value="copy" checked> <span data-i18n>Keep them on the remote, only new and changed files are copied</span></label>
+      <label><input type="radio" name="command" value="sync"> <span data-i18n>Delete them from the remote too, so it mirrors the folders</span></label>
+      <label><span data-i18n>Keep the old versions of deleted and changed files for</span><br><select id="retention">
+        <option value="" data-i18n>Do not keep them</option>
+        <option value="7d" data-i18n>7 days</option>
+        <option value="30d" selected data-i18n>30 days</option>
+        <option value="90d" data-i18n>90 days</option>
+        <option value="365d" data-i18n>1 year</option>
+      </select></label>
+    </fieldset>
+    <fieldset class="step">
+      <legend data-i18n>Who should be told when a backup fails?</legend>
+      <label><span data-i18n>Notify</span><br><select id="notify"><option value="" data-i18n>Nobody</option></select></label>
+      <label><input type="checkbox" id="notify-all"> <span data-i18n>Also when a backup succeeds</span></label>
+    </fieldset>
+    <fieldset class="step">
+      <legend data-i18n>Check and create the job</legend>
+      <label><span data-i18n>Name of the job</span><input type="text" id="name"></label>
+      <dl id="summary"></dl>
+    </fieldset>
+    <div class="controls">
+      <button type="button" class="secondary" id="back" data-i18n>Back</button>
+      <button type="submit" id="next" data-i18n>Next</button>
+    </div>
+  </form>
+  <p class="done" id="done" role="status" style="display:none;"></p>
+  <p class="error" id="err" role="alert" style="display:none;"></p>
+  <script>
+    const form = document.getElementById('wizard');
+    const steps = Array.from(document.querySelectorAll('.step'));
+    const remoteEl = document.getElementById('remote');
+    const sourcesEl = document.getElementById('sources');
+    const notifyEl = document.getElementById('notify');
+    const nameEl = document.getElementById('name');
+    const backBtn = document.getElementById('back');
+    const nextBtn = document.getElementById('next');
+    const errEl = document.getElementById('err');
+    const doneEl = document.getElementById('done');
+    let step = 0;
+    let info = null;
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        if (r.status === 428) {
+          const code = prompt(tr('Confirmation code (see the addon log or your notifications)'));
+          if (code) return api(path, Object.assign({}, opts, { headers: Object.assign({}, opts.headers, { 'X-Confirm-Code': code }) }));
+        }
+        return r;
+      });
+    }
+    function option(select, value, text) {
+      const o = document.createElement('option');
+      o.value = value;
+      o.textContent = text;
+      select.appendChild(o);
+    }
+    function value(name) { return form.querySelector('input[name=' + name + ']:checked').value; }
+    function sources() {
+      const list = Array.from(sourcesEl.querySelectorAll('input:checked')).map(c => c.value);
+      const other = document.getElementById('other').value.trim();
+      if (other) list.push(other);
+      return list;
+    }
+    function schedule() {
+      const when = value('when');
+      if (when === 'cron') return document.getElementById('cron').value.trim();
+      const [hour, minute] = (document.getElementById('time').value || '03:00').split(':').map(Number);
+      return minute + ' ' + hour + ' * * ' + (when === 'weekly' ? document.getElementById('weekday').value : '*');
+    }
+    function job() {
+      const notify = notifyEl.value;
+      return {
+        name: nameEl.value.trim(),
+        sources: sources(),
+        remote: remoteEl.value,
+        path: document.getElementById('path').value.trim(),
+        command: value('command'),
+        schedule: schedule(),
+        retention: document.getElementById('retention').value,
+        service: notify.startsWith('notify.') ? notify : '',
+        notifier: notify.startsWith('notifier:') ? notify.slice(9) : '',
+        notify_all: document.getElementById('notify-all').checked,
+      };
+    }
+    // each step is checked before moving on, the server checks everything again
+    function problem() {
+      if (step === 0 && !remoteEl.value) return tr('Pick a remote');
+      if (step === 1 && !sources().length) return tr('Pick at least one folder');
+      if (step === 2 && value('when') === 'cron' && schedule().split(/\s+/).length !== 5) return tr('A cron schedule has five fields, e.g. 0 3 * * *');
+      if (step === 5 && !nameEl.value.trim()) return tr('Give the job a name');
+      return '';
+    }
+    function summarize() {
+      const j = job();
+      const retention = document.getElementById('retention');
+      const rows = [
+        [tr('Destination'), j.remote + j.path.replace(/^\/+/, '')],
+        [tr('Folders'), j.sources.join(', ')],
+        [tr('Schedule'), j.schedule],
+        [tr('Deleted files'), j.command === 'sync' ? tr('Deleted from the remote too') : tr('Kept on the remote')],
+        [tr('Old versions'), retention.options[retention.selectedIndex].textContent],
+        [tr('Notify'), notifyEl.options[notifyEl.selectedIndex].textContent],
+      ];
+      const summary = document.getElementById('summary');
+      summary.textContent = '';
+      rows.forEach(([term, text]) => {
+        const dt = document.createElement('dt');
+        dt.textContent = term;
+        const dd = document.createElement('dd');
+        dd.textContent = text;
+        summary.append(dt, dd);
+      });
+    }
+    function go(n) {
+      step = n;
+      steps.forEach((s, i) => { s.style.display = i === step ? '' : 'none'; });
+      backBtn.disabled = step === 0;
+      nextBtn.textContent = step === steps.length - 1 ? tr('Create the job') : tr('Next');
+      document.getElementById('progress').textContent = tr('Step {step} of {steps}', { step: step + 1, steps: steps.length });
+      if (step === steps.length - 1) {
+        if (!nameEl.value) nameEl.value = tr('Backup to {remote}', { remote: remoteEl.value.replace(/:$/, '') });
+        summarize();
+      }
+      const first = steps[step].querySelector('input, select');
+      if (first) first.focus();
+    }
+    function create() {
+      nextBtn.disabled = backBtn.disabled = true;
+      api('/api/wizard' + (info.restart ? '?restart=1' : ''), { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(job()) })
+        .then(r => {
+          if (r.status === 422) return r.json().then(v => Promise.reject(new Error(tr('The job was not added, the config has errors') + ': ' +
+            v.problems.filter(p => p.severity === 'error').map(p => p.message).join('; '))));
+          return r.ok ? r.json() : r.text().then(t => Promise.reject(new Error(t || tr('Failed to add the job'))));
+        })
+        .then(() => {
+          form.style.display = 'none';
+          doneEl.innerHTML = info.restart ? tr('The job was added and the addon is restarting to start backing up, follow its runs on the <a href="/">jobs</a> page.') :
+            tr('The job was added. Restart the addon to start backing up, then follow its runs on the <a href="/">jobs</a> page.');
+          doneEl.style.display = 'block';
+        })
+        .catch(e => { showErr(e.message); nextBtn.disabled = backBtn.disabled = false; });
+    }
+    backBtn.onclick = () => go(step - 1);
+    // picking a day or typing a schedule chooses that kind of schedule
+    document.getElementById('weekday').onchange = () => { form.querySelector('input[value=weekly]').checked = true; };
+    document.getElementById('cron').oninput = () => { form.querySelector('input[value=cron]').checked = true; };
+    form.onsubmit = e => {
+      e.preventDefault();
+      errEl.style.display = 'none';
+      const p = problem();
+      if (p) { showErr(p); return; }
+      if (step < steps.length - 1) go(step + 1); else create();
+    };
+    [1, 2, 3, 4, 5, 6, 0].forEach(d => option(document.getElementById('weekday'), d, new Date(2024, 0, d || 7).toLocaleDateString(language, { weekday: 'long' })));
+    api('/api/wizard')
+      .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load the setup'))))
+      .then(i => {
+        info = i;
+        info.remotes.forEach(r => option(remoteEl, r, r));
+        document.getElementById('no-remotes').style.display = info.remotes.length ? 'none' : 'block';
+        info.sources.forEach(s => {
+          const label = document.createElement('label');
+          const box = document.createElement('input');
+          box.type = 'checkbox';
+          box.value = s;
+          box.checked = s === '/backup';
+          label.append(box, ' ' + s);
+          sourcesEl.appendChild(label);
+        });
+        info.services.forEach(s => option(notifyEl, s, s));
+        info.notifiers.forEach(n => option(notifyEl, 'notifier:' + n, n));
+        document.getElementById('existing').style.display = info.needed ? 'none' : 'block';
+        go(0);
+      })
+      .catch(e => showErr(e.message));
+  </script>
+</body>
+</html>
+`
+
+// remotesPageHTML lists the rclone remotes and adds Google Drive, Dropbox and OneDrive remotes by signing in to
+// them in the browser
+const remotesPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Remotes</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 700px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    h2 { font-size: 1.2rem; margin-top: 1.5rem; }
+    label { display: block; margin: 0.5rem 0; }
+    input[type=text], select, textarea { padding: 0.35rem; font-size: 1rem; }
+    input[type=text], textarea { width: 100%; box-sizing: border-box; }
+    textarea { height: 5rem; font-family: ui-monospace, monospace; font-size: 0.85rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    button { padding: 0.5rem 1rem; cursor: pointer; background: #0277bd; color: #fff; border: none; border-radius: 4px; font-size: 1rem; }
+    button:hover { background: #01579b; }
+    button:disabled { background: #ccc; cursor: not-allowed; }
+    button.secondary { background: #616161; }
+    button:focus-visible, input:focus-visible, select:focus-visible, textarea:focus-visible, a:focus-visible { outline: 3px solid #01579b; outline-offset: 2px; }
+    #signin a { font-weight: 600; word-break: break-all; }
+    .done { color: #2e7d32; }
+    .error { color: #c62828; margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Remotes</h1>
+  <p data-i18n>The rclone remotes jobs can back up to. <a href="/">Back to jobs</a></p>
+  <ul id="remotes"></ul>
+  <h2 data-i18n>Add a remote</h2>
+  <form id="start">
+    <label><span data-i18n>Provider</span><br><select id="backend"></select></label>
+    <label><span data-i18n>Name of the remote</span><input type="text" id="name" pattern="[A-Za-z0-9_][A-Za-z0-9_.+@\-]*" required></label>
+    <button type="submit" id="start-btn" data-i18n>Sign in</button>
+  </form>
+  <form id="signin" style="display:none;">
+    <p data-i18n>Open the link below and allow rclone to access your account. Your browser is then sent to an address starting with <code>http://127.0.0.1:53682</code> that doesn't load, copy it from the address bar and paste it here.</p>
+    <p><a id="link" target="_blank" rel="noopener"></a></p>
+    <label><span data-i18n>Address or token</span><textarea id="response" required></textarea></label>
+    <p class="meta" data-i18n>You can also run <code>rclone authorize</code> with the provider on a computer with rclone and paste the token it prints.</p>
+    <button type="submit" id="finish" data-i18n>Create the remote</button>
+    <button type="button" class="secondary" id="cancel" data-i18n>Cancel</button>
+  </form>
+  <p class="done" id="done" role="status" style="display:none;"></p>
+  <p class="error" id="err" role="alert" style="display:none;"></p>
+  <script>
+    const backendEl = document.getElementById('backend');
+    const nameEl = document.getElementById('name');
+    const startForm = document.getElementById('start');
+    const signinForm = document.getElementById('signin');
+    const responseEl = document.getElementById('response');
+    const doneEl = document.getElementById('done');
+    const errEl = document.getElementById('err');
+    let session = null;
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    function failed(r, msg) { return r.text().then(t => Promise.reject(new Error(t.trim() || msg))); }
+    function loadRemotes() {
+      api('/api/rclone')
+        .then(r => r.ok ? r.json() : failed(r, tr('Failed to load the remotes')))
+        .then(info => {
+          const list = document.getElementById('remotes');
+          list.textContent = '';
+          (info.remotes || []).forEach(name => {
+            const li = document.createElement('li');
+            li.textContent = name;
+            list.appendChild(li);
+          });
+          if (!list.children.length) {
+            const li = document.createElement('li');
+            li.textContent = tr('No remotes are configured yet.');
+            list.appendChild(li);
+          }
+        })
+        .catch(e => showErr(e.message));
+    }
+    startForm.onsubmit = e => {
+      e.preventDefault();
+      errEl.style.display = doneEl.style.display = 'none';
+      document.getElementById('start-btn').disabled = true;
+      api('/api/remotes/oauth', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ name: nameEl.value.trim(), backend: backendEl.value }) })
+        .then(r => r.ok ? r.json() : failed(r, tr('Failed to start signing in')))
+        .then(s => {
+          session = s;
+          const link = document.getElementById('link');
+          link.href = s.url;
+          link.textContent = tr('Sign in to {provider}', { provider: backendEl.options[backendEl.selectedIndex].textContent });
+          startForm.style.display = 'none';
+          signinForm.style.display = 'block';
+          responseEl.value = '';
+          link.focus();
+        })
+        .catch(e => showErr(e.message))
+        .finally(() => { document.getElementById('start-btn').disabled = false; });
+    };
+    signinForm.onsubmit = e => {
+      e.preventDefault();
+      errEl.style.display = 'none';
+      const finish = document.getElementById('finish');
+      finish.disabled = true;
+      finish.textContent = tr('Creating the remote…');
+      api('/api/remotes/oauth/' + session.id, { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ response: responseEl.value }) })
+        .then(r => r.ok ? r.json() : failed(r, tr('Failed to create the remote')))
+        .then(result => {
+          signinForm.style.display = 'none';
+          startForm.style.display = 'block';
+          nameEl.value = '';
+          doneEl.className = result.ok ? 'done' : 'error';
+          doneEl.textContent = (result.ok ? tr('The remote {name} was created and works, it has {count} folders.', { name: result.name, count: result.folders.length }) :
+            tr('The remote {name} was created but listing it failed: {error}', { name: result.name, error: result.error })) + ' ';
+          const hint = document.createElement('span');
+          hint.innerHTML = tr('Use it in a job, e.g. with the <a href="/setup">setup wizard</a>.');
+          doneEl.appendChild(hint);
+          doneEl.style.display = 'block';
+          loadRemotes();
+        })
+        .catch(e => showErr(e.message))
+        .finally(() => { finish.disabled = false; finish.textContent = tr('Create the remote'); });
+    };
+    document.getElementById('cancel').onclick = () => {
+      if (session) api('/api/remotes/oauth/' + session.id, { method: 'DELETE' });
+      session = null;
+      signinForm.style.display = 'none';
+      startForm.style.display = 'block';
+    };
+    api('/api/remotes/oauth')
+      .then(r => r.ok ? r.json() : failed(r, tr('Failed to load the providers')))
+      .then(backends => {
+        Object.keys(backends).sort().forEach(b => {
+          const o = document.createElement('option');
+          o.value = b;
+          o.textContent = backends[b];
+          backendEl.appendChild(o);
+        });
+        // the remote is named after its provider unless a name was typed
+        nameEl.value = backendEl.value;
+        backendEl.onchange = () => { if (!nameEl.value || backends[nameEl.value]) nameEl.value = backendEl.value; };
       })
       .catch(e => showErr(e.message));
+    loadRemotes();
+  </script>
+</body>
+</html>
+`
+
+const selfTestPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rclone Backup – Self-test</title>
+  <link rel="icon" href="/icon.png">
+  <script src="/i18n.js"></script>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 900px; margin: 1rem auto; padding: 0 1rem; }
+    h1 { font-size: 1.5rem; }
+    h2 { font-size: 1.1rem; margin: 1.5rem 0 0.25rem; }
+    .meta { color: #666; font-size: 0.85rem; }
+    table { width: 100%; border-collapse: collapse; font-size: 0.9rem; margin-top: 0.5rem; }
+    th, td { text-align: left; padding: 0.3rem 0.5rem; border-bottom: 1px solid #eee; vertical-align: top; }
+    button { padding: 0.35rem 0.75rem; cursor: pointer; background: #03a9f4; color: #fff; border: none; border-radius: 4px; }
+    button:hover { background: #0288d1; }
+    button:disabled { background: #ccc; cursor: not-allowed; }
+    .passed { color: #2e7d32; }
+    .failed, .error { color: #c62828; }
+    .skipped { color: #ef6c00; }
+    .error { margin-top: 0.5rem; }
+  </style>
+</head>
+<body>
+  <h1 data-i18n>Self-test</h1>
+  <p data-i18n>Uploads a small test file to each remote, checks its checksum, downloads it back, compares it and deletes it again. <a href="/">Back to jobs</a></p>
+  <button id="run" data-i18n>Test all remotes</button>
+  <p class="meta" id="status"></p>
+  <div id="remotes"></div>
+  <p class="error" id="err" style="display:none;"></p>
+  <script>
+    const el = document.getElementById('remotes');
+    const statusEl = document.getElementById('status');
+    const errEl = document.getElementById('err');
+    const runBtn = document.getElementById('run');
+    const steps = { write: 'Write test file', upload: 'Upload', checksum: 'Checksum', download: 'Download', compare: 'Compare', delete: 'Delete' };
+    let timer = null;
+    function showErr(msg) { errEl.textContent = msg; errEl.style.display = 'block'; }
+    function api(path, opts) {
+      opts = opts || {};
+      const token = localStorage.getItem('apiToken');
+      if (token) opts.headers = Object.assign({ 'Authorization': 'Bearer ' + token }, opts.headers);
+      return fetch(path, opts).then(r => {
+        if (r.status === 401) {
+          const t = prompt(tr('API token'));
+          if (t) { localStorage.setItem('apiToken', t); return api(path, opts); }
+        }
+        return r;
+      });
+    }
+    function cell(row, text, cls) {
+      const td = document.createElement('td');
+      td.textContent = text;
+      if (cls) td.className = cls;
+      row.appendChild(td);
+      return td;
+    }
+    function run(remote) {
+      errEl.style.display = 'none';
+      runBtn.disabled = true;
+      api('/api/selftest/run' + (remote ? '?remote=' + encodeURIComponent(remote) : ''), { method: 'POST' })
+        .then(r => r.ok ? null : r.text().then(t => Promise.reject(new Error(t || tr('Failed to start the self-test')))))
+        .then(() => load())
+        .catch(e => { showErr(e.message); runBtn.disabled = false; });
+    }
+    function load() {
+      clearTimeout(timer);
+      api('/api/selftest')
+        .then(r => r.ok ? r.json() : Promise.reject(new Error(tr('Failed to load the self-test'))))
+        .then(report => {
+          runBtn.disabled = report.running;
+          if (report.running) {
+            statusEl.textContent = tr('Testing since {time}…', { time: new Date(report.started).toLocaleString(language) });
+            timer = setTimeout(load, 2000);
+          } else if (report.finished) {
+            statusEl.textContent = tr(report.passed ? 'All remotes passed, tested {time}' : 'Some remotes failed, tested {time}',
+              { time: new Date(report.finished).toLocaleString(language) });
+          } else {
+            statusEl.textContent = tr('No self-test has run yet.');
+          }
+          el.textContent = '';
+          report.remotes.forEach(result => {
+            const h = document.createElement('h2');
+            h.textContent = result.path + ' ';
+            const state = document.createElement('span');
+            state.className = result.passed ? 'passed' : 'failed';
+            state.textContent = tr(result.passed ? 'passed' : 'failed');
+            h.appendChild(state);
+            const again = document.createElement('button');
+            again.textContent = tr('Test again');
+            again.disabled = report.running;
+            again.onclick = () => run(result.remote);
+            const table = document.createElement('table');
+            const head = document.createElement('tr');
+            ['Step', 'Result', 'Duration', 'Error'].forEach(t => { const th = document.createElement('th'); th.textContent = tr(t); head.appendChild(th); });
+            table.appendChild(head);
+            result.steps.forEach(s => {
+              const row = document.createElement('tr');
+              cell(row, tr(steps[s.name] || s.name));
+              if (s.skipped) cell(row, tr('skipped'), 'skipped');
+              else cell(row, tr(s.ok ? 'passed' : 'failed'), s.ok ? 'passed' : 'failed');
+              cell(row, s.duration);
+              cell(row, s.error || '');
+              table.appendChild(row);
+            });
+            el.appendChild(h);
+            el.appendChild(again);
+            el.appendChild(table);
+          });
+        })
+        .catch(e => showErr(e.message));
+    }
+    runBtn.onclick = () => run('');
+    load();
   </script>
 </body>
 </html>
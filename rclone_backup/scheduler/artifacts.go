@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultArtifactsMaxSize = "100M"
+
+// MaxDryRunChanges is the largest number of changes of a dry run kept in its artifact
+const MaxDryRunChanges = 10000
+
+const (
+	ArtifactReport   = "report.json"   // the history record of the run
+	ArtifactManifest = "manifest.json" // the files on each destination, see Manifest
+	ArtifactDryRun   = "dry-run.txt"   // what a dry run would have changed
+	ArtifactSpeed    = "speed.json"    // the transfer speed during the run, see SpeedSample
+)
+
+var ArtifactsPath = filepath.Join(DataPath, "artifacts")
+
+var ErrNoArtifacts = errors.New("run has no artifacts or log")
+
+// Artifact is a file kept for a run
+type Artifact struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// CheckArtifacts validates the artifacts_max_size option
+func CheckArtifacts() error {
+	if config.ArtifactsMaxSize == "" {
+		return nil
+	}
+	if _, err := ParseSizeString(config.ArtifactsMaxSize); err != nil {
+		return fmt.Errorf("invalid artifacts_max_size: %w", err)
+	}
+	return nil
+}
+
+func artifactsDir(job int, run string) string {
+	return filepath.Join(ArtifactsPath, strconv.Itoa(job)+"_"+run)
+}
+
+// ArtifactPath returns the file of an artifact, rejecting names that would leave the folder of the run
+func ArtifactPath(job int, run string, name string) (string, error) {
+	if run == "" || strings.ContainsAny(run, `/\.`) {
+		return "", fmt.Errorf("invalid run '%s'", run)
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid artifact '%s'", name)
+	}
+	return filepath.Join(artifactsDir(job, run), name), nil
+}
+
+// WriteArtifact stores a file in the artifacts of a run
+func WriteArtifact(job int, run string, name string, data []byte) error {
+	path, err := ArtifactPath(job, run, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// AppendArtifact adds to a file in the artifacts of a run, e.g. for each target of a job
+func AppendArtifact(job int, run string, name string, data []byte) error {
+	path, err := ArtifactPath(job, run, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ListArtifacts returns the artifacts of a run by name
+func ListArtifacts(job int, run string) ([]Artifact, error) {
+	if _, err := ArtifactPath(job, run, ArtifactReport); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(artifactsDir(job, run))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Artifact{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	artifacts := make([]Artifact, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	return artifacts, nil
+}
+
+// SaveReport stores the history record of a finished run as an artifact and lists its artifacts in the record
+func SaveReport(record *RunRecord) {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err == nil {
+		err = WriteArtifact(record.Job, record.ID, ArtifactReport, data)
+	}
+	if err != nil {
+		Errorln("failed to save run report:", err)
+	}
+	artifacts, _ := ListArtifacts(record.Job, record.ID)
+	record.Artifacts = nil
+	for _, artifact := range artifacts {
+		record.Artifacts = append(record.Artifacts, artifact.Name)
+	}
+}
+
+// SaveDryRunChanges adds what a dry run of one target would have changed to the artifacts of the run
+func SaveDryRunChanges(job JobConfig, source string, destination string, changes []string) {
+	run := statuses.Get(job.Index).RunID
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s -> %s: %d changes\n", source, destination, len(changes))
+	for _, change := range changes {
+		b.WriteString(change + "\n")
+	}
+	if err := AppendArtifact(job.Index, run, ArtifactDryRun, []byte(b.String())); err != nil {
+		Warnln("failed to save dry run changes:", err)
+	}
+}
+
+// WriteRunBundle writes a zip of the artifacts and log of a run, e.g. to attach to a support request
+func WriteRunBundle(w io.Writer, job int, run string) error {
+	artifacts, err := ListArtifacts(job, run)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]string)
+	for _, artifact := range artifacts {
+		files[artifact.Name] = filepath.Join(artifactsDir(job, run), artifact.Name)
+	}
+	if _, err := os.Stat(runLogPath(job, run)); err == nil {
+		files["run.log"] = runLogPath(job, run)
+	}
+	if len(files) == 0 {
+		return ErrNoArtifacts
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	archive := zip.NewWriter(w)
+	for _, name := range names {
+		if err := addZipFile(archive, name, files[name]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func addZipFile(archive *zip.Writer, name string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	out, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, file)
+	return err
+}
+
+// PruneArtifacts removes the artifacts of runs that are no longer in the history, then those of the
+// oldest runs until all artifacts fit in artifacts_max_size
+func PruneArtifacts() {
+	maxSize, _ := ParseSizeString(DefaultArtifactsMaxSize)
+	if config.ArtifactsMaxSize != "" {
+		maxSize, _ = ParseSizeString(config.ArtifactsMaxSize)
+	}
+	keep := make(map[string]bool)
+	for i := range config.Jobs {
+		for _, run := range history.Runs(i) {
+			keep[artifactsDir(i, run.ID)] = true
+		}
+	}
+	type runArtifacts struct {
+		path     string
+		size     int64
+		modified time.Time
+	}
+	var runs []runArtifacts
+	var total int64
+	dirs, _ := filepath.Glob(filepath.Join(ArtifactsPath, "*_*"))
+	for _, dir := range dirs {
+		// the run currently writing its artifacts is not in the history yet
+		if _, _, _, ok := parseLogName(dir); ok && !keep[dir] && !isCurrentRun(dir) {
+			Debugln("removing artifacts of old run", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				Warnln("failed to remove artifacts", dir+":", err)
+			}
+			continue
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			continue
+		}
+		run := runArtifacts{path: dir, modified: info.ModTime()}
+		files, _ := os.ReadDir(dir)
+		for _, file := range files {
+			if info, err := file.Info(); err == nil {
+				run.size += info.Size()
+			}
+		}
+		total += run.size
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].modified.Before(runs[j].modified) })
+	for _, run := range runs {
+		if total <= maxSize {
+			break
+		}
+		if isCurrentRun(run.path) {
+			continue
+		}
+		Debugln("removing artifacts", run.path, "to stay under", FormatBytes(maxSize))
+		if err := os.RemoveAll(run.path); err != nil {
+			Warnln("failed to remove artifacts", run.path+":", err)
+			continue
+		}
+		total -= run.size
+	}
+}
+
+// isCurrentRun reports whether an artifacts folder belongs to a running job
+func isCurrentRun(dir string) bool {
+	job, run, _, ok := parseLogName(dir)
+	if !ok {
+		return false
+	}
+	status := statuses.Get(job)
+	return status.State == StateRunning && status.RunID == run
+}
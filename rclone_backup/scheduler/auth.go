@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ScopeViewer   = "viewer"
+	ScopeOperator = "operator"
+	ScopeAdmin    = "admin"
+)
+
+var TokensPath = filepath.Join(DataPath, "tokens.json")
+
+var scopeLevels = map[string]int{
+	ScopeViewer:   1,
+	ScopeOperator: 2,
+	ScopeAdmin:    3,
+}
+
+// APIToken is a named token defined in the addon configuration
+type APIToken struct {
+	Name  string
+	Token string
+	Scope string
+}
+
+// StoredToken is a token created through the API, only the hash is persisted
+type StoredToken struct {
+	Name     string     `json:"name"`
+	Hash     string     `json:"hash,omitempty"`
+	Scope    string     `json:"scope"`
+	Source   string     `json:"source"` // "config" or "api"
+	Created  time.Time  `json:"created,omitzero"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+type TokenStore struct {
+	mu     sync.Mutex
+	tokens []*StoredToken
+}
+
+var tokens = &TokenStore{}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func ValidScope(scope string) bool {
+	_, ok := scopeLevels[scope]
+	return ok
+}
+
+// Load merges tokens from the addon config with those persisted on disk
+func (s *TokenStore) Load(configured []APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = nil
+	for _, t := range configured {
+		if t.Name == "" || t.Token == "" {
+			return errors.New("api tokens require both a name and a token")
+		}
+		if !ValidScope(t.Scope) {
+			return errors.New("api token '" + t.Name + "' has invalid scope '" + t.Scope + "'")
+		}
+		s.tokens = append(s.tokens, &StoredToken{
+			Name: t.Name, Hash: HashToken(t.Token), Scope: t.Scope, Source: "config",
+		})
+	}
+	data, err := os.ReadFile(TokensPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored []*StoredToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	for _, t := range stored {
+		if s.find(t.Name) == nil {
+			t.Source = "api"
+			s.tokens = append(s.tokens, t)
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether any tokens exist, when none do the API is open
+func (s *TokenStore) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokens) > 0
+}
+
+func (s *TokenStore) find(name string) *StoredToken {
+	for _, t := range s.tokens {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the token matching the given secret and records its use
+func (s *TokenStore) Authenticate(secret string) *StoredToken {
+	hash := HashToken(secret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			now := time.Now()
+			// avoid rewriting the file on every request
+			persist := t.Source == "api" && (t.LastUsed == nil || now.Sub(*t.LastUsed) > time.Minute)
+			t.LastUsed = &now
+			if persist {
+				if err := s.save(); err != nil {
+					Errorln("failed to save api tokens:", err)
+				}
+			}
+			return t
+		}
+	}
+	return nil
+}
+
+// Create generates a new random token and returns the secret, which is not stored
+func (s *TokenStore) Create(name string, scope string) (string, error) {
+	if name == "" {
+		return "", errors.New("token name is required")
+	}
+	if !ValidScope(scope) {
+		return "", errors.New("invalid scope '" + scope + "'")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(name) != nil {
+		return "", errors.New("token '" + name + "' already exists")
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(buf)
+	s.tokens = append(s.tokens, &StoredToken{
+		Name: name, Hash: HashToken(secret), Scope: scope, Source: "api", Created: time.Now(),
+	})
+	return secret, s.save()
+}
+
+// Delete removes a token created through the API
+func (s *TokenStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.tokens {
+		if t.Name == name {
+			if t.Source == "config" {
+				return errors.New("token '" + name + "' is defined in the addon config")
+			}
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			return s.save()
+		}
+	}
+	return os.ErrNotExist
+}
+
+// List returns a copy of all tokens without their hashes
+func (s *TokenStore) List() []StoredToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]StoredToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		c := *t
+		c.Hash = ""
+		list = append(list, c)
+	}
+	return list
+}
+
+func (s *TokenStore) save() error {
+	stored := make([]*StoredToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		if t.Source == "api" {
+			stored = append(stored, t)
+		}
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(TokensPath, data, 0600)
+}
+
+// RequestToken extracts a bearer token from the Authorization header
+func RequestToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// RequireScope wraps a handler to only allow tokens with at least the given scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tokens.Enabled() {
+			next(w, r)
+			return
+		}
+		token := tokens.Authenticate(RequestToken(r))
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if scopeLevels[token.Scope] < scopeLevels[scope] {
+			http.Error(w, "token scope '"+token.Scope+"' is insufficient, requires '"+scope+"'", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireTokens reports whether a request that changes what the addon runs may go ahead. Unlike other endpoints
+// these are never open to unauthenticated requests, without api tokens they are answered with 403 Forbidden
+func RequireTokens(w http.ResponseWriter, action string) bool {
+	if !tokens.Enabled() {
+		http.Error(w, action+" requires an admin api token to be configured", http.StatusForbidden)
+		return false
+	}
+	return true
+}
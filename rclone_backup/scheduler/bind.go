@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// BindAddress returns the local address rclone binds to for the job's bind option, which is
+// "ipv4", "ipv6", an address, or an interface optionally followed by the family, e.g. "wg0/ipv6".
+// Interfaces are looked up on every run as a vpn may get a new address when it reconnects.
+func BindAddress(bind string) (string, error) {
+	switch bind {
+	case "":
+		return "", nil
+	case "ipv4":
+		return "0.0.0.0", nil
+	case "ipv6":
+		return "::", nil
+	}
+	if ip := net.ParseIP(bind); ip != nil {
+		return ip.String(), nil
+	}
+	name, family, _ := strings.Cut(bind, "/")
+	if family != "" && family != "ipv4" && family != "ipv6" {
+		return "", fmt.Errorf("bind: unknown address family '%s', must be ipv4 or ipv6", family)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("bind: interface '%s' not found, e.g. the vpn is not connected", name)
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("bind: %w", err)
+	}
+	var fallback string
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		isIPv4 := ipNet.IP.To4() != nil
+		if (family == "ipv4" && !isIPv4) || (family == "ipv6" && isIPv4) {
+			continue
+		}
+		// prefer ipv4 when no family is given
+		if isIPv4 || family == "ipv6" {
+			return ipNet.IP.String(), nil
+		}
+		if fallback == "" {
+			fallback = ipNet.IP.String()
+		}
+	}
+	if fallback != "" {
+		return fallback, nil
+	}
+	if family == "" {
+		family = "an"
+	}
+	return "", fmt.Errorf("bind: interface '%s' has no %s address", name, family)
+}
+
+// CheckBind validates the bind option of a job, an interface that doesn't exist yet is only a warning
+func CheckBind(job JobConfig, warnings *[]string) error {
+	if job.Bind == "" {
+		return nil
+	}
+	if _, family, _ := strings.Cut(job.Bind, "/"); family != "" && family != "ipv4" && family != "ipv6" {
+		return fmt.Errorf("bind: unknown address family '%s', must be ipv4 or ipv6", family)
+	}
+	if _, err := BindAddress(job.Bind); err != nil {
+		*warnings = append(*warnings, err.Error())
+	}
+	return nil
+}
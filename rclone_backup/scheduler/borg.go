@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+	"github.com/jcwillox/emerald"
+)
+
+const EngineBorg = "borg"
+
+const DefaultBorgEncryption = "repokey-blake2"
+
+type BorgConfig struct {
+	Repository     string // borg repository, defaults to the destination
+	Passphrase     string
+	PassphraseFile string `yaml:"passphrase_file"`
+	SSHKey         string `yaml:"ssh_key"`
+	Encryption     string // used when initializing the repository
+	Compression    string // e.g. "zstd,10"
+	Keep           KeepConfig
+	Compact        bool
+	Check          bool
+	VerifyData     bool   `yaml:"verify_data"`
+	Borgmatic      string // run borgmatic with this config file instead
+}
+
+// CheckBorg validates the borg options of a job
+func CheckBorg(job JobConfig) ([]string, error) {
+	var warnings []string
+	if job.Borg.Borgmatic != "" {
+		if _, err := exec.LookPath("borgmatic"); err != nil {
+			return nil, errors.New("borgmatic is not installed")
+		}
+		if _, err := os.Stat(job.Borg.Borgmatic); err != nil {
+			return nil, fmt.Errorf("borgmatic config: %w", err)
+		}
+		return warnings, nil
+	}
+	if _, err := exec.LookPath("borg"); err != nil {
+		return nil, errors.New("borg is not installed")
+	}
+	if job.Borg.Passphrase == "" && job.Borg.PassphraseFile == "" && job.Borg.Encryption != "none" {
+		return nil, errors.New("borg requires a passphrase or passphrase_file to encrypt the repository")
+	}
+	if job.Borg.Repository == "" && len(job.Destinations) == 0 {
+		return nil, errors.New("borg requires a destination or repository to back up to")
+	}
+	for _, destination := range job.Destinations {
+		if job.Borg.Repository == "" && !strings.HasPrefix(destination, "/") && !strings.HasPrefix(destination, "ssh://") && !strings.Contains(destination, "@") {
+			return nil, fmt.Errorf("borg can't use rclone remotes, '%s' must be a local path or ssh:// repository", destination)
+		}
+	}
+	if len(job.Include) > 0 {
+		warnings = append(warnings, "include is not supported by borg and is ignored")
+	}
+	return warnings, nil
+}
+
+// BorgArchivePrefix returns the prefix of the archive names of a job, used to only prune archives of that job
+func BorgArchivePrefix(job JobConfig) string {
+	name := "rclone_backup"
+	if job.Name != "" {
+		name = slug.Make(job.Name)
+	}
+	return name + "-"
+}
+
+// borgCommand creates a borg command with the passphrase and ssh key of the job
+func borgCommand(ctx context.Context, job JobConfig, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "borg", args...)
+	cmd.Env = append(os.Environ(), "BORG_EXIT_CODES=modern")
+	if job.Borg.PassphraseFile != "" {
+		cmd.Env = append(cmd.Env, "BORG_PASSCOMMAND=cat "+job.Borg.PassphraseFile)
+	} else {
+		cmd.Env = append(cmd.Env, "BORG_PASSPHRASE="+job.Borg.Passphrase)
+	}
+	if job.Borg.SSHKey != "" {
+		cmd.Env = append(cmd.Env, "BORG_RSH=ssh -i "+job.Borg.SSHKey+" -o StrictHostKeyChecking=accept-new")
+	}
+	// never wait for an answer, e.g. when a repository was moved
+	cmd.Env = append(cmd.Env, "BORG_RELOCATED_REPO_ACCESS_IS_OK=no", "BORG_UNKNOWN_UNENCRYPTED_REPO_ACCESS_IS_OK=no")
+	return cmd
+}
+
+// runBorg runs a borg command, logging its output and returning the last error lines
+func runBorg(ctx context.Context, job JobConfig, args ...string) ([]string, error) {
+	Debugln("borg", args)
+	cmd := borgCommand(ctx, job, args...)
+	var stderr tailWriter
+	cmd.Stdout = JobLog(os.Stdout, job.Index)
+	cmd.Stderr = io.MultiWriter(JobLog(os.Stdout, job.Index), &stderr)
+	emerald.Print(emerald.Blue)
+	err := cmd.Run()
+	emerald.Print(emerald.Reset)
+	return stderr.lines, err
+}
+
+// RunBorg creates a borg archive of the source, then prunes, compacts and checks the repository
+func RunBorg(ctx context.Context, job JobConfig, source string, destination string) error {
+	repository := destination
+	if job.Borg.Repository != "" {
+		repository = job.Borg.Repository
+	}
+	dryRun := IsDryRun(job)
+	start := time.Now()
+	Infoln("running", JobInfo(job, "job", source, repository), "with borg")
+	fail := func(msg string, logged []string) error {
+		borgErr := NewRcloneError(msg, logged)
+		Errorln(borgErr.Message, "("+borgErr.Class+")")
+		FireJobEvent(EventJobFailed, job, source, destination, start, borgErr.Message)
+		return borgErr
+	}
+
+	if err := CheckSourceSize(ctx, job, source); err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+		return err
+	}
+
+	// create the repository the first time it is used
+	if !dryRun {
+		var stderr bytes.Buffer
+		cmd := borgCommand(ctx, job, "info", repository)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil && strings.Contains(stderr.String(), "does not exist") {
+			encryption := job.Borg.Encryption
+			if encryption == "" {
+				encryption = DefaultBorgEncryption
+			}
+			Infoln("initializing borg repository", HighlightRemote(repository))
+			if logged, err := runBorg(ctx, job, "init", "--encryption", encryption, repository); err != nil {
+				return fail(fmt.Sprintf("failed to initialize borg repository: %s", err), logged)
+			}
+		}
+	}
+
+	archive := BorgArchivePrefix(job) + start.Format(DefaultDateLayout)
+	args := []string{"create", "--json"}
+	if dryRun {
+		args = []string{"create", "--dry-run", "--list"}
+	}
+	if job.Borg.Compression != "" {
+		args = append(args, "--compression", job.Borg.Compression)
+	}
+	for _, exclusion := range job.Exclude {
+		args = append(args, "--exclude", exclusion)
+	}
+	args = append(args, job.ExtraFlags...)
+	args = append(args, repository+"::"+archive, source)
+	Debugln("borg", args)
+	var stdout bytes.Buffer
+	var stderr tailWriter
+	cmd := borgCommand(ctx, job, args...)
+	cmd.Stdout = &stdout
+	if dryRun {
+		cmd.Stdout = JobLog(os.Stdout, job.Index)
+	}
+	cmd.Stderr = io.MultiWriter(JobLog(os.Stdout, job.Index), &stderr)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		// modern exit codes above 100 are warnings, e.g. a file changed while it was read
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() < 100 {
+			return fail(fmt.Sprintf("failed to run borg create: %s", err), stderr.lines)
+		}
+		Warnln("borg create finished with warnings:", strings.Join(stderr.lines, "; "))
+	}
+	detail := ""
+	var created struct {
+		Archive struct {
+			Name  string
+			Stats struct {
+				OriginalSize     int64 `json:"original_size"`
+				DeduplicatedSize int64 `json:"deduplicated_size"`
+				Files            int64 `json:"nfiles"`
+			}
+		}
+	}
+	if !dryRun && json.Unmarshal(stdout.Bytes(), &created) == nil {
+		stats := created.Archive.Stats
+		statuses.AddTransferred(job.Index, stats.DeduplicatedSize, stats.Files)
+		detail = "archive " + created.Archive.Name + ", " + FormatBytes(stats.DeduplicatedSize) + " added"
+		Infoln("archive", created.Archive.Name, "added", FormatBytes(stats.DeduplicatedSize), "of", FormatBytes(stats.OriginalSize), "in", stats.Files, "files")
+	}
+
+	if keep := job.Borg.Keep.Args(); len(keep) > 0 {
+		prune := append([]string{"prune", "--glob-archives", BorgArchivePrefix(job) + "*"}, keep...)
+		if dryRun {
+			prune = append(prune, "--dry-run", "--list")
+		}
+		if logged, err := runBorg(ctx, job, append(prune, repository)...); err != nil {
+			return fail(fmt.Sprintf("failed to prune borg archives: %s", err), logged)
+		}
+		if job.Borg.Compact && !dryRun {
+			if logged, err := runBorg(ctx, job, "compact", repository); err != nil {
+				return fail(fmt.Sprintf("failed to compact borg repository: %s", err), logged)
+			}
+		}
+	}
+
+	if job.Borg.Check && !dryRun {
+		check := []string{"check"}
+		if job.Borg.VerifyData {
+			check = append(check, "--verify-data")
+		}
+		if logged, err := runBorg(ctx, job, append(check, repository)...); err != nil {
+			statuses.SetDetail(job.Index, detail+", check failed")
+			return fail(fmt.Sprintf("borg repository check failed: %s", err), logged)
+		}
+		detail += ", check passed"
+	}
+	statuses.SetDetail(job.Index, strings.TrimPrefix(detail, ", "))
+
+	Infoln("finished in", boldCyan(FormatDuration(time.Since(start))))
+	FireJobEvent(EventJobSuccessful, job, source, destination, start, "")
+	return nil
+}
+
+// RunBorgmatic runs borgmatic with its own config, which defines the sources, repositories and retention
+func RunBorgmatic(ctx context.Context, job JobConfig) error {
+	start := time.Now()
+	Infoln("running", JobInfo(job, "job"), "with borgmatic", job.Borg.Borgmatic)
+	args := []string{"--config", job.Borg.Borgmatic, "--verbosity", "1", "--stats"}
+	if IsDryRun(job) {
+		args = append(args, "--dry-run")
+	}
+	args = append(args, job.ExtraFlags...)
+	Debugln("borgmatic", args)
+	cmd := exec.CommandContext(ctx, "borgmatic", args...)
+	var stderr tailWriter
+	cmd.Stdout = JobLog(os.Stdout, job.Index)
+	cmd.Stderr = io.MultiWriter(JobLog(os.Stdout, job.Index), &stderr)
+	emerald.Print(emerald.Blue)
+	err := cmd.Run()
+	emerald.Print(emerald.Reset)
+	if err != nil {
+		borgErr := NewRcloneError(fmt.Sprintf("failed to run borgmatic: %s", err), stderr.lines)
+		Errorln(borgErr.Message, "("+borgErr.Class+")")
+		FireJobEvent(EventJobFailed, job, job.Borg.Borgmatic, "", start, borgErr.Message)
+		return borgErr
+	}
+	Infoln("finished in", boldCyan(FormatDuration(time.Since(start))))
+	FireJobEvent(EventJobSuccessful, job, job.Borg.Borgmatic, "", start, "")
+	return nil
+}
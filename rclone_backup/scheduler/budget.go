@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBudgetThreshold = 90
+	EventBudgetLow         = "rclone_backup.budget_low"
+	budgetDeferNote        = "deferred by the data budget"
+)
+
+var BudgetPath = filepath.Join(DataPath, "budget.json")
+
+// BudgetConfig caps the data uploaded each month, e.g. over a metered LTE connection, with off-peak windows
+// for the runs deferred once the budget is nearly used up
+type BudgetConfig struct {
+	Monthly     string   // upload cap per month, e.g. "50G"
+	ResetDay    int      `yaml:"reset_day"` // day of the month the budget starts again, defaults to 1
+	Threshold   float64  // percent of the budget used after which runs are deferred or throttled in peak hours
+	OffPeak     []string `yaml:"off_peak"`      // local time windows such as "00:00-06:00"
+	FreeOffPeak bool     `yaml:"free_off_peak"` // data uploaded off-peak is not counted against the budget
+	PeakBwLimit string   `yaml:"peak_bwlimit"`  // throttle runs in peak hours instead of deferring them
+	Remotes     []string // remotes reached over the metered connection, every remote when empty
+}
+
+// BudgetUsage is the data uploaded in the current budget period
+type BudgetUsage struct {
+	Budget  int64     `json:"budget"`
+	Used    int64     `json:"used"` // counted against the budget
+	Peak    int64     `json:"peak"`
+	OffPeak int64     `json:"off_peak"`
+	Percent float64   `json:"percent"`
+	State   string    `json:"state"` // ok, low or exhausted
+	Period  time.Time `json:"period"`
+	Resets  time.Time `json:"resets"`
+	InPeak  bool      `json:"in_peak"`
+}
+
+type budgetWindow struct {
+	start, end int // minutes since midnight
+}
+
+type DataBudget struct {
+	mu      sync.Mutex
+	Period  time.Time `json:"period"`
+	Peak    int64     `json:"peak"`
+	OffPeak int64     `json:"off_peak"`
+}
+
+var budget = &DataBudget{}
+
+func CheckBudget() error {
+	if config.Budget.Monthly == "" {
+		return nil
+	}
+	if _, err := ParseSizeString(config.Budget.Monthly); err != nil {
+		return fmt.Errorf("invalid budget monthly '%s'", config.Budget.Monthly)
+	}
+	if config.Budget.ResetDay < 0 || config.Budget.ResetDay > 31 {
+		return errors.New("budget reset_day must be between 1 and 31")
+	}
+	if config.Budget.Threshold < 0 || config.Budget.Threshold > 100 {
+		return errors.New("budget threshold must be between 0 and 100")
+	}
+	for _, window := range config.Budget.OffPeak {
+		if _, err := parseBudgetWindow(window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBudgetWindow parses a window such as "22:00-06:00", which may wrap around midnight
+func parseBudgetWindow(value string) (budgetWindow, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return budgetWindow{}, fmt.Errorf("invalid budget off_peak window '%s', expected e.g. 00:00-06:00", value)
+	}
+	parse := func(clock string) (int, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(clock))
+		if err != nil {
+			return 0, fmt.Errorf("invalid budget off_peak window '%s', expected e.g. 00:00-06:00", value)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	start, err := parse(from)
+	if err != nil {
+		return budgetWindow{}, err
+	}
+	end, err := parse(to)
+	if err != nil {
+		return budgetWindow{}, err
+	}
+	return budgetWindow{start, end}, nil
+}
+
+func budgetWindows() []budgetWindow {
+	var windows []budgetWindow
+	for _, value := range config.Budget.OffPeak {
+		if window, err := parseBudgetWindow(value); err == nil {
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+// InOffPeak reports whether t is in one of the off-peak windows
+func InOffPeak(t time.Time) bool {
+	t = t.Local()
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range budgetWindows() {
+		if window.start <= window.end && minute >= window.start && minute < window.end {
+			return true
+		}
+		if window.start > window.end && (minute >= window.start || minute < window.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOffPeak returns when the next off-peak window starts after t, or the zero time without windows
+func NextOffPeak(t time.Time) time.Time {
+	t = t.Local()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	var next time.Time
+	for _, window := range budgetWindows() {
+		start := midnight.Add(time.Duration(window.start) * time.Minute)
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// budgetReset returns when the budget period of the month starts, on the reset day or the last day of shorter months
+func budgetReset(year int, month time.Month) time.Time {
+	day := max(config.Budget.ResetDay, 1)
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.Local).Day()
+	return time.Date(year, month, min(day, last), 0, 0, 0, 0, time.Local)
+}
+
+// budgetPeriod returns the start of the budget period t is in and the start of the next one
+func budgetPeriod(t time.Time) (time.Time, time.Time) {
+	t = t.Local()
+	start := budgetReset(t.Year(), t.Month())
+	if t.Before(start) {
+		start = budgetReset(t.Year(), t.Month()-1)
+	}
+	return start, budgetReset(start.Year(), start.Month()+1)
+}
+
+// Metered reports whether the runs of a job count against the data budget
+func Metered(job JobConfig) bool {
+	if config.Budget.Monthly == "" {
+		return false
+	}
+	for _, remote := range JobRemotes(job) {
+		if len(config.Budget.Remotes) == 0 {
+			return true
+		}
+		for _, metered := range config.Budget.Remotes {
+			if strings.TrimSuffix(metered, ":")+":" == remote {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Load reads the data uploaded in the current period from disk
+func (b *DataBudget) Load() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := os.ReadFile(BudgetPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, b)
+}
+
+func (b *DataBudget) save() {
+	data, err := json.Marshal(b)
+	if err == nil {
+		err = os.WriteFile(BudgetPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save data budget:", err)
+	}
+}
+
+// rollover starts a new period once the reset day has passed
+func (b *DataBudget) rollover(now time.Time) {
+	start, _ := budgetPeriod(now)
+	if !b.Period.Equal(start) {
+		b.Period, b.Peak, b.OffPeak = start, 0, 0
+	}
+}
+
+func (b *DataBudget) usage(now time.Time) BudgetUsage {
+	b.rollover(now)
+	total, _ := ParseSizeString(config.Budget.Monthly)
+	_, resets := budgetPeriod(now)
+	usage := BudgetUsage{Budget: total, Peak: b.Peak, OffPeak: b.OffPeak, Period: b.Period, Resets: resets, InPeak: !InOffPeak(now), State: "ok"}
+	usage.Used = b.Peak
+	if !config.Budget.FreeOffPeak {
+		usage.Used += b.OffPeak
+	}
+	if total > 0 {
+		usage.Percent = float64(usage.Used) / float64(total) * 100
+	}
+	switch {
+	case usage.Percent >= 100:
+		usage.State = "exhausted"
+	case usage.Percent >= budgetThreshold():
+		usage.State = "low"
+	}
+	return usage
+}
+
+func budgetThreshold() float64 {
+	if config.Budget.Threshold > 0 {
+		return config.Budget.Threshold
+	}
+	return DefaultBudgetThreshold
+}
+
+// Usage returns the data uploaded in the current period
+func (b *DataBudget) Usage() BudgetUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.usage(time.Now())
+}
+
+// Gate returns when a run of the job should be deferred to, or the bandwidth limit it runs with, now that the
+// budget is nearly used up. Off-peak runs are let through when off-peak data is free.
+func (b *DataBudget) Gate(job JobConfig) (time.Time, string) {
+	if !Metered(job) {
+		return time.Time{}, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	usage := b.usage(now)
+	if !usage.InPeak && config.Budget.FreeOffPeak {
+		return time.Time{}, ""
+	}
+	switch usage.State {
+	case "exhausted":
+		if next := NextOffPeak(now); !next.IsZero() && config.Budget.FreeOffPeak {
+			return next, ""
+		}
+		return usage.Resets, ""
+	case "low":
+		if !usage.InPeak {
+			return time.Time{}, ""
+		}
+		if config.Budget.PeakBwLimit != "" {
+			return time.Time{}, config.Budget.PeakBwLimit
+		}
+		return NextOffPeak(now), ""
+	}
+	return time.Time{}, ""
+}
+
+// Record counts the data uploaded by a run, by when it started, and publishes the sensor of the budget
+func (b *DataBudget) Record(job JobConfig, record RunRecord) {
+	if !Metered(job) || record.Bytes == 0 {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	before := b.usage(now)
+	if InOffPeak(record.Start) {
+		b.OffPeak += record.Bytes
+	} else {
+		b.Peak += record.Bytes
+	}
+	b.save()
+	usage := b.usage(now)
+	b.mu.Unlock()
+
+	PublishBudgetSensor(usage)
+	if usage.State != before.State && usage.State != "ok" {
+		Warnln("used", boldCyan(FormatPercent(usage.Percent)+"%"), "of the monthly data budget,", FormatBytes(usage.Used), "of", FormatBytes(usage.Budget))
+		FireEvent(EventBudgetLow, usage)
+	}
+}
+
+// DeferForBudget plans a run of the job for when the data budget allows it, unless one is already planned
+func DeferForBudget(job JobConfig, at time.Time) {
+	for _, run := range onceRuns.List(job.Index) {
+		if run.Note == budgetDeferNote {
+			Warnln("skipping job", "'"+job.Name+"',", "a run deferred by the data budget is planned for", run.At.Local().Format("2006-01-02 15:04"))
+			return
+		}
+	}
+	Warnln("deferring job", "'"+job.Name+"'", "to", at.Local().Format("2006-01-02 15:04"), "because of the data budget")
+	if _, err := onceRuns.Add(job, at, budgetDeferNote); err != nil {
+		Errorln("failed to defer job", "'"+job.Name+"':", err)
+	}
+}
+
+func PublishBudgetSensor(usage BudgetUsage) {
+	attributes := map[string]interface{}{
+		"friendly_name":       "Rclone data budget",
+		"unit_of_measurement": "%",
+		"state_class":         "measurement",
+		"icon":                "mdi:signal-cellular-3",
+		"state":               usage.State,
+		"budget":              usage.Budget,
+		"used":                usage.Used,
+		"peak":                usage.Peak,
+		"off_peak":            usage.OffPeak,
+		"resets":              usage.Resets,
+	}
+	if err := SetSensorState("sensor.rclone_backup_data_budget", FormatPercent(usage.Percent), attributes); err != nil {
+		Debugln("failed to publish sensor sensor.rclone_backup_data_budget", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDataBudgetGate(t *testing.T) {
+	saved, savedRemotes := config, remotes
+	defer func() { config, remotes = saved, savedRemotes }()
+	remotes = []string{"b2:", "nas:"}
+	metered := JobConfig{Name: "cloud", Destinations: []string{"b2:ha"}}
+	local := JobConfig{Name: "nas", Destinations: []string{"nas:ha"}}
+
+	now := time.Now()
+	// an off-peak window around now, and one that has just ended
+	around := now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	ended := now.Add(-2*time.Hour).Format("15:04") + "-" + now.Add(-time.Hour).Format("15:04")
+	total, _ := ParseSizeString("100M")
+
+	tests := []struct {
+		name     string
+		budget   BudgetConfig
+		job      JobConfig
+		used     int64 // percent of the budget used in peak hours
+		deferred bool
+		resets   bool // deferred to the next budget period
+		bwlimit  string
+	}{
+		{"no budget", BudgetConfig{}, metered, 100, false, false, ""},
+		{"not a metered remote", BudgetConfig{Monthly: "100M", Remotes: []string{"b2"}}, local, 100, false, false, ""},
+		{"under the threshold", BudgetConfig{Monthly: "100M"}, metered, 50, false, false, ""},
+		{"low throttles in peak hours", BudgetConfig{Monthly: "100M", PeakBwLimit: "1M", OffPeak: []string{ended}}, metered, 95, false, false, "1M"},
+		{"low defers to off-peak", BudgetConfig{Monthly: "100M", OffPeak: []string{ended}}, metered, 95, true, false, ""},
+		{"low runs off-peak", BudgetConfig{Monthly: "100M", OffPeak: []string{around}}, metered, 95, false, false, ""},
+		{"custom threshold", BudgetConfig{Monthly: "100M", Threshold: 50, PeakBwLimit: "1M"}, metered, 60, false, false, "1M"},
+		{"exhausted", BudgetConfig{Monthly: "100M", PeakBwLimit: "1M", OffPeak: []string{around}}, metered, 100, true, true, ""},
+		{"exhausted with free off-peak", BudgetConfig{Monthly: "100M", FreeOffPeak: true, OffPeak: []string{ended}}, metered, 100, true, false, ""},
+		{"free off-peak runs off-peak", BudgetConfig{Monthly: "100M", FreeOffPeak: true, OffPeak: []string{around}}, metered, 100, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Budget = tt.budget
+			start, next := budgetPeriod(now)
+			b := &DataBudget{Period: start, Peak: total * tt.used / 100}
+			at, bwlimit := b.Gate(tt.job)
+			if at.IsZero() == tt.deferred {
+				t.Errorf("deferred to %v, want deferred %v", at, tt.deferred)
+			}
+			if tt.resets && !at.Equal(next) {
+				t.Errorf("deferred to %v, want the next period %v", at, next)
+			}
+			if tt.deferred && !tt.resets && !at.Equal(NextOffPeak(now)) {
+				t.Errorf("deferred to %v, want the next off-peak window", at)
+			}
+			if bwlimit != tt.bwlimit {
+				t.Errorf("bwlimit = %q, want %q", bwlimit, tt.bwlimit)
+			}
+		})
+	}
+}
+
+func TestInOffPeak(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", "2024-07-01 "+clock, time.Local)
+		return t
+	}
+	tests := []struct {
+		windows []string
+		clock   string
+		want    bool
+	}{
+		{nil, "03:00", false},
+		{[]string{"00:00-06:00"}, "03:00", true},
+		{[]string{"00:00-06:00"}, "06:00", false},
+		{[]string{"22:00-06:00"}, "23:30", true},
+		{[]string{"22:00-06:00"}, "05:59", true},
+		{[]string{"22:00-06:00"}, "12:00", false},
+		{[]string{"01:00-02:00", "12:00-13:00"}, "12:30", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.clock, func(t *testing.T) {
+			config.Budget.OffPeak = tt.windows
+			if got := InOffPeak(at(tt.clock)); got != tt.want {
+				t.Errorf("InOffPeak(%s) with %v = %v, want %v", tt.clock, tt.windows, got, tt.want)
+			}
+		})
+	}
+}
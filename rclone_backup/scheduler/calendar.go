@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const DefaultCalendarDays = 7
+
+// maxCalendarRuns is the largest number of runs of a single job listed, e.g. a job running every minute
+const maxCalendarRuns = 2000
+
+// CalendarRun is a scheduled run of a job
+type CalendarRun struct {
+	Job      int       `json:"job"`
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration,omitempty"` // seconds the last successful run took
+	Paused   bool      `json:"paused,omitempty"`
+	Once     bool      `json:"once,omitempty"` // a single planned run
+	Snoozed  bool      `json:"snoozed,omitempty"`
+}
+
+// CalendarPileup are runs of different jobs starting in the same minute
+type CalendarPileup struct {
+	Start time.Time `json:"start"`
+	Jobs  []int     `json:"jobs"`
+}
+
+// Calendar are the scheduled runs of every job over the next days
+type Calendar struct {
+	From    time.Time        `json:"from"`
+	Until   time.Time        `json:"until"`
+	Runs    []CalendarRun    `json:"runs"`
+	Pileups []CalendarPileup `json:"pileups"`
+}
+
+// lastDuration returns how long the last successful run of a job took
+func lastDuration(index int) time.Duration {
+	for _, run := range history.Runs(index) {
+		if IsSuccess(run.State) {
+			return run.End.Sub(run.Start)
+		}
+	}
+	return 0
+}
+
+// ScheduledRuns returns the scheduled runs of every job until the given time, by start
+func ScheduledRuns(until time.Time) []CalendarRun {
+	runs := make([]CalendarRun, 0)
+	for index, scheduled := range scheduledJobs {
+		next, err := scheduled.NextRuns(maxCalendarRuns)
+		if err != nil {
+			continue
+		}
+		duration := lastDuration(index).Seconds()
+		paused := pauses.Get(index) != nil
+		snoozed := snoozes.Get(index)
+		for _, start := range next {
+			if start.After(until) {
+				break
+			}
+			runs = append(runs, CalendarRun{Job: index, Name: config.Jobs[index].Name, Start: start, Duration: duration, Paused: paused, Snoozed: snoozed != nil && start.Equal(snoozed.Skip)})
+		}
+	}
+	for index := range config.Jobs {
+		for _, once := range onceRuns.List(index) {
+			if !once.At.After(until) {
+				runs = append(runs, CalendarRun{Job: index, Name: config.Jobs[index].Name, Start: once.At, Duration: lastDuration(index).Seconds(), Once: true})
+			}
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].Start.Equal(runs[j].Start) {
+			return runs[i].Job < runs[j].Job
+		}
+		return runs[i].Start.Before(runs[j].Start)
+	})
+	return runs
+}
+
+// GetCalendar returns the scheduled runs of the next days and the minutes several jobs start in
+func GetCalendar(days int) Calendar {
+	now := time.Now()
+	calendar := Calendar{From: now, Until: now.AddDate(0, 0, days), Pileups: make([]CalendarPileup, 0)}
+	calendar.Runs = ScheduledRuns(calendar.Until)
+	for i := 0; i < len(calendar.Runs); {
+		minute := calendar.Runs[i].Start.Truncate(time.Minute)
+		pileup := CalendarPileup{Start: minute}
+		for ; i < len(calendar.Runs) && calendar.Runs[i].Start.Truncate(time.Minute).Equal(minute); i++ {
+			pileup.Jobs = append(pileup.Jobs, calendar.Runs[i].Job)
+		}
+		if len(pileup.Jobs) > 1 {
+			calendar.Pileups = append(calendar.Pileups, pileup)
+		}
+	}
+	return calendar
+}
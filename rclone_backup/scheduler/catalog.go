@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultCatalogSchedule = "0 */6 * * *"
+
+var CatalogPath = filepath.Join(DataPath, "catalog.json")
+
+type CatalogConfig struct {
+	Enabled  bool
+	Schedule string
+	Paths    []string // remote folders to index, defaults to the destinations of jobs
+	MaxDepth int      `yaml:"max_depth"`
+}
+
+// CatalogEntry is a file or folder found on a remote
+type CatalogEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	IsDir    bool      `json:"is_dir,omitempty"`
+	Archive  string    `json:"archive,omitempty"` // full or incremental for archives made by the compress command
+	Base     string    `json:"base,omitempty"`    // full archive an incremental archive is restored on top of
+}
+
+// CatalogFolder is the indexed contents of a remote folder
+type CatalogFolder struct {
+	Path    string         `json:"path"`
+	Jobs    []string       `json:"jobs,omitempty"`
+	Indexed time.Time      `json:"indexed"`
+	Count   int            `json:"count"`
+	Size    int64          `json:"size"`
+	Error   string         `json:"error,omitempty"`
+	Entries []CatalogEntry `json:"entries"`
+}
+
+type Catalog struct {
+	mu       sync.Mutex
+	indexing sync.Mutex
+	folders  []CatalogFolder
+}
+
+var catalog = &Catalog{}
+
+// Load reads the last index from disk
+func (c *Catalog) Load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := os.ReadFile(CatalogPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.folders)
+}
+
+// Folders returns the indexed folders
+func (c *Catalog) Folders() []CatalogFolder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CatalogFolder{}, c.folders...)
+}
+
+// CatalogPaths returns the remote folders to index and the jobs writing to each
+func CatalogPaths() ([]string, map[string][]string) {
+	jobs := make(map[string][]string)
+	if len(config.Catalog.Paths) > 0 {
+		return config.Catalog.Paths, jobs
+	}
+	var paths []string
+	add := func(destination string, job JobConfig) {
+		path := CatalogBasePath(destination)
+		// local folders are only indexed for snapshot jobs, which keep their snapshots on an attached drive
+		if !strings.Contains(path, ":") && JobEngine(job) != EngineSnapshot {
+			return
+		}
+		if _, ok := jobs[path]; !ok {
+			paths = append(paths, path)
+		}
+		if job.Name != "" && !ArrayContains(jobs[path], job.Name) {
+			jobs[path] = append(jobs[path], job.Name)
+		}
+	}
+	for _, job := range config.Jobs {
+		for _, destination := range job.Destinations {
+			add(destination, job)
+		}
+		for _, step := range job.Steps {
+			if step.Destination != "" {
+				add(step.Destination, job)
+			}
+		}
+	}
+	return paths, jobs
+}
+
+// CatalogBasePath strips templated folders from a destination, e.g. "b2:bucket/{{now}}" becomes "b2:bucket"
+func CatalogBasePath(destination string) string {
+	i := strings.Index(destination, "{{")
+	if i < 0 {
+		return destination
+	}
+	base := destination[:i]
+	if j := strings.LastIndexAny(base, "/:"); j >= 0 {
+		if base[j] == ':' {
+			return base[:j+1]
+		}
+		return base[:j]
+	}
+	return ""
+}
+
+// Refresh indexes every catalog path, only one refresh runs at a time
+func (c *Catalog) Refresh() {
+	if !c.indexing.TryLock() {
+		Debugln("catalog is already being indexed")
+		return
+	}
+	defer c.indexing.Unlock()
+	paths, jobs := CatalogPaths()
+	folders := make([]CatalogFolder, 0, len(paths))
+	chains := ArchiveChains()
+	for _, path := range paths {
+		folder := IndexFolder(path)
+		folder.Jobs = jobs[path]
+		for i, entry := range folder.Entries {
+			folder.Entries[i].Archive, folder.Entries[i].Base = ArchiveKind(chains, JoinRemote(path, entry.Path))
+		}
+		if folder.Error != "" {
+			Warnln("failed to index", HighlightRemote(path)+":", folder.Error)
+		}
+		folders = append(folders, folder)
+	}
+	c.mu.Lock()
+	c.folders = folders
+	data, err := json.Marshal(c.folders)
+	c.mu.Unlock()
+	if err == nil {
+		err = os.WriteFile(CatalogPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save catalog:", err)
+	}
+}
+
+// IndexFolder lists a remote folder using rclone lsjson
+func IndexFolder(path string) CatalogFolder {
+	folder := CatalogFolder{Path: path, Indexed: time.Now(), Entries: []CatalogEntry{}}
+	depth := config.Catalog.MaxDepth
+	if depth <= 0 {
+		depth = 1
+	}
+	out, err := exec.Command(RcloneBinary(), "lsjson", "--recursive", "--max-depth", strconv.Itoa(depth), path).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		folder.Error = err.Error()
+		return folder
+	}
+	var items []struct {
+		Path    string    `json:"Path"`
+		Size    int64     `json:"Size"`
+		ModTime time.Time `json:"ModTime"`
+		IsDir   bool      `json:"IsDir"`
+	}
+	if err := json.Unmarshal(out, &items); err != nil {
+		folder.Error = err.Error()
+		return folder
+	}
+	for _, item := range items {
+		entry := CatalogEntry{Path: item.Path, Size: item.Size, Modified: item.ModTime, IsDir: item.IsDir}
+		if item.IsDir {
+			entry.Size = 0
+		} else {
+			folder.Count++
+			folder.Size += item.Size
+		}
+		folder.Entries = append(folder.Entries, entry)
+	}
+	// newest first
+	sort.SliceStable(folder.Entries, func(i, j int) bool {
+		return folder.Entries[i].Modified.After(folder.Entries[j].Modified)
+	})
+	return folder
+}
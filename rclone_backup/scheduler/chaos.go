@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const DefaultChaosPartialSize = "1M"
+
+// chaosFailures are realistic messages of each error class, so injected failures are handled like real ones
+var chaosFailures = map[string]string{
+	ErrorClassAuth:       "couldn't fetch token: invalid_grant",
+	ErrorClassQuota:      "insufficient storage",
+	ErrorClassRateLimit:  "429 Too Many Requests",
+	ErrorClassNetwork:    "dial tcp: connection reset by peer",
+	ErrorClassNotFound:   "directory not found",
+	ErrorClassPermission: "403 Forbidden",
+	ErrorClassUnknown:    "unexpected end of JSON input",
+}
+
+// ChaosConfig injects delays, failures and partial transfers into the transfers of jobs, so retries, notifications
+// and escalation can be tested before relying on them
+type ChaosConfig struct {
+	Enabled     bool
+	Jobs        []string // names of the jobs faults are injected into, all jobs when empty
+	Delay       string   // longest random delay before each transfer, e.g. 30s
+	FailureRate float64  `yaml:"failure_rate"` // share of transfers that fail, from 0 to 1
+	Failures    []string // error classes of the injected failures, one is picked at random, default network
+	PartialRate float64  `yaml:"partial_rate"` // share of transfers stopped after partial_size
+	PartialSize string   `yaml:"partial_size"` // how much a partial transfer uploads before it stops, default 1M
+}
+
+func CheckChaos() error {
+	c := config.Chaos
+	if c.FailureRate < 0 || c.FailureRate > 1 || c.PartialRate < 0 || c.PartialRate > 1 {
+		return errors.New("chaos: failure_rate and partial_rate must be between 0 and 1")
+	}
+	if c.Delay != "" {
+		if _, err := time.ParseDuration(c.Delay); err != nil {
+			return fmt.Errorf("chaos: invalid delay '%s'", c.Delay)
+		}
+	}
+	if c.PartialSize != "" {
+		if _, err := ParseSizeString(c.PartialSize); err != nil {
+			return fmt.Errorf("chaos: invalid partial_size '%s'", c.PartialSize)
+		}
+	}
+	for _, class := range c.Failures {
+		if _, ok := chaosFailures[class]; !ok {
+			return fmt.Errorf("chaos: unknown failure '%s'", class)
+		}
+	}
+	if c.Enabled {
+		Warnln("chaos mode is enabled, transfers are delayed, fail and stop early on purpose")
+	}
+	return nil
+}
+
+// chaosApplies reports whether faults are injected into the job
+func chaosApplies(job JobConfig) bool {
+	if !config.Chaos.Enabled {
+		return false
+	}
+	if len(config.Chaos.Jobs) == 0 {
+		return true
+	}
+	for _, name := range config.Chaos.Jobs {
+		if strings.EqualFold(name, job.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectChaos delays a transfer of the job, fails it or limits how much it transfers when chaos mode is enabled
+// for the job. A failure is returned as the rclone error of its class, a partial transfer sets the max transfer
+// of the job so rclone stops once it has uploaded that much.
+func InjectChaos(ctx context.Context, job JobConfig, source string, destination string) (JobConfig, error) {
+	if !chaosApplies(job) {
+		return job, nil
+	}
+	c := config.Chaos
+	if c.Delay != "" {
+		limit, _ := time.ParseDuration(c.Delay)
+		if limit > 0 {
+			delay := time.Duration(rand.Int63n(int64(limit))).Round(time.Second)
+			Warnln("chaos mode is delaying", "'"+job.Name+"'", "by", FormatDuration(delay))
+			statuses.SetProgress(job.Index, "chaos mode, waiting "+FormatDuration(delay))
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return job, ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	if c.FailureRate > 0 && rand.Float64() < c.FailureRate {
+		class := ErrorClassNetwork
+		if len(c.Failures) > 0 {
+			class = c.Failures[rand.Intn(len(c.Failures))]
+		}
+		msg := fmt.Sprintf("failed to run rclone command: %s (%s failure injected by chaos mode)", chaosFailures[class], class)
+		return job, &RcloneError{Class: class, Message: msg}
+	}
+	if c.PartialRate > 0 && rand.Float64() < c.PartialRate {
+		size := c.PartialSize
+		if size == "" {
+			size = DefaultChaosPartialSize
+		}
+		job.MaxTransfer, _ = ParseSizeString(size)
+		Warnln("chaos mode stops", "'"+job.Name+"'", "from", source, "to", destination, "after", FormatBytes(job.MaxTransfer))
+	}
+	return job, nil
+}
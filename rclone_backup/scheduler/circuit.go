@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCircuitFailures = 3
+	DefaultCircuitCooldown = time.Hour
+)
+
+const EventCircuitOpen = "rclone_backup.circuit_open"
+
+// CircuitBreakerConfig stops scheduled runs against a remote that keeps failing
+type CircuitBreakerConfig struct {
+	Enabled  bool
+	Failures int    // consecutive failed runs against a remote before opening the circuit
+	Cooldown string // how long runs are skipped for, e.g. 1h
+}
+
+// Circuit is the failure state of a remote
+type Circuit struct {
+	Remote   string     `json:"remote"`
+	Failures int        `json:"failures"`
+	Open     bool       `json:"open"`
+	Until    *time.Time `json:"until,omitempty"`
+	LastJob  string     `json:"last_job,omitempty"`
+}
+
+type CircuitEventData struct {
+	Remote   string    `json:"remote"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	circuits map[string]*Circuit
+}
+
+var breaker = &CircuitBreaker{circuits: make(map[string]*Circuit)}
+
+// CheckCircuitBreaker validates the circuit breaker config
+func CheckCircuitBreaker() error {
+	if config.CircuitBreaker.Cooldown == "" {
+		return nil
+	}
+	if _, err := time.ParseDuration(config.CircuitBreaker.Cooldown); err != nil {
+		return errors.New("circuit_breaker: invalid cooldown '" + config.CircuitBreaker.Cooldown + "'")
+	}
+	return nil
+}
+
+func circuitCooldown() time.Duration {
+	if cooldown, err := time.ParseDuration(config.CircuitBreaker.Cooldown); err == nil && cooldown > 0 {
+		return cooldown
+	}
+	return DefaultCircuitCooldown
+}
+
+func circuitFailures() int {
+	if config.CircuitBreaker.Failures > 0 {
+		return config.CircuitBreaker.Failures
+	}
+	return DefaultCircuitFailures
+}
+
+// JobRemotes returns the configured remotes a job reads from or writes to
+func JobRemotes(job JobConfig) []string {
+	var list []string
+	add := func(path string) {
+		if i := strings.Index(path, ":"); i > 0 {
+			remote := path[:i+1]
+			if ArrayContains(remotes, remote) && !ArrayContains(list, remote) {
+				list = append(list, remote)
+			}
+		}
+	}
+	for _, path := range append(append([]string{}, job.Sources...), job.Destinations...) {
+		add(path)
+	}
+	for _, step := range job.Steps {
+		add(step.Source)
+		add(step.Destination)
+	}
+	return list
+}
+
+// Blocked returns the first remote of the job with an open circuit, once the
+// cooldown has passed a single run is let through to test the remote again
+func (b *CircuitBreaker) Blocked(job JobConfig) (string, *time.Time) {
+	if !config.CircuitBreaker.Enabled {
+		return "", nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, remote := range JobRemotes(job) {
+		circuit, ok := b.circuits[remote]
+		if !ok || !circuit.Open {
+			continue
+		}
+		if time.Now().Before(*circuit.Until) {
+			return remote, circuit.Until
+		}
+		// half open, the result of this run decides whether it closes
+		circuit.Open = false
+	}
+	return "", nil
+}
+
+// circuitIgnored are failures caused by the job rather than the remote being unavailable
+var circuitIgnored = []string{ErrorClassNotFound, ErrorClassPermission}
+
+// Record updates the circuits of the remotes of the job with the result of a run
+func (b *CircuitBreaker) Record(job JobConfig, record RunRecord) {
+	state := record.State
+	if !config.CircuitBreaker.Enabled || state == StateCancelled || state == StateInterrupted || ArrayContains(circuitIgnored, record.ErrorClass) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, remote := range JobRemotes(job) {
+		circuit, ok := b.circuits[remote]
+		if !ok {
+			circuit = &Circuit{Remote: remote}
+			b.circuits[remote] = circuit
+		}
+		if IsSuccess(state) {
+			if circuit.Failures >= circuitFailures() {
+				Infoln("remote", HighlightRemote(remote), "is working again, closing circuit")
+			}
+			circuit.Failures = 0
+			circuit.Open = false
+			circuit.Until = nil
+			continue
+		}
+		circuit.Failures++
+		circuit.LastJob = job.Name
+		if circuit.Failures >= circuitFailures() && !circuit.Open {
+			until := time.Now().Add(circuitCooldown())
+			circuit.Open = true
+			circuit.Until = &until
+			msg := fmt.Sprintf("%d runs against %s failed in a row, skipping scheduled runs against it until %s",
+				circuit.Failures, remote, until.Local().Format("2006-01-02 15:04"))
+			Warnln(msg)
+			Notify("circuit_"+strings.TrimSuffix(remote, ":"), "Rclone Backup: remote "+remote+" is failing", msg)
+			FireEvent(EventCircuitOpen, CircuitEventData{Remote: remote, Failures: circuit.Failures, Until: until})
+		}
+	}
+}
+
+// Circuits returns the state of every remote that has been used
+func (b *CircuitBreaker) Circuits() []Circuit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]Circuit, 0, len(b.circuits))
+	for _, circuit := range b.circuits {
+		list = append(list, *circuit)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Remote < list[j].Remote })
+	return list
+}
+
+// Reset closes the circuit of a remote, returning false if it has never been used
+func (b *CircuitBreaker) Reset(remote string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	circuit, ok := b.circuits[remote]
+	if !ok {
+		return false
+	}
+	circuit.Failures = 0
+	circuit.Open = false
+	circuit.Until = nil
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerBlocked(t *testing.T) {
+	saved, savedRemotes := config, remotes
+	defer func() { config, remotes = saved, savedRemotes }()
+	remotes = []string{"b2:", "gdrive:"}
+	job := JobConfig{Name: "job", Sources: []string{"/backup"}, Destinations: []string{"gdrive:ha", "b2:ha"}}
+	later := time.Now().Add(time.Hour)
+	earlier := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name     string
+		enabled  bool
+		circuits map[string]*Circuit
+		remote   string
+		halfOpen bool
+	}{
+		{"disabled", false, map[string]*Circuit{"b2:": {Remote: "b2:", Open: true, Until: &later}}, "", false},
+		{"no circuits", true, map[string]*Circuit{}, "", false},
+		{"closed", true, map[string]*Circuit{"b2:": {Remote: "b2:", Failures: 2}}, "", false},
+		{"open", true, map[string]*Circuit{"b2:": {Remote: "b2:", Open: true, Until: &later}}, "b2:", false},
+		{"other remote open", true, map[string]*Circuit{"s3:": {Remote: "s3:", Open: true, Until: &later}}, "", false},
+		{"cooldown passed", true, map[string]*Circuit{"b2:": {Remote: "b2:", Open: true, Until: &earlier}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.CircuitBreaker.Enabled = tt.enabled
+			b := &CircuitBreaker{circuits: tt.circuits}
+			remote, until := b.Blocked(job)
+			if remote != tt.remote {
+				t.Errorf("Blocked() = %q, want %q", remote, tt.remote)
+			}
+			if (until != nil) != (tt.remote != "") {
+				t.Errorf("until = %v", until)
+			}
+			if tt.halfOpen && b.circuits["b2:"].Open {
+				t.Errorf("circuit is still open after the cooldown")
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerRecord(t *testing.T) {
+	saved, savedRemotes := config, remotes
+	defer func() { config, remotes = saved, savedRemotes }()
+	remotes = []string{"b2:"}
+	config.CircuitBreaker = CircuitBreakerConfig{Enabled: true, Failures: 3}
+	job := JobConfig{Name: "job", Destinations: []string{"b2:ha"}}
+	tests := []struct {
+		name     string
+		record   RunRecord
+		failures int
+	}{
+		{"failure", RunRecord{State: StateFailed}, 2},
+		{"cancelled", RunRecord{State: StateCancelled}, 1},
+		{"interrupted", RunRecord{State: StateInterrupted}, 1},
+		{"not found", RunRecord{State: StateFailed, ErrorClass: ErrorClassNotFound}, 1},
+		{"permission", RunRecord{State: StateFailed, ErrorClass: ErrorClassPermission}, 1},
+		{"success", RunRecord{State: StateSuccess}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &CircuitBreaker{circuits: map[string]*Circuit{"b2:": {Remote: "b2:", Failures: 1}}}
+			b.Record(job, tt.record)
+			if got := b.circuits["b2:"].Failures; got != tt.failures {
+				t.Errorf("failures = %d, want %d", got, tt.failures)
+			}
+			if b.circuits["b2:"].Open {
+				t.Errorf("circuit opened below the threshold")
+			}
+		})
+	}
+}
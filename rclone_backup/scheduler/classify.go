@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Categories of failed runs
+const (
+	ErrorClassAuth       = "auth"
+	ErrorClassQuota      = "quota"
+	ErrorClassRateLimit  = "rate_limit"
+	ErrorClassNetwork    = "network"
+	ErrorClassNotFound   = "not_found"
+	ErrorClassPermission = "permission"
+	ErrorClassUnknown    = "unknown"
+)
+
+// errorPatterns are checked in order, the first class with a matching pattern or status code wins
+var errorPatterns = []struct {
+	class    string
+	patterns []string
+	codes    []string
+}{
+	{ErrorClassAuth, []string{"unauthorized", "invalid_grant", "token expired", "couldn't fetch token", "oauth2", "authentication failed", "invalid credentials"}, []string{"401"}},
+	{ErrorClassQuota, []string{"quota", "storage limit", "insufficient storage", "no space left"}, []string{"507"}},
+	{ErrorClassRateLimit, []string{"rate limit", "ratelimit", "too many requests", "throttl", "activitylimitreached"}, []string{"429"}},
+	{ErrorClassNetwork, []string{"timeout", "timed out", "connection refused", "connection reset", "no such host", "network is unreachable", "tls handshake", "dial tcp", "broken pipe"}, nil},
+	{ErrorClassNotFound, []string{"directory not found", "object not found", "no such file or directory", "not found"}, []string{"404"}},
+	{ErrorClassPermission, []string{"permission denied", "forbidden", "access denied"}, []string{"403"}},
+}
+
+// statusPattern finds http status codes, only after a word like "error" or "status" so numbers in file names and
+// sizes such as IMG_4012.jpg aren't mistaken for them
+var statusPattern = regexp.MustCompile(`\b(?:http|status|status code|statuscode|error|code)\D{0,3}([1-5][0-9]{2})\b`)
+
+// RcloneError is a failed rclone command with the errors it logged
+type RcloneError struct {
+	Class      string
+	Message    string
+	RetryAfter time.Duration // how long a throttling provider asked to wait
+}
+
+func (e *RcloneError) Error() string {
+	return e.Message
+}
+
+// ClassifyError returns the category of an error message, or "" for no message
+func ClassifyError(text string) string {
+	if text == "" {
+		return ""
+	}
+	text = strings.ToLower(text)
+	codes := make(map[string]bool)
+	for _, m := range statusPattern.FindAllStringSubmatch(text, -1) {
+		codes[m[1]] = true
+	}
+	for _, group := range errorPatterns {
+		for _, pattern := range group.patterns {
+			if strings.Contains(text, pattern) {
+				return group.class
+			}
+		}
+		for _, code := range group.codes {
+			if codes[code] {
+				return group.class
+			}
+		}
+	}
+	return ErrorClassUnknown
+}
+
+// ErrorClass returns the category of an error, or "" if it is not a failure
+func ErrorClass(err error) string {
+	if err == nil || errors.Is(err, ErrCancelled) || errors.Is(err, ErrInterrupted) || errors.Is(err, ErrSourceSuspicious) {
+		return ""
+	}
+	var rcloneErr *RcloneError
+	if errors.As(err, &rcloneErr) {
+		return rcloneErr.Class
+	}
+	return ClassifyError(err.Error())
+}
+
+// NewRcloneError classifies a failed command using the errors it logged
+func NewRcloneError(msg string, logged []string) *RcloneError {
+	if len(logged) > 0 {
+		msg += ": " + logged[len(logged)-1]
+	}
+	return &RcloneError{Class: ClassifyError(msg + " " + strings.Join(logged, " ")), Message: msg}
+}
+
+// parseErrorLine returns the message of an rclone error log line, in either
+// the text or --use-json-log format
+func parseErrorLine(line string) (string, bool) {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Level  string `json:"level"`
+			Msg    string `json:"msg"`
+			Object string `json:"object"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Level != "error" {
+			return "", false
+		}
+		if entry.Object != "" {
+			return entry.Object + ": " + entry.Msg, true
+		}
+		return entry.Msg, true
+	}
+	// "2024/01/01 00:00:00 ERROR : file.txt: Failed to copy: ..."
+	idx := strings.Index(line, "ERROR : ")
+	if idx < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(line[idx+len("ERROR : "):]), true
+}
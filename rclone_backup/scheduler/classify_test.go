@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"couldn't fetch token: invalid_grant", ErrorClassAuth},
+		{"HTTP error 401 returned by the server", ErrorClassAuth},
+		{"failed with status code 401", ErrorClassAuth},
+		{"googleapi: Error 403: The user does not have sufficient permissions", ErrorClassPermission},
+		{"403 Forbidden", ErrorClassPermission},
+		{"HTTP error 429 (429 Too Many Requests)", ErrorClassRateLimit},
+		{"status=429 rejected", ErrorClassRateLimit},
+		{"Error 507: Insufficient Storage", ErrorClassQuota},
+		{"insufficient storage", ErrorClassQuota},
+		{"dial tcp: connection reset by peer", ErrorClassNetwork},
+		{"directory not found", ErrorClassNotFound},
+		{"error 404", ErrorClassNotFound},
+		{"unexpected end of JSON input", ErrorClassUnknown},
+		// numbers in file names and sizes are not status codes
+		{"IMG_4012.jpg: connection reset", ErrorClassNetwork},
+		{"IMG_4012.jpg: unexpected EOF", ErrorClassUnknown},
+		{"backup-4031.tar: corrupted on transfer", ErrorClassUnknown},
+		{"copied 4290 files, 1 failed: checksum mismatch", ErrorClassUnknown},
+		{"Failed to copy: file size 5070 bytes differs", ErrorClassUnknown},
+		{"photos/2024/0401/a.jpg: checksum mismatch", ErrorClassUnknown},
+		{"error decoding 4040 bytes", ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := ClassifyError(tt.text); got != tt.want {
+				t.Errorf("ClassifyError(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"cancelled", fmt.Errorf("run: %w", ErrCancelled), ""},
+		{"interrupted", ErrInterrupted, ""},
+		{"suspicious source", fmt.Errorf("%w: source is empty", ErrSourceSuspicious), ""},
+		{"rclone error", &RcloneError{Class: ErrorClassQuota, Message: "anything"}, ErrorClassQuota},
+		{"wrapped rclone error", fmt.Errorf("step failed: %w", &RcloneError{Class: ErrorClassAuth}), ErrorClassAuth},
+		{"plain error", errors.New("permission denied"), ErrorClassPermission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorClass(tt.err); got != tt.want {
+				t.Errorf("ErrorClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/robfig/cron/v3"
+)
+
+const cliUsage = `Usage: scheduler [command]
+
+Commands:
+  serve              schedule jobs and serve the api (default)
+  run <job>          run a job in the foreground, by index or name
+  list               list jobs and their last state
+  validate           check the config and exit, with --json print the problems found
+  history [job]      show recent runs, optionally of a single job
+  selftest [remote]  upload, verify, download and delete a test file on each remote
+  completion bash    print a bash completion script
+  help               show this help
+
+Flags:
+  --json             print list, history and selftest as json
+  --note=<text>      attach a note to a run
+  --config=<path>    load the addon config from a json or yaml file instead of /data/options.json
+`
+
+const bashCompletion = `_scheduler() {
+  local cur prev
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  prev="${COMP_WORDS[COMP_CWORD-1]}"
+  case "$prev" in
+    run|history)
+      COMPREPLY=($(compgen -W "$(scheduler list --names 2>/dev/null)" -- "$cur"))
+      return ;;
+    selftest)
+      COMPREPLY=($(compgen -W "$(rclone listremotes 2>/dev/null)" -- "$cur"))
+      return ;;
+    completion)
+      COMPREPLY=($(compgen -W "bash" -- "$cur"))
+      return ;;
+  esac
+  if [ "$COMP_CWORD" -eq 1 ]; then
+    COMPREPLY=($(compgen -W "serve run list validate history selftest completion help" -- "$cur"))
+  fi
+}
+complete -F _scheduler scheduler
+`
+
+// RunCLI runs the given command and returns the exit code
+func RunCLI(args []string) int {
+	configFile = DefaultConfigFile()
+	command := "serve"
+	if len(args) > 0 {
+		command = args[0]
+		args = args[1:]
+	}
+	asJSON := false
+	names := false
+	note := ""
+	var positional []string
+	for _, arg := range args {
+		switch arg {
+		case "--json":
+			asJSON = true
+		case "--names":
+			names = true
+		default:
+			if strings.HasPrefix(arg, "--note=") {
+				note = strings.TrimPrefix(arg, "--note=")
+				continue
+			}
+			if strings.HasPrefix(arg, "--config=") {
+				configFile = strings.TrimPrefix(arg, "--config=")
+				continue
+			}
+			positional = append(positional, arg)
+		}
+	}
+
+	switch command {
+	case "serve":
+		Setup()
+		Serve()
+	case "run":
+		if len(positional) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: scheduler run <job>")
+			return 2
+		}
+		Setup()
+		job, ok := FindJob(positional[0])
+		if !ok {
+			Errorln("job", "'"+positional[0]+"'", "does not exist")
+			return 1
+		}
+		// while the addon is running it runs the job, so its state and the run queue aren't bypassed
+		if delegated, code := LockOrRunInAddon(positional[0], note); delegated {
+			return code
+		}
+		if err := history.Load(); err != nil {
+			Errorln("failed to load job history", err)
+		}
+		if err := pauses.Load(); err != nil {
+			Errorln("failed to load paused jobs", err)
+		}
+		if err := budget.Load(); err != nil {
+			Errorln("failed to load data budget", err)
+		}
+		if err := traffic.Load(); err != nil {
+			Errorln("failed to load remote traffic", err)
+		}
+		if err := driveAccounts.Load(); err != nil {
+			Errorln("failed to load drive service accounts", err)
+		}
+		if err := pacing.Load(); err != nil {
+			Errorln("failed to load remote pacing", err)
+		}
+		job.Trigger = TriggerCLI
+		job.Note = note
+		RunTracked(job)
+		daemon.Stop()
+		mounts.UnmountAll()
+		if !IsSuccess(statuses.Get(job.Index).State) {
+			return 1
+		}
+	case "list":
+		SetQuiet()
+		Setup()
+		if err := history.Load(); err != nil {
+			Errorln("failed to load job history", err)
+		}
+		if names {
+			for _, job := range config.Jobs {
+				if job.Name != "" && !strings.ContainsAny(job.Name, " \t") {
+					fmt.Println(job.Name)
+				} else {
+					fmt.Println(job.Index)
+				}
+			}
+			return 0
+		}
+		return printJobList(asJSON)
+	case "validate":
+		if asJSON {
+			return printValidation()
+		}
+		Setup()
+		warnings := 0
+		for _, job := range config.Jobs {
+			warnings += len(job.Warnings)
+		}
+		Infoln("config is valid,", len(config.Jobs), "jobs,", warnings, "warnings")
+	case "history":
+		SetQuiet()
+		Setup()
+		if err := history.Load(); err != nil {
+			Errorln("failed to load job history", err)
+			return 1
+		}
+		jobs := config.Jobs
+		if len(positional) > 0 {
+			job, ok := FindJob(positional[0])
+			if !ok {
+				Errorln("job", "'"+positional[0]+"'", "does not exist")
+				return 1
+			}
+			jobs = []JobConfig{job}
+		}
+		return printHistory(jobs, asJSON)
+	case "selftest":
+		if len(positional) > 1 {
+			fmt.Fprintln(os.Stderr, "usage: scheduler selftest [remote]")
+			return 2
+		}
+		if asJSON {
+			SetQuiet()
+		}
+		Setup()
+		var paths []string
+		var err error
+		if len(positional) == 1 {
+			var path string
+			path, err = SelfTestPathOf(positional[0])
+			paths = []string{path}
+		} else {
+			paths, err = SelfTestPaths()
+		}
+		if err != nil {
+			Errorln(err)
+			return 1
+		}
+		report, err := selfTests.Run(context.Background(), paths)
+		if err != nil {
+			Errorln(err)
+			return 1
+		}
+		printSelfTest(report, asJSON)
+		if !report.Passed {
+			return 1
+		}
+	case "completion":
+		if len(positional) != 1 || positional[0] != "bash" {
+			fmt.Fprintln(os.Stderr, "usage: scheduler completion bash")
+			return 2
+		}
+		fmt.Print(bashCompletion)
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command '"+command+"'")
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	return 0
+}
+
+// FindJob finds a job by its index or name
+func FindJob(ref string) (JobConfig, bool) {
+	if index, err := strconv.Atoi(ref); err == nil && index >= 0 && index < len(config.Jobs) {
+		return config.Jobs[index], true
+	}
+	for _, job := range config.Jobs {
+		if strings.EqualFold(job.Name, ref) {
+			return job, true
+		}
+	}
+	return JobConfig{}, false
+}
+
+func printJobList(asJSON bool) int {
+	type listEntry struct {
+		JobSummary
+		JobStatus
+	}
+	if asJSON {
+		list := make([]listEntry, 0, len(config.Jobs))
+		for i, job := range config.Jobs {
+			list = append(list, listEntry{
+				JobSummary{Index: i, Name: job.Name, Schedule: job.Schedule, Command: job.Command, Run: job.Run, Type: JobCommandLabel(job), Warnings: job.Warnings},
+				statuses.Get(i),
+			})
+		}
+		_ = json.NewEncoder(os.Stdout).Encode(list)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tNAME\tSCHEDULE\tCOMMAND\tSTATE\tLAST RUN")
+	for i, job := range config.Jobs {
+		status := statuses.Get(i)
+		schedule := job.Schedule
+		if HotplugOnly(job) {
+			schedule = "@hotplug"
+		} else if schedule == "" {
+			schedule = "@startup"
+		}
+		lastRun := "-"
+		if status.LastStart != nil {
+			lastRun = status.LastStart.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", i, job.Name, schedule, JobCommandLabel(job), status.State, lastRun)
+	}
+	_ = tw.Flush()
+	return 0
+}
+
+// printValidation checks the config like at startup and prints the errors and warnings found as json
+func printValidation() int {
+	SetQuiet()
+	validating = true
+	print := func(validation ConfigValidation) {
+		_ = json.NewEncoder(os.Stdout).Encode(validation)
+	}
+	// a fatal error of the setup ends the check
+	fatalHook = func(message string) {
+		print(ConfigValidation{Problems: []ConfigProblem{{Severity: ProblemError, Message: message}}})
+	}
+	Setup()
+	validation := ConfigValidation{Valid: true, Jobs: len(config.Jobs), Problems: []ConfigProblem{}}
+	for _, job := range config.Jobs {
+		index := job.Index
+		// schedules are only parsed when the jobs are scheduled
+		if job.Schedule != "" {
+			if _, err := cron.ParseStandard(job.Schedule); err != nil {
+				validation.add(ConfigProblem{Severity: ProblemError, Message: "invalid schedule: " + err.Error(), Job: &index})
+			}
+		}
+		for _, warning := range job.Warnings {
+			validation.add(ConfigProblem{Severity: ProblemWarning, Message: warning, Job: &index})
+		}
+	}
+	print(validation)
+	return 0
+}
+
+func printSelfTest(report SelfTestReport, asJSON bool) {
+	if asJSON {
+		_ = json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REMOTE\tSTEP\tRESULT\tDURATION\tERROR")
+	for _, result := range report.Remotes {
+		for _, step := range result.Steps {
+			state := "passed"
+			if step.Skipped {
+				state = "skipped"
+			} else if !step.OK {
+				state = "failed"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Path, step.Name, state, step.Duration, step.Error)
+		}
+	}
+	_ = tw.Flush()
+}
+
+func printHistory(jobs []JobConfig, asJSON bool) int {
+	var runs []RunRecord
+	for _, job := range jobs {
+		runs = append(runs, history.Runs(job.Index)...)
+	}
+	if asJSON {
+		if runs == nil {
+			runs = []RunRecord{}
+		}
+		_ = json.NewEncoder(os.Stdout).Encode(runs)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STARTED\tJOB\tTRIGGER\tSTATE\tDURATION\tTRANSFERRED\tNOTE\tERROR")
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			run.Start.Local().Format("2006-01-02 15:04:05"), run.Name, run.Trigger, run.State, run.Duration, FormatBytes(run.Bytes), run.Note, run.Error)
+	}
+	_ = tw.Flush()
+	return 0
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CommandCompress is the job command that archives a folder and uploads the archive
+const CommandCompress = "compress"
+
+const DefaultStagingPath = "/data/staging"
+
+// CompressFormats maps each compression format to the extension of its archives
+var CompressFormats = map[string]string{
+	"gzip": ".tar.gz",
+	"zstd": ".tar.zst",
+	"none": ".tar",
+}
+
+type CompressConfig struct {
+	Format  string // gzip, zstd or none, defaults to gzip
+	Level   int    // compression level, 0 uses the default of the format
+	Name    string // archive name, defaults to the folder name and the current time
+	Staging string // folder the archive is written to before uploading
+	Stream  bool   // pipe the archive into rclone rcat instead of staging it
+
+	Incremental bool // only archive files changed since the last full archive
+	FullEvery   int  `yaml:"full_every"` // incremental archives between full archives
+	Checksum    bool // compare file hashes as well as sizes and modification times
+}
+
+// CheckCompress validates the compression options of a job or step
+func CheckCompress(compress CompressConfig) error {
+	format := compress.Format
+	if format == "" {
+		format = "gzip"
+	}
+	if _, ok := CompressFormats[format]; !ok {
+		return fmt.Errorf("compress: unknown format '%s', must be gzip, zstd or none", compress.Format)
+	}
+	switch {
+	case format == "gzip" && (compress.Level < 0 || compress.Level > gzip.BestCompression):
+		return fmt.Errorf("compress: gzip level must be between 1 and %d", gzip.BestCompression)
+	case format == "zstd" && (compress.Level < 0 || compress.Level > 19):
+		return errors.New("compress: zstd level must be between 1 and 19")
+	}
+	if format == "zstd" {
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return errors.New("compress: zstd is not installed")
+		}
+	}
+	return nil
+}
+
+// ArchiveName returns the name of the archive of a source folder
+func ArchiveName(compress CompressConfig, source string, now time.Time) string {
+	format := compress.Format
+	if format == "" {
+		format = "gzip"
+	}
+	if compress.Name != "" {
+		if strings.HasSuffix(compress.Name, CompressFormats[format]) {
+			return compress.Name
+		}
+		return compress.Name + CompressFormats[format]
+	}
+	base := filepath.Base(filepath.Clean(source))
+	if base == "/" || base == "." {
+		base = "root"
+	}
+	return base + "_" + now.Format(DefaultDateLayout) + CompressFormats[format]
+}
+
+// RunCompress archives the source folder to the staging folder, uploads it into the destination and removes it again
+func RunCompress(ctx context.Context, job JobConfig, source string, destination string) error {
+	start := time.Now()
+	name := ArchiveName(job.Compress, source, start)
+	stagingPath := StagingPath(job)
+	fail := func(err error) error {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+		return err
+	}
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		return fail(fmt.Errorf("failed to create staging folder: %w", err))
+	}
+
+	// incremental archives only contain the files changed since the full archive
+	var chain *ArchiveChain
+	var current map[string]FileState
+	var filter func(string) bool
+	var deleted []string
+	chainFile := ChainPath(job, source, destination)
+	full := true
+	if job.Compress.Incremental {
+		var err error
+		if chain, err = LoadChain(chainFile); err != nil {
+			Warnln("failed to read archive chain, making a full archive:", err)
+		}
+		if current, err = ScanFolder(source, job.Exclude, job.Compress.Checksum); err != nil {
+			return fail(fmt.Errorf("failed to scan %s: %w", source, err))
+		}
+		fullEvery := job.Compress.FullEvery
+		if fullEvery <= 0 {
+			fullEvery = DefaultFullEvery
+		}
+		full = chain == nil || len(chain.Latest().Incrementals) >= fullEvery
+		if full {
+			name = IncrementalArchiveName(name, "full")
+		} else {
+			var changed map[string]bool
+			changed, deleted = ChangedFiles(chain.Files, current)
+			filter = func(rel string) bool { return changed[rel] }
+			name = IncrementalArchiveName(name, "incr")
+			Infoln(len(changed), "files changed and", len(deleted), "deleted since", chain.Latest().Full)
+		}
+	}
+
+	stream := job.Compress.Stream
+	if !stream {
+		if current == nil {
+			var err error
+			if current, err = ScanFolder(source, job.Exclude, false); err != nil {
+				return fail(fmt.Errorf("failed to scan %s: %w", source, err))
+			}
+		}
+		if err := CheckStagingSpace(stagingPath, EstimateArchiveSize(current, filter)); err != nil {
+			if !config.Staging.StreamWhenFull {
+				return fail(err)
+			}
+			Warnln(err.Error()+",", "streaming the archive instead")
+			stream = true
+		}
+	}
+
+	upload := job
+	upload.Include = nil
+	upload.Exclude = nil
+	upload.Versioning.Enabled = false
+	remote := JoinRemote(destination, path.Base(name))
+	if stream {
+		if err := StreamArchive(ctx, upload, remote, source, filter, deleted); err != nil {
+			return fail(err)
+		}
+	} else {
+		archive := filepath.Join(stagingPath, name)
+		defer staging.Remove(archive)
+
+		Infoln("compressing", source, "to", archive)
+		out, err := staging.Create(job, archive)
+		if err == nil {
+			err = WriteArchive(ctx, job, out, source, archive, filter, deleted)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			return fail(fmt.Errorf("failed to compress %s: %w", source, err))
+		}
+		if stat, err := os.Stat(archive); err == nil {
+			Infoln("compressed", source, "to", FormatBytes(stat.Size()))
+		}
+
+		upload.Command = "copyto"
+		if err := RunJob(ctx, upload, archive, remote); err != nil {
+			return err
+		}
+	}
+	if !job.Compress.Incremental || IsDryRun(job) {
+		return nil
+	}
+	if chain == nil {
+		chain = &ArchiveChain{Job: JobName(job), Source: source, Destination: destination}
+	}
+	if full {
+		// files are compared against the full archive, so only a full archive updates them
+		chain.Sets = append(chain.Sets, ArchiveSet{Full: remote, Time: start})
+		if len(chain.Sets) > MaxArchiveSets {
+			chain.Sets = chain.Sets[len(chain.Sets)-MaxArchiveSets:]
+		}
+		chain.Files = current
+	} else {
+		latest := chain.Latest()
+		latest.Incrementals = append(latest.Incrementals, remote)
+	}
+	if err := SaveChain(chainFile, chain); err != nil {
+		Errorln("failed to save archive chain:", err)
+	}
+	return nil
+}
+
+// StreamArchive pipes the archive of the folder straight into rclone rcat, so it never touches local storage
+func StreamArchive(ctx context.Context, job JobConfig, remote string, folder string, filter func(string) bool, deleted []string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// rclone is killed before the pipe is closed when the archive fails, so a truncated archive is never uploaded
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	written := make(chan error, 1)
+	go func() {
+		err := WriteArchive(uploadCtx, job, w, folder, "", filter, deleted)
+		if err != nil {
+			cancel()
+		} else {
+			_ = w.Close()
+		}
+		written <- err
+	}()
+
+	Infoln("streaming the archive of", folder, "to", remote)
+	job.Command = "rcat"
+	job.MinSourceSize = ""
+	job.MinSourceFiles = 0
+	job.Stdin = r
+	err = RunJob(uploadCtx, job, "", remote)
+	// rclone exited, writes to the pipe fail from now on
+	_ = r.Close()
+	writeErr := <-written
+	_ = w.Close()
+	if writeErr != nil && !errors.Is(writeErr, os.ErrClosed) && !errors.Is(writeErr, syscall.EPIPE) {
+		return fmt.Errorf("failed to compress %s: %w", folder, writeErr)
+	}
+	return err
+}
+
+// WriteArchive writes a tar of the folder to out, compressed using the configured format of the job. skip is the
+// archive itself when it is written inside the folder. When filter is set only the files it accepts are written,
+// along with the list of deleted files.
+func WriteArchive(ctx context.Context, job JobConfig, out io.Writer, folder string, skip string, filter func(string) bool, deleted []string) error {
+	compress, exclude := job.Compress, job.Exclude
+	var w io.WriteCloser
+	var wait func() error
+	var err error
+	switch compress.Format {
+	case "", "gzip":
+		level := compress.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		w, err = gzip.NewWriterLevel(out, level)
+	case "zstd":
+		// stream through the zstd binary, there is no zstd encoder in the standard library
+		args := []string{"-q", "-T0"}
+		if compress.Level > 0 {
+			args = append(args, "-"+strconv.Itoa(compress.Level))
+		}
+		cmd := exec.CommandContext(ctx, "zstd", args...)
+		cmd.Stdout = out
+		cmd.Stderr = os.Stderr
+		w, err = cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		wait = cmd.Wait
+	default:
+		w = nopWriteCloser{out}
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(folder, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ExcludedFromArchive(rel, info.Name(), exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// skip the archive itself when staging inside the folder
+		if p == skip {
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		// folders are created when extracting the files inside them
+		if filter != nil && (info.IsDir() || info.Mode().IsRegular() && !filter(rel)) {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil && filter != nil {
+		list := []byte(strings.Join(deleted, "\n"))
+		err = tw.WriteHeader(&tar.Header{Name: DeletedFilesEntry, Mode: 0644, Size: int64(len(list)), ModTime: time.Now()})
+		if err == nil {
+			_, err = tw.Write(list)
+		}
+	}
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if wait != nil {
+		if waitErr := wait(); err == nil {
+			err = waitErr
+		}
+	}
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// ExcludedFromArchive reports whether a file matches one of the exclude patterns, by its path or its name
+func ExcludedFromArchive(rel string, name string, exclude []string) bool {
+	for _, pattern := range exclude {
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/**")
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigVersionsPath keeps the last versions of the addon config, so a change can be rolled back
+var ConfigVersionsPath = filepath.Join(DataPath, "config_versions.json")
+
+// DefaultConfigVersions is how many versions of the config are kept unless config_versions is set
+const DefaultConfigVersions = 20
+
+// maxConfigSize is the largest config accepted by the api
+const maxConfigSize = 1 << 20
+
+// validateTimeout is how long checking a config like at startup may take, it runs rclone to list the remotes
+const validateTimeout = time.Minute
+
+const (
+	ProblemError   = "error"
+	ProblemWarning = "warning"
+)
+
+var ErrInvalidConfig = errors.New("config is invalid")
+
+var ErrConfigVersionNotFound = errors.New("config version not found")
+
+// what a version of the config was recorded for
+const (
+	VersionStartup  = "startup" // the addon started with changed options, e.g. from the configuration tab of the addon
+	VersionAPI      = "api"     // saved through the api or the Config page
+	VersionRollback = "rollback"
+	VersionWizard   = "wizard" // a job was added with the setup wizard
+)
+
+// yamlLine finds the line number of yaml errors, e.g. "yaml: line 3: mapping values are not allowed"
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// jobProblem finds the job of fatal errors of Setup, e.g. "job 'Daily': notify: unknown notifier 'x'"
+var jobProblem = regexp.MustCompile(`^job '(.*?)': (.*)$`)
+
+// ConfigProblem is an error that keeps the addon from starting or a warning about a config
+type ConfigProblem struct {
+	Severity string `json:"severity"` // error or warning
+	Message  string `json:"message"`
+	Job      *int   `json:"job,omitempty"`
+	Line     int    `json:"line,omitempty"` // in the validated yaml or json, if known
+}
+
+// ConfigValidation is the result of checking a config, it is valid when there are no errors
+type ConfigValidation struct {
+	Valid    bool            `json:"valid"`
+	Jobs     int             `json:"jobs"`
+	Problems []ConfigProblem `json:"problems"`
+}
+
+// add records a problem and updates whether the config is still valid
+func (v *ConfigValidation) add(problem ConfigProblem) {
+	v.Problems = append(v.Problems, problem)
+	v.Valid = !slices.ContainsFunc(v.Problems, func(p ConfigProblem) bool { return p.Severity == ProblemError })
+}
+
+// ReadConfig returns the addon config as indented json, or as yaml in the order of the json
+func ReadConfig(format string) ([]byte, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = ConfigJSON(data); err != nil {
+		return nil, err
+	}
+	return FormatConfig(data, format)
+}
+
+// FormatConfig returns a json config indented, or as yaml in the order of the json
+func FormatConfig(data []byte, format string) ([]byte, error) {
+	if format != "yaml" {
+		var out bytes.Buffer
+		if err := json.Indent(&out, data, "", "  "); err != nil {
+			return nil, err
+		}
+		out.WriteByte('\n')
+		return out.Bytes(), nil
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	blockStyle(&root)
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), encoder.Close()
+}
+
+// blockStyle drops the json styles of parsed nodes, strings that would read as another type stay quoted
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// ValidateConfig checks a config in yaml or json the way the Supervisor and the addon at startup would, returning
+// the options it contains
+func ValidateConfig(text []byte) (ConfigValidation, map[string]interface{}) {
+	validation := ConfigValidation{Valid: true, Problems: []ConfigProblem{}}
+	var root yaml.Node
+	if err := yaml.Unmarshal(text, &root); err != nil {
+		validation.add(lineProblem(ProblemError, err.Error()))
+		return validation, nil
+	}
+	options := make(map[string]interface{})
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode || root.Decode(&options) != nil {
+		validation.add(ConfigProblem{Severity: ProblemError, Message: "the config must be a mapping of options", Line: 1})
+		return validation, nil
+	}
+	// the options and their types, options the scheduler doesn't know are left to the supervisor
+	decoder := yaml.NewDecoder(bytes.NewReader(text))
+	decoder.KnownFields(true)
+	var typeErr *yaml.TypeError
+	if err := decoder.Decode(&Config{}); errors.As(err, &typeErr) {
+		for _, message := range typeErr.Errors {
+			severity := ProblemError
+			if strings.Contains(message, "not found in type") {
+				severity = ProblemWarning
+			}
+			validation.add(lineProblem(severity, message))
+		}
+	} else if err != nil {
+		validation.add(lineProblem(ProblemError, err.Error()))
+	}
+	if !validation.Valid {
+		return validation, options
+	}
+
+	if HasSupervisor() {
+		var result struct {
+			Valid   bool   `json:"valid"`
+			Message string `json:"message"`
+		}
+		if err := SupervisorPost("/addons/self/options/validate", options, &result); err != nil {
+			validation.add(ConfigProblem{Severity: ProblemWarning, Message: "the options could not be checked against the addon schema: " + err.Error()})
+		} else if !result.Valid {
+			validation.add(ConfigProblem{Severity: ProblemError, Message: result.Message})
+			return validation, options
+		}
+	}
+
+	startup, err := validateStartup(options)
+	if err != nil {
+		validation.add(ConfigProblem{Severity: ProblemError, Message: err.Error()})
+		return validation, options
+	}
+	validation.Jobs = startup.Jobs
+	names := jobNames(options)
+	for _, problem := range startup.Problems {
+		if match := jobProblem.FindStringSubmatch(problem.Message); problem.Job == nil && match != nil {
+			if index := slices.Index(names, match[1]); index >= 0 {
+				problem.Job = &index
+			}
+		}
+		if problem.Job != nil {
+			problem.Line = jobLine(&root, *problem.Job)
+		}
+		validation.add(problem)
+	}
+	return validation, options
+}
+
+// validateStartup checks the options like the addon does at startup, by validating them in another process so the
+// running jobs aren't affected
+func validateStartup(options map[string]interface{}) (ConfigValidation, error) {
+	var validation ConfigValidation
+	data, err := json.Marshal(options)
+	if err != nil {
+		return validation, err
+	}
+	file, err := os.CreateTemp("", "options-*.json")
+	if err != nil {
+		return validation, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return validation, err
+	}
+	if err := file.Close(); err != nil {
+		return validation, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return validation, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, "validate", "--json", "--config="+file.Name())
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if jsonErr := json.Unmarshal(out, &validation); jsonErr != nil {
+		if err == nil {
+			err = jsonErr
+		}
+		return validation, fmt.Errorf("failed to check the config: %w %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return validation, nil
+}
+
+// lineProblem returns the problem of a yaml error, with the line it names
+func lineProblem(severity string, message string) ConfigProblem {
+	problem := ConfigProblem{Severity: severity, Message: message}
+	if match := yamlLine.FindStringSubmatch(message); match != nil {
+		problem.Line, _ = strconv.Atoi(match[1])
+		problem.Message = match[2]
+	}
+	return problem
+}
+
+// jobNames returns the names of the jobs of the options, in order
+func jobNames(options map[string]interface{}) []string {
+	jobs, _ := options["jobs"].([]interface{})
+	names := make([]string, len(jobs))
+	for i, job := range jobs {
+		if job, ok := job.(map[string]interface{}); ok {
+			names[i], _ = job["name"].(string)
+		}
+	}
+	return names
+}
+
+// jobLine returns the line a job of the jobs option starts at, or 0 if it can't be found
+func jobLine(root *yaml.Node, index int) int {
+	if len(root.Content) == 0 {
+		return 0
+	}
+	mapping := root.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == "jobs" && index < len(mapping.Content[i+1].Content) {
+			return mapping.Content[i+1].Content[index].Line
+		}
+	}
+	return 0
+}
+
+// SaveConfig makes a valid config the addon config and records it as a new version. The supervisor stores the
+// options for the next start of the addon, and the config file is replaced right away, a yaml file of a standalone
+// scheduler stays yaml.
+func SaveConfig(text []byte, version ConfigVersion) (ConfigValidation, error) {
+	validation, options := ValidateConfig(text)
+	if !validation.Valid {
+		return validation, ErrInvalidConfig
+	}
+	data, err := json.MarshalIndent(options, "", "  ")
+	if err != nil {
+		return validation, err
+	}
+	if HasSupervisor() {
+		if err := SupervisorPost("/addons/self/options", map[string]interface{}{"options": options}, nil); err != nil {
+			return validation, err
+		}
+	}
+	file := data
+	if configIsYAML() {
+		if file, err = FormatConfig(data, "yaml"); err != nil {
+			return validation, err
+		}
+	}
+	if err := os.WriteFile(configFile, file, 0600); err != nil {
+		return validation, err
+	}
+	version.Jobs = validation.Jobs
+	id := configVersions.Record(data, version)
+	Infoln("saved the config as version", id, "with", validation.Jobs, "jobs")
+	return validation, nil
+}
+
+// ErrNoRestart is returned when the addon can't restart itself without the supervisor
+var ErrNoRestart = errors.New("restarting requires the supervisor, restart the scheduler to load the config")
+
+// RestartAddon restarts the addon through the supervisor so a saved config is loaded
+func RestartAddon() error {
+	if !HasSupervisor() {
+		return ErrNoRestart
+	}
+	go func() {
+		// give the response a moment to be sent
+		time.Sleep(time.Second)
+		Infoln("restarting the addon to load the saved config")
+		if err := SupervisorPost("/addons/self/restart", nil, nil); err != nil {
+			Errorln("failed to restart the addon:", err)
+		}
+	}()
+	return nil
+}
+
+// ConfigVersion is the addon config as it was at some point
+type ConfigVersion struct {
+	ID       int             `json:"id"`
+	Time     time.Time       `json:"time"`
+	Source   string          `json:"source"`
+	Token    string          `json:"token,omitempty"`    // name of the api token that saved it
+	Restored int             `json:"restored,omitempty"` // the version a rollback went back to
+	Jobs     int             `json:"jobs"`
+	Options  json.RawMessage `json:"options,omitempty"`
+}
+
+type ConfigVersionStore struct {
+	mu       sync.Mutex
+	versions []ConfigVersion // oldest first
+}
+
+var configVersions = &ConfigVersionStore{}
+
+// Load reads the config versions from disk
+func (s *ConfigVersionStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(ConfigVersionsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.versions)
+}
+
+func (s *ConfigVersionStore) save() {
+	data, err := json.Marshal(s.versions)
+	if err == nil {
+		err = os.WriteFile(ConfigVersionsPath, data, 0600)
+	}
+	if err != nil {
+		Errorln("failed to save config versions:", err)
+	}
+}
+
+// Record keeps options as a new version unless they are the same as the latest one, dropping the oldest versions
+// past config_versions. It returns the id of the version of the options.
+func (s *ConfigVersionStore) Record(options []byte, version ConfigVersion) int {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, options); err != nil {
+		Errorln("failed to record config version:", err)
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.versions); n > 0 && sameOptions(s.versions[n-1].Options, compact.Bytes()) {
+		return s.versions[n-1].ID
+	}
+	version.ID = 1
+	if n := len(s.versions); n > 0 {
+		version.ID = s.versions[n-1].ID + 1
+	}
+	version.Time = time.Now()
+	version.Options = compact.Bytes()
+	s.versions = append(s.versions, version)
+	limit := config.ConfigVersions
+	if limit <= 0 {
+		limit = DefaultConfigVersions
+	}
+	if len(s.versions) > limit {
+		s.versions = slices.Delete(s.versions, 0, len(s.versions)-limit)
+	}
+	s.save()
+	return version.ID
+}
+
+// RecordStartup keeps the options the addon started with as a version, when they were changed since the latest
+// version, e.g. on the configuration tab of the addon
+func (s *ConfigVersionStore) RecordStartup() {
+	data, err := os.ReadFile(configFile)
+	if err == nil {
+		data, err = ConfigJSON(data)
+	}
+	if err != nil {
+		Errorln("failed to record config version:", err)
+		return
+	}
+	if id := s.Record(data, ConfigVersion{Source: VersionStartup, Jobs: len(config.Jobs)}); id != 0 {
+		Debugln("started with config version", id)
+	}
+}
+
+// List returns the versions without their options, newest first
+func (s *ConfigVersionStore) List() []ConfigVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ConfigVersion, 0, len(s.versions))
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		version := s.versions[i]
+		version.Options = nil
+		list = append(list, version)
+	}
+	return list
+}
+
+// Get returns a version with its options
+func (s *ConfigVersionStore) Get(id int) (ConfigVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, version := range s.versions {
+		if version.ID == id {
+			return version, nil
+		}
+	}
+	return ConfigVersion{}, ErrConfigVersionNotFound
+}
+
+// sameOptions reports whether two json configs have the same options, ignoring their order
+func sameOptions(a, b []byte) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// RollbackConfig saves a previous version of the config again, as a new version
+func RollbackConfig(id int, token string) (ConfigValidation, error) {
+	version, err := configVersions.Get(id)
+	if err != nil {
+		return ConfigValidation{}, err
+	}
+	return SaveConfig(version.Options, ConfigVersion{Source: VersionRollback, Token: token, Restored: id})
+}
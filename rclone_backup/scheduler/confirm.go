@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultConfirmExpiry is how long a confirmation code can be used
+const DefaultConfirmExpiry = "5m"
+
+// ConfirmHeader carries the one-time code confirming a destructive request
+const ConfirmHeader = "X-Confirm-Code"
+
+const (
+	DefaultConfirmTitle   = "Rclone Backup: confirm {{.Name}}"
+	DefaultConfirmMessage = "Confirmation code {{.Detail}} for {{.Name}}, it expires in {{.Duration}}"
+)
+
+// destructiveCommands are the ad-hoc rclone commands that delete or overwrite files
+var destructiveCommands = []string{"bisync", "cleanup", "dedupe", "delete", "deletefile", "move", "moveto", "purge", "rmdir", "rmdirs", "sync"}
+
+// ConfirmConfig requires destructive api requests to be repeated with a one-time code that is only
+// shown in the log or sent to the notifiers, so a second person has to confirm them
+type ConfirmConfig struct {
+	Enabled        bool
+	Notifiers      []string
+	Expiry         string
+	DifferentToken bool `yaml:"different_token"` // the code must be sent with another api token than the request
+}
+
+type pendingConfirmation struct {
+	request string // hash of the method, path and body of the request
+	token   string // name of the api token that made the request
+	expires time.Time
+}
+
+// Confirmations are the codes waiting to be confirmed, by code
+type Confirmations struct {
+	mu      sync.Mutex
+	pending map[string]pendingConfirmation
+}
+
+var confirmations = &Confirmations{pending: make(map[string]pendingConfirmation)}
+
+// CheckConfirm validates the confirm option
+func CheckConfirm() error {
+	if !config.Confirm.Enabled {
+		return nil
+	}
+	if config.Confirm.Expiry != "" {
+		if d, err := time.ParseDuration(config.Confirm.Expiry); err != nil || d <= 0 {
+			return fmt.Errorf("invalid confirm expiry '%s'", config.Confirm.Expiry)
+		}
+	}
+	for _, name := range config.Confirm.Notifiers {
+		if FindNotifier(name) == nil {
+			return fmt.Errorf("confirm: unknown notifier '%s'", name)
+		}
+	}
+	return nil
+}
+
+func confirmExpiry() time.Duration {
+	expiry, err := time.ParseDuration(config.Confirm.Expiry)
+	if err != nil || expiry <= 0 {
+		expiry, _ = time.ParseDuration(DefaultConfirmExpiry)
+	}
+	return expiry
+}
+
+func newConfirmCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", fmt.Errorf("failed to create confirmation code: %w", err)
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// requestHash identifies a request so a code only confirms the exact request it was created for
+func requestHash(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	sum.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n"))
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+func requestTokenName(r *http.Request) string {
+	if token := tokens.Authenticate(RequestToken(r)); token != nil {
+		return token.Name
+	}
+	return ""
+}
+
+// RequireConfirmation reports whether a destructive request may go ahead. Without a valid code a new code is
+// logged and sent to the notifiers, and the request is answered with 428 Precondition Required
+func RequireConfirmation(w http.ResponseWriter, r *http.Request, action string) bool {
+	if !config.Confirm.Enabled {
+		return true
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	request := requestHash(r, body)
+	token := requestTokenName(r)
+	now := time.Now()
+
+	confirmations.mu.Lock()
+	for code, pending := range confirmations.pending {
+		if now.After(pending.expires) {
+			delete(confirmations.pending, code)
+		}
+	}
+	if code := r.Header.Get(ConfirmHeader); code != "" {
+		pending, ok := confirmations.pending[code]
+		if !ok || pending.request != request {
+			// a wrong guess invalidates the codes of the request, so they can't be guessed
+			for code, pending := range confirmations.pending {
+				if pending.request == request {
+					delete(confirmations.pending, code)
+				}
+			}
+			confirmations.mu.Unlock()
+			http.Error(w, "invalid or expired confirmation code", http.StatusForbidden)
+			return false
+		}
+		if config.Confirm.DifferentToken && pending.token == token {
+			confirmations.mu.Unlock()
+			http.Error(w, "the confirmation code must be sent with a different api token", http.StatusForbidden)
+			return false
+		}
+		delete(confirmations.pending, code)
+		confirmations.mu.Unlock()
+		Infoln("confirmed", action)
+		return true
+	}
+	code, err := newConfirmCode()
+	if err != nil {
+		confirmations.mu.Unlock()
+		Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	pending := pendingConfirmation{request: request, token: token, expires: now.Add(confirmExpiry())}
+	confirmations.pending[code] = pending
+	confirmations.mu.Unlock()
+
+	Warnln("confirmation code for", action+":", code+", expires in", FormatDuration(confirmExpiry()))
+	if len(config.Confirm.Notifiers) > 0 && !config.NoNotifications {
+		result := RunResult{Name: action, Detail: code, Start: now, End: pending.expires, Duration: FormatDuration(confirmExpiry())}
+		go SendNotification(config.Confirm.Notifiers, DefaultConfirmTitle, DefaultConfirmMessage, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionRequired)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "confirmation required, repeat the request with the code in the " + ConfirmHeader + " header",
+		"action":  action,
+		"expires": pending.expires,
+	})
+	return false
+}
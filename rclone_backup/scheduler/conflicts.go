@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// conflictWindow is how far ahead the schedules of jobs are compared
+const conflictWindow = 7 * 24 * time.Hour
+
+// DefaultConflictDuration is how long a run is assumed to take when the job never succeeded
+const DefaultConflictDuration = 5 * time.Minute
+
+// conflictMargin is the gap left after the other job when suggesting a later start
+const conflictMargin = 5 * time.Minute
+
+// sharedResource returns the remote or local source two jobs both use, if any
+func sharedResource(a JobConfig, b JobConfig) string {
+	for _, remote := range JobRemotes(a) {
+		if ArrayContains(JobRemotes(b), remote) {
+			return remote
+		}
+	}
+	for _, source := range a.Sources {
+		if strings.Contains(source, ":") {
+			continue
+		}
+		for _, other := range b.Sources {
+			if source == other || strings.HasPrefix(other, source+"/") {
+				return source
+			} else if strings.HasPrefix(source, other+"/") {
+				return other
+			}
+		}
+	}
+	return ""
+}
+
+// lastDurations returns how long the last successful run of each job took
+func lastDurations() map[int]time.Duration {
+	durations := make(map[int]time.Duration)
+	runs, err := readHistory()
+	if err != nil {
+		Debugln("failed to read job history for schedule conflicts:", err)
+	}
+	for _, run := range runs {
+		if IsSuccess(run.State) {
+			durations[run.Job] = run.End.Sub(run.Start)
+		}
+	}
+	return durations
+}
+
+// scheduleRuns returns the start times of a cron schedule within the window
+func scheduleRuns(schedule cron.Schedule, from time.Time, until time.Time) []time.Time {
+	var runs []time.Time
+	for next := schedule.Next(from); !next.IsZero() && next.Before(until) && len(runs) < maxCalendarRuns; next = schedule.Next(next) {
+		runs = append(runs, next)
+	}
+	return runs
+}
+
+// firstOverlap returns when a run of b starts while a run of a is still going, and how long that run of a has left
+func firstOverlap(a []time.Time, aDuration time.Duration, b []time.Time, bDuration time.Duration) (time.Time, time.Duration, bool) {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		aEnd, bEnd := a[i].Add(aDuration), b[j].Add(bDuration)
+		if !b[j].Before(a[i]) && b[j].Before(aEnd) {
+			return b[j], aEnd.Sub(b[j]), true
+		}
+		if aEnd.Before(bEnd) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return time.Time{}, 0, false
+}
+
+// ShiftSchedule returns the cron schedule started later by offset, when its minute and hour are plain numbers
+func ShiftSchedule(schedule string, offset time.Duration) (string, bool) {
+	fields := strings.Fields(schedule)
+	if len(fields) != 5 {
+		return "", false
+	}
+	minute, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", false
+	}
+	minutes := int(offset.Minutes())
+	if fields[1] == "*" {
+		if minute+minutes >= 60 {
+			return "", false
+		}
+		fields[0] = strconv.Itoa(minute + minutes)
+		return strings.Join(fields, " "), true
+	}
+	hour, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", false
+	}
+	// moving past midnight would change the day fields too
+	total := hour*60 + minute + minutes
+	if total >= 24*60 {
+		return "", false
+	}
+	fields[0], fields[1] = strconv.Itoa(total%60), strconv.Itoa(total/60)
+	return strings.Join(fields, " "), true
+}
+
+// CheckScheduleConflicts warns about jobs scheduled to start while another job using the same remote
+// or source is still running, suggesting how much later to start them
+func CheckScheduleConflicts(jobs []JobConfig) {
+	now := time.Now()
+	durations := lastDurations()
+	type scheduledJob struct {
+		job      JobConfig
+		runs     []time.Time
+		duration time.Duration
+	}
+	var scheduled []scheduledJob
+	for _, job := range jobs {
+		if job.Schedule == "" {
+			continue
+		}
+		schedule, err := cron.ParseStandard(job.Schedule)
+		if err != nil {
+			continue
+		}
+		duration, ok := durations[job.Index]
+		if !ok {
+			duration = DefaultConflictDuration
+		}
+		duration = max(duration, time.Minute)
+		scheduled = append(scheduled, scheduledJob{job, scheduleRuns(schedule, now, now.Add(conflictWindow)), duration})
+	}
+
+	for i, first := range scheduled {
+		for _, second := range scheduled[i+1:] {
+			resource := sharedResource(first.job, second.job)
+			if resource == "" {
+				continue
+			}
+			// the job starting inside the other's run is the one that should move
+			later, earlier := second, first
+			at, left, ok := firstOverlap(first.runs, first.duration, second.runs, second.duration)
+			if !ok {
+				at, left, ok = firstOverlap(second.runs, second.duration, first.runs, first.duration)
+				later, earlier = first, second
+			}
+			if !ok {
+				continue
+			}
+			offset := (left + conflictMargin).Round(5 * time.Minute)
+			if offset < left+conflictMargin {
+				offset += 5 * time.Minute
+			}
+			warning := fmt.Sprintf("scheduled while '%s' is running, which also uses %s, e.g. %s; start it %s later", earlier.job.Name, resource, at.Format("Mon 15:04"), FormatDuration(offset))
+			if suggestion, ok := ShiftSchedule(later.job.Schedule, offset); ok {
+				warning += fmt.Sprintf(" with schedule \"%s\"", suggestion)
+			}
+			Warnln("job", "'"+later.job.Name+"':", warning)
+			index := later.job.Index
+			jobs[index].Warnings = append(jobs[index].Warnings, warning)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jcwillox/emerald"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// DataLockPath is locked by the process that reads and writes the state files in the data dir
+	DataLockPath = filepath.Join(DataPath, "scheduler.lock")
+	// ControlSocketPath is where the running addon accepts runs started with `scheduler run`
+	ControlSocketPath = filepath.Join(DataPath, "scheduler.sock")
+)
+
+var dataLock *os.File
+
+// controlRun is a run started with `scheduler run` and handed to the running addon
+type controlRun struct {
+	Job  string `json:"job"` // index or name, looked up in the config of the running addon
+	Note string `json:"note,omitempty"`
+}
+
+// LockDataDir takes an exclusive lock on the data dir that is held until the process exits, so the addon and
+// runs started from the command line don't overwrite each other's history, pauses and other state. Without
+// wait it returns false if another process holds the lock.
+func LockDataDir(wait bool) (bool, error) {
+	if dataLock != nil {
+		return true, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(DataLockPath), 0755); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(DataLockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+	dataLock = file
+	return true, nil
+}
+
+// WaitForDataDir locks the data dir, waiting for runs started from the command line to finish first
+func WaitForDataDir() {
+	locked, err := LockDataDir(false)
+	if err == nil && !locked {
+		Infoln("waiting for a job started from the command line to finish")
+		_, err = LockDataDir(true)
+	}
+	if err != nil {
+		Errorln("failed to lock the data dir", emerald.HighlightPath(DataLockPath)+":", err)
+	}
+}
+
+// ServeControl accepts runs started with `scheduler run` while the addon is running. The socket is only
+// reachable inside the addon container, so unlike the api socket no token is needed.
+func ServeControl() {
+	listener, err := ListenSocket(ControlSocketPath)
+	if err != nil {
+		Errorln("failed to listen on control socket", emerald.HighlightPath(ControlSocketPath)+":", err)
+		return
+	}
+	if err := os.Chmod(ControlSocketPath, 0600); err != nil {
+		Errorln("failed to restrict control socket", emerald.HighlightPath(ControlSocketPath)+":", err)
+		_ = listener.Close()
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", HandleControlRun)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			Errorln("control socket error:", err)
+		}
+	}()
+}
+
+// HandleControlRun runs a job and streams its log until it finishes, the exit code is sent as the X-Exit-Code trailer
+func HandleControlRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req controlRun
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	job, ok := FindJob(req.Job)
+	if !ok {
+		http.Error(w, "job '"+req.Job+"' does not exist", http.StatusNotFound)
+		return
+	}
+	if statuses.Get(job.Index).State == StateRunning {
+		http.Error(w, "job '"+job.Name+"' is already running", http.StatusConflict)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	job.Trigger = TriggerCLI
+	job.Note = req.Note
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", "X-Exit-Code")
+	w.WriteHeader(http.StatusOK)
+	out := flushWriter{w, flusher}
+
+	// the run goes on if the command line disconnects, as would a run started from the api
+	output, stop := runLogs.Follow(job.Index)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		RunTracked(job)
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case b := <-output:
+			_, _ = out.Write(b)
+		case <-done:
+			running = false
+		}
+	}
+	for len(output) > 0 {
+		_, _ = out.Write(<-output)
+	}
+	code := 0
+	if !IsSuccess(statuses.Get(job.Index).State) {
+		code = 1
+	}
+	w.Header().Set("X-Exit-Code", strconv.Itoa(code))
+}
+
+// RunInAddon hands a run to the running addon and prints its log, returning an error if the addon isn't running
+func RunInAddon(ref, note string) (int, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", ControlSocketPath)
+		},
+	}}
+	body, err := json.Marshal(controlRun{Job: ref, Note: note})
+	if err != nil {
+		return 0, err
+	}
+	res, err := client.Post("http://scheduler/run", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		Errorln(strings.TrimSpace(string(msg)))
+		return 1, nil
+	}
+	Infoln("running", "'"+ref+"'", "in the running addon")
+	if _, err := io.Copy(os.Stdout, res.Body); err != nil {
+		Errorln("lost the connection to the addon, the run goes on:", err)
+		return 1, nil
+	}
+	if res.Trailer.Get("X-Exit-Code") != "0" {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// LockOrRunInAddon takes the data dir lock for a run from the command line, or hands the run to the running
+// addon. It returns true with the exit code if the addon ran it.
+func LockOrRunInAddon(ref, note string) (bool, int) {
+	waiting := false
+	for {
+		locked, err := LockDataDir(false)
+		if err != nil {
+			Errorln("failed to lock the data dir", emerald.HighlightPath(DataLockPath)+":", err)
+			return true, 1
+		}
+		if locked {
+			return false, 0
+		}
+		if code, err := RunInAddon(ref, note); err == nil {
+			return true, code
+		}
+		// another run from the command line holds the lock, or the addon is starting
+		if !waiting {
+			Infoln("waiting for the addon to start or another run from the command line to finish")
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+}
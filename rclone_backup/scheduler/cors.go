@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowedHeaders []string `yaml:"allowed_headers"`
+}
+
+// ListsOrigin reports whether the origin is listed explicitly in the allowed origins
+func (c CORSConfig) ListsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed != "*" && strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAnyOrigin reports whether "*" is one of the allowed origins
+func (c CORSConfig) AllowsAnyOrigin() bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCORS adds CORS headers for allowed origins and answers preflight requests
+func WithCORS(cors CORSConfig, next http.Handler) http.Handler {
+	if len(cors.AllowedOrigins) == 0 {
+		return next
+	}
+	headers := strings.Join(append(defaultCORSHeaders, cors.AllowedHeaders...), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		// only origins that are listed can send credentials, any other origin gets the wildcard without them
+		if cors.ListsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else if cors.AllowsAnyOrigin() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// preflight requests are answered before authentication
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", TotalCountHeader+", ETag")
+		next.ServeHTTP(w, r)
+	})
+}
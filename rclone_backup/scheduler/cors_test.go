@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		origin      string
+		method      string
+		allow       string
+		credentials string
+		status      int
+	}{
+		{"no origin", []string{"*"}, "", http.MethodGet, "", "", http.StatusOK},
+		{"listed origin", []string{"http://ha.local:8123"}, "http://ha.local:8123", http.MethodGet, "http://ha.local:8123", "true", http.StatusOK},
+		{"listed origin with slash", []string{"http://ha.local:8123/"}, "http://HA.local:8123", http.MethodGet, "http://HA.local:8123", "true", http.StatusOK},
+		{"unlisted origin", []string{"http://ha.local:8123"}, "http://evil.example", http.MethodGet, "", "", http.StatusOK},
+		{"wildcard", []string{"*"}, "http://evil.example", http.MethodGet, "*", "", http.StatusOK},
+		{"wildcard and listed origin", []string{"*", "http://ha.local:8123"}, "http://ha.local:8123", http.MethodGet, "http://ha.local:8123", "true", http.StatusOK},
+		{"wildcard and other origin", []string{"*", "http://ha.local:8123"}, "http://evil.example", http.MethodGet, "*", "", http.StatusOK},
+		{"preflight", []string{"*"}, "http://evil.example", http.MethodOptions, "*", "", http.StatusNoContent},
+		{"preflight of unlisted origin", []string{"http://ha.local:8123"}, "http://evil.example", http.MethodOptions, "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			handler := WithCORS(CORSConfig{AllowedOrigins: tt.origins}, next)
+			req := httptest.NewRequest(tt.method, "/api/jobs", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allow)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.credentials)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultCostsSchedule = "0 9 1 * *"
+	DefaultCostsCurrency = "USD"
+	DefaultCostsTitle    = "Rclone Backup: {{.Name}}"
+	DefaultCostsMessage  = "{{.Detail}}"
+)
+
+// bytesPerGB is the unit providers bill storage and traffic in
+const bytesPerGB = 1e9
+
+// PricingConfig is what a remote costs, used to estimate the monthly bill from the traffic and the catalog
+type PricingConfig struct {
+	Storage   float64 // per GB stored per month
+	Egress    float64 // per GB downloaded
+	Ingress   float64 // per GB uploaded
+	Uploads   float64 // per 1000 files uploaded, e.g. class A transactions
+	Downloads float64 // per 1000 files downloaded, e.g. class B transactions
+}
+
+// CostsConfig sends the estimated costs of the last month on a schedule
+type CostsConfig struct {
+	Currency  string
+	Report    bool
+	Schedule  string
+	Notifiers []string // sent as a persistent notification when empty
+}
+
+// CostEstimate is the estimated bill of a remote for a month
+type CostEstimate struct {
+	Remote          string  `json:"remote"`
+	Month           string  `json:"month"`
+	Currency        string  `json:"currency"`
+	Stored          int64   `json:"stored"`
+	Uploaded        int64   `json:"uploaded"`
+	Downloaded      int64   `json:"downloaded"`
+	UploadedFiles   int64   `json:"uploaded_files"`
+	DownloadedFiles int64   `json:"downloaded_files"`
+	Storage         float64 `json:"storage"`
+	Egress          float64 `json:"egress"`
+	Ingress         float64 `json:"ingress"`
+	Operations      float64 `json:"operations"`
+	Total           float64 `json:"total"`
+	Projected       float64 `json:"projected,omitempty"` // the whole current month at the rate so far
+}
+
+func CheckCosts() error {
+	for _, remote := range config.Remotes {
+		p := remote.Pricing
+		if p.Storage < 0 || p.Egress < 0 || p.Ingress < 0 || p.Uploads < 0 || p.Downloads < 0 {
+			return fmt.Errorf("remotes: '%s' prices can't be negative", remoteName(remote.Name))
+		}
+	}
+	for _, name := range config.Costs.Notifiers {
+		if FindNotifier(name) == nil {
+			return fmt.Errorf("costs: unknown notifier '%s'", name)
+		}
+	}
+	return nil
+}
+
+func costsCurrency() string {
+	if config.Costs.Currency != "" {
+		return config.Costs.Currency
+	}
+	return DefaultCostsCurrency
+}
+
+// StoredBytes returns how much is stored on a remote, from the catalog or else the usage reported by rclone about
+func StoredBytes(remote string) int64 {
+	var stored int64
+	found := false
+	for _, folder := range catalog.Folders() {
+		if trafficRemote(folder.Path) == remote && folder.Error == "" {
+			stored += folder.Size
+			found = true
+		}
+	}
+	if found {
+		return stored
+	}
+	for _, quota := range GetQuotas() {
+		if quota.Remote == remote && quota.Used != nil {
+			return *quota.Used
+		}
+	}
+	return 0
+}
+
+// EstimateCosts returns the estimated costs of every remote with prices for a month such as "2024-07",
+// storage is what is stored now
+func EstimateCosts(month string) []CostEstimate {
+	monthly := make(map[string]RemoteTraffic)
+	for _, total := range traffic.List("", true) {
+		if total.Period == month {
+			monthly[total.Remote] = total
+		}
+	}
+	// the current month is projected from the days so far
+	now := time.Now()
+	fraction := 0.0
+	if month == now.Format("2006-01") {
+		days := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.Local).Day()
+		elapsed := float64(now.Day()-1) + float64(now.Hour()*60+now.Minute())/(24*60)
+		fraction = max(elapsed, 1) / float64(days)
+	}
+
+	estimates := make([]CostEstimate, 0, len(config.Remotes))
+	for _, remote := range config.Remotes {
+		p := remote.Pricing
+		if p == (PricingConfig{}) {
+			continue
+		}
+		name := remoteName(remote.Name)
+		used := monthly[name]
+		estimate := CostEstimate{
+			Remote: name, Month: month, Currency: costsCurrency(), Stored: StoredBytes(name),
+			Uploaded: used.Uploaded, Downloaded: used.Downloaded, UploadedFiles: used.UploadedFiles, DownloadedFiles: used.DownloadedFiles,
+		}
+		estimate.Storage = float64(estimate.Stored) / bytesPerGB * p.Storage
+		estimate.Egress = float64(used.Downloaded) / bytesPerGB * p.Egress
+		estimate.Ingress = float64(used.Uploaded) / bytesPerGB * p.Ingress
+		estimate.Operations = float64(used.UploadedFiles)/1000*p.Uploads + float64(used.DownloadedFiles)/1000*p.Downloads
+		transfers := estimate.Egress + estimate.Ingress + estimate.Operations
+		estimate.Total = estimate.Storage + transfers
+		if fraction > 0 {
+			estimate.Projected = estimate.Storage + transfers/fraction
+		}
+		estimates = append(estimates, estimate)
+	}
+	sort.Slice(estimates, func(i, j int) bool { return estimates[i].Total > estimates[j].Total })
+	return estimates
+}
+
+// formatCost formats an amount of money with its currency
+func formatCost(amount float64, currency string) string {
+	return fmt.Sprintf("%.2f %s", amount, currency)
+}
+
+// ReportCosts sends the estimated costs of the last month to the notifiers
+func ReportCosts() {
+	now := time.Now()
+	month := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local).Format("2006-01")
+	estimates := EstimateCosts(month)
+	if len(estimates) == 0 {
+		return
+	}
+	var lines []string
+	total := 0.0
+	for _, estimate := range estimates {
+		total += estimate.Total
+		lines = append(lines, fmt.Sprintf("%s %s: storage %s (%s), egress %s (%s), operations %s",
+			estimate.Remote, formatCost(estimate.Total, estimate.Currency),
+			formatCost(estimate.Storage, estimate.Currency), FormatBytes(estimate.Stored),
+			formatCost(estimate.Egress, estimate.Currency), FormatBytes(estimate.Downloaded),
+			formatCost(estimate.Operations, estimate.Currency)))
+	}
+	name := "estimated costs of " + month
+	message := "About " + formatCost(total, costsCurrency()) + " in total.\n" + strings.Join(lines, "\n")
+	Infoln(name+":", formatCost(total, costsCurrency()))
+	if len(config.Costs.Notifiers) == 0 {
+		Notify("costs", "Rclone Backup: "+name, message)
+		return
+	}
+	if config.NoNotifications {
+		return
+	}
+	result := RunResult{Name: name, Detail: message, Start: now, End: now}
+	SendNotification(config.Costs.Notifiers, DefaultCostsTitle, DefaultCostsMessage, result)
+}
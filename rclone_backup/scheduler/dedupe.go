@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultDedupeSchedule = "0 3 * * 0"
+
+var DedupePath = filepath.Join(DataPath, "dedupe.json")
+
+// DedupeModes are the rclone dedupe modes that can resolve a group of duplicates
+var DedupeModes = []string{"newest", "oldest", "largest", "smallest", "first", "rename"}
+
+type DedupeConfig struct {
+	Enabled  bool
+	Schedule string
+	Paths    []string // remote folders to check, defaults to the destinations of jobs
+}
+
+// DuplicateFile is one copy of a duplicated file
+type DuplicateFile struct {
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// DuplicateGroup are files with the same name in the same folder
+type DuplicateGroup struct {
+	Name   string          `json:"name"`
+	Files  []DuplicateFile `json:"files"`
+	Wasted int64           `json:"wasted"` // bytes used by all but the largest copy
+}
+
+// DedupeReport are the duplicates found in a remote folder
+type DedupeReport struct {
+	Path    string           `json:"path"`
+	Checked time.Time        `json:"checked"`
+	Wasted  int64            `json:"wasted"`
+	Error   string           `json:"error,omitempty"`
+	Groups  []DuplicateGroup `json:"groups"`
+}
+
+type Dedupe struct {
+	mu       sync.Mutex
+	checking sync.Mutex
+	reports  []DedupeReport
+}
+
+var dedupe = &Dedupe{}
+
+var (
+	// "dir/file.tar: 2 duplicates"
+	duplicateGroupPattern = regexp.MustCompile(`^(.+): (\d+) duplicates`)
+	// "  1:      6048320 bytes, 2016-03-05 16:18:31.000000000, md5 1eedaa9fe86fd4b8632e2ac549403b36"
+	duplicateFilePattern = regexp.MustCompile(`^\s*\d+:\s+(-?\d+) bytes, (\S+ [^,\s]+)(?:, \S+ (\S*))?`)
+)
+
+// Load reads the last reports from disk
+func (d *Dedupe) Load() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := os.ReadFile(DedupePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.reports)
+}
+
+// Reports returns the duplicates found in each folder
+func (d *Dedupe) Reports() []DedupeReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DedupeReport{}, d.reports...)
+}
+
+// Refresh checks every folder for duplicates, only one check runs at a time
+func (d *Dedupe) Refresh() {
+	if !d.checking.TryLock() {
+		Debugln("duplicates are already being checked")
+		return
+	}
+	defer d.checking.Unlock()
+	paths := config.Dedupe.Paths
+	if len(paths) == 0 {
+		paths, _ = CatalogPaths()
+	}
+	reports := make([]DedupeReport, 0, len(paths))
+	for _, path := range paths {
+		report := FindDuplicates(path)
+		if report.Error != "" {
+			Warnln("failed to check", HighlightRemote(path), "for duplicates:", report.Error)
+		} else if len(report.Groups) > 0 {
+			Warnln("found", len(report.Groups), "duplicated files in", HighlightRemote(path), "wasting", FormatBytes(report.Wasted))
+		}
+		reports = append(reports, report)
+	}
+	d.mu.Lock()
+	d.reports = reports
+	d.mu.Unlock()
+	d.save()
+}
+
+// Resolve removes the duplicates of a file using the given rclone dedupe mode
+func (d *Dedupe) Resolve(folder string, name string, mode string) error {
+	if !ArrayContains(DedupeModes, mode) {
+		return errors.New("unknown dedupe mode \"" + mode + "\"")
+	}
+	d.mu.Lock()
+	found := false
+	for _, report := range d.reports {
+		if report.Path != folder {
+			continue
+		}
+		for _, group := range report.Groups {
+			found = found || group.Name == name
+		}
+	}
+	d.mu.Unlock()
+	if !found {
+		return errors.New("no duplicates of \"" + name + "\" in " + folder)
+	}
+
+	// only dedupe the one file, in its own folder
+	dir, file := path.Split(name)
+	target := strings.TrimSuffix(folder, "/")
+	if dir != "" {
+		if !strings.HasSuffix(target, ":") {
+			target += "/"
+		}
+		target += strings.TrimSuffix(dir, "/")
+	}
+	args := []string{"dedupe", "--dedupe-mode", mode, "--max-depth", "1", "--include", "/" + EscapeFilterGlob(file), target}
+	if config.DryRun {
+		args = append(args, "--dry-run")
+	}
+	Infoln("resolving duplicates of", name, "in", HighlightRemote(folder), "keeping", mode)
+	out, err := exec.Command(RcloneBinary(), args...).CombinedOutput()
+	if err != nil {
+		return NewRcloneError(strings.TrimSpace(string(out)), nil)
+	}
+	if config.DryRun {
+		return nil
+	}
+
+	d.mu.Lock()
+	for i, report := range d.reports {
+		if report.Path != folder {
+			continue
+		}
+		groups := make([]DuplicateGroup, 0, len(report.Groups))
+		for _, group := range report.Groups {
+			if group.Name == name {
+				d.reports[i].Wasted -= group.Wasted
+				continue
+			}
+			groups = append(groups, group)
+		}
+		d.reports[i].Groups = groups
+	}
+	d.mu.Unlock()
+	d.save()
+	return nil
+}
+
+func (d *Dedupe) save() {
+	d.mu.Lock()
+	data, err := json.Marshal(d.reports)
+	d.mu.Unlock()
+	if err == nil {
+		err = os.WriteFile(DedupePath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save duplicates report:", err)
+	}
+}
+
+// FindDuplicates lists the files with duplicate names using rclone dedupe in list mode, which changes nothing
+func FindDuplicates(path string) DedupeReport {
+	report := DedupeReport{Path: path, Checked: time.Now(), Groups: []DuplicateGroup{}}
+	out, err := exec.Command(RcloneBinary(), "dedupe", "--dedupe-mode", "list", path).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		report.Error = err.Error()
+		return report
+	}
+	report.Groups = ParseDuplicates(out)
+	for _, group := range report.Groups {
+		report.Wasted += group.Wasted
+	}
+	return report
+}
+
+// ParseDuplicates reads the groups printed by rclone dedupe in list mode
+func ParseDuplicates(out []byte) []DuplicateGroup {
+	groups := []DuplicateGroup{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := duplicateFilePattern.FindStringSubmatch(line); match != nil && len(groups) > 0 {
+			size, _ := strconv.ParseInt(match[1], 10, 64)
+			group := &groups[len(groups)-1]
+			group.Files = append(group.Files, DuplicateFile{Size: size, Modified: match[2], Hash: match[3]})
+			continue
+		}
+		if match := duplicateGroupPattern.FindStringSubmatch(line); match != nil {
+			groups = append(groups, DuplicateGroup{Name: match[1]})
+		}
+	}
+	for i := range groups {
+		var total, largest int64
+		for _, file := range groups[i].Files {
+			total += file.Size
+			largest = max(largest, file.Size)
+		}
+		groups[i].Wasted = total - largest
+	}
+	return groups
+}
+
+// EscapeFilterGlob escapes the characters rclone's filter patterns treat as special
+func EscapeFilterGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]{}\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
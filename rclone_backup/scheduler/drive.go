@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// driveQuotaReset is how long Google Drive blocks uploads of an account after its daily upload limit was hit
+const driveQuotaReset = 24 * time.Hour
+
+var DriveAccountsPath = filepath.Join(DataPath, "drive_accounts.json")
+
+// driveUploadLimit are the errors Google Drive returns once the 750 GB a day an account can upload is used up
+var driveUploadLimit = []string{"user rate limit exceeded", "userratelimitexceeded", "uploadlimitexceeded"}
+
+// DriveConfig sets the shared drive of a Google Drive remote and the service accounts uploads are rotated between
+type DriveConfig struct {
+	SharedDrive     string `yaml:"shared_drive"`     // id of the shared drive, the team_drive backend option
+	ServiceAccounts string `yaml:"service_accounts"` // folder of service account json files
+}
+
+// DriveAccount is the service account a Google Drive remote currently uploads with
+type DriveAccount struct {
+	Remote    string               `json:"remote"`
+	File      string               `json:"file"`
+	Accounts  int                  `json:"accounts"`
+	Exhausted map[string]time.Time `json:"exhausted"` // when each account hit the upload limit
+}
+
+type driveAccountState struct {
+	File      string               `json:"file"`
+	Exhausted map[string]time.Time `json:"exhausted,omitempty"`
+}
+
+// DriveAccounts remembers the service account of each remote and the accounts that hit the upload limit, so a
+// rotation survives restarts
+type DriveAccounts struct {
+	mu      sync.Mutex
+	remotes map[string]*driveAccountState
+}
+
+var driveAccounts = &DriveAccounts{remotes: make(map[string]*driveAccountState)}
+
+// serviceAccountFiles returns the service account json files in a folder, sorted by name
+func serviceAccountFiles(dir string) []string {
+	if dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	return files
+}
+
+func checkDriveConfig(remote RemoteConfig) error {
+	name := remoteName(remote.Name)
+	if remote.Drive.ServiceAccounts == "" {
+		return nil
+	}
+	if _, err := os.Stat(remote.Drive.ServiceAccounts); err != nil {
+		return fmt.Errorf("remotes: '%s' service_accounts folder '%s' doesn't exist", name, remote.Drive.ServiceAccounts)
+	}
+	if len(serviceAccountFiles(remote.Drive.ServiceAccounts)) == 0 {
+		return fmt.Errorf("remotes: '%s' service_accounts folder '%s' contains no json files", name, remote.Drive.ServiceAccounts)
+	}
+	return nil
+}
+
+// Load reads the service accounts in use from disk
+func (d *DriveAccounts) Load() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := os.ReadFile(DriveAccountsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.remotes)
+}
+
+func (d *DriveAccounts) save() {
+	data, err := json.Marshal(d.remotes)
+	if err == nil {
+		err = os.WriteFile(DriveAccountsPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save drive service accounts:", err)
+	}
+}
+
+// state returns the rotation of a remote, forgetting accounts whose upload limit has reset
+func (d *DriveAccounts) state(remote string) *driveAccountState {
+	state := d.remotes[remote]
+	if state == nil {
+		state = &driveAccountState{}
+		d.remotes[remote] = state
+	}
+	for file, at := range state.Exhausted {
+		if time.Since(at) >= driveQuotaReset {
+			delete(state.Exhausted, file)
+		}
+	}
+	return state
+}
+
+// Current returns the service account file a remote uploads with, the first one until a rotation
+func (d *DriveAccounts) Current(remote string, dir string) string {
+	files := serviceAccountFiles(dir)
+	if len(files) == 0 {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := d.state(remote)
+	if !ArrayContains(files, state.File) {
+		state.File = files[0]
+	}
+	return state.File
+}
+
+// Rotate marks the current service account of a remote as exhausted and switches to the next one that isn't,
+// returning false when every account hit the upload limit today
+func (d *DriveAccounts) Rotate(remote string, dir string) (string, bool) {
+	files := serviceAccountFiles(dir)
+	if len(files) == 0 {
+		return "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := d.state(remote)
+	if state.Exhausted == nil {
+		state.Exhausted = make(map[string]time.Time)
+	}
+	current := state.File
+	if !ArrayContains(files, current) {
+		current = files[0]
+	}
+	state.Exhausted[current] = time.Now()
+	defer d.save()
+	start := slices.Index(files, current)
+	for i := 1; i < len(files); i++ {
+		next := files[(start+i)%len(files)]
+		if _, exhausted := state.Exhausted[next]; !exhausted {
+			state.File = next
+			return next, true
+		}
+	}
+	return "", false
+}
+
+// List returns the service account in use by each remote with service accounts
+func (d *DriveAccounts) List() []DriveAccount {
+	var list []DriveAccount
+	for _, remote := range config.Remotes {
+		if remote.Drive.ServiceAccounts == "" {
+			continue
+		}
+		name := remoteName(remote.Name)
+		account := DriveAccount{Remote: name, File: d.Current(name, remote.Drive.ServiceAccounts), Accounts: len(serviceAccountFiles(remote.Drive.ServiceAccounts))}
+		d.mu.Lock()
+		account.Exhausted = make(map[string]time.Time)
+		for file, at := range d.state(name).Exhausted {
+			account.Exhausted[file] = at
+		}
+		d.mu.Unlock()
+		list = append(list, account)
+	}
+	return list
+}
+
+// driveBackendOptions returns the backend options selecting the shared drive and service account of a remote
+func driveBackendOptions(r *RemoteConfig, options map[string]string) {
+	if r.Drive.SharedDrive != "" {
+		options["team_drive"] = r.Drive.SharedDrive
+	}
+	if file := driveAccounts.Current(remoteName(r.Name), r.Drive.ServiceAccounts); file != "" {
+		options["service_account_file"] = file
+		// fail straight away instead of retrying for hours once the daily upload limit is hit
+		options["stop_on_upload_limit"] = "true"
+	}
+}
+
+// IsDriveUploadLimit reports whether a failure is Google Drive's daily upload limit
+func IsDriveUploadLimit(err error) bool {
+	if err == nil {
+		return false
+	}
+	text := strings.ToLower(err.Error())
+	for _, pattern := range driveUploadLimit {
+		if strings.Contains(text, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateOnUploadLimit switches the destination's remote to its next service account after a run failed on the
+// daily upload limit, reporting whether the run should be resumed under it
+func RotateOnUploadLimit(job JobConfig, destination string, err error) bool {
+	if !IsDriveUploadLimit(err) || IsDryRun(job) {
+		return false
+	}
+	remote := RemoteConfigOf(destination)
+	if remote == nil || remote.Drive.ServiceAccounts == "" {
+		return false
+	}
+	name := remoteName(remote.Name)
+	next, ok := driveAccounts.Rotate(name, remote.Drive.ServiceAccounts)
+	if !ok {
+		Errorln("every service account of", name, "hit the daily upload limit")
+		return false
+	}
+	Warnln("the upload limit of", name, "was hit, resuming under service account", filepath.Base(next))
+	statuses.AddWarning(job.Index, "upload limit of "+name+" hit, rotated to "+filepath.Base(next))
+	return true
+}
+
+// SharedDrive is a shared drive a Google Drive remote can access
+type SharedDrive struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ListSharedDrives returns the shared drives a Google Drive remote can access
+func ListSharedDrives(ctx context.Context, remote string) ([]SharedDrive, error) {
+	out, err := exec.CommandContext(ctx, RcloneBinary(), "backend", "drives", ApplyRemoteOptions(remoteName(remote))).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to list shared drives of %s: %s", remote, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("failed to list shared drives of %s: %w", remote, err)
+	}
+	var drives []SharedDrive
+	if err := json.Unmarshal(out, &drives); err != nil {
+		return nil, fmt.Errorf("failed to list shared drives of %s: %w", remote, err)
+	}
+	return drives, nil
+}
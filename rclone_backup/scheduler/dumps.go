@@ -0,0 +1,317 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DumpMariaDB   = "mariadb"
+	DumpPostgres  = "postgres"
+	DumpInfluxDB  = "influxdb"  // InfluxDB 1.x, e.g. the InfluxDB addon
+	DumpInfluxDB2 = "influxdb2" // InfluxDB 2.x
+	DumpSQLite    = "sqlite"    // e.g. the default recorder database
+)
+
+const DefaultDumpPath = "/share/dumps"
+
+const DefaultDumpKeep = 3
+
+// DefaultSQLiteDatabase is the recorder database of Home Assistant
+const DefaultSQLiteDatabase = "/homeassistant/home-assistant_v2.db"
+
+// dumpDefaults are the hostnames and ports of the official addons
+var dumpDefaults = map[string]struct {
+	host string
+	port int
+}{
+	DumpMariaDB:   {"core-mariadb", 3306},
+	DumpPostgres:  {"localhost", 5432},
+	DumpInfluxDB:  {"a0d7b954-influxdb", 8088},
+	DumpInfluxDB2: {"localhost", 8086},
+}
+
+// dumpBinaries are the clients used to create each type of dump
+var dumpBinaries = map[string]string{
+	DumpMariaDB:   "mysqldump",
+	DumpPostgres:  "pg_dump",
+	DumpInfluxDB:  "influxd",
+	DumpInfluxDB2: "influx",
+	DumpSQLite:    "sqlite3",
+}
+
+// DumpConfig is a database dump made before the job uploads its sources
+type DumpConfig struct {
+	Name      string
+	Type      string
+	Host      string
+	Port      int
+	User      string
+	Password  string
+	Token     string   // InfluxDB 2.x api token
+	Databases []string // database names, or the file of a sqlite database
+	Path      string   // folder the dumps are written to, should be one of the sources
+	Keep      int      // number of dumps kept in the folder
+}
+
+// DumpName returns the name of the dump used in logs and file names
+func DumpName(dump DumpConfig) string {
+	if dump.Name != "" {
+		return dump.Name
+	}
+	if dump.Type == DumpSQLite {
+		file := filepath.Base(SQLiteDatabase(dump))
+		return strings.TrimSuffix(file, filepath.Ext(file))
+	}
+	if len(dump.Databases) > 0 {
+		return dump.Type + "-" + strings.Join(dump.Databases, "-")
+	}
+	return dump.Type
+}
+
+// CheckDumps validates the database dumps of a job
+func CheckDumps(job JobConfig) ([]string, error) {
+	var warnings []string
+	for _, dump := range job.Dumps {
+		binary, ok := dumpBinaries[dump.Type]
+		if !ok {
+			return nil, fmt.Errorf("dump '%s': type must be mariadb, postgres, influxdb, influxdb2 or sqlite", DumpName(dump))
+		}
+		if _, err := exec.LookPath(binary); err != nil {
+			if dump.Type == DumpInfluxDB2 {
+				return nil, fmt.Errorf("dump '%s': influx is not installed, it is only available on 64-bit systems", DumpName(dump))
+			}
+			return nil, fmt.Errorf("dump '%s': %s is not installed", DumpName(dump), binary)
+		}
+		if (dump.Type == DumpPostgres || dump.Type == DumpSQLite) && len(dump.Databases) > 1 {
+			return nil, fmt.Errorf("dump '%s': %s dumps a single database, add a dump for each database", DumpName(dump), dump.Type)
+		}
+		if dump.Type == DumpSQLite {
+			if _, err := os.Stat(SQLiteDatabase(dump)); err != nil {
+				return nil, fmt.Errorf("dump '%s': %w", DumpName(dump), err)
+			}
+		}
+		path := dump.Path
+		if path == "" {
+			path = DefaultDumpPath
+		}
+		inSource := false
+		for _, source := range job.Sources {
+			inSource = inSource || strings.HasPrefix(filepath.Clean(path)+"/", filepath.Clean(source)+"/")
+		}
+		if !inSource && len(job.Steps) == 0 {
+			warnings = append(warnings, fmt.Sprintf("dump '%s' is written to %s which is not part of any source", DumpName(dump), path))
+		}
+	}
+	return warnings, nil
+}
+
+// RunDumps creates every database dump of the job, stopping at the first failure
+func RunDumps(ctx context.Context, job JobConfig) error {
+	for _, dump := range job.Dumps {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		start := time.Now()
+		Infoln("dumping", DumpName(dump))
+		file, err := RunDump(ctx, dump, start)
+		if err != nil {
+			msg := fmt.Sprintf("failed to dump %s, aborting upload: %s", DumpName(dump), err)
+			Errorln(msg)
+			FireJobEvent(EventJobFailed, job, "", dump.Path, start, msg)
+			return errors.New(msg)
+		}
+		if stat, err := os.Stat(file); err == nil {
+			Infoln("dumped", DumpName(dump), "to", file, "("+FormatBytes(stat.Size())+")", "in", boldCyan(FormatDuration(time.Since(start))))
+		}
+		PruneDumps(dump)
+	}
+	return nil
+}
+
+// RunDump writes a single dump, returning the file or folder it was written to
+func RunDump(ctx context.Context, dump DumpConfig, now time.Time) (string, error) {
+	folder := dump.Path
+	if folder == "" {
+		folder = DefaultDumpPath
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return "", err
+	}
+	host, port := dump.Host, dump.Port
+	if host == "" {
+		host = dumpDefaults[dump.Type].host
+	}
+	if port == 0 {
+		port = dumpDefaults[dump.Type].port
+	}
+	base := filepath.Join(folder, DumpName(dump)+"_"+now.Format(DefaultDateLayout))
+
+	switch dump.Type {
+	case DumpMariaDB:
+		args := []string{"--host", host, "--port", strconv.Itoa(port), "--single-transaction", "--routines", "--events", "--triggers"}
+		if dump.User != "" {
+			args = append(args, "--user", dump.User)
+		}
+		if len(dump.Databases) > 0 {
+			args = append(args, "--databases")
+			args = append(args, dump.Databases...)
+		} else {
+			args = append(args, "--all-databases")
+		}
+		cmd := exec.CommandContext(ctx, "mysqldump", args...)
+		cmd.Env = append(os.Environ(), "MYSQL_PWD="+dump.Password)
+		return base + ".sql.gz", dumpToGzip(cmd, base+".sql.gz")
+	case DumpPostgres:
+		args := []string{"--host", host, "--port", strconv.Itoa(port), "--no-password", "--clean", "--if-exists"}
+		if dump.User != "" {
+			args = append(args, "--username", dump.User)
+		}
+		if len(dump.Databases) > 0 {
+			args = append(args, dump.Databases[0])
+		}
+		cmd := exec.CommandContext(ctx, "pg_dump", args...)
+		cmd.Env = append(os.Environ(), "PGPASSWORD="+dump.Password)
+		return base + ".sql.gz", dumpToGzip(cmd, base+".sql.gz")
+	case DumpInfluxDB:
+		// portable backups are consistent snapshots taken by the server
+		args := []string{"backup", "-portable", "-host", host + ":" + strconv.Itoa(port)}
+		for _, database := range dump.Databases {
+			args = append(args, "-db", database)
+		}
+		return base, runDumpCommand(exec.CommandContext(ctx, "influxd", append(args, base)...), base)
+	case DumpInfluxDB2:
+		args := []string{"backup", base, "--host", "http://" + host + ":" + strconv.Itoa(port)}
+		for _, database := range dump.Databases {
+			args = append(args, "--bucket", database)
+		}
+		cmd := exec.CommandContext(ctx, "influx", args...)
+		cmd.Env = append(os.Environ(), "INFLUX_TOKEN="+dump.Token)
+		return base, runDumpCommand(cmd, base)
+	case DumpSQLite:
+		// the backup api copies a consistent snapshot, even while the database is written to
+		file := base + ".db"
+		quoted := "'" + strings.ReplaceAll(file, "'", "''") + "'"
+		cmd := exec.CommandContext(ctx, "sqlite3", "-bail", "-cmd", ".timeout 30000", SQLiteDatabase(dump), ".backup "+quoted)
+		if err := runDumpCommand(cmd, file); err != nil {
+			return "", err
+		}
+		// the copy is a single file without a write-ahead log, so it can be restored as is
+		out, err := exec.CommandContext(ctx, "sqlite3", "-bail", file, "PRAGMA journal_mode=DELETE", "PRAGMA quick_check").CombinedOutput()
+		if result := strings.TrimSpace(string(out)); err != nil || !strings.HasSuffix(result, "ok") {
+			os.Remove(file)
+			return "", fmt.Errorf("snapshot failed integrity check: %s", result)
+		}
+		return file, nil
+	}
+	return "", fmt.Errorf("unknown dump type '%s'", dump.Type)
+}
+
+// SQLiteDatabase returns the database file of a sqlite dump
+func SQLiteDatabase(dump DumpConfig) string {
+	if len(dump.Databases) > 0 {
+		return dump.Databases[0]
+	}
+	return DefaultSQLiteDatabase
+}
+
+// ExcludeDumpedDatabases excludes the live files of sqlite databases that are dumped from the job's sources,
+// the snapshot is uploaded instead
+func ExcludeDumpedDatabases(job JobConfig) JobConfig {
+	if len(job.Include) > 0 {
+		return job
+	}
+	for _, dump := range job.Dumps {
+		if dump.Type != DumpSQLite {
+			continue
+		}
+		database := filepath.Clean(SQLiteDatabase(dump))
+		for _, source := range job.Sources {
+			rel, err := filepath.Rel(filepath.Clean(source), database)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			pattern := "/" + EscapeFilterGlob(rel) + "*"
+			if !slices.Contains(job.Exclude, pattern) {
+				job.Exclude = append(append([]string{}, job.Exclude...), pattern)
+			}
+		}
+	}
+	return job
+}
+
+// dumpToGzip writes the output of the dump command to a gzip file, removing it when the dump fails
+func dumpToGzip(cmd *exec.Cmd, file string) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	var stderr tailWriter
+	cmd.Stdout = gz
+	cmd.Stderr = io.MultiWriter(os.Stdout, &stderr)
+	err = cmd.Run()
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+		if len(stderr.lines) > 0 {
+			return fmt.Errorf("%w: %s", err, stderr.lines[len(stderr.lines)-1])
+		}
+	}
+	return err
+}
+
+// runDumpCommand runs a dump command that writes its own files, removing them when the dump fails
+func runDumpCommand(cmd *exec.Cmd, path string) error {
+	var stderr tailWriter
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stdout, &stderr)
+	err := cmd.Run()
+	if err != nil {
+		os.RemoveAll(path)
+		if len(stderr.lines) > 0 {
+			return fmt.Errorf("%w: %s", err, stderr.lines[len(stderr.lines)-1])
+		}
+	}
+	return err
+}
+
+// PruneDumps removes the oldest dumps so only the configured number are kept
+func PruneDumps(dump DumpConfig) {
+	keep := dump.Keep
+	if keep <= 0 {
+		keep = DefaultDumpKeep
+	}
+	folder := dump.Path
+	if folder == "" {
+		folder = DefaultDumpPath
+	}
+	matches, err := filepath.Glob(filepath.Join(folder, DumpName(dump)+"_*"))
+	if err != nil || len(matches) <= keep {
+		return
+	}
+	// names end with the time of the dump, so they sort oldest first
+	sort.Strings(matches)
+	for _, file := range matches[:len(matches)-keep] {
+		Debugln("removing old dump", file)
+		if err := os.RemoveAll(file); err != nil {
+			Warnln("failed to remove old dump", file+":", err)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"time"
@@ -11,6 +13,10 @@ import (
 const (
 	EventJobSuccessful = "rclone_backup.job_successful"
 	EventJobFailed     = "rclone_backup.job_failed"
+	EventQuotaExceeded = "rclone_backup.quota_exceeded"
+	EventSizeAnomaly   = "rclone_backup.size_anomaly"
+	EventJobOverdue    = "rclone_backup.job_overdue"
+	EventSLABreached   = "rclone_backup.sla_breached"
 )
 
 type EventData struct {
@@ -19,41 +25,163 @@ type EventData struct {
 	Source      string  `json:"source"`
 	Destination string  `json:"destination,omitempty"`
 	Error       string  `json:"error,omitempty"`
+	ErrorClass  string  `json:"error_class,omitempty"`
+	Trigger     string  `json:"trigger,omitempty"`
+	Note        string  `json:"note,omitempty"`
 	Duration    string  `json:"duration"`
 	Seconds     float64 `json:"seconds"`
 }
 
-func FireEvent(type_ string, data EventData) {
-	if config.NoEvents {
+func FireEvent(type_ string, data interface{}) {
+	if config.NoEvents || !HasSupervisor() {
 		return
 	}
-
-	body, err := json.Marshal(data)
+	err := CoreAPIRequest(http.MethodPost, "/events/"+type_, data)
 	if err != nil {
-		Errorln("failed to marshal event data:", err)
-		return
+		Errorln("failed to fire event:", err)
 	}
+}
 
-	req, err := http.NewRequest("POST", "http://supervisor/core/api/events/"+type_, bytes.NewReader(body))
+// CoreAPIRequest sends a request to the Home Assistant Core API through the Supervisor
+func CoreAPIRequest(method string, path string, data interface{}) error {
+	return coreAPI(method, path, data, nil)
+}
+
+// CoreAPIGet reads a response of the Home Assistant Core API into out
+func CoreAPIGet(path string, out interface{}) error {
+	return coreAPI(http.MethodGet, path, nil, out)
+}
+
+// coreClient gives up on Home Assistant when it doesn't answer, e.g. while it restarts, so notify services,
+// events and sensors don't hold up the end of a run
+var coreClient = &http.Client{Timeout: 30 * time.Second}
+
+func coreAPI(method string, path string, data interface{}, out interface{}) error {
+	if !HasSupervisor() {
+		return ErrNoSupervisor
+	}
+	var body []byte
+	var err error
+	if data != nil {
+		if body, err = json.Marshal(data); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://supervisor/core/api"+path, bytes.NewReader(body))
 	if err != nil {
-		Errorln("failed to create event request:", err)
-		return
+		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+os.Getenv("SUPERVISOR_TOKEN"))
 
+	resp, err := coreClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// HasSupervisor reports whether the addon can reach the Supervisor API
+func HasSupervisor() bool {
+	return os.Getenv("SUPERVISOR_TOKEN") != ""
+}
+
+// SupervisorGet reads the data of a Supervisor API response into out
+func SupervisorGet(path string, out interface{}) error {
+	return supervisorAPI(http.MethodGet, path, nil, out)
+}
+
+// SupervisorPost sends data to the Supervisor API and reads the data of the response into out, if not nil
+func SupervisorPost(path string, data interface{}, out interface{}) error {
+	return supervisorAPI(http.MethodPost, path, data, out)
+}
+
+func supervisorAPI(method string, path string, data interface{}, out interface{}) error {
+	if !HasSupervisor() {
+		return ErrNoSupervisor
+	}
+	var body io.Reader
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, "http://supervisor"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("SUPERVISOR_TOKEN"))
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		Errorln("failed to fire event:", err)
-		return
+		return err
 	}
 
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		Errorln("bad status code when firing event:", resp.StatusCode)
+	var result struct {
+		Result  string          `json:"result"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		// errors of the supervisor explain what was wrong with the request
+		if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Message != "" {
+			return fmt.Errorf("supervisor returned status %d: %s", resp.StatusCode, result.Message)
+		}
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Result != "ok" {
+		return fmt.Errorf("supervisor returned '%s'", result.Result)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+// Notify creates a persistent notification in Home Assistant, standalone it is only logged
+func Notify(id string, title string, message string) {
+	if config.NoNotifications {
 		return
 	}
+	if !HasSupervisor() {
+		Infoln(title+":", message)
+		return
+	}
+	err := CoreAPIRequest(http.MethodPost, "/services/persistent_notification/create", map[string]string{
+		"notification_id": "rclone_backup_" + id,
+		"title":           title,
+		"message":         message,
+	})
+	if err != nil {
+		Errorln("failed to send notification:", err)
+	}
+}
+
+// SetSensorState creates or updates a sensor entity in Home Assistant
+func SetSensorState(entityID string, state string, attributes map[string]interface{}) error {
+	return CoreAPIRequest(http.MethodPost, "/states/"+entityID, map[string]interface{}{
+		"state":      state,
+		"attributes": attributes,
+	})
 }
 
 func FireJobEvent(type_ string, job JobConfig, source string, destination string, start time.Time, msg string) {
@@ -63,6 +191,9 @@ func FireJobEvent(type_ string, job JobConfig, source string, destination string
 		Source:      source,
 		Destination: destination,
 		Error:       msg,
+		ErrorClass:  ClassifyError(msg),
+		Trigger:     job.Trigger,
+		Note:        job.Note,
 		Duration:    FormatDuration(time.Since(start)),
 		Seconds:     time.Since(start).Seconds(),
 	}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosimple/slug"
+)
+
+// freshnessInterval is how often the age of the last successful run of each job is checked
+const freshnessInterval = time.Minute
+
+const (
+	DefaultSLATitle      = "Rclone Backup: {{.Name}} is out of date"
+	DefaultSLAMessage    = "{{.Name}} has not succeeded in {{.Duration}}{{if .Error}}, last error: {{.Error}}{{end}}"
+	DefaultSLAEscalation = "{{.Name}} has still not succeeded in {{.Duration}}{{if .Error}}, last error: {{.Error}}{{end}}"
+)
+
+var FreshnessPath = filepath.Join(DataPath, "freshness.json")
+
+// SLABreach is a job whose last successful run is older than its max_age
+type SLABreach struct {
+	Job         int        `json:"job"`
+	Name        string     `json:"name"`
+	Since       time.Time  `json:"since"`                  // when the breach was detected
+	LastSuccess *time.Time `json:"last_success,omitempty"` // nil when the job never succeeded
+	Escalated   bool       `json:"escalated,omitempty"`    // the job has been out of date for twice its max_age
+}
+
+type SLAEventData struct {
+	Name        string     `json:"name"`
+	MaxAge      string     `json:"max_age"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Escalated   bool       `json:"escalated,omitempty"`
+}
+
+// FreshnessMonitor flags jobs that have not succeeded within their max_age, e.g. because they are never scheduled
+type FreshnessMonitor struct {
+	mu       sync.Mutex
+	started  time.Time
+	breaches map[int]*SLABreach
+}
+
+var freshness = &FreshnessMonitor{started: time.Now(), breaches: make(map[int]*SLABreach)}
+
+// CheckMaxAge validates the max_age option of a job
+func CheckMaxAge(job JobConfig) error {
+	if job.MaxAge == "" {
+		return nil
+	}
+	if age, err := ParseAge(job.MaxAge); err != nil || age <= 0 {
+		return fmt.Errorf("invalid max_age '%s'", job.MaxAge)
+	}
+	return nil
+}
+
+// Load reads the breaches recorded before a restart, so they are not alerted again
+func (f *FreshnessMonitor) Load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := os.ReadFile(FreshnessPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var breaches []SLABreach
+	if err := json.Unmarshal(data, &breaches); err != nil {
+		return err
+	}
+	for _, breach := range breaches {
+		if breach.Job < len(config.Jobs) && config.Jobs[breach.Job].MaxAge != "" {
+			f.breaches[breach.Job] = &breach
+		}
+	}
+	return nil
+}
+
+func (f *FreshnessMonitor) save() {
+	breaches := make([]SLABreach, 0, len(f.breaches))
+	for _, breach := range f.breaches {
+		breaches = append(breaches, *breach)
+	}
+	data, err := json.Marshal(breaches)
+	if err == nil {
+		err = os.WriteFile(FreshnessPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save sla breaches:", err)
+	}
+}
+
+// Start checks the freshness of every job with a max_age in a goroutine
+func (f *FreshnessMonitor) Start() {
+	for _, job := range config.Jobs {
+		if job.MaxAge != "" {
+			PublishSLASensor(job, f.Breach(job.Index))
+		}
+	}
+	go func() {
+		f.check(time.Now())
+		ticker := time.NewTicker(freshnessInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			f.check(now)
+		}
+	}()
+}
+
+// lastSuccess returns the end of the last successful run of a job
+func lastSuccess(index int) *time.Time {
+	for _, run := range history.Runs(index) {
+		if IsSuccess(run.State) {
+			end := run.End
+			return &end
+		}
+	}
+	return nil
+}
+
+func (f *FreshnessMonitor) check(now time.Time) {
+	for _, job := range config.Jobs {
+		maxAge, err := ParseAge(job.MaxAge)
+		if job.MaxAge == "" || err != nil {
+			continue
+		}
+		last := lastSuccess(job.Index)
+		// jobs that never succeeded are measured from when the addon started
+		since := f.started
+		if last != nil {
+			since = *last
+		}
+		age := now.Sub(since)
+
+		f.mu.Lock()
+		breach := f.breaches[job.Index]
+		switch {
+		case age <= maxAge && breach != nil:
+			delete(f.breaches, job.Index)
+			f.save()
+			f.mu.Unlock()
+			Infoln("job", "'"+job.Name+"'", "is up to date again")
+			PublishSLASensor(job, nil)
+		case age > maxAge && breach == nil:
+			breach = &SLABreach{Job: job.Index, Name: job.Name, Since: now, LastSuccess: last}
+			f.breaches[job.Index] = breach
+			f.save()
+			f.mu.Unlock()
+			f.alert(job, *breach, age, false)
+		case breach != nil && !breach.Escalated && age > 2*maxAge:
+			breach.Escalated = true
+			f.save()
+			f.mu.Unlock()
+			f.alert(job, *breach, age, true)
+		default:
+			f.mu.Unlock()
+		}
+	}
+}
+
+// alert notifies about a breach once, and once more when it is escalated
+func (f *FreshnessMonitor) alert(job JobConfig, breach SLABreach, age time.Duration, escalated bool) {
+	name := JobName(job)
+	if breach.LastSuccess == nil {
+		Warnln("job", "'"+name+"'", "has not succeeded since the addon started", FormatDuration(age), "ago, max_age is", job.MaxAge)
+	} else {
+		Warnln("job", "'"+name+"'", "last succeeded", FormatDuration(age), "ago, max_age is", job.MaxAge)
+	}
+	PublishSLASensor(job, &breach)
+	FireEvent(EventSLABreached, SLAEventData{Name: job.Name, MaxAge: job.MaxAge, LastSuccess: breach.LastSuccess, Escalated: escalated})
+	if config.NoNotifications {
+		return
+	}
+	status := statuses.Get(job.Index)
+	result := RunResult{Name: name, Index: job.Index, State: status.State, Error: status.LastError, ErrorClass: status.ErrorClass, Duration: FormatDuration(age)}
+	message := DefaultSLAMessage
+	notify := JobNotify(job)
+	notifiers := notify.Notifiers
+	if escalated {
+		message = DefaultSLAEscalation
+		if notify.Escalation != nil && len(notify.Escalation.Notifiers) > 0 {
+			notifiers = notify.Escalation.Notifiers
+		}
+	}
+	if len(config.Notifiers) > 0 {
+		SendNotification(notifiers, DefaultSLATitle, message, result)
+		return
+	}
+	title, _ := renderTemplate(DefaultSLATitle, result)
+	message, _ = renderTemplate(message, result)
+	Notify(fmt.Sprintf("sla_%d", job.Index), title, message)
+}
+
+// Breach returns the breach of a job, nil when it is up to date
+func (f *FreshnessMonitor) Breach(index int) *SLABreach {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if breach, ok := f.breaches[index]; ok {
+		copied := *breach
+		return &copied
+	}
+	return nil
+}
+
+// Breaches returns every job that is out of date
+func (f *FreshnessMonitor) Breaches() []SLABreach {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	breaches := make([]SLABreach, 0, len(f.breaches))
+	for _, breach := range f.breaches {
+		breaches = append(breaches, *breach)
+	}
+	sort.Slice(breaches, func(i, j int) bool { return breaches[i].Job < breaches[j].Job })
+	return breaches
+}
+
+// PublishSLASensor sets a binary sensor in Home Assistant that is on while the job is out of date
+func PublishSLASensor(job JobConfig, breach *SLABreach) {
+	name := JobName(job)
+	entityID := "binary_sensor.rclone_backup_" + strings.ToLower(strings.ReplaceAll(slug.Make(name), "-", "_")) + "_sla_breached"
+	state := "off"
+	attributes := map[string]interface{}{
+		"friendly_name": "Rclone " + name + " out of date",
+		"device_class":  "problem",
+		"max_age":       job.MaxAge,
+		"last_success":  lastSuccess(job.Index),
+	}
+	if breach != nil {
+		state = "on"
+		attributes["since"] = breach.Since
+		attributes["escalated"] = breach.Escalated
+	}
+	if err := SetSensorState(entityID, state, attributes); err != nil {
+		Debugln("failed to publish sensor", entityID, err)
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/go-co-op/gocron/v2 v2.19.0
 	github.com/gosimple/slug v1.15.0
 	github.com/jcwillox/emerald v0.3.3
+	github.com/robfig/cron/v3 v3.0.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -18,7 +19,6 @@ require (
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
-	github.com/robfig/cron/v3 v3.0.1 // indirect
 	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8 // indirect
 	golang.org/x/sys v0.0.0-20220330033206-e17cdc41300f // indirect
 )
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcPort is the port of the gRPC interface, enabled with the grpc option. 8099 is the port of the
+// Rclone Web GUI that ingress uses.
+const grpcPort = "8100"
+
+// grpcService is the path prefix of the methods of the Scheduler service in scheduler.proto
+const grpcService = "/rclone_backup.v1.Scheduler/"
+
+// grpcMaxMessage is the largest request message accepted, requests only name a job and its overrides
+const grpcMaxMessage = 1 << 20
+
+// SchedulerProto is the definition of the gRPC interface, served at /api/grpc/scheduler.proto
+//
+//go:embed scheduler.proto
+var SchedulerProto string
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// GRPCError is a failed call with its gRPC status code
+type GRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *GRPCError) Error() string {
+	return e.Message
+}
+
+// grpcMethod is a method of the Scheduler service, send writes a response message, once for unary methods
+type grpcMethod struct {
+	scope  string
+	handle func(ctx context.Context, request pbMessage, send func([]byte) error) error
+}
+
+var grpcMethods = map[string]grpcMethod{
+	"ListJobs":    {ScopeViewer, grpcListJobs},
+	"GetStatus":   {ScopeViewer, grpcGetStatus},
+	"RunJob":      {ScopeOperator, grpcRunJob},
+	"CancelJob":   {ScopeOperator, grpcCancelJob},
+	"WatchStatus": {ScopeViewer, grpcWatchStatus},
+	"StreamLogs":  {ScopeViewer, grpcStreamLogs},
+}
+
+// StartGRPCServer serves the gRPC interface over unencrypted HTTP/2 in a goroutine
+func StartGRPCServer() {
+	if !config.GRPC {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(grpcService, HandleGRPC)
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":" + grpcPort, Handler: mux, Protocols: &protocols}
+	go func() {
+		Infoln("gRPC interface listening on port", grpcPort)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			Errorln("gRPC server error:", err)
+		}
+	}()
+}
+
+// HandleGRPC serves a call of the Scheduler service, the status of the call is sent in the trailers
+func HandleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requires a POST over HTTP/2 with the application/grpc content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	err := serveGRPC(w, r)
+	code, message := grpcOK, ""
+	var grpcErr *GRPCError
+	if errors.As(err, &grpcErr) {
+		code, message = grpcErr.Code, grpcErr.Message
+	} else if err != nil {
+		code, message = grpcInternal, err.Error()
+	}
+	if code != grpcOK {
+		Debugln("grpc:", strings.TrimPrefix(r.URL.Path, grpcService), "failed:", message)
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(message))
+	}
+}
+
+func serveGRPC(w http.ResponseWriter, r *http.Request) error {
+	method, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, grpcService)]
+	if !ok {
+		return &GRPCError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+	if tokens.Enabled() {
+		token := tokens.Authenticate(RequestToken(r))
+		if token == nil {
+			return &GRPCError{grpcUnauthenticated, "unauthorized, send a token as authorization: Bearer <token>"}
+		}
+		if scopeLevels[token.Scope] < scopeLevels[method.scope] {
+			return &GRPCError{grpcPermissionDenied, "token scope '" + token.Scope + "' is insufficient, requires '" + method.scope + "'"}
+		}
+	}
+	data, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	request, err := decodePB(data)
+	if err != nil {
+		return &GRPCError{grpcInvalidArgument, "invalid request: " + err.Error()}
+	}
+	controller := http.NewResponseController(w)
+	send := func(message []byte) error {
+		frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+		if _, err := w.Write(append(frame, message...)); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+	return method.handle(r.Context(), request, send)
+}
+
+// readGRPCMessage reads a length prefixed request message
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return nil, &GRPCError{grpcInvalidArgument, "missing request message"}
+	}
+	if header[0] != 0 {
+		return nil, &GRPCError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessage {
+		return nil, &GRPCError{grpcInvalidArgument, "request message is too large"}
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, &GRPCError{grpcInvalidArgument, "incomplete request message"}
+	}
+	return data, nil
+}
+
+// grpcJob returns the job a JobRef or RunJobRequest refers to
+func grpcJob(request pbMessage) (JobConfig, error) {
+	ref := request.String(1)
+	if ref == "" {
+		return JobConfig{}, &GRPCError{grpcInvalidArgument, "job must be the name or index of a job"}
+	}
+	job, ok := FindJob(ref)
+	if !ok {
+		return JobConfig{}, &GRPCError{grpcNotFound, fmt.Sprintf("job '%s' not found", ref)}
+	}
+	return job, nil
+}
+
+func grpcListJobs(_ context.Context, _ pbMessage, send func([]byte) error) error {
+	var response pbBuffer
+	for i, job := range config.Jobs {
+		var message pbBuffer
+		message.Varint(1, uint64(i))
+		message.String(2, job.Name)
+		message.String(3, job.Schedule)
+		switch {
+		case len(job.Steps) > 0:
+			message.String(4, "steps")
+		case job.Run != "":
+			message.String(4, "run")
+		case job.Command == CommandRestoreTest:
+			message.String(4, CommandRestoreTest)
+		default:
+			message.String(4, "rclone")
+			message.String(5, job.Command)
+		}
+		message.String(6, statuses.Get(i).State)
+		message.Timestamp(7, NextRun(i))
+		response.Message(1, message)
+	}
+	return send(response)
+}
+
+// encodeStatus encodes the JobStatus message of a job
+func encodeStatus(index int) []byte {
+	status := statuses.Get(index)
+	var message pbBuffer
+	message.Varint(1, uint64(index))
+	message.String(2, status.State)
+	message.String(3, status.RunID)
+	message.String(4, status.Trigger)
+	message.String(5, status.Note)
+	message.Timestamp(6, status.LastStart)
+	message.Timestamp(7, status.LastEnd)
+	message.String(8, status.LastError)
+	message.String(9, status.ErrorClass)
+	message.String(10, status.Progress)
+	message.Varint(11, uint64(status.Bytes))
+	message.Varint(12, uint64(status.Files))
+	message.String(13, status.Detail)
+	return message
+}
+
+func grpcGetStatus(_ context.Context, request pbMessage, send func([]byte) error) error {
+	job, err := grpcJob(request)
+	if err != nil {
+		return err
+	}
+	return send(encodeStatus(job.Index))
+}
+
+func grpcRunJob(_ context.Context, request pbMessage, send func([]byte) error) error {
+	job, err := grpcJob(request)
+	if err != nil {
+		return err
+	}
+	overrides := RunOverrides{Note: request.String(2), BwLimit: request.String(4), Destination: request.String(5), ExtraFlags: request.Strings(6)}
+	if dryRun, ok := request.Bool(3); ok {
+		overrides.DryRun = &dryRun
+	}
+	job, err = overrides.Apply(job)
+	if err != nil {
+		return &GRPCError{grpcInvalidArgument, err.Error()}
+	}
+	job.Trigger = TriggerGRPC
+	go RunTracked(job)
+	return send(nil)
+}
+
+func grpcCancelJob(_ context.Context, request pbMessage, send func([]byte) error) error {
+	job, err := grpcJob(request)
+	if err != nil {
+		return err
+	}
+	if !statuses.Cancel(job.Index) {
+		return &GRPCError{grpcFailedPrecondition, "job is not running"}
+	}
+	return send(nil)
+}
+
+func grpcWatchStatus(ctx context.Context, request pbMessage, send func([]byte) error) error {
+	job, err := grpcJob(request)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		if status := encodeStatus(job.Index); last == nil || !bytes.Equal(status, last) {
+			if err := send(status); err != nil {
+				return err
+			}
+			last = status
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func grpcStreamLogs(ctx context.Context, request pbMessage, send func([]byte) error) error {
+	job, err := grpcJob(request)
+	if err != nil {
+		return err
+	}
+	output, stop := runLogs.Follow(job.Index)
+	defer stop()
+	var partial []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case chunk := <-output:
+			partial = append(partial, chunk...)
+			for {
+				end := bytes.IndexByte(partial, '\n')
+				if end < 0 {
+					break
+				}
+				var line pbBuffer
+				line.Varint(1, uint64(job.Index))
+				line.String(2, statuses.Get(job.Index).RunID)
+				line.String(3, strings.TrimRight(string(partial[:end]), "\r"))
+				if err := send(line); err != nil {
+					return err
+				}
+				partial = partial[end+1:]
+			}
+		}
+	}
+}
+
+// pbBuffer encodes a protobuf message, fields with their default value are left out as in proto3
+type pbBuffer []byte
+
+func (b *pbBuffer) tag(field int, wireType uint64) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|wireType)
+}
+
+// Varint encodes an integer or bool field
+func (b *pbBuffer) Varint(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	b.tag(field, 0)
+	*b = binary.AppendUvarint(*b, value)
+}
+
+// String encodes a string field
+func (b *pbBuffer) String(field int, value string) {
+	if value == "" {
+		return
+	}
+	b.tag(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(value)))
+	*b = append(*b, value...)
+}
+
+// Message encodes an embedded message field
+func (b *pbBuffer) Message(field int, message []byte) {
+	b.tag(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(message)))
+	*b = append(*b, message...)
+}
+
+// Timestamp encodes a google.protobuf.Timestamp field, a nil time is left out
+func (b *pbBuffer) Timestamp(field int, t *time.Time) {
+	if t == nil {
+		return
+	}
+	var message pbBuffer
+	message.Varint(1, uint64(t.Unix()))
+	message.Varint(2, uint64(t.Nanosecond()))
+	b.Message(field, message)
+}
+
+// pbMessage is a decoded protobuf message, the varint and length delimited values of each field
+type pbMessage struct {
+	varints map[int][]uint64
+	bytes   map[int][][]byte
+}
+
+// decodePB decodes a protobuf message, fixed size fields are skipped as no request has any
+func decodePB(data []byte) (pbMessage, error) {
+	m := pbMessage{varints: make(map[int][]uint64), bytes: make(map[int][][]byte)}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return m, errors.New("malformed field tag")
+		}
+		data = data[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return m, errors.New("malformed varint")
+			}
+			m.varints[field] = append(m.varints[field], value)
+			data = data[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return m, errors.New("truncated field")
+			}
+			data = data[size:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return m, errors.New("truncated field")
+			}
+			m.bytes[field] = append(m.bytes[field], data[n:n+int(length)])
+			data = data[n+int(length):]
+		default:
+			return m, fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return m, nil
+}
+
+// String returns the last value of a string field
+func (m pbMessage) String(field int) string {
+	values := m.bytes[field]
+	if len(values) == 0 {
+		return ""
+	}
+	return string(values[len(values)-1])
+}
+
+// Strings returns the values of a repeated string field
+func (m pbMessage) Strings(field int) []string {
+	var values []string
+	for _, value := range m.bytes[field] {
+		values = append(values, string(value))
+	}
+	return values
+}
+
+// Bool returns the value of an optional bool field and whether it was set
+func (m pbMessage) Bool(field int) (bool, bool) {
+	values := m.varints[field]
+	if len(values) == 0 {
+		return false, false
+	}
+	return values[len(values)-1] != 0, true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var ErrSourceSuspicious = errors.New("source suspicious")
+
+// ParseSizeString parses sizes like "500M", "1.5G" or "100KiB" into bytes
+func ParseSizeString(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	unit := strings.TrimSpace(s[i:])
+	switch strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(unit), "B"), "I") {
+	case "":
+		return int64(n), nil
+	case "K":
+		return int64(n * (1 << 10)), nil
+	case "M":
+		return int64(n * (1 << 20)), nil
+	case "G":
+		return int64(n * (1 << 30)), nil
+	case "T":
+		return int64(n * (1 << 40)), nil
+	}
+	return 0, fmt.Errorf("invalid size unit '%s'", unit)
+}
+
+// CheckSourceSize aborts the run when the source is smaller than the job expects,
+// so an empty or unmounted source isn't synced over good remote data
+func CheckSourceSize(ctx context.Context, job JobConfig, source string) error {
+	if job.MinSourceSize == "" && job.MinSourceFiles <= 0 {
+		return nil
+	}
+	args := []string{"size", "--json", source}
+	for _, inclusion := range job.Include {
+		args = append(args, "--include", inclusion)
+	}
+	for _, exclusion := range job.Exclude {
+		args = append(args, "--exclude", exclusion)
+	}
+	out, err := exec.CommandContext(ctx, RcloneBinary(), args...).Output()
+	if err != nil {
+		return fmt.Errorf("%w: failed to measure source size: %s", ErrSourceSuspicious, err)
+	}
+	var size struct {
+		Count int64 `json:"count"`
+		Bytes int64 `json:"bytes"`
+	}
+	if err := json.Unmarshal(out, &size); err != nil {
+		return fmt.Errorf("%w: failed to measure source size: %s", ErrSourceSuspicious, err)
+	}
+	if job.MinSourceSize != "" {
+		minSize, _ := ParseSizeString(job.MinSourceSize)
+		if size.Bytes < minSize {
+			return fmt.Errorf("%w: '%s' is %s, expected at least %s", ErrSourceSuspicious, source, FormatBytes(size.Bytes), FormatBytes(minSize))
+		}
+	}
+	if job.MinSourceFiles > 0 && size.Count < job.MinSourceFiles {
+		return fmt.Errorf("%w: '%s' has %d files, expected at least %d", ErrSourceSuspicious, source, size.Count, job.MinSourceFiles)
+	}
+	Debugln("source", source, "has", size.Count, "files totalling", FormatBytes(size.Bytes))
+	return nil
+}
+
+// ParseMaxDelete parses a max_delete option, either a number of files like "100" or a percentage of
+// the files on the destination like "10%"
+func ParseMaxDelete(s string) (count int64, percent float64, err error) {
+	s = strings.TrimSpace(s)
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err = strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid max_delete '%s'", s)
+		}
+		return 0, percent, nil
+	}
+	count, err = strconv.ParseInt(s, 10, 64)
+	if err != nil || count < 0 {
+		return 0, 0, fmt.Errorf("invalid max_delete '%s'", s)
+	}
+	return count, 0, nil
+}
+
+// CheckDeletions aborts a sync when it would delete more files on the destination than max_delete allows,
+// e.g. because the source was remounted empty, returning the --max-delete flag that enforces the limit during the run
+func CheckDeletions(ctx context.Context, job JobConfig, source string, destination string) ([]string, error) {
+	if job.MaxDelete == "" || job.Command != "sync" || destination == "" || IsDryRun(job) {
+		return nil, nil
+	}
+	count, percent, err := ParseMaxDelete(job.MaxDelete)
+	if err != nil {
+		return nil, err
+	}
+	deletes, err := countDeletions(ctx, job, source, destination)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to count files that would be deleted: %s", ErrSourceSuspicious, err)
+	}
+	limit := count
+	if strings.HasSuffix(job.MaxDelete, "%") {
+		total, err := countFiles(ctx, job, destination)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to count files on destination: %s", ErrSourceSuspicious, err)
+		}
+		limit = int64(float64(total) * percent / 100)
+	}
+	if deletes > limit {
+		return nil, fmt.Errorf("%w: sync would delete %d files from '%s', max_delete is %s", ErrSourceSuspicious, deletes, destination, job.MaxDelete)
+	}
+	Debugln("sync would delete", deletes, "files from", destination+",", "max_delete allows", limit)
+	return []string{"--max-delete", strconv.FormatInt(limit, 10)}, nil
+}
+
+// countDeletions returns the number of files on the destination that are missing from the source
+func countDeletions(ctx context.Context, job JobConfig, source string, destination string) (int64, error) {
+	args := []string{"check", source, destination, "--size-only", "--missing-on-src", "-"}
+	for _, inclusion := range job.Include {
+		args = append(args, "--include", inclusion)
+	}
+	for _, exclusion := range job.Exclude {
+		args = append(args, "--exclude", exclusion)
+	}
+	args = append(args, LockExcludes()...)
+	out, err := exec.CommandContext(ctx, RcloneBinary(), args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case 1: // differences were found
+		case 3: // the destination doesn't exist yet
+			return 0, nil
+		default:
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+	var deletes int64
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != "" {
+			deletes++
+		}
+	}
+	return deletes, nil
+}
+
+// countFiles returns the number of files matching the filters of the job at a path
+func countFiles(ctx context.Context, job JobConfig, path string) (int64, error) {
+	args := []string{"size", "--json", path}
+	for _, inclusion := range job.Include {
+		args = append(args, "--include", inclusion)
+	}
+	for _, exclusion := range job.Exclude {
+		args = append(args, "--exclude", exclusion)
+	}
+	out, err := exec.CommandContext(ctx, RcloneBinary(), args...).Output()
+	if err != nil {
+		return 0, err
+	}
+	var size struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.Unmarshal(out, &size); err != nil {
+		return 0, err
+	}
+	return size.Count, nil
+}
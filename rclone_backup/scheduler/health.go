@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HealthLimit is the number of scheduler anomalies kept
+const HealthLimit = 50
+
+// DefaultDriftThreshold is how late a tick or scheduled run can be before it is recorded
+const DefaultDriftThreshold = 2 * time.Minute
+
+// healthTickInterval is how often the monitor checks the clock
+const healthTickInterval = 30 * time.Second
+
+var HealthPath = filepath.Join(DataPath, "health.json")
+
+const (
+	AnomalyClockJump  = "clock_jump"
+	AnomalyDelayedRun = "delayed_run"
+)
+
+// SchedulerAnomaly is a tick or scheduled run that happened later than expected
+type SchedulerAnomaly struct {
+	Type     string    `json:"type"`
+	Job      *int      `json:"job,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Expected time.Time `json:"expected"`
+	Actual   time.Time `json:"actual"`
+	Delay    string    `json:"delay"`
+}
+
+// Health is the status returned by /api/health
+type Health struct {
+	Status    string             `json:"status"`
+	Started   time.Time          `json:"started"`
+	Uptime    string             `json:"uptime"`
+	LastTick  *time.Time         `json:"last_tick,omitempty"`
+	Threshold string             `json:"drift_threshold"`
+	Anomalies []SchedulerAnomaly `json:"anomalies"`
+	Breaches  []SLABreach        `json:"sla_breaches"` // jobs whose last success is older than their max_age
+}
+
+type HealthMonitor struct {
+	mu        sync.Mutex
+	started   time.Time
+	lastTick  time.Time
+	threshold time.Duration
+	expected  map[int]time.Time
+	anomalies []SchedulerAnomaly
+}
+
+var health = &HealthMonitor{started: time.Now(), threshold: DefaultDriftThreshold, expected: make(map[int]time.Time)}
+
+// Load reads previously recorded anomalies from disk
+func (h *HealthMonitor) Load() error {
+	threshold := DefaultDriftThreshold
+	if config.DriftThreshold != "" {
+		parsed, err := time.ParseDuration(config.DriftThreshold)
+		if err != nil {
+			return errors.New("invalid drift_threshold '" + config.DriftThreshold + "'")
+		}
+		threshold = parsed
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.threshold = threshold
+	data, err := os.ReadFile(HealthPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &h.anomalies)
+}
+
+// Start checks the wall clock in a goroutine, detecting when the system was suspended or starved
+func (h *HealthMonitor) Start() {
+	h.mu.Lock()
+	h.lastTick = time.Now()
+	h.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(healthTickInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			h.tick(now)
+		}
+	}()
+}
+
+func (h *HealthMonitor) tick(now time.Time) {
+	h.mu.Lock()
+	last := h.lastTick
+	h.lastTick = now
+	h.mu.Unlock()
+	// strip the monotonic reading, it does not advance while the system is suspended
+	expected := last.Round(0).Add(healthTickInterval)
+	if delay := now.Round(0).Sub(expected); delay > h.threshold {
+		Warnln("scheduler clock jumped by", FormatDuration(delay)+", the system may have been suspended or overloaded")
+		h.record(SchedulerAnomaly{Type: AnomalyClockJump, Expected: expected, Actual: now})
+	}
+}
+
+// Expect records when the scheduled job at index should next run
+func (h *HealthMonitor) Expect(index int) {
+	next := NextRun(index)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if next == nil {
+		delete(h.expected, index)
+	} else {
+		h.expected[index] = *next
+	}
+}
+
+// ScheduledTask wraps the task of a scheduled job to record when it runs later than scheduled
+func (h *HealthMonitor) ScheduledTask(job JobConfig, task func()) func() {
+	return func() {
+		now := time.Now()
+		h.mu.Lock()
+		expected, ok := h.expected[job.Index]
+		h.mu.Unlock()
+		if ok {
+			// runs waiting for another job to finish are expected to be late
+			if finished := statuses.LastFinished(); finished.After(expected) {
+				expected = finished
+			}
+			if delay := now.Sub(expected); delay > h.threshold {
+				Warnln("job", "'"+job.Name+"'", "started", FormatDuration(delay), "later than scheduled")
+				index := job.Index
+				h.record(SchedulerAnomaly{Type: AnomalyDelayedRun, Job: &index, Name: job.Name, Expected: expected, Actual: now})
+			}
+		}
+		task()
+		h.Expect(job.Index)
+	}
+}
+
+func (h *HealthMonitor) record(anomaly SchedulerAnomaly) {
+	anomaly.Delay = FormatDuration(anomaly.Actual.Round(0).Sub(anomaly.Expected.Round(0)))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.anomalies = append(h.anomalies, anomaly)
+	if len(h.anomalies) > HealthLimit {
+		h.anomalies = h.anomalies[len(h.anomalies)-HealthLimit:]
+	}
+	data, err := json.Marshal(h.anomalies)
+	if err == nil {
+		err = os.WriteFile(HealthPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save scheduler anomalies:", err)
+	}
+}
+
+// Get returns the current health, degraded if there were anomalies in the last day
+func (h *HealthMonitor) Get() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	result := Health{
+		Status:    "ok",
+		Started:   h.started,
+		Uptime:    FormatDuration(now.Sub(h.started)),
+		Threshold: h.threshold.String(),
+		Anomalies: make([]SchedulerAnomaly, 0, len(h.anomalies)),
+	}
+	if !h.lastTick.IsZero() {
+		tick := h.lastTick
+		result.LastTick = &tick
+	}
+	for i := len(h.anomalies) - 1; i >= 0; i-- {
+		anomaly := h.anomalies[i]
+		if now.Sub(anomaly.Actual) < 24*time.Hour {
+			result.Status = "degraded"
+		}
+		result.Anomalies = append(result.Anomalies, anomaly)
+	}
+	result.Breaches = freshness.Breaches()
+	if len(result.Breaches) > 0 {
+		result.Status = "degraded"
+	}
+	return result
+}
+
+func HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(health.Get())
+}
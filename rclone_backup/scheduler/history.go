@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryLimit is the number of runs kept for each job
+const HistoryLimit = 50
+
+var HistoryPath = filepath.Join(DataPath, "history.json")
+
+// RunRecord is a run of a job, runs are saved when they start so a run the addon died during can be found
+type RunRecord struct {
+	ID          string          `json:"id"`
+	Job         int             `json:"job"`
+	Name        string          `json:"name"`
+	Trigger     string          `json:"trigger,omitempty"`
+	Note        string          `json:"note,omitempty"`
+	State       string          `json:"state"`
+	Error       string          `json:"error,omitempty"`
+	ErrorClass  string          `json:"error_class,omitempty"`
+	Start       time.Time       `json:"start"`
+	End         time.Time       `json:"end"`
+	Duration    string          `json:"duration"`
+	Bytes       int64           `json:"bytes"`
+	Files       int64           `json:"files"`
+	ServerSide  ServerSideStats `json:"server_side,omitzero"`
+	Steps       []StepResult    `json:"steps,omitempty"`
+	Detail      string          `json:"detail,omitempty"`
+	FailedFiles []FailedTarget  `json:"failed_files,omitempty"`
+	Manifest    bool            `json:"manifest,omitempty"` // the destinations were listed after the run, see DiffRuns
+	Artifacts   []string        `json:"artifacts,omitempty"`
+	Warnings    []string        `json:"warnings,omitempty"`
+}
+
+type History struct {
+	mu   sync.Mutex
+	runs []RunRecord
+}
+
+var history = &History{}
+
+// readHistory reads the runs saved on disk, oldest first
+func readHistory() ([]RunRecord, error) {
+	data, err := os.ReadFile(HistoryPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []RunRecord
+	if err := json.Unmarshal(data, &runs); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Start.Before(runs[j].Start) })
+	return runs, nil
+}
+
+// Load reads the history from disk and restores the last state of each job
+func (h *History) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	runs, err := readHistory()
+	if err != nil {
+		return err
+	}
+	h.runs = runs
+	interrupted := false
+	for i, run := range h.runs {
+		if run.State == StateRunning {
+			h.runs[i] = interruptedRun(run)
+			interrupted = true
+		}
+	}
+	if interrupted {
+		h.save()
+	}
+	for _, run := range h.runs {
+		if run.Job < len(config.Jobs) {
+			statuses.Restore(run)
+		}
+	}
+	return nil
+}
+
+// interruptedRun marks a run that was still running when the addon stopped, it ended at the last line of its log
+func interruptedRun(run RunRecord) RunRecord {
+	Warnln("run of", "'"+run.Name+"'", "started", run.Start.Local().Format("2006-01-02 15:04"), "was interrupted by the addon stopping")
+	run.State = StateInterrupted
+	run.Error = "the addon stopped while the job was running"
+	run.End = run.Start
+	if info, err := os.Stat(runLogPath(run.Job, run.ID)); err == nil && info.ModTime().After(run.Start) {
+		run.End = info.ModTime()
+	}
+	run.Duration = FormatDuration(run.End.Sub(run.Start))
+	return run
+}
+
+// Begin records a run that started, it is replaced by the finished run
+func (h *History) Begin(job JobConfig, status JobStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runs = append(h.runs, RunRecord{
+		ID:      status.RunID,
+		Job:     job.Index,
+		Name:    job.Name,
+		Trigger: status.Trigger,
+		Note:    status.Note,
+		State:   StateRunning,
+		Start:   *status.LastStart,
+	})
+	h.save()
+}
+
+// Add records a finished run, pruning old runs of the same job
+func (h *History) Add(record RunRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, run := range h.runs {
+		if run.ID == record.ID && run.State == StateRunning {
+			h.runs = append(h.runs[:i], h.runs[i+1:]...)
+			break
+		}
+	}
+	h.runs = append(h.runs, record)
+
+	count := 0
+	for i := len(h.runs) - 1; i >= 0; i-- {
+		if h.runs[i].Job == record.Job {
+			count++
+			if count > HistoryLimit {
+				h.runs = append(h.runs[:i], h.runs[i+1:]...)
+			}
+		}
+	}
+	h.save()
+}
+
+func (h *History) save() {
+	data, err := json.Marshal(h.runs)
+	if err == nil {
+		err = os.WriteFile(HistoryPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save job history:", err)
+	}
+}
+
+// Runs returns the runs of the job at index, newest first
+func (h *History) Runs(index int) []RunRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	runs := make([]RunRecord, 0)
+	for i := len(h.runs) - 1; i >= 0; i-- {
+		if h.runs[i].Job == index {
+			runs = append(runs, h.runs[i])
+		}
+	}
+	return runs
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosimple/slug"
+)
+
+// usbLabelsPath lists the filesystems of attached drives by their label, kept up to date by udev
+const usbLabelsPath = "/dev/disk/by-label"
+
+// hotplugInterval is how often the watched usb drives are checked
+const hotplugInterval = 10 * time.Second
+
+// HotplugWatcher runs the jobs using a usb drive each time it is plugged in, then unmounts it so it can be unplugged
+// again, e.g. for an offsite drive that is brought home once a week
+type HotplugWatcher struct {
+	mu       sync.Mutex
+	attached map[string]bool // drives seen in the last check
+	running  map[string]bool // drives whose jobs are running
+}
+
+var hotplug = &HotplugWatcher{attached: make(map[string]bool), running: make(map[string]bool)}
+
+// usbDevice returns the device of a drive by the label of its filesystem, udev escapes spaces and slashes
+func usbDevice(label string) string {
+	return filepath.Join(usbLabelsPath, strings.NewReplacer(" ", `\x20`, "/", `\x2f`).Replace(label))
+}
+
+// usbAttached reports whether a drive with the label is plugged in
+func usbAttached(label string) bool {
+	_, err := os.Stat(usbDevice(label))
+	return err == nil
+}
+
+// HotplugJobs returns the jobs using a mount, in the order they are configured
+func HotplugJobs(mount MountConfig) []JobConfig {
+	var jobs []JobConfig
+	for _, job := range config.Jobs {
+		for _, used := range JobMounts(job) {
+			if used.Name == mount.Name {
+				jobs = append(jobs, job)
+				break
+			}
+		}
+	}
+	return jobs
+}
+
+// HotplugOnly reports whether a job without a schedule uses a hotplug drive, it then only runs when the drive is
+// plugged in instead of at startup
+func HotplugOnly(job JobConfig) bool {
+	if job.Schedule != "" {
+		return false
+	}
+	for _, mount := range JobMounts(job) {
+		if mount.Type == MountUSB && mount.Hotplug {
+			return true
+		}
+	}
+	return false
+}
+
+// Start watches the usb drives with hotplug, a drive that is already plugged in when the addon starts doesn't run
+// its jobs until it is plugged in again
+func (h *HotplugWatcher) Start() {
+	var watched []MountConfig
+	for _, mount := range config.Mounts {
+		if mount.Type != MountUSB || !mount.Hotplug {
+			continue
+		}
+		if len(HotplugJobs(mount)) == 0 {
+			Warnln("no job uses the path of usb drive", "'"+mount.Name+"',", "nothing runs when it is plugged in")
+			continue
+		}
+		h.attached[mount.Name] = usbAttached(mount.Label)
+		watched = append(watched, mount)
+	}
+	if len(watched) == 0 {
+		return
+	}
+	Infoln("watching for", len(watched), "usb drives to be plugged in")
+	go func() {
+		ticker := time.NewTicker(hotplugInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, mount := range watched {
+				h.check(mount)
+			}
+		}
+	}()
+}
+
+func (h *HotplugWatcher) check(mount MountConfig) {
+	attached := usbAttached(mount.Label)
+	h.mu.Lock()
+	plugged := attached && !h.attached[mount.Name] && !h.running[mount.Name]
+	h.attached[mount.Name] = attached
+	if plugged {
+		h.running[mount.Name] = true
+	}
+	h.mu.Unlock()
+	if plugged {
+		go h.run(mount)
+	}
+}
+
+// run mounts a drive that was plugged in, runs its jobs one after the other and unmounts it again
+func (h *HotplugWatcher) run(mount MountConfig) {
+	defer func() {
+		h.mu.Lock()
+		delete(h.running, mount.Name)
+		h.mu.Unlock()
+	}()
+	id := "hotplug_" + slug.Make(mount.Name)
+	jobs := HotplugJobs(mount)
+	Infoln("usb drive", "'"+mount.Label+"'", "was plugged in, running", len(jobs), "jobs")
+	// keeps the drive mounted until every job has run instead of mounting it for each
+	release, err := mounts.Acquire(context.Background(), JobConfig{Destinations: []string{MountPath(mount)}})
+	if err != nil {
+		Errorln(err)
+		Notify(id, "Rclone Backup: drive not mounted", fmt.Sprintf("%s was plugged in but can't be mounted: %s", mount.Label, err))
+		return
+	}
+	failed := false
+	var results []string
+	for _, job := range jobs {
+		job.Trigger = TriggerHotplug
+		runQueue.Run(job, RunTracked)
+		state := statuses.Get(job.Index).State
+		if !IsSuccess(state) {
+			failed = true
+		}
+		results = append(results, fmt.Sprintf("%s: %s", JobName(job), state))
+	}
+	release()
+	title := "Rclone Backup: drive can be unplugged"
+	message := strings.Join(results, "\n")
+	if isMounted(MountPath(mount)) {
+		title = "Rclone Backup: drive backup finished"
+		message += "\n\n" + mount.Label + " is still mounted, unmount it before unplugging it"
+	} else {
+		Infoln("usb drive", "'"+mount.Label+"'", "was unmounted and can be unplugged")
+	}
+	if failed {
+		title = "Rclone Backup: drive backup failed"
+	}
+	Notify(id, title, message)
+}
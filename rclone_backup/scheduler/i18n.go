@@ -0,0 +1,96 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// translationFiles are the UI strings of each language but English, keyed by the English string, with {name}
+// placeholders for the values filled in by the pages
+//
+//go:embed translations/*.json
+var translationFiles embed.FS
+
+// Translations returns the UI strings of every language but English, keyed by language and English string
+var Translations = sync.OnceValues(func() (map[string]map[string]string, error) {
+	all := make(map[string]map[string]string)
+	files, err := translationFiles.ReadDir("translations")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := translationFiles.ReadFile(path.Join("translations", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		texts := make(map[string]string)
+		if err := json.Unmarshal(data, &texts); err != nil {
+			return nil, fmt.Errorf("invalid translations %s: %w", file.Name(), err)
+		}
+		all[strings.TrimSuffix(file.Name(), ".json")] = texts
+	}
+	return all, nil
+})
+
+// HandleI18nScript serves the script that translates the pages of the web UI, with the translations and the
+// configured language
+func HandleI18nScript(w http.ResponseWriter, r *http.Request) {
+	all, err := Translations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	texts, _ := json.Marshal(all)
+	language, _ := json.Marshal(config.Language)
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "const translations = %s;\nconst configuredLanguage = %s;\n%s", texts, language, i18nScript)
+}
+
+// i18nScript picks the language of the page and translates it, the language chosen on the Jobs page is stored in
+// the browser and overrides the language option, which in turn overrides the languages of the browser. Elements
+// with a data-i18n attribute are translated when the page has loaded, the scripts of the pages translate the texts
+// they add with tr.
+const i18nScript = `const languageNames = { auto: 'Automatic', en: 'English', de: 'Deutsch', fr: 'Français', nl: 'Nederlands', es: 'Español' };
+function pageLanguage() {
+  const chosen = localStorage.getItem('language') || configuredLanguage;
+  if (chosen && chosen !== 'auto') return chosen;
+  for (const l of navigator.languages || [navigator.language || '']) {
+    const code = l.toLowerCase().split('-')[0];
+    if (code === 'en' || translations[code]) return code;
+  }
+  return 'en';
+}
+const language = pageLanguage();
+document.documentElement.lang = language;
+function tr(text, values) {
+  let s = (translations[language] || {})[text] || text;
+  Object.keys(values || {}).forEach(k => { s = s.split('{' + k + '}').join(values[k]); });
+  return s;
+}
+function languageSelect(select) {
+  Object.keys(languageNames).forEach(code => {
+    const o = document.createElement('option');
+    o.value = code;
+    o.textContent = code === 'auto' ? tr(languageNames[code]) : languageNames[code];
+    select.appendChild(o);
+  });
+  select.value = localStorage.getItem('language') || 'auto';
+  select.onchange = () => {
+    if (select.value === 'auto') localStorage.removeItem('language');
+    else localStorage.setItem('language', select.value);
+    location.reload();
+  };
+}
+document.addEventListener('DOMContentLoaded', () => {
+  document.title = tr(document.title);
+  document.querySelectorAll('[data-i18n]').forEach(el => {
+    if (el.placeholder) el.placeholder = tr(el.placeholder);
+    else el.innerHTML = tr(el.innerHTML.trim());
+  });
+});
+`
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFullEvery is the number of incremental archives made between full archives
+const DefaultFullEvery = 6
+
+// DeletedFilesEntry lists the files deleted since the full archive inside an incremental archive
+const DeletedFilesEntry = ".rclone_backup_deleted"
+
+var IncrementalPath = filepath.Join(DataPath, "incremental")
+
+// FileState is what is known about a file when it was archived
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// MaxArchiveSets is the number of full archives remembered for each chain
+const MaxArchiveSets = 20
+
+// ArchiveSet is a full archive and the incremental archives restored on top of it
+type ArchiveSet struct {
+	Full         string    `json:"full"` // remote path of the full archive
+	Time         time.Time `json:"time"`
+	Incrementals []string  `json:"incrementals,omitempty"`
+}
+
+// ArchiveChain are the archive sets of a folder, the files are those of the latest full archive
+type ArchiveChain struct {
+	Job         string               `json:"job"`
+	Source      string               `json:"source"`
+	Destination string               `json:"destination"`
+	Sets        []ArchiveSet         `json:"sets"`
+	Files       map[string]FileState `json:"files"`
+}
+
+// Latest returns the newest archive set
+func (c *ArchiveChain) Latest() *ArchiveSet {
+	return &c.Sets[len(c.Sets)-1]
+}
+
+var chainsMu sync.Mutex
+
+// ChainPath returns the file the archive chain of a job's source and destination is stored in
+func ChainPath(job JobConfig, source string, destination string) string {
+	sum := sha1.Sum([]byte(JobName(job) + "\x00" + source + "\x00" + destination))
+	return filepath.Join(IncrementalPath, hex.EncodeToString(sum[:8])+".json")
+}
+
+// LoadChain reads an archive chain, returning nil when there is no full archive yet
+func LoadChain(file string) (*ArchiveChain, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var chain ArchiveChain
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, err
+	}
+	if len(chain.Sets) == 0 {
+		return nil, nil
+	}
+	return &chain, nil
+}
+
+// SaveChain stores an archive chain
+func SaveChain(file string, chain *ArchiveChain) error {
+	chainsMu.Lock()
+	defer chainsMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(chain)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// ArchiveChains returns every known archive chain
+func ArchiveChains() []ArchiveChain {
+	chainsMu.Lock()
+	defer chainsMu.Unlock()
+	files, _ := filepath.Glob(filepath.Join(IncrementalPath, "*.json"))
+	chains := make([]ArchiveChain, 0, len(files))
+	for _, file := range files {
+		chain, err := LoadChain(file)
+		if err != nil {
+			Warnln("failed to read archive chain", file+":", err)
+			continue
+		}
+		if chain != nil {
+			chains = append(chains, *chain)
+		}
+	}
+	return chains
+}
+
+// ScanFolder records the size and modification time of every file in the folder, and its hash when checksum is set
+func ScanFolder(folder string, exclude []string, checksum bool) (map[string]FileState, error) {
+	files := make(map[string]FileState)
+	err := filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(folder, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ExcludedFromArchive(rel, info.Name(), exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		state := FileState{Size: info.Size(), ModTime: info.ModTime().UTC().Round(time.Second)}
+		if checksum {
+			if state.Hash, err = HashFile(p); err != nil {
+				return err
+			}
+		}
+		files[rel] = state
+		return nil
+	})
+	return files, err
+}
+
+// HashFile returns the sha256 of a file
+func HashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ChangedFiles compares the current files with those of the full archive, returning the changed and deleted files
+func ChangedFiles(full map[string]FileState, current map[string]FileState) (map[string]bool, []string) {
+	changed := make(map[string]bool)
+	for name, state := range current {
+		previous, ok := full[name]
+		if !ok || previous.Size != state.Size || !previous.ModTime.Equal(state.ModTime) || previous.Hash != state.Hash {
+			changed[name] = true
+		}
+	}
+	var deleted []string
+	for name := range full {
+		if _, ok := current[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+	return changed, deleted
+}
+
+// IncrementalArchiveName marks an archive name as a full or incremental archive, e.g. "share_2024-07-01_full.tar.gz"
+func IncrementalArchiveName(name string, kind string) string {
+	for _, ext := range CompressFormats {
+		if strings.HasSuffix(name, ext) && len(ext) > 0 {
+			return strings.TrimSuffix(name, ext) + "_" + kind + ext
+		}
+	}
+	return name + "_" + kind
+}
+
+// ArchiveKind reports whether a remote file is a full or incremental archive of a chain, and the full archive it depends on
+func ArchiveKind(chains []ArchiveChain, remote string) (string, string) {
+	for _, chain := range chains {
+		for _, set := range chain.Sets {
+			if set.Full == remote {
+				return "full", ""
+			}
+			if ArrayContains(set.Incrementals, remote) {
+				return "incremental", set.Full
+			}
+		}
+	}
+	return "", ""
+}
@@ -1,68 +1,229 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/jcwillox/emerald"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // CreateJob create run job closure with the job config
 func CreateJob(job JobConfig) func() {
+	return func() { RunTracked(job) }
+}
+
+// RunTracked runs the job while recording its status, so it can be cancelled or retried
+func RunTracked(job JobConfig) {
+	if IsAutomatedTrigger(job.Trigger) {
+		if remote, until := breaker.Blocked(job); remote != "" {
+			Warnln("skipping job", "'"+job.Name+"',", "circuit for", remote, "is open until", until.Local().Format("15:04"))
+			return
+		}
+		if until, bwlimit := budget.Gate(job); !until.IsZero() {
+			DeferForBudget(job, until)
+			return
+		} else if bwlimit != "" {
+			Infoln("the data budget is nearly used up, limiting", "'"+job.Name+"'", "to", bwlimit)
+			job.ExtraFlags = append(slices.Clone(job.ExtraFlags), "--bwlimit="+bwlimit)
+		}
+	}
+	if !beginRun() {
+		Warnln("skipping job", "'"+job.Name+"',", "the addon is shutting down")
+		return
+	}
+	defer activeRuns.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !statuses.Start(job, cancel) {
+		Warnln("job", "'"+job.Name+"'", "is already running, skipping")
+		return
+	}
+	status := statuses.Get(job.Index)
+	history.Begin(job, status)
+	runLogs.Open(job.Index, status.RunID)
+	stopWatch := WatchOverdue(job)
+	err := RunJobTargets(ctx, job)
+	stopWatch()
+	if errors.Is(ctx.Err(), context.Canceled) && statuses.Interrupted(job.Index) {
+		Warnln("job", "'"+job.Name+"'", "was interrupted")
+		err = ErrInterrupted
+	} else if errors.Is(ctx.Err(), context.Canceled) {
+		Warnln("job", "'"+job.Name+"'", "was cancelled")
+		err = ErrCancelled
+	}
+	record := statuses.Finish(job.Index, err)
+	SaveManifest(&record, statuses.Manifest(job.Index))
+	SaveSpeedSamples(&record)
+	SaveReport(&record)
+	runLogs.Close(job.Index, record)
+	history.Add(record)
+	PublishRunSensor(job, &record)
+	PruneArtifacts()
+	CheckSizeAnomaly(job, record)
+	breaker.Record(job, record)
+	budget.Record(job, record)
+	NotifyRun(job, record)
+}
+
+// IsDryRun reports whether the run only shows what would be changed
+func IsDryRun(job JobConfig) bool {
+	if job.DryRun != nil {
+		return *job.DryRun
+	}
+	return config.DryRun
+}
+
+// RunJobTargets runs the job against each of its sources and destinations,
+// returning the last error encountered
+func RunJobTargets(ctx context.Context, job JobConfig) error {
+	job, err := ExpandJob(job, time.Now())
+	if err != nil {
+		msg := fmt.Sprintf("failed to interpolate job variables: %s", err)
+		Errorln(msg)
+		FireJobEvent(EventJobFailed, job, "", "", time.Now(), msg)
+		return errors.New(msg)
+	}
+	release, err := WaitForVPN(ctx, job)
+	if err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, "", "", time.Now(), err.Error())
+		return &RcloneError{Class: ErrorClassNetwork, Message: err.Error()}
+	}
+	defer release()
+	shutdown, err := WakeTarget(ctx, job)
+	if err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, "", "", time.Now(), err.Error())
+		return &RcloneError{Class: ErrorClassNetwork, Message: err.Error()}
+	}
+	defer shutdown()
+	if err := CheckServers(ctx, job); err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, "", "", time.Now(), err.Error())
+		return &RcloneError{Class: ErrorClassNetwork, Message: err.Error()}
+	}
+	unmount, err := mounts.Acquire(ctx, job)
+	if err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, "", "", time.Now(), err.Error())
+		return &RcloneError{Class: ErrorClassNetwork, Message: err.Error()}
+	}
+	defer unmount()
+	if err := RunDumps(ctx, job); err != nil {
+		return err
+	}
+	if len(job.Steps) > 0 {
+		return RunPipeline(ctx, job)
+	}
+	return runTargets(ctx, job)
+}
+
+func runTargets(ctx context.Context, job JobConfig) error {
 	if job.Run != "" {
-		return func() { RunShellJob(job) }
-	}
-	return func() {
-		if len(job.Sources) > 1 && len(job.Destinations) > 1 {
-			// multiple destinations and multiple sources
-			for _, destination := range job.Destinations {
-				for _, source := range job.Sources {
-					RunJob(job, source, destination+source)
-				}
-			}
-		} else if len(job.Sources) > 1 {
-			// multiple sources
-			// multiple sources to single destination
-			if len(job.Destinations) > 0 {
-				job.Destination = job.Destinations[0]
-			}
-			for _, source := range job.Sources {
-				RunJob(job, source, job.Destination+source)
-			}
+		return RunShellJob(ctx, job)
+	}
+	if job.Command == CommandRestoreTest {
+		return RunRestoreTest(ctx, job)
+	}
+	if len(job.RetryFiles) > 0 {
+		return runFailedFiles(ctx, job)
+	}
+	if JobEngine(job) == EngineBorg && job.Borg.Borgmatic != "" {
+		return RunBorgmatic(ctx, job)
+	}
+	var lastErr error
+	run := func(source string, destination string) {
+		if ctx.Err() != nil {
 			return
-		} else if len(job.Destinations) > 1 {
-			// multiple destinations
-			// multiple destinations to single source
-			if len(job.Sources) > 0 {
-				job.Source = job.Sources[0]
+		}
+		runner := RunJob
+		if job.Command == CommandCompress {
+			runner = RunCompress
+		} else if job.Shards > 1 && shardCommands[job.Command] && JobEngine(job) != EngineRestic && JobEngine(job) != EngineBorg && JobEngine(job) != EngineSnapshot {
+			runner = RunSharded
+		} else if JobEngine(job) == EngineRestic {
+			runner = RunRestic
+		} else if JobEngine(job) == EngineBorg {
+			runner = RunBorg
+		} else if JobEngine(job) == EngineSnapshot {
+			runner = RunSnapshot
+		}
+		err := runner(ctx, job, source, destination)
+		// a sync resumes where it stopped, the files uploaded before are skipped
+		for throttled, dropped := 0, 0; err != nil && ctx.Err() == nil; err = runner(ctx, job, source, destination) {
+			if RotateOnUploadLimit(job, destination, err) {
+				continue
 			}
-			for _, destination := range job.Destinations {
-				RunJob(job, job.Source, destination)
+			if WaitForThrottle(ctx, job, err, throttled) {
+				throttled++
+				continue
 			}
-		} else {
-			// single source
-			// single destination
-			// single source to single destination
-			if len(job.Destinations) > 0 {
-				job.Destination = job.Destinations[0]
+			if ResumeDropped(ctx, job, source, destination, err, dropped) {
+				dropped++
+				continue
 			}
-			if len(job.Sources) > 0 {
-				job.Source = job.Sources[0]
+			break
+		}
+		if err != nil {
+			lastErr = err
+		} else if JobEngine(job) != EngineRestic && JobEngine(job) != EngineBorg && JobEngine(job) != EngineSnapshot {
+			RecordManifest(job, source, destination)
+		}
+	}
+	if len(job.Sources) > 1 && len(job.Destinations) > 1 {
+		// multiple destinations and multiple sources
+		for _, destination := range job.Destinations {
+			for _, source := range job.Sources {
+				run(source, destination+source)
 			}
-			RunJob(job, job.Source, job.Destination)
 		}
+	} else if len(job.Sources) > 1 {
+		// multiple sources
+		// multiple sources to single destination
+		if len(job.Destinations) > 0 {
+			job.Destination = job.Destinations[0]
+		}
+		for _, source := range job.Sources {
+			run(source, job.Destination+source)
+		}
+	} else if len(job.Destinations) > 1 {
+		// multiple destinations
+		// multiple destinations to single source
+		if len(job.Sources) > 0 {
+			job.Source = job.Sources[0]
+		}
+		for _, destination := range job.Destinations {
+			run(job.Source, destination)
+		}
+	} else {
+		// single source
+		// single destination
+		// single source to single destination
+		if len(job.Destinations) > 0 {
+			job.Destination = job.Destinations[0]
+		}
+		if len(job.Sources) > 0 {
+			job.Source = job.Sources[0]
+		}
+		run(job.Source, job.Destination)
 	}
+	return lastErr
 }
 
-func RunShellJob(job JobConfig) {
+func RunShellJob(ctx context.Context, job JobConfig) error {
 	Infoln("running", JobInfoShell(job))
 	start := time.Now()
 	emerald.Print(emerald.Blue)
-	cmd := exec.Command("sh", "-c", job.Run)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
+	cmd := exec.CommandContext(ctx, "sh", "-c", job.Run)
+	output := JobLog(os.Stdout, job.Index)
+	cmd.Stdout = output
+	cmd.Stderr = output
 	cmd.Stdin = os.Stdin
 	err := cmd.Run()
 	emerald.Print(emerald.Reset)
@@ -74,19 +235,30 @@ func RunShellJob(job JobConfig) {
 		msg := fmt.Sprintf("failed to run command: %s", err)
 		Errorln(msg)
 		FireJobEvent(EventJobFailed, eventJob, "", "", start, msg)
-		return
+		return errors.New(msg)
 	}
 	Infoln("finished in", boldCyan(FormatDuration(time.Since(start))))
 	FireJobEvent(EventJobSuccessful, eventJob, "", "", start, "")
+	return nil
 }
 
-func RunJob(job JobConfig, source string, destination string) {
-	// generate rclone command
-	args := []string{job.Command, source}
+func RunJob(ctx context.Context, job JobConfig, source string, destination string) error {
+	job, err := InjectChaos(ctx, job, source, destination)
+	if err != nil {
+		Errorln(err.Error(), "("+ErrorClass(err)+")")
+		FireJobEvent(EventJobFailed, job, source, destination, time.Now(), err.Error())
+		return err
+	}
+
+	// generate rclone command, source is not required either when reading stdin
+	args := []string{job.Command}
+	if source != "" {
+		args = append(args, ApplyRemoteOptions(source))
+	}
 
 	// destination is not required
 	if destination != "" {
-		args = append(args, destination)
+		args = append(args, ApplyRemoteOptions(destination))
 	}
 
 	args = append(args, "--verbose")
@@ -98,22 +270,69 @@ func RunJob(job JobConfig, source string, destination string) {
 	for _, exclusion := range job.Exclude {
 		args = append(args, "--exclude", exclusion)
 	}
+	args = append(args, LockExcludes()...)
 
-	if config.DryRun {
+	if job.Versioning.Enabled && destination != "" {
+		args = append(args, "--backup-dir", ApplyRemoteOptions(VersionsPath(job, destination)+"/"+time.Now().Format(DefaultDateLayout)))
+	} else if job.Trash.Enabled && destination != "" {
+		args = append(args, "--backup-dir", ApplyRemoteOptions(TrashPath(job, destination)+"/"+time.Now().Format(DefaultDateLayout)))
+	}
+
+	dryRun := IsDryRun(job)
+	if dryRun {
 		args = append(args, "--dry-run")
 	}
 
 	// append any extra flags
 	args = append(args, FlagMapToList(config.Flags)...)
 	args = append(args, config.ExtraFlags...)
+	args = append(args, RemoteFlags(source, destination)...)
+	args = append(args, S3Flags(job)...)
+	if job.ServerSideAcrossConfigs {
+		args = append(args, "--server-side-across-configs")
+	}
+	if bind, err := BindAddress(job.Bind); err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, time.Now(), err.Error())
+		return err
+	} else if bind != "" {
+		args = append(args, "--bind="+bind)
+	}
 	args = append(args, FlagMapToList(job.Flags)...)
 	args = append(args, job.ExtraFlags...)
+	if job.MaxTransfer > 0 {
+		args = append(args, "--max-transfer="+strconv.FormatInt(job.MaxTransfer, 10))
+	}
 
 	Infoln("running", JobInfo(job, "job", source, destination))
 	Debugln("rclone", args)
 
 	start := time.Now()
 
+	if err := CheckSourceSize(ctx, job, source); err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+		return err
+	}
+
+	maxDelete, err := CheckDeletions(ctx, job, source, destination)
+	if err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+		return err
+	}
+	args = append(args, maxDelete...)
+
+	if config.RemoteLock.Enabled && strings.Contains(destination, ":") && !dryRun && !job.Sharded {
+		release, err := AcquireLease(ctx, job, destination)
+		if err != nil {
+			Errorln(err)
+			FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+			return err
+		}
+		defer release()
+	}
+
 	var undoRename func()
 	if strings.HasPrefix(source, BackupPath) && !config.NoRename {
 		var err error
@@ -122,22 +341,63 @@ func RunJob(job JobConfig, source string, destination string) {
 			msg := fmt.Sprintf("failed to rename backups, aborting upload: %s", err)
 			Errorln(msg)
 			FireJobEvent(EventJobFailed, job, source, destination, start, msg)
-			return
+			return errors.New(msg)
 		}
 	}
 
+	logDataPath(ctx, job, source, destination)
 	emerald.Print(emerald.Blue)
 
-	cmd := exec.Command("rclone", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
-	cmd.Stdin = os.Stdin
-	err := cmd.Run()
+	var logged, failed []string
+	var retryAfter time.Duration
+	if UseRC(job) {
+		err = RunRC(ctx, job, source, destination, dryRun)
+	} else {
+		output := NewProgressWriter(JobLog(os.Stdout, job.Index), job.Index)
+		cmd := exec.CommandContext(ctx, RcloneBinary(), args...)
+		cmd.Stdout = output
+		cmd.Stderr = output
+		cmd.Stdin = os.Stdin
+		if job.Stdin != nil {
+			cmd.Stdin = job.Stdin
+		}
+		err = cmd.Run()
+		output.Done()
+		logServerSide(output.ServerSide(), output.Bytes())
+		if !dryRun {
+			traffic.Add(source, destination, output.Bytes(), output.Files())
+		}
+		logged = output.Errors()
+		failed = output.FailedFiles()
+		var throttled int
+		throttled, retryAfter = output.Throttled()
+		pacing.Record(job, source, destination, throttled)
+		if dryRun && err == nil {
+			SaveDryRunChanges(job, source, destination, output.DryRunChanges())
+		}
+	}
+	if err != nil && ToleratedFailure(job, err, failed) {
+		Warnln("rclone failed with", err.Error()+",", len(failed), "failed files, treated as success by the success rules of the job")
+		if len(failed) > 0 {
+			statuses.AddFailedFiles(job.Index, source, destination, failed)
+			statuses.AddWarning(job.Index, fmt.Sprintf("%d files failed to transfer from %s to %s", len(failed), source, destination))
+		}
+		err = nil
+	}
 	if err != nil {
-		msg := fmt.Sprintf("failed to run rclone command: %s", err)
-		Errorln(msg)
-		FireJobEvent(EventJobFailed, job, source, destination, start, msg)
-		return
+		statuses.AddFailedFiles(job.Index, source, destination, failed)
+		rcloneErr := NewRcloneError(fmt.Sprintf("failed to run rclone command: %s", err), logged)
+		rcloneErr.RetryAfter = retryAfter
+		if len(maxDelete) > 0 && strings.Contains(rcloneErr.Message, "max-delete") {
+			// more files were deleted during the run than the check found
+			err = fmt.Errorf("%w: %s", ErrSourceSuspicious, rcloneErr.Message)
+			Errorln(err)
+			FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+			return err
+		}
+		Errorln(rcloneErr.Message, "("+rcloneErr.Class+")")
+		FireJobEvent(EventJobFailed, job, source, destination, start, rcloneErr.Message)
+		return rcloneErr
 	}
 
 	emerald.Print(emerald.Reset)
@@ -146,6 +406,14 @@ func RunJob(job JobConfig, source string, destination string) {
 		undoRename()
 	}
 
+	if job.Versioning.Enabled && destination != "" && !dryRun {
+		PruneVersions(ctx, job, destination)
+	}
+	if job.Trash.Enabled && destination != "" && !dryRun {
+		PruneTrash(ctx, job, destination)
+	}
+
 	Infoln("finished in", boldCyan(FormatDuration(time.Since(start))))
 	FireJobEvent(EventJobSuccessful, job, source, destination, start, "")
+	return nil
 }
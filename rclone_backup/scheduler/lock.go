@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultLockTTL = 30 * time.Minute
+
+var InstanceIDPath = filepath.Join(DataPath, "instance_id")
+
+var ErrRemoteLocked = errors.New("destination is locked")
+
+// LockSuffix ends the name of every lock file, lock files are excluded from all transfers so a job syncing a parent
+// folder doesn't upload or delete the lock of another job
+const LockSuffix = ".rclone_backup.lock"
+
+// RemoteLockConfig coordinates instances writing to the same remotes with a lease file
+type RemoteLockConfig struct {
+	Enabled  bool
+	TTL      string // how long a lease is valid without being renewed
+	Instance string // name of this instance, defaults to a random id
+	Path     string // remote folder all lock files are kept in instead of next to their destination
+}
+
+// RemoteLease is the content of a lock file on a remote
+type RemoteLease struct {
+	Instance string    `json:"instance"`
+	Host     string    `json:"host"`
+	Job      string    `json:"job"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+	Token    string    `json:"token"` // random per lease, only its owner renews and deletes it
+}
+
+var (
+	leasesMu sync.Mutex
+	// heldLeases are the jobs of this instance holding a lease, by lock file
+	heldLeases = make(map[string]string)
+)
+
+var instanceID string
+
+// InstanceID returns the name of this instance, generating a persistent id the first time
+func InstanceID() string {
+	if config.RemoteLock.Instance != "" {
+		return config.RemoteLock.Instance
+	}
+	if instanceID != "" {
+		return instanceID
+	}
+	if data, err := os.ReadFile(InstanceIDPath); err == nil && len(data) > 0 {
+		instanceID = strings.TrimSpace(string(data))
+		return instanceID
+	}
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	instanceID = hex.EncodeToString(buf)
+	if err := os.WriteFile(InstanceIDPath, []byte(instanceID), 0644); err != nil {
+		Errorln("failed to save instance id:", err)
+	}
+	return instanceID
+}
+
+func lockTTL() time.Duration {
+	if ttl, err := time.ParseDuration(config.RemoteLock.TTL); err == nil && ttl > 0 {
+		return ttl
+	}
+	return DefaultLockTTL
+}
+
+// CheckRemoteLock validates the remote lock config
+func CheckRemoteLock() error {
+	if config.RemoteLock.TTL == "" {
+		return nil
+	}
+	if ttl, err := time.ParseDuration(config.RemoteLock.TTL); err != nil || ttl < time.Minute {
+		return errors.New("remote_lock: ttl must be a duration of at least 1m")
+	}
+	return nil
+}
+
+// isRemoteRoot reports whether the destination is the root of its remote, e.g. google: or google:/
+func isRemoteRoot(destination string) bool {
+	i := strings.Index(destination, ":")
+	return i >= 0 && strings.Trim(destination[i+1:], "/") == ""
+}
+
+// LockPath returns the lock file for a destination. It is kept next to the destination, outside the synced folder,
+// or in the remote_lock path when set. The root of a remote has no folder next to it, so it needs the path.
+func LockPath(destination string) (string, error) {
+	destination = strings.TrimSuffix(destination, "/")
+	if config.RemoteLock.Path != "" {
+		name := strings.NewReplacer(":", "_", "/", "_").Replace(destination)
+		return strings.TrimSuffix(config.RemoteLock.Path, "/") + "/" + name + LockSuffix, nil
+	}
+	if isRemoteRoot(destination) {
+		return "", fmt.Errorf("remote_lock: set path to lock '%s', a lock file in the root of the remote would be inside the synced folder", destination)
+	}
+	return destination + LockSuffix, nil
+}
+
+// LockExcludes returns the filter flags that keep transfers from uploading or deleting lock files
+func LockExcludes() []string {
+	if !config.RemoteLock.Enabled {
+		return nil
+	}
+	return []string{"--exclude", "*" + LockSuffix}
+}
+
+func readLease(ctx context.Context, path string) (*RemoteLease, error) {
+	out, err := exec.CommandContext(ctx, RcloneBinary(), "cat", path).Output()
+	if err != nil {
+		// a missing lock file fails with "object not found", ignore it
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && strings.Contains(strings.ToLower(string(exitErr.Stderr)), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil, nil
+	}
+	lease := &RemoteLease{}
+	if err := json.Unmarshal(out, lease); err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %w", path, err)
+	}
+	return lease, nil
+}
+
+func writeLease(ctx context.Context, path string, lease RemoteLease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, RcloneBinary(), "rcat", path)
+	cmd.Stdin = strings.NewReader(string(data))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// AcquireLease takes the lock for a remote destination, renewing it until the
+// returned release function is called
+func AcquireLease(ctx context.Context, job JobConfig, destination string) (func(), error) {
+	path, err := LockPath(destination)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	now := time.Now()
+	own := RemoteLease{Instance: InstanceID(), Host: host, Job: job.Name, Acquired: now, Expires: now.Add(lockTTL()), Token: hex.EncodeToString(buf)}
+
+	// another run of this instance may hold the lease, its lock file is then the same as ours
+	leasesMu.Lock()
+	if holder, held := heldLeases[path]; held {
+		leasesMu.Unlock()
+		return nil, fmt.Errorf("%w by job '%s' of this instance", ErrRemoteLocked, holder)
+	}
+	heldLeases[path] = job.Name
+	leasesMu.Unlock()
+	acquired := false
+	defer func() {
+		if !acquired {
+			leasesMu.Lock()
+			delete(heldLeases, path)
+			leasesMu.Unlock()
+		}
+	}()
+
+	lease, err := readLease(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock %s: %w", path, err)
+	}
+	// a lease of this instance that isn't held was left behind when it stopped and can be taken over
+	if lease != nil && lease.Instance != own.Instance && time.Now().Before(lease.Expires) {
+		return nil, fmt.Errorf("%w by instance '%s' (job '%s') until %s", ErrRemoteLocked, lease.Instance, lease.Job, lease.Expires.Local().Format("2006-01-02 15:04"))
+	}
+
+	if err := writeLease(ctx, path, own); err != nil {
+		return nil, fmt.Errorf("failed to write lock %s: %w", path, err)
+	}
+	// read it back in case another instance wrote at the same time
+	lease, err = readLease(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock %s: %w", path, err)
+	}
+	if lease == nil || lease.Token != own.Token {
+		return nil, fmt.Errorf("%w, lost the race for %s", ErrRemoteLocked, path)
+	}
+	acquired = true
+	Debugln("acquired lock", path)
+
+	// owns reports whether the lock file still holds our lease, it may have expired and been taken over
+	owns := func(ctx context.Context) bool {
+		lease, err := readLease(ctx, path)
+		if err != nil {
+			Errorln("failed to read lock", path+":", err)
+			return false
+		}
+		return lease != nil && lease.Token == own.Token
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockTTL() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !owns(context.Background()) {
+					Errorln("lost lock", path+", it expired or was taken over by another instance")
+					return
+				}
+				own.Expires = time.Now().Add(lockTTL())
+				if err := writeLease(context.Background(), path, own); err != nil {
+					Errorln("failed to renew lock", path+":", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		defer func() {
+			leasesMu.Lock()
+			delete(heldLeases, path)
+			leasesMu.Unlock()
+		}()
+		if !owns(context.Background()) {
+			Warnln("not releasing lock", path+", it is no longer held by this run")
+			return
+		}
+		if out, err := exec.Command(RcloneBinary(), "deletefile", path).CombinedOutput(); err != nil {
+			Errorln("failed to release lock", path+":", err, strings.TrimSpace(string(out)))
+		}
+	}, nil
+}
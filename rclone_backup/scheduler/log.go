@@ -1,11 +1,25 @@
 package main
 
 import (
+	"fmt"
 	"github.com/jcwillox/emerald"
 	"os"
+	"strings"
 	"time"
 )
 
+// logQuiet hides info and debug logs, e.g. for cli commands printing tables
+var logQuiet bool
+
+// fatalHook is called with the message of a fatal log before exiting, e.g. to print it as json
+var fatalHook func(message string)
+
+// SetQuiet hides info logs and moves the remaining logs to stderr
+func SetQuiet() {
+	logQuiet = true
+	emerald.Stdout = emerald.Stderr
+}
+
 func Logln(tag string, color string, a ...interface{}) {
 	emerald.Print(
 		emerald.White, time.Now().Format("[2006-01-02] [15:04:05]"), emerald.Reset,
@@ -16,12 +30,15 @@ func Logln(tag string, color string, a ...interface{}) {
 }
 
 func Debugln(a ...interface{}) {
-	if config.LogLevel == "debug" {
+	if config.LogLevel == "debug" && !logQuiet {
 		Logln("DEBUG", emerald.Cyan, a...)
 	}
 }
 
 func Infoln(a ...interface{}) {
+	if logQuiet {
+		return
+	}
 	Logln("INFO", emerald.Green, a...)
 }
 
@@ -35,5 +52,8 @@ func Errorln(a ...interface{}) {
 
 func Fatalln(a ...interface{}) {
 	Logln("FATAL", emerald.Bold+emerald.Red, a...)
+	if fatalHook != nil {
+		fatalHook(strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+	}
 	os.Exit(1)
 }
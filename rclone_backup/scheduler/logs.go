@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultLogRetention = "31d"
+
+// MaxLogMatches is the largest number of lines a log search returns
+const MaxLogMatches = 1000
+
+var LogsPath = filepath.Join(DataPath, "logs")
+
+// RunLogs keeps the output of each running job in a file per run
+type RunLogs struct {
+	mu        sync.Mutex
+	files     map[int]*os.File
+	followers map[int]map[chan []byte]struct{} // receive the output of a job as it is written
+}
+
+var runLogs = &RunLogs{files: make(map[int]*os.File), followers: make(map[int]map[chan []byte]struct{})}
+
+// LogMatch is a line of a job log matching a search
+type LogMatch struct {
+	Job  int       `json:"job"`
+	Name string    `json:"name,omitempty"`
+	Run  string    `json:"run"`
+	Time time.Time `json:"time"` // start of the run
+	Line int       `json:"line"`
+	Text string    `json:"text"`
+}
+
+// LogSearch filters the lines returned by a log search
+type LogSearch struct {
+	Query string
+	Job   *int
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// CheckLogRetention validates the log_retention option
+func CheckLogRetention() error {
+	if config.LogRetention == "" {
+		return nil
+	}
+	if _, err := ParseAge(config.LogRetention); err != nil {
+		return fmt.Errorf("invalid log_retention: %w", err)
+	}
+	return nil
+}
+
+// Open starts the log of a run, removing logs older than the retention
+func (l *RunLogs) Open(index int, run string) {
+	l.Prune()
+	if err := os.MkdirAll(LogsPath, 0755); err != nil {
+		Errorln("failed to create job log folder:", err)
+		return
+	}
+	file, err := os.Create(runLogPath(index, run))
+	if err != nil {
+		Errorln("failed to create job log:", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files[index] = file
+}
+
+// Close ends the log of the current run of a job, recording its outcome
+func (l *RunLogs) Close(index int, record RunRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, ok := l.files[index]
+	if !ok {
+		return
+	}
+	delete(l.files, index)
+	line := "run " + record.State + " in " + record.Duration
+	if record.Error != "" {
+		line += ": " + record.Error
+	}
+	_, _ = fmt.Fprintln(file, line)
+	l.broadcast(index, []byte(line+"\n"))
+	if err := file.Close(); err != nil {
+		Errorln("failed to save job log:", err)
+	}
+}
+
+func runLogPath(index int, run string) string {
+	return filepath.Join(LogsPath, strconv.Itoa(index)+"_"+run+".log")
+}
+
+func (l *RunLogs) write(index int, b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if file, ok := l.files[index]; ok {
+		_, _ = file.Write(b)
+		l.broadcast(index, b)
+	}
+}
+
+// broadcast sends output to the followers of a job, output is dropped for followers that can't keep up
+func (l *RunLogs) broadcast(index int, b []byte) {
+	for ch := range l.followers[index] {
+		select {
+		case ch <- append([]byte(nil), b...):
+		default:
+		}
+	}
+}
+
+// Writing reports whether the log of a run of the job is open
+func (l *RunLogs) Writing(index int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.files[index]
+	return ok
+}
+
+// FollowRun returns what has been logged by the current run of a job and its output from then on, until stop is
+// called, reading both while holding the lock so no output is missed or repeated
+func (l *RunLogs) FollowRun(index int, run string) (logged []byte, output <-chan []byte, stop func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.files[index]; !ok {
+		return nil, nil, nil, errors.New("run is not being logged")
+	}
+	logged, err = os.ReadFile(runLogPath(index, run))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	output, stop = l.follow(index)
+	return logged, output, stop, nil
+}
+
+// Follow returns the output of a job's runs as it is written, until stop is called
+func (l *RunLogs) Follow(index int) (output <-chan []byte, stop func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.follow(index)
+}
+
+func (l *RunLogs) follow(index int) (<-chan []byte, func()) {
+	ch := make(chan []byte, 256)
+	if l.followers[index] == nil {
+		l.followers[index] = make(map[chan []byte]struct{})
+	}
+	l.followers[index][ch] = struct{}{}
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.followers[index], ch)
+	}
+}
+
+// Prune removes logs older than the retention
+func (l *RunLogs) Prune() {
+	retention, err := ParseAge(DefaultLogRetention)
+	if config.LogRetention != "" {
+		retention, err = ParseAge(config.LogRetention)
+	}
+	if err != nil {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(LogsPath, "*.log"))
+	for _, file := range matches {
+		if stat, err := os.Stat(file); err == nil && time.Since(stat.ModTime()) > retention {
+			Debugln("removing old job log", file)
+			if err := os.Remove(file); err != nil {
+				Warnln("failed to remove old job log", file+":", err)
+			}
+		}
+	}
+}
+
+type jobLogWriter struct {
+	index int
+}
+
+func (w jobLogWriter) Write(b []byte) (int, error) {
+	runLogs.write(w.index, b)
+	return len(b), nil
+}
+
+// JobLog copies output written to out into the log of the job's current run
+func JobLog(out io.Writer, index int) io.Writer {
+	return io.MultiWriter(out, jobLogWriter{index})
+}
+
+// parseLogName returns the job and run of a log file, run ids start with the time of the run
+func parseLogName(file string) (int, string, time.Time, bool) {
+	name := strings.TrimSuffix(filepath.Base(file), ".log")
+	job, run, ok := strings.Cut(name, "_")
+	index, err := strconv.Atoi(job)
+	if !ok || err != nil || len(run) < 15 {
+		return 0, "", time.Time{}, false
+	}
+	start, err := time.ParseInLocation("20060102-150405", run[:15], time.Local)
+	return index, run, start, err == nil
+}
+
+// SearchLogs returns the lines of the job logs containing the query, newest runs first
+func SearchLogs(search LogSearch) ([]LogMatch, bool, error) {
+	if strings.TrimSpace(search.Query) == "" {
+		return nil, false, errors.New("search query is empty")
+	}
+	limit := search.Limit
+	if limit <= 0 || limit > MaxLogMatches {
+		limit = MaxLogMatches
+	}
+	pattern := "*.log"
+	if search.Job != nil {
+		pattern = strconv.Itoa(*search.Job) + "_*.log"
+	}
+	files, err := filepath.Glob(filepath.Join(LogsPath, pattern))
+	if err != nil {
+		return nil, false, err
+	}
+	type logFile struct {
+		path  string
+		job   int
+		run   string
+		start time.Time
+	}
+	var logs []logFile
+	for _, file := range files {
+		job, run, start, ok := parseLogName(file)
+		if !ok || (!search.Since.IsZero() && start.Before(search.Since)) || (!search.Until.IsZero() && !start.Before(search.Until)) {
+			continue
+		}
+		logs = append(logs, logFile{file, job, run, start})
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].start.After(logs[j].start) })
+
+	query := strings.ToLower(search.Query)
+	matches := make([]LogMatch, 0)
+	for _, log := range logs {
+		file, err := os.Open(log.path)
+		if err != nil {
+			continue
+		}
+		name := ""
+		if log.job < len(config.Jobs) {
+			name = config.Jobs[log.job].Name
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if !strings.Contains(strings.ToLower(scanner.Text()), query) {
+				continue
+			}
+			if len(matches) == limit {
+				file.Close()
+				return matches, true, nil
+			}
+			matches = append(matches, LogMatch{Job: log.job, Name: name, Run: log.run, Time: log.start, Line: line, Text: scanner.Text()})
+		}
+		file.Close()
+	}
+	return matches, false, nil
+}
+
+// ParseLogTime parses the date filters of a log search, either a date or a full timestamp,
+// a date used as the end of the search includes that day
+func ParseLogTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ServeRunLog responds with the log of a run, with follow the output of the running job is streamed until the run
+// finishes or the client goes away
+func ServeRunLog(w http.ResponseWriter, r *http.Request, index int, run string) {
+	if run == "" || strings.ContainsAny(run, `/\.`) {
+		http.Error(w, "invalid run '"+run+"'", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+strconv.Itoa(index)+"_"+run+`.log"`)
+	}
+	status := statuses.Get(index)
+	if r.URL.Query().Get("follow") == "" || status.RunID != run {
+		http.ServeFile(w, r, runLogPath(index, run))
+		return
+	}
+	logged, output, stop, err := runLogs.FollowRun(index, run)
+	if err != nil {
+		// the run finished in the meantime
+		http.ServeFile(w, r, runLogPath(index, run))
+		return
+	}
+	defer stop()
+	controller := http.NewResponseController(w)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(logged)
+	_ = controller.Flush()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case chunk := <-output:
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			_ = controller.Flush()
+		case <-ticker.C:
+			// the last line is sent before the log is closed
+			if !runLogs.Writing(index) || statuses.Get(index).RunID != run {
+				for {
+					select {
+					case chunk := <-output:
+						_, _ = w.Write(chunk)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}
+}
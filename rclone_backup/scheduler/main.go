@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/go-co-op/gocron/v2"
@@ -11,9 +12,11 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
+	DataPath          = "/data"
 	ConfigPath        = "/data/options.json"
 	BackupPath        = "/backup"
 	DefaultConfigPath = "/root/.config/rclone/rclone.conf"
@@ -24,39 +27,123 @@ var (
 )
 
 var (
-	config   = &Config{}
-	boldCyan = emerald.ColorFunc("cyan+b")
-	remotes  []string
+	// configFile is the addon config that is loaded, ConfigPath unless changed with --config or running standalone
+	configFile = ConfigPath
+	config     = &Config{}
+	boldCyan   = emerald.ColorFunc("cyan+b")
+	remotes    []string
+	// scheduledJobs maps job indexes to their scheduler entry
+	scheduledJobs = make(map[int]gocron.Job)
 )
 
 type Config struct {
-	Jobs         []JobConfig
-	Flags        Flags
-	ExtraFlags   []string `yaml:"extra_flags"`
-	DryRun       bool     `yaml:"dry_run"`
-	RunOnce      bool     `yaml:"run_once"`
-	ConfigPath   string   `yaml:"config_path"`
-	RcloneConfig string   `yaml:"rclone_config"`
-	NoRename     bool     `yaml:"no_rename"`
-	NoUnrename   bool     `yaml:"no_unrename"`
-	NoSlugify    bool     `yaml:"no_slugify"`
-	NoEvents     bool     `yaml:"no_events"`
-	LogLevel     string   `yaml:"log_level"`
+	Jobs               []JobConfig
+	Templates          []JobConfig
+	Variables          Flags // decoded the same way as flags
+	Flags              Flags
+	ExtraFlags         []string     `yaml:"extra_flags"`
+	DryRun             bool         `yaml:"dry_run"`
+	RunOnce            bool         `yaml:"run_once"`
+	ConfigPath         string       `yaml:"config_path"`
+	RcloneConfig       string       `yaml:"rclone_config"`
+	NoRename           bool         `yaml:"no_rename"`
+	NoUnrename         bool         `yaml:"no_unrename"`
+	NoSlugify          bool         `yaml:"no_slugify"`
+	NoEvents           bool         `yaml:"no_events"`
+	NoNotifications    bool         `yaml:"no_notifications"`
+	NoVolatileExcludes bool         `yaml:"no_volatile_excludes"`
+	LogLevel           string       `yaml:"log_level"`
+	LogRetention       string       `yaml:"log_retention"` // how long job logs are kept for searching
+	APITokens          []APIToken   `yaml:"api_tokens"`
+	CORS               CORSConfig   `yaml:"cors"`
+	APISocket          string       `yaml:"api_socket"`
+	NoAPIPort          bool         `yaml:"no_api_port"`
+	GRPC               bool         `yaml:"grpc"`            // serve the gRPC interface on port 8100
+	Language           string       `yaml:"language"`        // of the web UI, auto or empty for the language of the browser
+	ConfigVersions     int          `yaml:"config_versions"` // how many versions of the config are kept for rolling back
+	DriftThreshold     string       `yaml:"drift_threshold"`
+	RcloneUpdate       UpdateConfig `yaml:"rclone_update"`
+	Quota              QuotaConfig
+	Catalog            CatalogConfig
+	Dedupe             DedupeConfig
+	SelfTest           SelfTestConfig `yaml:"self_test"` // uploads, verifies, downloads and deletes a test file on each remote
+	Notifiers          []NotifierConfig
+	Notify             NotifyConfig
+	CircuitBreaker     CircuitBreakerConfig `yaml:"circuit_breaker"`
+	RemoteLock         RemoteLockConfig     `yaml:"remote_lock"`
+	Remotes            []RemoteConfig       // rate limits and backend options of each remote
+	Proxy              string               // http or socks5 proxy for rclone and notifications
+	NoProxy            []string             `yaml:"no_proxy"`
+	Mounts             []MountConfig        // network shares mounted while the jobs using them run
+	ArtifactsMaxSize   string               `yaml:"artifacts_max_size"`
+	Confirm            ConfirmConfig        // destructive api requests must be confirmed with a one-time code
+	Engine             string               // how transfers are run, "exec" or "rc"
+	Workers            WorkersConfig        // how many scheduled runs may run at once
+	ShutdownGrace      string               `yaml:"shutdown_grace"` // how long running jobs may finish when the addon stops
+	Staging            StagingConfig        // where archives are written before they are uploaded
+	Budget             BudgetConfig         // monthly upload cap for metered connections
+	Costs              CostsConfig          // monthly report of the estimated costs of remotes
+	Throttle           ThrottleConfig       // retries and adaptive pacing of remotes that throttle requests
+	MQTT               MQTTConfig           `yaml:"mqtt"` // broker jobs are triggered from and run states are published on
+	Chaos              ChaosConfig          // injects delays, failures and partial transfers to test retries and notifications
 }
 
 type JobConfig struct {
-	Name         string
-	Schedule     string
-	Command      string
-	Run          string   // when set, run this shell command instead of rclone
-	Source       string
-	Sources      []string
-	Destination  string
-	Destinations []string
-	Include      []string
-	Exclude      []string
-	Flags        Flags
-	ExtraFlags   []string `yaml:"extra_flags"`
+	Name                    string
+	Schedule                string
+	Command                 string
+	Run                     string // when set, run this shell command instead of rclone
+	Source                  string
+	Sources                 []string
+	Destination             string
+	Destinations            []string
+	Include                 []string
+	Exclude                 []string
+	Flags                   Flags
+	ExtraFlags              []string      `yaml:"extra_flags"`
+	SizeAnomaly             float64       `yaml:"size_anomaly"` // percent of the average size below which a run is suspicious
+	MinSourceSize           string        `yaml:"min_source_size"`
+	MinSourceFiles          int64         `yaml:"min_source_files"`
+	MaxDelete               string        `yaml:"max_delete"`        // files a sync may delete, a number or a percentage like "10%"
+	ExpectedDuration        string        `yaml:"expected_duration"` // a run taking longer than this times overdue_factor is degraded
+	OverdueFactor           float64       `yaml:"overdue_factor"`
+	MaxAge                  string        `yaml:"max_age"`            // the last successful run must be newer than this
+	ResumeInterrupted       bool          `yaml:"resume_interrupted"` // run again at startup when the last run was interrupted
+	Shards                  int           // rclone processes run at once, one per top-level folder of the source
+	Success                 SuccessConfig // rclone failures that still count as a successful run
+	RestoreRecent           int           `yaml:"restore_recent"` // number of newest backups a restore test picks from
+	Versioning              VersioningConfig
+	Trash                   TrashConfig
+	Compress                CompressConfig
+	S3                      S3Config `yaml:"s3"` // storage class and tags of uploaded objects
+	Engine                  string   // overrides the global engine, or "restic" to back up into a restic repository
+	Restic                  ResticConfig
+	Borg                    BorgConfig
+	Snapshot                SnapshotConfig // keep rules of the local snapshots of engine snapshot
+	Dumps                   []DumpConfig   // databases dumped before the sources are uploaded
+	Notify                  *NotifyConfig  // overrides the global notify routing
+	Steps                   []StepConfig
+	Template                string
+	Preset                  string         // built-in job, see Presets
+	NoVolatileExcludes      bool           `yaml:"no_volatile_excludes"`
+	Manifest                bool           // list the destinations after each run so runs can be compared
+	Bind                    string         // interface, address or address family transfers are sent from
+	ServerSideAcrossConfigs bool           `yaml:"server_side_across_configs"` // copy server-side between remotes of the same backend
+	VPN                     VPNConfig      `yaml:"vpn"`
+	Wake                    WakeConfig     // wake-on-lan target woken up before the job runs
+	Watch                   WatchConfig    // run when files in the local sources change
+	MQTT                    MQTTTrigger    `yaml:"mqtt"` // run when a message is published on a topic
+	Params                  Flags          // decoded the same way as flags
+	DryRun                  *bool          `yaml:"-"` // overrides the global dry_run for a single run
+	Note                    string         `yaml:"-"` // annotation given when triggering a run
+	Trigger                 string         `yaml:"-"` // what started the run, e.g. schedule or manual
+	RunID                   string         `yaml:"-"` // id given to the run before it started, e.g. while queued
+	Sharded                 bool           `yaml:"-"` // one folder of a sharded run, the remote lock is taken by the whole run
+	MaxTransfer             int64          `yaml:"-"` // bytes transferred before rclone stops, set by chaos mode
+	RetryFiles              []FailedTarget `yaml:"-"` // only transfer these files of each target
+	Stdin                   *os.File       `yaml:"-"` // piped into rclone, e.g. a streamed archive
+	Index                   int            `yaml:"-"`
+	Warnings                []string       `yaml:"-"` // problems found at startup, e.g. unknown remotes
 }
 
 type Flags map[string]string
@@ -89,6 +176,11 @@ func main() {
 		",": "_",
 	}
 
+	os.Exit(RunCLI(os.Args[1:]))
+}
+
+// Setup loads the addon config, checks rclone and validates every job
+func Setup() {
 	// load addon configuration
 	var err error
 	config, err = LoadConfig()
@@ -96,9 +188,23 @@ func main() {
 		Fatalln("failed to read or parse config", err)
 	}
 
+	if !HasSupervisor() {
+		SetupStandalone()
+	}
 	if config.RcloneConfig != "" {
 		config.ConfigPath = DefaultConfigPath
+	} else if config.ConfigPath == "" {
+		config.ConfigPath = os.Getenv("RCLONE_CONFIG")
+	}
+	if config.ConfigPath == "" {
+		// where rclone looks for its config without RCLONE_CONFIG
+		config.ConfigPath = DefaultConfigPath
+	}
+
+	if err := CheckProxy(); err != nil {
+		Fatalln(err)
 	}
+	ApplyProxy()
 
 	// check rclone config exists
 	if stat, _ := os.Stat(config.ConfigPath); stat == nil {
@@ -107,69 +213,339 @@ func main() {
 		Infoln("rclone config found")
 	}
 
+	err = CheckRclone()
+	if err != nil {
+		Fatalln("rclone is not installed or not working", err)
+	}
+	Infoln("found rclone", rcloneInfo.Version, "at", emerald.HighlightPathStat(rcloneInfo.Path))
+
 	remotes, err = GetRcloneRemotes()
 	if err != nil {
 		Fatalln("failed to retrieve list of rclone remotes")
 	}
+	rcloneMu.Lock()
+	rcloneInfo.Remotes = remotes
+	rcloneMu.Unlock()
+	if len(remotes) == 0 {
+		Warnln("no rclone remotes are configured")
+	} else {
+		Infoln("configured remotes:", strings.Join(remotes, ", "))
+	}
+
+	DetectRemotePresets(context.Background())
+	if err := CheckRemoteConfigs(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckNotifiers(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckCircuitBreaker(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckRemoteLock(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckEngine(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckLogRetention(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckMounts(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckArtifacts(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckConfirm(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckWorkers(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckShutdownGrace(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckStaging(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckBudget(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckCosts(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckSelfTest(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckChaos(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckThrottle(); err != nil {
+		Fatalln(err)
+	}
+	if err := CheckMQTT(); err != nil {
+		Fatalln(err)
+	}
 
 	Infoln("checking job configs...")
-	for i, job := range config.Jobs {
+	for i, entry := range config.Jobs {
+		job, err := ResolveTemplate(entry, config.Templates)
+		if err != nil {
+			Fatalln("job", "'"+entry.Name+"':", err)
+		}
+		job, err = ApplyPreset(job)
+		if err != nil {
+			Fatalln("job", "'"+job.Name+"':", err)
+		}
 		if job.Source != "" {
 			job.Sources = []string{job.Source}
 		}
 		if job.Destination != "" {
 			job.Destinations = []string{job.Destination}
 		}
-		err := CheckJob(job)
+		job = AddVolatileExcludes(job)
+		job = ExcludeDumpedDatabases(job)
+		job.Index = i
+		// variables are evaluated again at run time, schedules and the triggers watched from startup only now
+		expanded, err := ExpandJob(job, time.Now())
+		if err != nil {
+			Fatalln("job", "'"+job.Name+"':", err)
+		}
+		job.Schedule = expanded.Schedule
+		job.MQTT.Topic = expanded.MQTT.Topic
+		job.Watch.Paths = expanded.Watch.Paths
+		job.Warnings, err = CheckJob(expanded)
 		if err != nil {
-			Fatalln(err)
+			Fatalln("job", "'"+job.Name+"':", err)
+		}
+		if err := CheckNotify(job); err != nil {
+			Fatalln("job", "'"+job.Name+"':", err)
+		}
+		for _, warning := range job.Warnings {
+			Warnln("job", "'"+job.Name+"':", warning)
 		}
 		config.Jobs[i] = job
 	}
+	CheckScheduleConflicts(config.Jobs)
+}
 
+// Serve schedules the jobs and runs the API until interrupted
+func Serve() {
+	var err error
+	WaitForDataDir()
 	PrintJobs(config.Jobs)
+	CleanStaging()
 
 	// Build runnables for on-demand execution via API
 	runnables := make([]func(), len(config.Jobs))
 	for i, job := range config.Jobs {
+		job.Trigger = TriggerStartup
 		runnables[i] = CreateJob(job)
 	}
 
 	if config.RunOnce {
-		for _, job := range config.Jobs {
+		for i, job := range config.Jobs {
 			if job.Schedule == "" {
-				CreateJob(job)()
+				runnables[i]()
 			}
 		}
+		daemon.Stop()
+		mounts.UnmountAll()
 	} else {
-		// Start Jobs API and UI for "Run now" buttons
-		StartAPIServer(runnables)
+		err = history.Load()
+		if err != nil {
+			Errorln("failed to load job history", err)
+		}
+
+		err = health.Load()
+		if err != nil {
+			Errorln("failed to load scheduler health", err)
+		}
+
+		err = pauses.Load()
+		if err != nil {
+			Errorln("failed to load paused jobs", err)
+		}
+
+		err = freshness.Load()
+		if err != nil {
+			Errorln("failed to load sla breaches", err)
+		}
+
+		err = onceRuns.Load()
+		if err != nil {
+			Errorln("failed to load planned runs", err)
+		}
+
+		err = snoozes.Load()
+		if err != nil {
+			Errorln("failed to load snoozed runs", err)
+		}
+
+		err = budget.Load()
+		if err != nil {
+			Errorln("failed to load data budget", err)
+		}
+
+		err = traffic.Load()
+		if err != nil {
+			Errorln("failed to load remote traffic", err)
+		}
+
+		err = driveAccounts.Load()
+		if err != nil {
+			Errorln("failed to load drive service accounts", err)
+		}
+
+		err = pacing.Load()
+		if err != nil {
+			Errorln("failed to load remote pacing", err)
+		}
+
+		err = configVersions.Load()
+		if err != nil {
+			Errorln("failed to load config versions", err)
+		}
+		configVersions.RecordStartup()
+
+		err = tokens.Load(config.APITokens)
+		if err != nil {
+			Fatalln("failed to load api tokens", err)
+		}
 
-		// only run 1 job at a time to prevent issues with file locks
-		scheduler, err := gocron.NewScheduler(gocron.WithLimitConcurrentJobs(1, gocron.LimitModeWait))
+		// scheduled runs of jobs wait for each other in the run queue
+		scheduler, err := gocron.NewScheduler()
 		if err != nil {
 			Fatalln("failed to create scheduler", err)
 		}
 
 		for i, job := range config.Jobs {
 			if job.Schedule != "" {
-				r := runnables[i]
-				_, err = scheduler.NewJob(gocron.CronJob(job.Schedule, false), gocron.NewTask(r))
+				scheduledJob := job
+				scheduledJob.Trigger = TriggerSchedule
+				r := health.ScheduledTask(job, SkipIfSnoozed(job, SkipIfPaused(job, runQueue.Task(scheduledJob, RunTracked))))
+				scheduled, err := scheduler.NewJob(gocron.CronJob(job.Schedule, false), gocron.NewTask(r))
 				if err != nil {
 					Fatalln("failed to schedule job", "'"+job.Name+"'", err)
 				}
+				scheduledJobs[i] = scheduled
+			}
+		}
+
+		if config.RcloneUpdate.Enabled {
+			schedule := config.RcloneUpdate.Schedule
+			if schedule == "" {
+				schedule = DefaultUpdateSchedule
+			}
+			_, err = scheduler.NewJob(gocron.CronJob(schedule, false), gocron.NewTask(UpdateRclone))
+			if err != nil {
+				Fatalln("failed to schedule rclone updates", err)
 			}
 		}
 
-		// run all immediate jobs (no schedule = run at startup)
+		// maintenance tasks run separately so they aren't delayed by long transfers
+		maintenance, err := gocron.NewScheduler()
+		if err != nil {
+			Fatalln("failed to create scheduler", err)
+		}
+
+		if config.Quota.Enabled {
+			schedule := config.Quota.Schedule
+			if schedule == "" {
+				schedule = DefaultQuotaSchedule
+			}
+			_, err = maintenance.NewJob(gocron.CronJob(schedule, false), gocron.NewTask(CheckQuotas), gocron.WithStartAt(gocron.WithStartImmediately()))
+			if err != nil {
+				Fatalln("failed to schedule quota checks", err)
+			}
+		}
+
+		err = catalog.Load()
+		if err != nil {
+			Errorln("failed to load catalog", err)
+		}
+		if config.Catalog.Enabled {
+			schedule := config.Catalog.Schedule
+			if schedule == "" {
+				schedule = DefaultCatalogSchedule
+			}
+			_, err = maintenance.NewJob(gocron.CronJob(schedule, false), gocron.NewTask(catalog.Refresh), gocron.WithStartAt(gocron.WithStartImmediately()))
+			if err != nil {
+				Fatalln("failed to schedule catalog indexing", err)
+			}
+		}
+
+		err = dedupe.Load()
+		if err != nil {
+			Errorln("failed to load duplicates report", err)
+		}
+		if config.Dedupe.Enabled {
+			schedule := config.Dedupe.Schedule
+			if schedule == "" {
+				schedule = DefaultDedupeSchedule
+			}
+			_, err = maintenance.NewJob(gocron.CronJob(schedule, false), gocron.NewTask(dedupe.Refresh))
+			if err != nil {
+				Fatalln("failed to schedule duplicate checks", err)
+			}
+		}
+
+		if config.Costs.Report {
+			schedule := config.Costs.Schedule
+			if schedule == "" {
+				schedule = DefaultCostsSchedule
+			}
+			_, err = maintenance.NewJob(gocron.CronJob(schedule, false), gocron.NewTask(ReportCosts))
+			if err != nil {
+				Fatalln("failed to schedule cost reports", err)
+			}
+		}
+
+		err = selfTests.Load()
+		if err != nil {
+			Errorln("failed to load self-test", err)
+		}
+		if config.SelfTest.Enabled {
+			schedule := config.SelfTest.Schedule
+			if schedule == "" {
+				schedule = DefaultSelfTestSchedule
+			}
+			_, err = maintenance.NewJob(gocron.CronJob(schedule, false), gocron.NewTask(selfTests.Scheduled))
+			if err != nil {
+				Fatalln("failed to schedule self-tests", err)
+			}
+		}
+
+		// Start Jobs API and UI for "Run now" buttons
+		StartAPIServer()
+		StartGRPCServer()
+		ServeControl()
+
+		// run all immediate jobs (no schedule = run at startup), except those waiting for their usb drive
 		for i, job := range config.Jobs {
-			if job.Schedule == "" {
+			if job.Schedule == "" && !HotplugOnly(job) {
 				runnables[i]()
 			}
 		}
 
-		// start the scheduler
+		// start the schedulers
+		StartWorkers()
 		scheduler.Start()
+		maintenance.Start()
+		for i := range scheduledJobs {
+			health.Expect(i)
+		}
+		health.Start()
+		freshness.Start()
+		PublishRunSensors()
+		onceRuns.Start()
+		hotplug.Start()
+		StartWatchers()
+		StartMQTT()
+		ListenStdin()
+		ResumeInterrupted()
+		SignalReady()
 
 		// block until interrupted
 		done := make(chan os.Signal, 1)
@@ -177,18 +553,27 @@ func main() {
 		<-done
 
 		Infoln("shutting down...")
+		SignalStopping()
+		Shutdown()
 
-		// shutdown scheduler
+		// shutdown schedulers
 		err = scheduler.Shutdown()
 		if err != nil {
 			Errorln("failed to shutdown scheduler", err)
 		}
+		err = maintenance.Shutdown()
+		if err != nil {
+			Errorln("failed to shutdown maintenance scheduler", err)
+		}
+		daemon.Stop()
+		mounts.UnmountAll()
 
 	}
 }
 
+// LoadConfig reads the addon config from the config file
 func LoadConfig() (*Config, error) {
-	data, err := os.ReadFile(ConfigPath)
+	data, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
@@ -200,25 +585,159 @@ func LoadConfig() (*Config, error) {
 	return config, nil
 }
 
-func CheckJob(job JobConfig) error {
+// NextRun returns the next scheduled or planned run of the job at index, if any
+func NextRun(index int) *time.Time {
+	once := onceRuns.Next(index)
+	scheduled, ok := scheduledJobs[index]
+	if !ok {
+		return once
+	}
+	runs, err := scheduled.NextRuns(2)
+	if err != nil || len(runs) == 0 || runs[0].IsZero() {
+		return once
+	}
+	next := runs[0]
+	if snoozed := snoozes.Get(index); snoozed != nil && next.Equal(snoozed.Skip) {
+		if len(runs) < 2 {
+			return once
+		}
+		next = runs[1]
+	}
+	if once != nil && once.Before(next) {
+		return once
+	}
+	return &next
+}
+
+// CheckJob validates the job, returning warnings for problems that don't prevent it running
+func CheckJob(job JobConfig) ([]string, error) {
+	warnings, err := CheckDumps(job)
+	if err != nil {
+		return warnings, err
+	}
+	if err := CheckBind(job, &warnings); err != nil {
+		return warnings, err
+	}
+	if err := CheckVPNConfig(job); err != nil {
+		return warnings, err
+	}
+	if err := CheckWake(job); err != nil {
+		return warnings, err
+	}
+	if err := CheckExpectedDuration(job); err != nil {
+		return warnings, err
+	}
+	if err := CheckMaxAge(job); err != nil {
+		return warnings, err
+	}
+	if err := CheckSuccess(job); err != nil {
+		return warnings, err
+	}
+	if err := CheckWatch(job); err != nil {
+		return warnings, err
+	}
+	if err := CheckMQTTTrigger(job); err != nil {
+		return warnings, err
+	}
+	if len(job.Steps) > 0 {
+		return warnings, CheckSteps(job.Steps, &warnings)
+	}
 	if job.Run != "" {
 		// Arbitrary shell command: no source/destination required
-		return nil
+		return warnings, nil
+	}
+	if job.Command == CommandRestoreTest {
+		if len(job.Sources) == 0 {
+			return nil, errors.New("restore tests require a source to download backups from")
+		}
+		for _, source := range job.Sources {
+			if err := checkTarget(source, &warnings); err != nil {
+				return warnings, err
+			}
+		}
+		return warnings, nil
+	}
+	if job.Engine != "" && job.Engine != EngineExec && job.Engine != EngineRC && job.Engine != EngineRestic && job.Engine != EngineBorg && job.Engine != EngineSnapshot {
+		return nil, errors.New("engine must be 'exec', 'rc', 'restic', 'borg' or 'snapshot'")
+	}
+	if JobEngine(job) == EngineSnapshot {
+		engineWarnings, err := CheckSnapshot(job)
+		warnings = append(warnings, engineWarnings...)
+		if err != nil {
+			return warnings, err
+		}
+	}
+	if JobEngine(job) == EngineBorg {
+		engineWarnings, err := CheckBorg(job)
+		warnings = append(warnings, engineWarnings...)
+		if err != nil || job.Borg.Borgmatic != "" {
+			// borgmatic has its own sources and repositories
+			return warnings, err
+		}
+	}
+	if JobEngine(job) == EngineRestic {
+		engineWarnings, err := CheckRestic(job)
+		warnings = append(warnings, engineWarnings...)
+		if err != nil {
+			return warnings, err
+		}
+	}
+	if job.Command == CommandCompress {
+		if err := CheckCompress(job.Compress); err != nil {
+			return nil, err
+		}
+		if len(job.Sources) == 0 || len(job.Destinations) == 0 {
+			return nil, errors.New("compress requires a source folder and a destination to upload the archive to")
+		}
+		for _, source := range job.Sources {
+			if strings.Contains(source, ":") {
+				return nil, fmt.Errorf("compress can only archive local folders, not '%s'", source)
+			}
+		}
+	}
+	if job.MinSourceSize != "" {
+		if _, err := ParseSizeString(job.MinSourceSize); err != nil {
+			return nil, fmt.Errorf("min_source_size: %w", err)
+		}
+	}
+	if job.MaxDelete != "" {
+		if _, _, err := ParseMaxDelete(job.MaxDelete); err != nil {
+			return nil, err
+		}
+		if job.Command != "sync" {
+			warnings = append(warnings, "max_delete only applies to sync jobs")
+		}
+	}
+	if err := CheckVersioning(job); err != nil {
+		return nil, err
+	}
+	if err := CheckShards(job); err != nil {
+		return nil, err
+	}
+	if err := CheckS3(job); err != nil {
+		return nil, err
+	}
+	if err := CheckTrash(job); err != nil {
+		return nil, err
 	}
 	if len(job.Sources) == 0 {
-		return errors.New("at least 1 source must be specified, or set 'run' for a shell command")
+		return nil, errors.New("at least 1 source must be specified, or set 'run' for a shell command or 'steps' for a pipeline")
 	}
 	for _, source := range job.Sources {
-		if err := CheckRemote(source); err != nil {
-			return err
+		if err := checkTarget(source, &warnings); err != nil {
+			return warnings, err
 		}
 	}
+	// borg creates its repository when it is first used
+	if JobEngine(job) == EngineBorg {
+		return warnings, nil
+	}
 	for _, destination := range job.Destinations {
-		if err := CheckRemote(destination); err != nil {
-			return err
+		if err := checkTarget(destination, &warnings); err != nil {
+			return warnings, err
 		}
 	}
-	return nil
+	return warnings, nil
 }
 
 func CheckRemote(path string) error {
@@ -226,10 +745,10 @@ func CheckRemote(path string) error {
 	if len(parts) == 2 {
 		remote := parts[0] + ":"
 		if !ArrayContains(remotes, remote) {
-			return fmt.Errorf("remote '%s' does not exist; configured remotes are [%s]", remote, remotes)
+			return fmt.Errorf("%w '%s'; configured remotes are %v", ErrUnknownRemote, remote, remotes)
 		}
-	} else if len(parts) == 1 {
-		// check local path exists
+	} else if len(parts) == 1 && !InMount(parts[0]) {
+		// check local path exists, managed mounts are only mounted while a job runs
 		if stat, err := os.Stat(parts[0]); stat == nil {
 			return fmt.Errorf("local target '%s' does not exist; %v", parts[0], err)
 		}
@@ -249,6 +768,19 @@ func JobInfoShell(job JobConfig) string {
 	return "run: " + emerald.HighlightPath(snippet)
 }
 
+// JobInfoSteps returns a short description for a pipeline job
+func JobInfoSteps(job JobConfig) string {
+	names := make([]string, len(job.Steps))
+	for i, step := range job.Steps {
+		names[i] = StepName(step, i)
+	}
+	info := strings.Join(names, " "+Arrow+" ")
+	if job.Name != "" {
+		return emerald.Cyan + "\"" + job.Name + "\"" + emerald.Reset + "; " + info
+	}
+	return info
+}
+
 func JobInfo(job JobConfig, defaultName string, sourceDest ...string) string {
 	sb := strings.Builder{}
 	if job.Name != "" {
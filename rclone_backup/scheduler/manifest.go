@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestFile is a file found on the destination after a run
+type ManifestFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// ManifestTarget is the listing of one destination of a run
+type ManifestTarget struct {
+	Source      string         `json:"source,omitempty"`
+	Destination string         `json:"destination"`
+	Files       []ManifestFile `json:"files"`
+}
+
+// Manifest is the contents of every destination of a run
+type Manifest struct {
+	Run     string           `json:"run"`
+	Job     int              `json:"job"`
+	Start   time.Time        `json:"start"`
+	Targets []ManifestTarget `json:"targets"`
+}
+
+// ManifestChange is a file that differs between two runs
+type ManifestChange struct {
+	Destination string        `json:"destination"`
+	Path        string        `json:"path"`
+	Before      *ManifestFile `json:"before,omitempty"`
+	After       *ManifestFile `json:"after,omitempty"`
+}
+
+// ManifestDiff are the files added, removed and changed between two runs
+type ManifestDiff struct {
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+	Added   []ManifestChange `json:"added"`
+	Removed []ManifestChange `json:"removed"`
+	Changed []ManifestChange `json:"changed"`
+}
+
+// ListManifest lists every file on the destination using rclone lsjson
+func ListManifest(source string, destination string) (ManifestTarget, error) {
+	target := ManifestTarget{Source: source, Destination: destination, Files: []ManifestFile{}}
+	out, err := exec.Command(RcloneBinary(), "lsjson", "--recursive", "--files-only", destination).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return target, err
+	}
+	var items []struct {
+		Path    string    `json:"Path"`
+		Size    int64     `json:"Size"`
+		ModTime time.Time `json:"ModTime"`
+	}
+	if err := json.Unmarshal(out, &items); err != nil {
+		return target, err
+	}
+	for _, item := range items {
+		target.Files = append(target.Files, ManifestFile{Path: item.Path, Size: item.Size, Modified: item.ModTime})
+	}
+	sort.Slice(target.Files, func(i, j int) bool { return target.Files[i].Path < target.Files[j].Path })
+	return target, nil
+}
+
+// RecordManifest lists the destination after a successful transfer and adds it to the manifest of the run
+func RecordManifest(job JobConfig, source string, destination string) {
+	if !job.Manifest || IsDryRun(job) || destination == "" {
+		return
+	}
+	target, err := ListManifest(source, destination)
+	if err != nil {
+		Warnln("failed to list", HighlightRemote(destination), "for the run manifest:", err)
+		return
+	}
+	Debugln("recorded", len(target.Files), "files of", destination, "in the run manifest")
+	statuses.AddManifest(job.Index, target)
+}
+
+// SaveManifest writes the manifest of a finished run to its artifacts, marking the record as having one
+func SaveManifest(record *RunRecord, targets []ManifestTarget) {
+	if len(targets) == 0 {
+		return
+	}
+	manifest := Manifest{Run: record.ID, Job: record.Job, Start: record.Start, Targets: targets}
+	data, err := json.Marshal(manifest)
+	if err == nil {
+		err = WriteArtifact(record.Job, record.ID, ArtifactManifest, data)
+	}
+	if err != nil {
+		Errorln("failed to save run manifest:", err)
+		return
+	}
+	record.Manifest = true
+}
+
+// LoadManifest reads the manifest of a run
+func LoadManifest(job int, run string) (Manifest, error) {
+	var manifest Manifest
+	path, err := ArtifactPath(job, run, ArtifactManifest)
+	if err != nil {
+		return manifest, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, fmt.Errorf("run '%s' has no manifest", run)
+	}
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, json.Unmarshal(data, &manifest)
+}
+
+// ManifestRuns returns the ids of the runs of a job that have a manifest, newest first
+func ManifestRuns(job int) []string {
+	var runs []string
+	for _, run := range history.Runs(job) {
+		if run.Manifest {
+			runs = append(runs, run.ID)
+		}
+	}
+	return runs
+}
+
+// DiffManifests compares two manifests, targets are matched by their order so
+// destinations containing the date of the run are still compared
+func DiffManifests(from Manifest, to Manifest) ManifestDiff {
+	diff := ManifestDiff{From: from.Run, To: to.Run, Added: []ManifestChange{}, Removed: []ManifestChange{}, Changed: []ManifestChange{}}
+	for i := 0; i < len(from.Targets) || i < len(to.Targets); i++ {
+		before := make(map[string]ManifestFile)
+		destination := ""
+		if i < len(from.Targets) {
+			destination = from.Targets[i].Destination
+			for _, file := range from.Targets[i].Files {
+				before[file.Path] = file
+			}
+		}
+		after := make(map[string]ManifestFile)
+		if i < len(to.Targets) {
+			destination = to.Targets[i].Destination
+			for _, file := range to.Targets[i].Files {
+				after[file.Path] = file
+				old, ok := before[file.Path]
+				if !ok {
+					diff.Added = append(diff.Added, ManifestChange{Destination: destination, Path: file.Path, After: &file})
+				} else if old.Size != file.Size || !old.Modified.Equal(file.Modified) {
+					diff.Changed = append(diff.Changed, ManifestChange{Destination: destination, Path: file.Path, Before: &old, After: &file})
+				}
+			}
+		}
+		if i < len(from.Targets) {
+			for _, file := range from.Targets[i].Files {
+				if _, ok := after[file.Path]; !ok {
+					diff.Removed = append(diff.Removed, ManifestChange{Destination: destination, Path: file.Path, Before: &file})
+				}
+			}
+		}
+	}
+	return diff
+}
+
+// DiffRuns compares the manifests of two runs of a job, by default the two newest runs with a manifest
+func DiffRuns(job int, from string, to string) (ManifestDiff, error) {
+	runs := ManifestRuns(job)
+	if to == "" && len(runs) > 0 {
+		to = runs[0]
+	}
+	if from == "" {
+		for i, run := range runs {
+			if run == to && i+1 < len(runs) {
+				from = runs[i+1]
+			}
+		}
+	}
+	if from == "" || to == "" {
+		return ManifestDiff{}, errors.New("job needs two runs with a manifest to compare")
+	}
+	before, err := LoadManifest(job, from)
+	if err != nil {
+		return ManifestDiff{}, err
+	}
+	after, err := LoadManifest(job, to)
+	if err != nil {
+		return ManifestDiff{}, err
+	}
+	return DiffManifests(before, after), nil
+}
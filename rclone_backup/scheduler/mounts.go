@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosimple/slug"
+)
+
+const (
+	MountCIFS = "cifs"
+	MountNFS  = "nfs"
+	MountUSB  = "usb"
+)
+
+// DefaultMountsPath is the folder mounts are created in when they have no path
+const DefaultMountsPath = "/mnt"
+
+// mountTimeout is how long mounting, unmounting or reading a share may take, a stale nfs mount blocks forever
+const mountTimeout = time.Minute
+
+// MountConfig is a network share mounted while the jobs using its path run
+type MountConfig struct {
+	Name         string
+	Type         string // cifs, nfs or usb
+	Share        string // e.g. //nas.local/backups or nas.local:/volume1/backups
+	Label        string // filesystem label of a usb drive
+	Path         string // where the share is mounted, defaults to /mnt/<name>
+	Username     string
+	Password     string
+	PasswordFile string `yaml:"password_file"`
+	Domain       string
+	Options      string // extra mount options, e.g. vers=3.0
+	Keep         bool   // keep the share mounted between runs
+	Hotplug      bool   // run the jobs using a usb drive when it is plugged in
+}
+
+// Mounts counts the running jobs using each managed mount
+type Mounts struct {
+	mu    sync.Mutex
+	users map[string]int
+	// mounted are the shares mounted by the addon, which are unmounted when it stops
+	mounted map[string]bool
+}
+
+var mounts = &Mounts{users: make(map[string]int), mounted: make(map[string]bool)}
+
+// MountPath returns the folder the share is mounted on
+func MountPath(mount MountConfig) string {
+	if mount.Path != "" {
+		return filepath.Clean(mount.Path)
+	}
+	return filepath.Join(DefaultMountsPath, slug.Make(mount.Name))
+}
+
+// CheckMounts validates the mounts option
+func CheckMounts() error {
+	paths := make(map[string]string)
+	for _, mount := range config.Mounts {
+		if mount.Name == "" {
+			return errors.New("mounts: every mount requires a name")
+		}
+		switch mount.Type {
+		case MountCIFS:
+			if !strings.HasPrefix(mount.Share, "//") {
+				return fmt.Errorf("mounts: '%s' share must look like //host/share", mount.Name)
+			}
+		case MountNFS:
+			if !strings.Contains(mount.Share, ":/") {
+				return fmt.Errorf("mounts: '%s' share must look like host:/export", mount.Name)
+			}
+			if mount.Username != "" || mount.Password != "" || mount.PasswordFile != "" {
+				return fmt.Errorf("mounts: '%s' nfs shares don't use credentials", mount.Name)
+			}
+		case MountUSB:
+			if mount.Label == "" {
+				return fmt.Errorf("mounts: '%s' usb drives require the label of their filesystem", mount.Name)
+			}
+			if mount.Username != "" || mount.Password != "" || mount.PasswordFile != "" {
+				return fmt.Errorf("mounts: '%s' usb drives don't use credentials", mount.Name)
+			}
+		default:
+			return fmt.Errorf("mounts: '%s' has unknown type '%s', must be %s, %s or %s", mount.Name, mount.Type, MountCIFS, MountNFS, MountUSB)
+		}
+		if mount.Hotplug && mount.Type != MountUSB {
+			return fmt.Errorf("mounts: '%s' hotplug only applies to usb drives", mount.Name)
+		}
+		if mount.Password != "" && mount.PasswordFile != "" {
+			return fmt.Errorf("mounts: '%s' can't have both a password and password_file", mount.Name)
+		}
+		path := MountPath(mount)
+		if !filepath.IsAbs(path) || path == "/" {
+			return fmt.Errorf("mounts: '%s' path must be an absolute folder", mount.Name)
+		}
+		if other, ok := paths[path]; ok {
+			return fmt.Errorf("mounts: '%s' and '%s' use the same path %s", other, mount.Name, path)
+		}
+		paths[path] = mount.Name
+	}
+	return nil
+}
+
+// JobMounts returns the mounts whose path contains one of the job's sources or destinations
+func JobMounts(job JobConfig) []MountConfig {
+	paths := append(append([]string{}, job.Sources...), job.Destinations...)
+	for _, step := range job.Steps {
+		paths = append(paths, step.Source, step.Destination)
+	}
+	var list []MountConfig
+	for _, mount := range config.Mounts {
+		for _, path := range paths {
+			if mountContains(mount, path) {
+				list = append(list, mount)
+				break
+			}
+		}
+	}
+	return list
+}
+
+func mountContains(mount MountConfig, path string) bool {
+	root := MountPath(mount)
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// InMount reports whether a local path is inside a managed mount, which may only be mounted while a job runs
+func InMount(path string) bool {
+	for _, mount := range config.Mounts {
+		if mountContains(mount, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMounted reports whether a filesystem is mounted on the path
+func isMounted(path string) bool {
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// spaces in mount points are escaped as \040
+		if len(fields) > 1 && strings.ReplaceAll(fields[1], `\040`, " ") == path {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMount returns why a mounted share can't be read, or nil when it is healthy
+func checkMount(path string) error {
+	if !isMounted(path) {
+		return fmt.Errorf("%s is not mounted", path)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.ReadDir(path)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(mountTimeout):
+		return fmt.Errorf("%s is not responding", path)
+	}
+}
+
+// mountOptions returns the options of a mount, cifs credentials are written to a file
+// so the password isn't visible in the process list, the returned function removes it
+func mountOptions(mount MountConfig) (string, func(), error) {
+	options := []string{}
+	cleanup := func() {}
+	if mount.Type == MountCIFS {
+		password := mount.Password
+		if mount.PasswordFile != "" {
+			data, err := os.ReadFile(mount.PasswordFile)
+			if err != nil {
+				return "", cleanup, fmt.Errorf("failed to read password_file: %w", err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		if mount.Username == "" {
+			options = append(options, "guest")
+		} else {
+			file, err := os.CreateTemp("", "mount-*.cred")
+			if err != nil {
+				return "", cleanup, err
+			}
+			cleanup = func() { _ = os.Remove(file.Name()) }
+			_, err = fmt.Fprintf(file, "username=%s\npassword=%s\n", mount.Username, password)
+			if err == nil && mount.Domain != "" {
+				_, err = fmt.Fprintf(file, "domain=%s\n", mount.Domain)
+			}
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				cleanup()
+				return "", func() {}, err
+			}
+			options = append(options, "credentials="+file.Name())
+		}
+	}
+	if mount.Options != "" {
+		options = append(options, mount.Options)
+	}
+	return strings.Join(options, ","), cleanup, nil
+}
+
+// runMount runs mount or umount, returning its output as the error
+func runMount(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, mountTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// mount mounts a share if it isn't mounted and healthy, remounting stale mounts
+func (m *Mounts) mount(ctx context.Context, mount MountConfig) error {
+	path := MountPath(mount)
+	if err := checkMount(path); err == nil {
+		Debugln("mount", mount.Name, "is healthy")
+		return nil
+	} else if isMounted(path) {
+		Warnln("mount", mount.Name, "is stale,", err.Error()+", remounting")
+		if err := runMount(ctx, "umount", "-l", path); err != nil {
+			return fmt.Errorf("failed to unmount stale %s: %w", path, err)
+		}
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	options, cleanup, err := mountOptions(mount)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	share := mount.Share
+	args := []string{"-t", mount.Type, share, path}
+	if mount.Type == MountUSB {
+		// the filesystem of the drive is detected by mount
+		share = usbDevice(mount.Label)
+		if !usbAttached(mount.Label) {
+			return fmt.Errorf("usb drive '%s' is not plugged in", mount.Label)
+		}
+		args = []string{share, path}
+	}
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+	Infoln("mounting", share, "on", path)
+	if err := runMount(ctx, "mount", args...); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", share, err)
+	}
+	if err := checkMount(path); err != nil {
+		_ = runMount(ctx, "umount", "-l", path)
+		return fmt.Errorf("mounted %s but it can't be read: %w", share, err)
+	}
+	m.mounted[path] = true
+	return nil
+}
+
+// unmount unmounts a share mounted by the addon
+func (m *Mounts) unmount(mount MountConfig) {
+	path := MountPath(mount)
+	if !m.mounted[path] {
+		return
+	}
+	Infoln("unmounting", path)
+	if err := runMount(context.Background(), "umount", path); err != nil {
+		Warnln("failed to unmount", path+":", err)
+		return
+	}
+	delete(m.mounted, path)
+}
+
+// Acquire mounts the shares used by the job, the returned function unmounts them once no
+// other running job uses them and must be called when the job finishes
+func (m *Mounts) Acquire(ctx context.Context, job JobConfig) (func(), error) {
+	var acquired []MountConfig
+	release := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, mount := range acquired {
+			m.users[mount.Name]--
+			if m.users[mount.Name] == 0 && !mount.Keep {
+				m.unmount(mount)
+			}
+		}
+	}
+	for _, mount := range JobMounts(job) {
+		m.mu.Lock()
+		err := m.mount(ctx, mount)
+		if err == nil {
+			m.users[mount.Name]++
+			acquired = append(acquired, mount)
+		}
+		m.mu.Unlock()
+		if err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// UnmountAll unmounts every share mounted by the addon when it stops
+func (m *Mounts) UnmountAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mount := range config.Mounts {
+		m.unmount(mount)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMQTTPort = 1883
+	// mqttKeepAlive is how often the broker is pinged, it drops clients it hasn't heard from for 1.5 times this long
+	mqttKeepAlive = 60 * time.Second
+	// mqttMaxReconnectDelay caps the wait between reconnects, which doubles from mqttReconnectDelay
+	mqttReconnectDelay    = 5 * time.Second
+	mqttMaxReconnectDelay = 5 * time.Minute
+)
+
+// MQTT packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttConnackErrors are the reasons a broker refuses a connection
+var mqttConnackErrors = map[byte]string{
+	1: "unsupported protocol version", 2: "client id rejected", 3: "server unavailable",
+	4: "bad username or password", 5: "not authorized",
+}
+
+// MQTTConfig is the broker jobs are triggered from and run states are published on, by default the broker of the
+// Mosquitto addon
+type MQTTConfig struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	TLS        bool   `yaml:"tls"`
+	ClientID   string `yaml:"client_id"`
+	StateTopic string `yaml:"state_topic"` // prefix of the topics the last run of each job is published on
+}
+
+// MQTTTrigger runs a job when a message is published on a topic
+type MQTTTrigger struct {
+	Topic   string // may contain the + and # wildcards
+	Payload string // regular expression the whole payload has to match
+}
+
+// mqttConnection is the client connected to the broker, nil while disconnected
+var mqttConnection struct {
+	mu     sync.Mutex
+	client *mqttClient
+}
+
+// mqttService is the broker the Supervisor provides to addons with the mqtt service
+type mqttService struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	SSL      bool   `json:"ssl"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CheckMQTT validates the global mqtt options
+func CheckMQTT() error {
+	topic := config.MQTT.StateTopic
+	if strings.ContainsAny(topic, "+#") || strings.HasSuffix(topic, "/") {
+		return fmt.Errorf("mqtt: invalid state_topic '%s', it can't contain wildcards or end with /", topic)
+	}
+	return nil
+}
+
+// CheckMQTTTrigger validates the mqtt trigger of a job
+func CheckMQTTTrigger(job JobConfig) error {
+	topic := job.MQTT.Topic
+	if topic == "" {
+		if job.MQTT.Payload != "" {
+			return errors.New("mqtt: payload requires a topic")
+		}
+		return nil
+	}
+	for i, level := range strings.Split(topic, "/") {
+		if strings.Contains(level, "#") && (level != "#" || i != strings.Count(topic, "/")) {
+			return fmt.Errorf("mqtt: invalid topic '%s', # must be the last level", topic)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("mqtt: invalid topic '%s', + must be a whole level", topic)
+		}
+	}
+	if _, err := regexp.Compile(job.MQTT.Payload); err != nil {
+		return fmt.Errorf("mqtt: invalid payload pattern: %w", err)
+	}
+	return nil
+}
+
+// MQTTTopicMatches reports whether a topic matches a subscription with wildcards
+func MQTTTopicMatches(filter string, topic string) bool {
+	filters := strings.Split(filter, "/")
+	levels := strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(levels) || (f != "+" && f != levels[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(levels)
+}
+
+// mqttBroker returns the configured broker, or the one of the Mosquitto addon
+func mqttBroker() (MQTTConfig, error) {
+	broker := config.MQTT
+	if broker.Host == "" {
+		var service mqttService
+		if err := SupervisorGet("/services/mqtt", &service); err != nil {
+			return broker, fmt.Errorf("no mqtt host is set and no broker is provided by the supervisor: %w", err)
+		}
+		broker.Host, broker.Port, broker.TLS = service.Host, service.Port, service.SSL
+		if broker.Username == "" {
+			broker.Username, broker.Password = service.Username, service.Password
+		}
+	}
+	if broker.Port == 0 {
+		broker.Port = DefaultMQTTPort
+	}
+	if broker.ClientID == "" {
+		broker.ClientID = "rclone_backup_" + InstanceID()
+	}
+	return broker, nil
+}
+
+// mqttJobs returns the jobs triggered by mqtt messages
+func mqttJobs() []JobConfig {
+	var jobs []JobConfig
+	for _, job := range config.Jobs {
+		if job.MQTT.Topic != "" {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// StartMQTT subscribes to the topics of the jobs triggered by mqtt messages and publishes the run states,
+// reconnecting whenever the connection to the broker is lost
+func StartMQTT() {
+	jobs := mqttJobs()
+	if len(jobs) == 0 && config.MQTT.StateTopic == "" {
+		return
+	}
+	go func() {
+		delay := mqttReconnectDelay
+		for {
+			started := time.Now()
+			err := listenMQTT(jobs)
+			if time.Since(started) > mqttMaxReconnectDelay {
+				delay = mqttReconnectDelay
+			}
+			Warnln("mqtt:", err.Error()+", reconnecting in", FormatDuration(delay))
+			time.Sleep(delay)
+			delay = min(delay*2, mqttMaxReconnectDelay)
+		}
+	}()
+}
+
+// PublishMQTT publishes a retained message, failing while the broker isn't connected
+func PublishMQTT(topic string, payload []byte) error {
+	mqttConnection.mu.Lock()
+	client := mqttConnection.client
+	mqttConnection.mu.Unlock()
+	if client == nil {
+		return errors.New("not connected to the broker")
+	}
+	return client.Publish(topic, payload)
+}
+
+// listenMQTT connects to the broker and runs the jobs whose topic a message is published on until the connection
+// is lost
+func listenMQTT(jobs []JobConfig) error {
+	broker, err := mqttBroker()
+	if err != nil {
+		return err
+	}
+	client, err := dialMQTT(broker)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	var topics []string
+	for _, job := range jobs {
+		if !ArrayContains(topics, job.MQTT.Topic) {
+			topics = append(topics, job.MQTT.Topic)
+		}
+	}
+	if len(topics) > 0 {
+		if err := client.Subscribe(topics); err != nil {
+			return err
+		}
+		Infoln("subscribed to", len(topics), "mqtt topics on", broker.Host+":"+strconv.Itoa(broker.Port))
+	}
+	go client.ping()
+	if config.MQTT.StateTopic != "" {
+		mqttConnection.mu.Lock()
+		mqttConnection.client = client
+		mqttConnection.mu.Unlock()
+		defer func() {
+			mqttConnection.mu.Lock()
+			mqttConnection.client = nil
+			mqttConnection.mu.Unlock()
+		}()
+		Infoln("publishing run states on", config.MQTT.StateTopic+"/# of", broker.Host+":"+strconv.Itoa(broker.Port))
+		// states that changed while disconnected are published again
+		for _, job := range config.Jobs {
+			publishRunState(job, lastRun(job.Index))
+		}
+	}
+	for {
+		topic, payload, err := client.Receive()
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if !MQTTTopicMatches(job.MQTT.Topic, topic) {
+				continue
+			}
+			// the pattern was checked at startup
+			if pattern := regexp.MustCompile("^(?:" + job.MQTT.Payload + ")$"); !pattern.Match(payload) {
+				Debugln("mqtt:", topic, "payload doesn't match the pattern of", "'"+job.Name+"'")
+				continue
+			}
+			Infoln("mqtt: message on", topic+",", "running", "'"+job.Name+"'")
+			job.Trigger = TriggerMQTT
+			go SkipIfPaused(job, runQueue.Task(job, RunTracked))()
+		}
+	}
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client that subscribes and publishes retained messages with QoS 0
+type mqttClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	done    chan struct{}
+}
+
+// dialMQTT connects and logs in to the broker
+func dialMQTT(broker MQTTConfig) (*mqttClient, error) {
+	address := net.JoinHostPort(broker.Host, strconv.Itoa(broker.Port))
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if broker.TLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: broker.Host})
+	}
+	c := &mqttClient{conn: conn, reader: bufio.NewReader(conn), done: make(chan struct{})}
+
+	// clean session, the topics are subscribed again after each connect
+	flags := byte(0x02)
+	payload := mqttString(broker.ClientID)
+	if broker.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(broker.Username)...)
+		if broker.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(broker.Password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := c.write(mqttConnect<<4, append(body, payload...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	header, ack, err := c.read()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	if header>>4 != mqttConnack || len(ack) < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: unexpected packet %d", address, header>>4)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		reason, ok := mqttConnackErrors[ack[1]]
+		if !ok {
+			reason = "refused with code " + strconv.Itoa(int(ack[1]))
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %s", address, reason)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// mqttString encodes a length prefixed string
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// write sends a packet, header is the packet type and flags
+func (c *mqttClient) write(header byte, body []byte) error {
+	packet := []byte{header}
+	// the remaining length is encoded 7 bits at a time
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+// read returns the type and body of the next packet
+func (c *mqttClient) read() (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed packet length")
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// Subscribe subscribes to the topics with QoS 1, so messages published while the job ran aren't lost
+func (c *mqttClient) Subscribe(topics []string) error {
+	body := binary.BigEndian.AppendUint16(nil, 1)
+	for _, topic := range topics {
+		body = append(append(body, mqttString(topic)...), 1)
+	}
+	return c.write(mqttSubscribe<<4|0x02, body)
+}
+
+// Publish publishes a retained message with QoS 0, the broker keeps the last one for clients that subscribe later
+func (c *mqttClient) Publish(topic string, payload []byte) error {
+	return c.write(mqttPublish<<4|0x01, append(mqttString(topic), payload...))
+}
+
+// Receive returns the topic and payload of the next published message, acknowledging it
+func (c *mqttClient) Receive() (string, []byte, error) {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		header, body, err := c.read()
+		if err != nil {
+			return "", nil, err
+		}
+		switch header >> 4 {
+		case mqttSuback:
+			for _, code := range body[min(2, len(body)):] {
+				if code == 0x80 {
+					return "", nil, errors.New("the broker refused a subscription, check the acl of the user")
+				}
+			}
+		case mqttPublish:
+			if len(body) < 2 {
+				return "", nil, errors.New("malformed publish packet")
+			}
+			length := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+length {
+				return "", nil, errors.New("malformed publish packet")
+			}
+			topic := string(body[2 : 2+length])
+			rest := body[2+length:]
+			if qos := (header >> 1) & 0x03; qos > 0 {
+				if len(rest) < 2 {
+					return "", nil, errors.New("malformed publish packet")
+				}
+				if err := c.write(mqttPuback<<4, rest[:2]); err != nil {
+					return "", nil, err
+				}
+				rest = rest[2:]
+			}
+			return topic, rest, nil
+		case mqttPingresp:
+		default:
+			Debugln("mqtt: ignoring packet", header>>4)
+		}
+	}
+}
+
+// ping keeps the connection alive until it is closed
+func (c *mqttClient) ping() {
+	ticker := time.NewTicker(mqttKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(mqttPingreq<<4, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Close disconnects from the broker
+func (c *mqttClient) Close() {
+	close(c.done)
+	_ = c.write(mqttDisconnect<<4, nil)
+	c.conn.Close()
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	DefaultNotifyTitle       = "Rclone Backup: {{.Name}} {{.State}}"
+	DefaultNotifyMessage     = "{{if .Error}}{{.Name}} failed: {{.Error}}{{else}}{{.Name}} finished in {{.Duration}}, transferred {{.Transferred}}{{end}}{{if .Note}} ({{.Note}}){{end}}"
+	DefaultWarningTitle      = "Rclone Backup: {{.Name}} finished with warnings"
+	DefaultWarningMessage    = "{{.Name}} finished in {{.Duration}} with warnings: {{range $i, $w := .Warnings}}{{if $i}}; {{end}}{{$w}}{{end}}"
+	DefaultEscalationTitle   = "Rclone Backup: {{.Name}} keeps failing"
+	DefaultEscalationMessage = "{{.Name}} failed {{.Failures}} times in a row, last error: {{.Error}}"
+)
+
+// notifyClient gives up on webhooks that don't answer, so a hung webhook doesn't hold up the end of a run
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// defaultNotifyStates are the run states that are notified when not configured
+var defaultNotifyStates = []string{StateFailed, StateSuspicious, StateWarning}
+
+// notifyStates are the run states that can be notified
+var notifyStates = []string{StateSuccess, StateDegraded, StateWarning, StateFailed, StateCancelled, StateInterrupted, StateSuspicious}
+
+// NotifierConfig is a notification provider, either a Home Assistant service or a webhook
+type NotifierConfig struct {
+	Name    string
+	Service string // e.g. notify.mobile_app_phone
+	URL     string
+	Data    Flags // extra service data, e.g. priority
+}
+
+// NotifyConfig chooses which notifiers are sent a message for which runs
+type NotifyConfig struct {
+	States     []string // run states to notify about
+	Notifiers  []string
+	Title      string
+	Message    string
+	Escalation *EscalationConfig
+	Warning    *WarningConfig
+}
+
+// WarningConfig sends runs that finished with warnings to their own notifiers and templates
+type WarningConfig struct {
+	Notifiers []string
+	Title     string
+	Message   string
+}
+
+// EscalationConfig sends repeated failures to additional notifiers instead of
+// repeating the same failure notification
+type EscalationConfig struct {
+	After     int // consecutive failures before escalating
+	Notifiers []string
+	Pause     bool // pause the scheduled runs of the job when escalating
+	Title     string
+	Message   string
+}
+
+// RunResult is the finished run given to notification templates
+type RunResult struct {
+	Name        string
+	Index       int
+	State       string
+	Error       string
+	ErrorClass  string
+	Trigger     string
+	Note        string
+	Detail      string
+	Start       time.Time
+	End         time.Time
+	Duration    string
+	Bytes       int64
+	Files       int64
+	Transferred string
+	Failures    int // consecutive failed runs, including this one
+	Warnings    []string
+}
+
+func NewRunResult(job JobConfig, record RunRecord) RunResult {
+	return RunResult{
+		Name:        JobName(job),
+		Index:       job.Index,
+		State:       record.State,
+		Error:       record.Error,
+		ErrorClass:  record.ErrorClass,
+		Trigger:     record.Trigger,
+		Note:        record.Note,
+		Detail:      record.Detail,
+		Start:       record.Start,
+		End:         record.End,
+		Duration:    record.Duration,
+		Bytes:       record.Bytes,
+		Files:       record.Files,
+		Transferred: FormatBytes(record.Bytes),
+		Failures:    ConsecutiveFailures(job.Index),
+		Warnings:    record.Warnings,
+	}
+}
+
+// JobNotify returns the notification routing of the job, falling back to the global config
+func JobNotify(job JobConfig) NotifyConfig {
+	notify := config.Notify
+	if job.Notify != nil {
+		if job.Notify.States != nil {
+			notify.States = job.Notify.States
+		}
+		if job.Notify.Notifiers != nil {
+			notify.Notifiers = job.Notify.Notifiers
+		}
+		if job.Notify.Title != "" {
+			notify.Title = job.Notify.Title
+		}
+		if job.Notify.Message != "" {
+			notify.Message = job.Notify.Message
+		}
+		if job.Notify.Escalation != nil {
+			notify.Escalation = job.Notify.Escalation
+		}
+		if job.Notify.Warning != nil {
+			notify.Warning = job.Notify.Warning
+		}
+	}
+	if notify.States == nil {
+		notify.States = defaultNotifyStates
+	}
+	if notify.Notifiers == nil {
+		for _, notifier := range config.Notifiers {
+			notify.Notifiers = append(notify.Notifiers, notifier.Name)
+		}
+	}
+	if notify.Title == "" {
+		notify.Title = DefaultNotifyTitle
+	}
+	if notify.Message == "" {
+		notify.Message = DefaultNotifyMessage
+	}
+	return notify
+}
+
+// CheckNotify validates the notifiers and templates the job would use
+func CheckNotify(job JobConfig) error {
+	notify := JobNotify(job)
+	for _, name := range notify.Notifiers {
+		if FindNotifier(name) == nil {
+			return fmt.Errorf("notify: unknown notifier '%s'", name)
+		}
+	}
+	for _, state := range notify.States {
+		if !ArrayContains(notifyStates, state) {
+			return fmt.Errorf("notify: invalid state '%s'", state)
+		}
+	}
+	if escalation := notify.Escalation; escalation != nil {
+		if escalation.After < 1 {
+			return errors.New("notify: escalation requires after to be at least 1")
+		}
+		for _, name := range escalation.Notifiers {
+			if FindNotifier(name) == nil {
+				return fmt.Errorf("notify: unknown escalation notifier '%s'", name)
+			}
+		}
+		for _, text := range []string{escalation.Title, escalation.Message} {
+			if _, err := template.New("escalation").Parse(text); err != nil {
+				return fmt.Errorf("notify: invalid escalation template: %w", err)
+			}
+		}
+	}
+	if warning := notify.Warning; warning != nil {
+		for _, name := range warning.Notifiers {
+			if FindNotifier(name) == nil {
+				return fmt.Errorf("notify: unknown warning notifier '%s'", name)
+			}
+		}
+		for _, text := range []string{warning.Title, warning.Message} {
+			if _, err := template.New("warning").Parse(text); err != nil {
+				return fmt.Errorf("notify: invalid warning template: %w", err)
+			}
+		}
+	}
+	if _, err := template.New("title").Parse(notify.Title); err != nil {
+		return fmt.Errorf("notify: invalid title template: %w", err)
+	}
+	if _, err := template.New("message").Parse(notify.Message); err != nil {
+		return fmt.Errorf("notify: invalid message template: %w", err)
+	}
+	return nil
+}
+
+// CheckNotifiers validates the configured notifiers
+func CheckNotifiers() error {
+	names := make(map[string]bool)
+	for _, notifier := range config.Notifiers {
+		if notifier.Name == "" {
+			return errors.New("notifiers require a name")
+		}
+		if names[notifier.Name] {
+			return fmt.Errorf("notifier '%s' is defined more than once", notifier.Name)
+		}
+		names[notifier.Name] = true
+		if (notifier.Service == "") == (notifier.URL == "") {
+			return fmt.Errorf("notifier '%s' requires either a service or a url", notifier.Name)
+		}
+		if notifier.Service != "" && !strings.Contains(notifier.Service, ".") {
+			return fmt.Errorf("notifier '%s' has invalid service '%s', expected e.g. notify.mobile_app_phone", notifier.Name, notifier.Service)
+		}
+	}
+	return nil
+}
+
+func FindNotifier(name string) *NotifierConfig {
+	for i := range config.Notifiers {
+		if config.Notifiers[i].Name == name {
+			return &config.Notifiers[i]
+		}
+	}
+	return nil
+}
+
+// NotifyRun sends the result of a run to the notifiers of the job, escalating
+// once a job has failed too many times in a row
+func NotifyRun(job JobConfig, record RunRecord) {
+	notify := JobNotify(job)
+	result := NewRunResult(job, record)
+	escalation := notify.Escalation
+	if escalation != nil && IsFailure(record.State) && result.Failures >= escalation.After {
+		if result.Failures > escalation.After {
+			Debugln("job", "'"+job.Name+"'", "already escalated, not notifying failure", result.Failures)
+			return
+		}
+		Escalate(job, *escalation, result)
+	}
+	if config.NoNotifications || len(config.Notifiers) == 0 {
+		return
+	}
+	if record.State == StateWarning && notify.Warning != nil {
+		NotifyWarning(notify, *notify.Warning, result)
+		return
+	}
+	if !ArrayContains(notify.States, record.State) {
+		return
+	}
+	SendNotification(notify.Notifiers, notify.Title, notify.Message, result)
+}
+
+// NotifyWarning sends a run that finished with warnings to the notifiers of the warning routing,
+// falling back to the notifiers of the job
+func NotifyWarning(notify NotifyConfig, warning WarningConfig, result RunResult) {
+	notifiers := warning.Notifiers
+	if notifiers == nil {
+		notifiers = notify.Notifiers
+	}
+	title := warning.Title
+	if title == "" {
+		title = DefaultWarningTitle
+	}
+	message := warning.Message
+	if message == "" {
+		message = DefaultWarningMessage
+	}
+	SendNotification(notifiers, title, message, result)
+}
+
+// Escalate notifies the escalation notifiers and optionally pauses the job
+func Escalate(job JobConfig, escalation EscalationConfig, result RunResult) {
+	Warnln("job", "'"+job.Name+"'", "failed", result.Failures, "times in a row, escalating")
+	if escalation.Pause {
+		pauses.Pause(job, fmt.Sprintf("paused after %d consecutive failures", result.Failures))
+	}
+	if config.NoNotifications {
+		return
+	}
+	title := escalation.Title
+	if title == "" {
+		title = DefaultEscalationTitle
+	}
+	message := escalation.Message
+	if message == "" {
+		message = DefaultEscalationMessage
+	}
+	SendNotification(escalation.Notifiers, title, message, result)
+}
+
+// IsSuccess reports whether a run state means the run finished, including runs that took too long or had warnings
+func IsSuccess(state string) bool {
+	return state == StateSuccess || state == StateDegraded || state == StateWarning
+}
+
+// IsFailure reports whether a run state counts as a failure
+func IsFailure(state string) bool {
+	return state == StateFailed || state == StateSuspicious
+}
+
+// ConsecutiveFailures counts the failed runs of a job since it last succeeded, cancelled and interrupted runs are ignored
+func ConsecutiveFailures(index int) int {
+	count := 0
+	for _, run := range history.Runs(index) {
+		if run.State == StateCancelled || run.State == StateInterrupted {
+			continue
+		}
+		if !IsFailure(run.State) {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// SendNotification renders the templates and sends them to each notifier
+func SendNotification(notifiers []string, titleTemplate string, messageTemplate string, result RunResult) {
+	title, err := renderTemplate(titleTemplate, result)
+	if err != nil {
+		Errorln("failed to render notification title:", err)
+		return
+	}
+	message, err := renderTemplate(messageTemplate, result)
+	if err != nil {
+		Errorln("failed to render notification message:", err)
+		return
+	}
+	for _, name := range notifiers {
+		notifier := FindNotifier(name)
+		if notifier == nil {
+			continue
+		}
+		if err := notifier.Send(title, message, result); err != nil {
+			Errorln("failed to send notification to", "'"+name+"':", err)
+		}
+	}
+}
+
+func renderTemplate(text string, result RunResult) (string, error) {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, result); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Send delivers a message through the notifier
+func (n *NotifierConfig) Send(title string, message string, result RunResult) error {
+	if n.URL != "" {
+		body, err := json.Marshal(map[string]interface{}{"title": title, "message": message, "run": result})
+		if err != nil {
+			return err
+		}
+		resp, err := notifyClient.Post(n.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("bad status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+	data := map[string]interface{}{"title": title, "message": message}
+	if len(n.Data) > 0 {
+		extra := make(map[string]string, len(n.Data))
+		for key, value := range n.Data {
+			extra[key] = value
+		}
+		data["data"] = extra
+	}
+	domain, service, _ := strings.Cut(n.Service, ".")
+	return CoreAPIRequest(http.MethodPost, "/services/"+domain+"/"+service, data)
+}
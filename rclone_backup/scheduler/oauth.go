@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuthBackends are the backends whose remotes can be set up from the web UI, by their rclone type
+var OAuthBackends = map[string]string{
+	"drive":    "Google Drive",
+	"dropbox":  "Dropbox",
+	"onedrive": "OneDrive",
+}
+
+// oauthAddress is where rclone authorize waits for the provider to redirect the browser to after signing in
+const oauthAddress = "http://127.0.0.1:53682"
+
+// oauthTimeout is how long signing in to the provider may take
+const oauthTimeout = 10 * time.Minute
+
+// oauthQuestions is the most questions of rclone answered with their default while creating a remote, e.g. which
+// drive of a OneDrive account to use
+const oauthQuestions = 10
+
+var (
+	ErrNoOAuthSession   = errors.New("no remote is being set up, start again")
+	ErrInlineRcloneConf = errors.New("remotes can't be added while the rclone_config option is set, add them to it instead")
+)
+
+// oauthLink finds the link rclone authorize logs, e.g. "Please go to the following link: http://127.0.0.1:53682/auth?state=x"
+var oauthLink = regexp.MustCompile(`(` + regexp.QuoteMeta(oauthAddress) + `/auth\?state=\S+)`)
+
+// remoteNamePattern is what names of remotes created from the UI may look like
+var remoteNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+@-]*$`)
+
+// OAuthSession is a remote being set up, waiting for the user to sign in to the provider
+type OAuthSession struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Backend string    `json:"backend"`
+	URL     string    `json:"url"` // where the user signs in
+	Expires time.Time `json:"expires"`
+	cancel  context.CancelFunc
+	done    <-chan struct{} // closed when rclone authorize stopped
+	token   chan string
+}
+
+// RemoteTest is the result of creating a remote and listing its top folders
+type RemoteTest struct {
+	Name    string   `json:"name"`
+	OK      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	Folders []string `json:"folders"`
+}
+
+// rcloneQuestion is the output of rclone config create with --non-interactive, asking for the next option
+type rcloneQuestion struct {
+	State  string
+	Option *struct {
+		Name     string
+		Default  interface{}
+		Examples []struct{ Value string }
+	}
+	Error string
+}
+
+var oauthSessions struct {
+	mu      sync.Mutex
+	current *OAuthSession // rclone authorize always listens on the same port, so there is one at a time
+}
+
+// StartOAuth runs rclone authorize for a new remote and returns the link to sign in to the provider with. A
+// session that was still waiting is cancelled.
+func StartOAuth(name string, backend string) (*OAuthSession, error) {
+	if _, ok := OAuthBackends[backend]; !ok {
+		return nil, fmt.Errorf("remotes of type '%s' can't be set up from the web UI", backend)
+	}
+	if !remoteNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid remote name '%s', use letters, digits and _ . + @ -", name)
+	}
+	if config.RcloneConfig != "" {
+		return nil, ErrInlineRcloneConf
+	}
+	existing, err := GetRcloneRemotes()
+	if err != nil {
+		return nil, err
+	}
+	if ArrayContains(existing, remoteName(name)) {
+		return nil, fmt.Errorf("remote '%s' already exists", name)
+	}
+
+	oauthSessions.mu.Lock()
+	defer oauthSessions.mu.Unlock()
+	if oauthSessions.current != nil {
+		oauthSessions.current.cancel()
+		oauthSessions.current = nil
+	}
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	ctx, cancel := context.WithTimeout(context.Background(), oauthTimeout)
+	session := &OAuthSession{ID: hex.EncodeToString(buf), Name: name, Backend: backend, Expires: time.Now().Add(oauthTimeout),
+		cancel: cancel, done: ctx.Done(), token: make(chan string, 1)}
+
+	cmd := exec.CommandContext(ctx, RcloneBinary(), "authorize", backend, "--auth-no-open-browser")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	link := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if match := oauthLink.FindStringSubmatch(scanner.Text()); match != nil {
+				link <- match[1]
+			}
+			Debugln("rclone authorize:", scanner.Text())
+		}
+	}()
+	go func() {
+		// the token is printed between these lines once the user signed in
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		pasting := false
+		var token strings.Builder
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case strings.HasSuffix(line, "--->"):
+				pasting = true
+			case strings.HasPrefix(line, "<---End paste"):
+				session.token <- token.String()
+				return
+			case pasting:
+				token.WriteString(line)
+			}
+		}
+	}()
+	go func() {
+		_ = cmd.Wait()
+		cancel()
+	}()
+
+	var local string
+	select {
+	case local = <-link:
+	case <-time.After(15 * time.Second):
+		cancel()
+		return nil, errors.New("rclone authorize didn't show a link to sign in with")
+	case <-ctx.Done():
+		return nil, errors.New("rclone authorize exited before showing a link to sign in with")
+	}
+	// the local link redirects to the provider, the browser of the user can't reach it
+	session.URL, err = providerURL(ctx, local)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	oauthSessions.current = session
+	Infoln("setting up remote", "'"+name+"'", "of type", backend+", waiting for the user to sign in")
+	return session, nil
+}
+
+// providerURL returns where the local link of rclone authorize redirects to
+func providerURL(ctx context.Context, local string) (string, error) {
+	client := &http.Client{
+		Timeout:       10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, local, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the link to sign in with: %w", err)
+	}
+	defer res.Body.Close()
+	location := res.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("failed to get the link to sign in with: rclone answered %s", res.Status)
+	}
+	return location, nil
+}
+
+// oauthSession returns the remote being set up with id
+func oauthSession(id string) (*OAuthSession, error) {
+	oauthSessions.mu.Lock()
+	defer oauthSessions.mu.Unlock()
+	if oauthSessions.current == nil || oauthSessions.current.ID != id || time.Now().After(oauthSessions.current.Expires) {
+		return nil, ErrNoOAuthSession
+	}
+	return oauthSessions.current, nil
+}
+
+// CancelOAuth stops setting up a remote
+func CancelOAuth(id string) error {
+	session, err := oauthSession(id)
+	if err != nil {
+		return err
+	}
+	oauthSessions.mu.Lock()
+	defer oauthSessions.mu.Unlock()
+	session.cancel()
+	oauthSessions.current = nil
+	return nil
+}
+
+// CompleteOAuth finishes setting up a remote with what the user pasted after signing in: the address the provider
+// sent the browser to, which rclone authorize is waiting for, or a token from running rclone authorize elsewhere.
+// The remote is created and tested.
+func CompleteOAuth(ctx context.Context, id string, pasted string) (RemoteTest, error) {
+	session, err := oauthSession(id)
+	if err != nil {
+		return RemoteTest{}, err
+	}
+	pasted = strings.TrimSpace(pasted)
+	token := pasted
+	if !strings.HasPrefix(pasted, "{") {
+		address, err := url.Parse(pasted)
+		if err != nil || address.Query().Get("code") == "" {
+			return RemoteTest{}, errors.New("paste the address your browser was sent to after signing in, it contains a code")
+		}
+		if err := forwardOAuthCode(ctx, address.RawQuery); err != nil {
+			return RemoteTest{}, err
+		}
+		select {
+		case token = <-session.token:
+		case <-session.done:
+			return RemoteTest{}, errors.New("rclone authorize stopped before it received a token, start again")
+		case <-time.After(time.Minute):
+			return RemoteTest{}, errors.New("rclone didn't receive a token from the provider, start again")
+		}
+	}
+	if err := CancelOAuth(id); err != nil {
+		return RemoteTest{}, err
+	}
+	if err := CreateRemote(ctx, session.Name, session.Backend, token); err != nil {
+		return RemoteTest{}, err
+	}
+	Infoln("created remote", "'"+session.Name+"'", "of type", session.Backend)
+	RefreshRemotes()
+	return TestRemote(ctx, session.Name), nil
+}
+
+// forwardOAuthCode passes the code of the provider on to rclone authorize, as the browser would have on the same
+// machine
+func forwardOAuthCode(ctx context.Context, query string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthAddress+"/?"+query, nil)
+	if err != nil {
+		return err
+	}
+	res, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to pass the code on to rclone: %w", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("rclone didn't accept the code: %s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// CreateRemote writes a remote with an oauth token to the rclone config, answering the further questions of the
+// backend with their default
+func CreateRemote(ctx context.Context, name string, backend string, token string) error {
+	args := []string{"config", "create", name, backend, "token", token, "--non-interactive"}
+	for i := 0; i < oauthQuestions; i++ {
+		out, err := exec.CommandContext(ctx, RcloneBinary(), args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to create remote '%s': %w %s", name, err, strings.TrimSpace(string(out)))
+		}
+		var question rcloneQuestion
+		if start := bytes.IndexByte(out, '{'); start >= 0 {
+			_ = json.Unmarshal(out[start:], &question)
+		}
+		if question.Error != "" {
+			return fmt.Errorf("failed to create remote '%s': %s", name, question.Error)
+		}
+		if question.State == "" || question.Option == nil {
+			return nil
+		}
+		answer := ""
+		if question.Option.Default != nil {
+			answer = fmt.Sprint(question.Option.Default)
+		}
+		if answer == "" && len(question.Option.Examples) > 0 {
+			answer = question.Option.Examples[0].Value
+		}
+		Infoln("remote", "'"+name+"':", "answered", question.Option.Name, "with", "'"+answer+"'")
+		args = []string{"config", "update", name, "--continue", "--state", question.State, "--result", answer, "--non-interactive"}
+	}
+	return fmt.Errorf("failed to create remote '%s': rclone kept asking questions, finish it with rclone config", name)
+}
+
+// RefreshRemotes reads the configured remotes of the rclone info again, e.g. after one was created. The jobs keep
+// the remotes found at startup until the addon restarts.
+func RefreshRemotes() {
+	list, err := GetRcloneRemotes()
+	if err != nil {
+		Warnln("failed to retrieve list of rclone remotes:", err)
+		return
+	}
+	rcloneMu.Lock()
+	rcloneInfo.Remotes = list
+	rcloneMu.Unlock()
+}
+
+// TestRemote lists the top folders of a remote to check it works
+func TestRemote(ctx context.Context, name string) RemoteTest {
+	result := RemoteTest{Name: name, Folders: []string{}}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, RcloneBinary(), "lsf", "--dirs-only", "--max-depth", "1", remoteName(name))
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		result.Error = strings.TrimSpace(err.Error() + " " + lastLine(stderr.String()))
+		return result
+	}
+	result.OK = true
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			result.Folders = append(result.Folders, line)
+		}
+	}
+	return result
+}
+
+// lastLine returns the last line of output that isn't empty
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var OnceRunsPath = filepath.Join(DataPath, "schedule_once.json")
+
+// OnceRun is a single run of a job planned for a point in time, e.g. a full backup before a holiday
+type OnceRun struct {
+	ID      string    `json:"id"`
+	Job     int       `json:"job"`
+	Name    string    `json:"name"`
+	At      time.Time `json:"at"`
+	Note    string    `json:"note,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// OnceScheduler runs the planned one-shot runs of jobs, they are kept across restarts until they ran
+type OnceScheduler struct {
+	mu      sync.Mutex
+	started bool
+	runs    map[string]OnceRun
+	timers  map[string]*time.Timer
+}
+
+var onceRuns = &OnceScheduler{runs: make(map[string]OnceRun), timers: make(map[string]*time.Timer)}
+
+// ParseRunTime parses the time of a one-shot run, either RFC 3339 or a local time like "2024-07-01 02:00"
+func ParseRunTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', expected e.g. 2024-07-01 02:00", value)
+}
+
+// Load reads the planned runs from disk, ignoring jobs that no longer exist
+func (s *OnceScheduler) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(OnceRunsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []OnceRun
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, run := range list {
+		if run.Job < len(config.Jobs) && config.Jobs[run.Job].Name == run.Name {
+			s.runs[run.ID] = run
+		}
+	}
+	return nil
+}
+
+func (s *OnceScheduler) save() {
+	list := make([]OnceRun, 0, len(s.runs))
+	for _, run := range s.runs {
+		list = append(list, run)
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = os.WriteFile(OnceRunsPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save planned runs:", err)
+	}
+}
+
+// Start sets a timer for each planned run, runs planned while the addon was stopped are started now
+func (s *OnceScheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+	for _, run := range s.runs {
+		if run.At.Before(time.Now()) {
+			Warnln("starting run of", "'"+run.Name+"'", "planned for", run.At.Local().Format("2006-01-02 15:04"), "which was missed")
+		}
+		s.schedule(run)
+	}
+}
+
+func (s *OnceScheduler) schedule(run OnceRun) {
+	s.timers[run.ID] = time.AfterFunc(time.Until(run.At), func() { s.fire(run.ID) })
+}
+
+func (s *OnceScheduler) fire(id string) {
+	s.mu.Lock()
+	run, ok := s.runs[id]
+	delete(s.runs, id)
+	delete(s.timers, id)
+	s.save()
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	job := config.Jobs[run.Job]
+	job.Trigger = TriggerOnce
+	job.Note = run.Note
+	Infoln("starting planned run of", "'"+JobName(job)+"'")
+	runQueue.Run(job, RunTracked)
+}
+
+// Add plans a single run of a job
+func (s *OnceScheduler) Add(job JobConfig, at time.Time, note string) (OnceRun, error) {
+	if !at.After(time.Now()) {
+		return OnceRun{}, fmt.Errorf("%s is in the past", at.Local().Format("2006-01-02 15:04"))
+	}
+	run := OnceRun{ID: NewRunID(), Job: job.Index, Name: job.Name, At: at, Note: note, Created: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.ID] = run
+	s.save()
+	if s.started {
+		s.schedule(run)
+	}
+	Infoln("planned a run of", "'"+JobName(job)+"'", "at", at.Local().Format("2006-01-02 15:04"))
+	return run, nil
+}
+
+// Cancel removes a planned run of a job, returning false if there is none with the id
+func (s *OnceScheduler) Cancel(index int, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, ok := s.runs[id]
+	if !ok || run.Job != index {
+		return false
+	}
+	if timer, ok := s.timers[id]; ok {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	delete(s.runs, id)
+	s.save()
+	return true
+}
+
+// List returns the planned runs of a job, soonest first
+func (s *OnceScheduler) List(index int) []OnceRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]OnceRun, 0)
+	for _, run := range s.runs {
+		if run.Job == index {
+			list = append(list, run)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+// Next returns the soonest planned run of a job, if any
+func (s *OnceScheduler) Next(index int) *time.Time {
+	list := s.List(index)
+	if len(list) == 0 {
+		return nil
+	}
+	return &list[0].At
+}
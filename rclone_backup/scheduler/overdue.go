@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultOverdueFactor is how many times the expected duration a run may take before it is running long
+const DefaultOverdueFactor = 1.5
+
+const (
+	DefaultOverdueTitle   = "Rclone Backup: {{.Name}} is running long"
+	DefaultOverdueMessage = "{{.Name}} has been running for {{.Duration}}, longer than expected{{if .Note}} ({{.Note}}){{end}}"
+)
+
+type OverdueEventData struct {
+	Name     string  `json:"name"`
+	Expected string  `json:"expected"`
+	Limit    string  `json:"limit"`
+	Seconds  float64 `json:"seconds"`
+	Note     string  `json:"note,omitempty"`
+}
+
+// CheckExpectedDuration validates the expected_duration and overdue_factor options of a job
+func CheckExpectedDuration(job JobConfig) error {
+	if job.ExpectedDuration == "" {
+		if job.OverdueFactor != 0 {
+			return fmt.Errorf("overdue_factor requires an expected_duration")
+		}
+		return nil
+	}
+	if d, err := time.ParseDuration(job.ExpectedDuration); err != nil || d <= 0 {
+		return fmt.Errorf("invalid expected_duration '%s'", job.ExpectedDuration)
+	}
+	if job.OverdueFactor != 0 && job.OverdueFactor < 1 {
+		return fmt.Errorf("overdue_factor must be at least 1")
+	}
+	return nil
+}
+
+// OverdueLimit returns how long a run of the job may take before it is running long, 0 when the job has no expected duration
+func OverdueLimit(job JobConfig) time.Duration {
+	expected, err := time.ParseDuration(job.ExpectedDuration)
+	if err != nil {
+		return 0
+	}
+	factor := job.OverdueFactor
+	if factor == 0 {
+		factor = DefaultOverdueFactor
+	}
+	return time.Duration(float64(expected) * factor)
+}
+
+// WatchOverdue marks the run as degraded and notifies once it takes longer than the overdue limit,
+// the run is not stopped, the returned function must be called when the run finishes
+func WatchOverdue(job JobConfig) func() {
+	limit := OverdueLimit(job)
+	if limit <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	timer := time.AfterFunc(limit, func() {
+		statuses.SetOverdue(job.Index)
+		name := JobName(job)
+		Warnln("job", "'"+name+"'", "is running long, expected", job.ExpectedDuration, "but has been running for", FormatDuration(time.Since(start)))
+		FireEvent(EventJobOverdue, OverdueEventData{
+			Name: job.Name, Expected: job.ExpectedDuration, Limit: FormatDuration(limit), Seconds: time.Since(start).Seconds(), Note: job.Note,
+		})
+		if config.NoNotifications {
+			return
+		}
+		result := RunResult{
+			Name: name, Index: job.Index, State: StateRunning, Trigger: job.Trigger, Note: job.Note,
+			Start: start, Duration: FormatDuration(time.Since(start)),
+		}
+		if len(config.Notifiers) > 0 {
+			SendNotification(JobNotify(job).Notifiers, DefaultOverdueTitle, DefaultOverdueMessage, result)
+		} else {
+			message, _ := renderTemplate(DefaultOverdueMessage, result)
+			title, _ := renderTemplate(DefaultOverdueTitle, result)
+			Notify(fmt.Sprintf("overdue_%d", job.Index), title, message)
+		}
+	})
+	return func() { timer.Stop() }
+}
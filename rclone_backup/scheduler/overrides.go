@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// RunOverrides are optional parameters for a single run triggered through the API
+type RunOverrides struct {
+	Destination string   `json:"destination"`
+	ExtraFlags  []string `json:"extra_flags"`
+	DryRun      *bool    `json:"dry_run"`
+	BwLimit     string   `json:"bwlimit"`
+	Note        string   `json:"note"`
+}
+
+// DecodeRunOverrides reads overrides from the request body, an empty body has no overrides
+func DecodeRunOverrides(r *http.Request) (*RunOverrides, error) {
+	overrides := &RunOverrides{}
+	err := json.NewDecoder(r.Body).Decode(overrides)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// Apply returns a copy of the job with the overrides applied
+func (o *RunOverrides) Apply(job JobConfig) (JobConfig, error) {
+	if o == nil {
+		return job, nil
+	}
+	if o.Destination != "" {
+		if job.Run != "" || len(job.Steps) > 0 {
+			return job, errors.New("destination can only be overridden for rclone jobs")
+		}
+		if err := CheckRemote(o.Destination); err != nil {
+			return job, err
+		}
+		job.Destination = o.Destination
+		job.Destinations = []string{o.Destination}
+	}
+	job.ExtraFlags = append(append([]string{}, job.ExtraFlags...), o.ExtraFlags...)
+	if o.BwLimit != "" {
+		job.ExtraFlags = append(job.ExtraFlags, "--bwlimit="+o.BwLimit)
+	}
+	if o.DryRun != nil {
+		job.DryRun = o.DryRun
+	}
+	job.Note = o.Note
+	return job, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TotalCountHeader is the number of items of a list endpoint that match the filters, before limit and offset
+const TotalCountHeader = "X-Total-Count"
+
+// ListQuery is the sorting and paging of a list endpoint, e.g. ?sort=-next_run&limit=20&offset=40
+type ListQuery struct {
+	Sort   string
+	Desc   bool
+	Limit  int // 0 returns every item
+	Offset int
+}
+
+// ListSorts are the fields a list endpoint can be sorted by, each comparing two items in ascending order
+type ListSorts[T any] map[string]func(a, b T) int
+
+// ParseListQuery reads the sort, limit and offset parameters, a sort starting with - is descending
+func ParseListQuery[T any](r *http.Request, sorts ListSorts[T]) (ListQuery, error) {
+	var query ListQuery
+	values := r.URL.Query()
+	if s := values.Get("sort"); s != "" {
+		query.Sort, query.Desc = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+		if sorts[query.Sort] == nil {
+			keys := make([]string, 0, len(sorts))
+			for key := range sorts {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			return query, fmt.Errorf("invalid sort '%s', must be one of %s", query.Sort, strings.Join(keys, ", "))
+		}
+	}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"limit", &query.Limit}, {"offset", &query.Offset}} {
+		if s := values.Get(param.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return query, fmt.Errorf("invalid %s '%s'", param.name, s)
+			}
+			*param.value = n
+		}
+	}
+	return query, nil
+}
+
+// MatchesFilter reports whether a value is one of the comma separated values of a query parameter, any value
+// matches when the parameter isn't set
+func MatchesFilter(r *http.Request, name string, value string) bool {
+	filter := r.URL.Query().Get(name)
+	return filter == "" || slices.Contains(strings.Split(filter, ","), value)
+}
+
+// Page sorts the filtered items and returns the page of the query, setting the total count header so clients can
+// page through them
+func Page[T any](w http.ResponseWriter, items []T, query ListQuery, sorts ListSorts[T]) []T {
+	if compare := sorts[query.Sort]; compare != nil {
+		// stable so items that compare equal keep their order between pages
+		slices.SortStableFunc(items, func(a, b T) int {
+			if query.Desc {
+				return compare(b, a)
+			}
+			return compare(a, b)
+		})
+	}
+	w.Header().Set(TotalCountHeader, strconv.Itoa(len(items)))
+	start := min(query.Offset, len(items))
+	end := len(items)
+	if query.Limit > 0 {
+		end = min(start+query.Limit, len(items))
+	}
+	return items[start:end]
+}
+
+// compareNames orders names alphabetically, ignoring case
+func compareNames(a, b string) int {
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// compareTimes orders times oldest first, missing times last
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return a.Compare(*b)
+}
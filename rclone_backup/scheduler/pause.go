@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var PausesPath = filepath.Join(DataPath, "paused.json")
+
+// PausedJob is a job whose scheduled runs are skipped until it is resumed
+type PausedJob struct {
+	Job    int       `json:"job"`
+	Name   string    `json:"name"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+type PauseStore struct {
+	mu     sync.Mutex
+	paused map[int]PausedJob
+}
+
+var pauses = &PauseStore{paused: make(map[int]PausedJob)}
+
+// Load reads the paused jobs from disk, ignoring jobs that no longer exist
+func (s *PauseStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(PausesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []PausedJob
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, paused := range list {
+		if paused.Job < len(config.Jobs) && config.Jobs[paused.Job].Name == paused.Name {
+			s.paused[paused.Job] = paused
+		}
+	}
+	return nil
+}
+
+// Get returns the pause of the job at index, if any
+func (s *PauseStore) Get(index int) *PausedJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paused, ok := s.paused[index]
+	if !ok {
+		return nil
+	}
+	return &paused
+}
+
+// Pause stops the scheduled runs of a job
+func (s *PauseStore) Pause(job JobConfig, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused[job.Index] = PausedJob{Job: job.Index, Name: job.Name, Reason: reason, Since: time.Now()}
+	s.save()
+}
+
+// Resume restarts the scheduled runs of a job, returning false if it was not paused
+func (s *PauseStore) Resume(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.paused[index]; !ok {
+		return false
+	}
+	delete(s.paused, index)
+	s.save()
+	return true
+}
+
+func (s *PauseStore) save() {
+	list := make([]PausedJob, 0, len(s.paused))
+	for _, paused := range s.paused {
+		list = append(list, paused)
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = os.WriteFile(PausesPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save paused jobs:", err)
+	}
+}
+
+// SkipIfPaused wraps the task of a scheduled job to skip it while the job is paused
+func SkipIfPaused(job JobConfig, task func()) func() {
+	return func() {
+		if paused := pauses.Get(job.Index); paused != nil {
+			Warnln("job", "'"+job.Name+"'", "is paused, skipping:", paused.Reason)
+			return
+		}
+		task()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// StepConfig is a single step of a pipeline job, either an rclone command or a shell command
+type StepConfig struct {
+	Name            string
+	Command         string
+	Run             string
+	Source          string
+	Destination     string
+	Include         []string
+	Exclude         []string
+	Flags           Flags
+	ExtraFlags      []string `yaml:"extra_flags"`
+	Timeout         string
+	ContinueOnError bool `yaml:"continue_on_error"`
+	Compress        CompressConfig
+}
+
+// StepResult is the outcome of a pipeline step for the status API
+type StepResult struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+func StepName(step StepConfig, i int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return "step " + strconv.Itoa(i+1)
+}
+
+func CheckSteps(steps []StepConfig, warnings *[]string) error {
+	for i, step := range steps {
+		name := StepName(step, i)
+		if step.Run == "" && step.Command == "" {
+			return fmt.Errorf("step '%s' requires either 'command' or 'run'", name)
+		}
+		if step.Command == CommandCompress {
+			if err := CheckCompress(step.Compress); err != nil {
+				return fmt.Errorf("step '%s': %w", name, err)
+			}
+			if step.Source == "" || step.Destination == "" {
+				return fmt.Errorf("step '%s' requires a source folder and a destination to compress", name)
+			}
+		}
+		if step.Timeout != "" {
+			if _, err := time.ParseDuration(step.Timeout); err != nil {
+				return fmt.Errorf("step '%s' has invalid timeout: %w", name, err)
+			}
+		}
+		if step.Run == "" && step.Source != "" {
+			if err := checkTarget(step.Source, warnings); err != nil {
+				return fmt.Errorf("step '%s': %w", name, err)
+			}
+		}
+		if step.Run == "" && step.Destination != "" {
+			if err := checkTarget(step.Destination, warnings); err != nil {
+				return fmt.Errorf("step '%s': %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// StepJob converts a step into a job config that can be run by the regular runners, the step inherits the flags,
+// notifications and transfer settings of the job and its own flags take precedence
+func StepJob(job JobConfig, step StepConfig, i int) JobConfig {
+	name := StepName(step, i)
+	if job.Name != "" {
+		name = job.Name + " / " + name
+	}
+	flags := Flags{}
+	for key, value := range job.Flags {
+		flags[key] = value
+	}
+	for key, value := range step.Flags {
+		flags[key] = value
+	}
+	stepJob := JobConfig{
+		Name:                    name,
+		Command:                 step.Command,
+		Run:                     step.Run,
+		Include:                 step.Include,
+		Exclude:                 step.Exclude,
+		Flags:                   flags,
+		ExtraFlags:              append(append([]string{}, job.ExtraFlags...), step.ExtraFlags...),
+		Compress:                step.Compress,
+		DryRun:                  job.DryRun,
+		Note:                    job.Note,
+		Trigger:                 job.Trigger,
+		Index:                   job.Index,
+		NoVolatileExcludes:      job.NoVolatileExcludes,
+		Bind:                    job.Bind,
+		Notify:                  job.Notify,
+		Success:                 job.Success,
+		MaxDelete:               job.MaxDelete,
+		S3:                      job.S3,
+		ServerSideAcrossConfigs: job.ServerSideAcrossConfigs,
+	}
+	if step.Source != "" {
+		stepJob.Sources = []string{step.Source}
+	}
+	if step.Destination != "" {
+		stepJob.Destinations = []string{step.Destination}
+	}
+	return AddVolatileExcludes(stepJob)
+}
+
+// RunPipeline runs each step in order, stopping at the first failure unless
+// the step allows continuing
+func RunPipeline(ctx context.Context, job JobConfig) error {
+	results := make([]StepResult, len(job.Steps))
+	for i, step := range job.Steps {
+		results[i] = StepResult{Name: StepName(step, i), State: StateIdle}
+	}
+	statuses.SetSteps(job.Index, results)
+
+	var failed error
+	for i, step := range job.Steps {
+		if failed != nil || ctx.Err() != nil {
+			results[i].State = "skipped"
+			continue
+		}
+
+		stepCtx := ctx
+		cancel := func() {}
+		if step.Timeout != "" {
+			timeout, _ := time.ParseDuration(step.Timeout)
+			stepCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		results[i].State = StateRunning
+		statuses.SetSteps(job.Index, results)
+
+		start := time.Now()
+		err := runTargets(stepCtx, StepJob(job, step, i))
+		if errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("step timed out after %s", step.Timeout)
+		}
+		cancel()
+
+		results[i].Duration = FormatDuration(time.Since(start))
+		if err != nil {
+			results[i].State = StateFailed
+			results[i].Error = err.Error()
+			if step.ContinueOnError {
+				// the run goes on but finishes with the warning state
+				statuses.AddWarning(job.Index, fmt.Sprintf("step '%s' failed: %s", results[i].Name, err))
+			} else {
+				failed = fmt.Errorf("step '%s' failed: %w", results[i].Name, err)
+			}
+		} else {
+			results[i].State = StateSuccess
+		}
+		statuses.SetSteps(job.Index, results)
+	}
+	statuses.SetSteps(job.Index, results)
+	return failed
+}
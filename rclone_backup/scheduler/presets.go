@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// JobPreset is a built-in job for a common part of Home Assistant, only the destination has to be given
+type JobPreset struct {
+	Job    JobConfig
+	Folder string // appended to the destination so presets can share one
+}
+
+// excludeVolatile are files that change while Home Assistant is running and can't be restored from a copy
+var excludeVolatile = []string{"*.db-wal", "*.db-shm", "*.db-journal", "*.log", "*.log.*", "**/__pycache__/**", "**/.cache/**"}
+
+// Presets are selected with the preset option of a job, at least one of the sources of a preset has to exist
+var Presets = map[string]JobPreset{
+	"homeassistant": {Folder: "homeassistant", Job: JobConfig{
+		Name:     "Home Assistant config",
+		Schedule: "0 3 * * *",
+		Command:  "sync",
+		Sources:  []string{"/homeassistant"},
+		Exclude: append([]string{
+			// the recorder database is written constantly, use a dump or a Home Assistant backup instead
+			"/home-assistant_v2.db*", "/deps/**", "/tts/**", "/.cloud/**", "/zigbee2mqtt/log/**", "/esphome/.esphome/**",
+		}, excludeVolatile...),
+	}},
+	"zigbee2mqtt": {Folder: "zigbee2mqtt", Job: JobConfig{
+		Name:     "Zigbee2MQTT",
+		Schedule: "15 3 * * *",
+		Command:  "sync",
+		Sources:  []string{"/homeassistant/zigbee2mqtt", "/addon_configs/45df7312_zigbee2mqtt"},
+		Exclude:  append([]string{"/log/**", "*.tmp"}, excludeVolatile...),
+	}},
+	"esphome": {Folder: "esphome", Job: JobConfig{
+		Name:     "ESPHome",
+		Schedule: "30 3 * * *",
+		Command:  "sync",
+		Sources:  []string{"/homeassistant/esphome", "/addon_configs/5c53de3b_esphome"},
+		// build files are recreated when compiling
+		Exclude: append([]string{"/.esphome/**", "/.pioenvs/**", "/.piolibdeps/**"}, excludeVolatile...),
+	}},
+	"addon_configs": {Folder: "addon_configs", Job: JobConfig{
+		Name:     "Addon configs",
+		Schedule: "45 3 * * *",
+		Command:  "sync",
+		Sources:  []string{"/addon_configs"},
+		Exclude:  append([]string{"*/logs/**", "*/cache/**", "*/tmp/**"}, excludeVolatile...),
+	}},
+	"share": {Folder: "share", Job: JobConfig{
+		Name:     "Share",
+		Schedule: "0 4 * * *",
+		Command:  "sync",
+		Sources:  []string{"/share"},
+		Exclude:  append([]string{"*.tmp", "*.part"}, excludeVolatile...),
+	}},
+	"backups": {Folder: "backups", Job: JobConfig{
+		Name:     "Backups",
+		Schedule: "0 5 * * *",
+		Command:  "copy",
+		Sources:  []string{"/backup"},
+		Include:  []string{"*.tar"},
+	}},
+}
+
+// PresetNames returns the names of the built-in presets
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyPreset merges the job's preset into the job, job values take precedence
+func ApplyPreset(job JobConfig) (JobConfig, error) {
+	if job.Preset == "" {
+		return job, nil
+	}
+	preset, ok := Presets[job.Preset]
+	if !ok {
+		return job, fmt.Errorf("preset '%s' does not exist, must be one of %s", job.Preset, strings.Join(PresetNames(), ", "))
+	}
+	if job.Destination == "" && len(job.Destinations) == 0 {
+		return job, fmt.Errorf("preset '%s' requires a destination", job.Preset)
+	}
+	custom := job.Source != "" || len(job.Sources) > 0
+	job = MergeJob(job, preset.Job)
+	if job.Name == "" {
+		job.Name = preset.Job.Name
+	}
+
+	// presets list the locations used by different installs, only back up those that exist
+	if !custom {
+		var sources []string
+		for _, source := range job.Sources {
+			if stat, err := os.Stat(source); err == nil && stat.IsDir() {
+				sources = append(sources, source)
+			}
+		}
+		if len(sources) == 0 {
+			return job, fmt.Errorf("preset '%s' found none of %s", job.Preset, strings.Join(job.Sources, ", "))
+		}
+		job.Sources = sources
+	}
+
+	if job.Destination != "" {
+		job.Destination = JoinRemote(job.Destination, preset.Folder)
+	}
+	destinations := make([]string, len(job.Destinations))
+	for i, destination := range job.Destinations {
+		destinations[i] = JoinRemote(destination, preset.Folder)
+	}
+	job.Destinations = destinations
+	return job, nil
+}
+
+// RemotePreset tunes a remote for a provider whose quirks every user would otherwise have to rediscover
+type RemotePreset struct {
+	Type     string // rclone backend of the remotes the preset is detected for
+	Detect   func(settings map[string]string) bool
+	Options  map[string]string // backend options, the options of the remote take precedence
+	Flags    []string          // rclone flags of commands using the remote, the flags of the job take precedence
+	TPSLimit float64
+}
+
+// RemotePresetNone turns off the preset a remote would be detected as
+const RemotePresetNone = "none"
+
+// RemotePresets are selected with the preset option of a remote, or detected from the rclone config
+var RemotePresets = map[string]RemotePreset{
+	"nextcloud": {
+		Type: "webdav",
+		Detect: func(settings map[string]string) bool {
+			// Nextcloud remotes set up with the generic vendor still have the Nextcloud dav path
+			vendor := settings["vendor"]
+			return vendor == "nextcloud" || ((vendor == "" || vendor == "other") && strings.Contains(settings["url"], "/remote.php/dav/files/"))
+		},
+		Options: map[string]string{
+			// the nextcloud vendor keeps modification times and sha1 checksums, others upload every file again
+			"vendor": "nextcloud",
+			// fewer, larger chunks, each chunk is a request the brute force protection counts
+			"nextcloud_chunk_size": "64M",
+		},
+		Flags: []string{
+			// assembling a chunked upload can take minutes before the server answers
+			"--timeout=10m",
+			// every check is a PROPFIND, which is slow on small servers
+			"--checkers=4",
+		},
+		// bursts of requests are throttled or banned by the brute force protection
+		TPSLimit: 10,
+	},
+}
+
+// RemotePresetNames returns the names of the built-in remote presets
+func RemotePresetNames() []string {
+	names := make([]string, 0, len(RemotePresets))
+	for name := range RemotePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DetectRemotePresets selects the preset of each rclone remote that matches one, unless the remote sets its own
+func DetectRemotePresets(ctx context.Context) {
+	dump, err := RcloneConfigDump(ctx)
+	if err != nil {
+		Debugln("failed to detect remote presets:", err)
+		return
+	}
+	names := make([]string, 0, len(dump))
+	for name := range dump {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, presetName := range RemotePresetNames() {
+			preset := RemotePresets[presetName]
+			if dump[name]["type"] != preset.Type || !preset.Detect(dump[name]) {
+				continue
+			}
+			remote := RemoteConfigOf(name + ":")
+			if remote != nil && remote.Preset != "" {
+				break
+			}
+			if remote == nil {
+				config.Remotes = append(config.Remotes, RemoteConfig{Name: name, Preset: presetName})
+			} else {
+				remote.Preset = presetName
+			}
+			Infoln("applying the", presetName, "preset to", HighlightRemote(remoteName(name)))
+			break
+		}
+	}
+}
+
+// remotePreset returns the preset of a remote, or nil without one
+func (r *RemoteConfig) remotePreset() *RemotePreset {
+	if preset, ok := RemotePresets[r.Preset]; ok {
+		return &preset
+	}
+	return nil
+}
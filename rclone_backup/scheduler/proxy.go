@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// localHosts are never sent through the proxy, e.g. the supervisor api, other addons and the rclone rc daemon
+var localHosts = []string{"localhost", "127.0.0.1", "::1", "supervisor", "homeassistant", "hassio", "172.30.32.0/23"}
+
+// CheckProxy validates the proxy option
+func CheckProxy() error {
+	if config.Proxy == "" {
+		return nil
+	}
+	proxy, err := url.Parse(config.Proxy)
+	if err != nil || proxy.Host == "" {
+		return fmt.Errorf("invalid proxy '%s', must be a url such as http://proxy:3128", config.Proxy)
+	}
+	if proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5" {
+		return fmt.Errorf("proxy scheme must be http, https or socks5, not '%s'", proxy.Scheme)
+	}
+	return nil
+}
+
+// ApplyProxy sets the proxy environment variables used by rclone, restic and the notifiers,
+// it must be called before any http request is made as they are only read once
+func ApplyProxy() {
+	if config.Proxy == "" {
+		return
+	}
+	noProxy := append(append([]string{}, localHosts...), config.NoProxy...)
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		_ = os.Setenv(key, config.Proxy)
+	}
+	for _, key := range []string{"NO_PROXY", "no_proxy"} {
+		_ = os.Setenv(key, strings.Join(noProxy, ","))
+	}
+	proxy, _ := url.Parse(config.Proxy)
+	Infoln("using proxy", proxy.Redacted())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// appIcon is the icon of the addon, used as favicon and as icon of the installed dashboard
+//
+//go:embed icon.png
+var appIcon []byte
+
+// webManifest describes the jobs page as an installable app
+const webManifest = `{
+  "name": "Rclone Backup",
+  "short_name": "Backups",
+  "description": "Run and follow the backup jobs of the Rclone Backup addon",
+  "start_url": "/",
+  "scope": "/",
+  "display": "standalone",
+  "background_color": "#ffffff",
+  "theme_color": "#0277bd",
+  "icons": [{ "src": "/icon.png", "sizes": "400x400", "type": "image/png", "purpose": "any" }]
+}
+`
+
+// serviceWorkerScript caches the jobs page and the last job list and summary it loaded, so an installed dashboard
+// still opens and shows the last known state of the jobs while the addon can't be reached. Requests always go to
+// the addon first, cached responses have an X-Cached-At header with the time they were loaded.
+const serviceWorkerScript = `const CACHE = 'rclone-backup-1';
+const SHELL = ['/', '/i18n.js', '/manifest.json', '/icon.png'];
+const CACHED = SHELL.concat(['/jobs', '/api/jobs', '/api/summary']);
+self.addEventListener('install', e => {
+  e.waitUntil(caches.open(CACHE).then(c => c.addAll(SHELL)).then(() => self.skipWaiting()));
+});
+self.addEventListener('activate', e => {
+  e.waitUntil(caches.keys()
+    .then(keys => Promise.all(keys.filter(k => k !== CACHE).map(k => caches.delete(k))))
+    .then(() => self.clients.claim()));
+});
+self.addEventListener('fetch', e => {
+  const url = new URL(e.request.url);
+  if (e.request.method !== 'GET' || url.origin !== location.origin || !CACHED.includes(url.pathname)) return;
+  e.respondWith(fetch(e.request)
+    .then(r => {
+      if (r.ok) {
+        const copy = r.clone();
+        e.waitUntil(copy.blob().then(body => caches.open(CACHE).then(c => c.put(url.pathname, new Response(body, {
+          headers: { 'Content-Type': copy.headers.get('Content-Type') || '', 'X-Cached-At': new Date().toISOString() },
+        })))));
+      }
+      return r;
+    })
+    .catch(err => caches.match(url.pathname).then(r => r || Promise.reject(err))));
+});
+`
+
+// HandleWebManifest serves the manifest of the installable dashboard
+func HandleWebManifest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/manifest+json")
+	_, _ = w.Write([]byte(webManifest))
+}
+
+// HandleServiceWorker serves the service worker of the installable dashboard, it is never cached by the browser so
+// changes to it are picked up on the next visit
+func HandleServiceWorker(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(serviceWorkerScript))
+}
+
+// HandleIcon serves the icon of the addon
+func HandleIcon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	_, _ = w.Write(appIcon)
+}
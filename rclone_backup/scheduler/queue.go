@@ -0,0 +1,194 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// QueuedRun is a run of a job waiting in the run queue, or the one it is waiting for
+type QueuedRun struct {
+	ID          string    `json:"id"` // becomes the id of the run once it starts
+	Job         int       `json:"job"`
+	Name        string    `json:"name"`
+	Trigger     string    `json:"trigger"`
+	Queued      time.Time `json:"queued"`
+	Running     bool      `json:"running,omitempty"`
+	Prioritized bool      `json:"prioritized,omitempty"`
+	Position    int       `json:"position"`              // 0 for running runs
+	WaitingFor  string    `json:"waiting_for,omitempty"` // a running job reading from the same disk
+	disks       []uint64
+}
+
+type queueEntry struct {
+	run     QueuedRun
+	ready   chan struct{}
+	dropped bool // the queue was closed before it started
+}
+
+// RunQueue runs scheduled jobs in the order they were queued unless one is moved to the front, by
+// default one at a time to prevent issues with file locks
+type RunQueue struct {
+	mu      sync.Mutex
+	closed  bool
+	limit   int // runs allowed at once
+	running []QueuedRun
+	waiting []*queueEntry
+}
+
+var runQueue = &RunQueue{}
+
+// Task wraps the task of a job so it waits for its turn in the queue
+func (q *RunQueue) Task(job JobConfig, task func(job JobConfig)) func() {
+	return func() { q.Run(job, task) }
+}
+
+// Run waits for its turn in the queue and runs the task, the job's run id is set to the queued id
+func (q *RunQueue) Run(job JobConfig, task func(job JobConfig)) {
+	job.RunID = NewRunID()
+	entry := &queueEntry{
+		run:   QueuedRun{ID: job.RunID, Job: job.Index, Name: job.Name, Trigger: job.Trigger, Queued: time.Now(), disks: SourceDisks(job)},
+		ready: make(chan struct{}),
+	}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		Warnln("skipping job", "'"+job.Name+"',", "the addon is shutting down")
+		return
+	}
+	q.waiting = append(q.waiting, entry)
+	q.dispatch()
+	if len(q.waiting) > 0 && q.waiting[len(q.waiting)-1] == entry {
+		Infoln("job", "'"+job.Name+"'", "is queued behind", "'"+q.running[0].Name+"'")
+	}
+	q.mu.Unlock()
+	<-entry.ready
+	if entry.dropped {
+		Warnln("skipping queued run of", "'"+job.Name+"',", "the addon is shutting down")
+		return
+	}
+	defer q.finish(entry.run.ID)
+	task(job)
+}
+
+// Close drops the waiting runs and stops new runs from being queued
+func (q *RunQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for _, entry := range q.waiting {
+		entry.dropped = true
+		close(entry.ready)
+	}
+	q.waiting = nil
+}
+
+// SetLimit changes how many runs may run at once, runs over the limit finish but no new ones start
+func (q *RunQueue) SetLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = limit
+	q.dispatch()
+}
+
+// Limit returns how many runs may run at once
+func (q *RunQueue) Limit() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return max(q.limit, 1)
+}
+
+func (q *RunQueue) finish(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, run := range q.running {
+		if run.ID == id {
+			q.running = append(q.running[:i], q.running[i+1:]...)
+			break
+		}
+	}
+	q.dispatch()
+}
+
+// dispatch starts waiting runs while there are free slots, a job never runs twice at once and by
+// default runs reading from the same disk wait for each other, as parallel reads of one SD card are slower
+func (q *RunQueue) dispatch() {
+	for len(q.running) < max(q.limit, 1) {
+		next := -1
+		for i, entry := range q.waiting {
+			if q.isRunning(entry.run.Job) || q.sameDisk(entry.run) != nil {
+				continue
+			}
+			next = i
+			break
+		}
+		if next == -1 {
+			return
+		}
+		entry := q.waiting[next]
+		q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+		q.running = append(q.running, entry.run)
+		close(entry.ready)
+	}
+}
+
+func (q *RunQueue) isRunning(index int) bool {
+	for _, run := range q.running {
+		if run.Job == index {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDisk returns the running run reading from one of the disks of a run, if any
+func (q *RunQueue) sameDisk(run QueuedRun) *QueuedRun {
+	if config.Workers.SameDisk {
+		return nil
+	}
+	for i, other := range q.running {
+		for _, disk := range run.disks {
+			if slices.Contains(other.disks, disk) {
+				return &q.running[i]
+			}
+		}
+	}
+	return nil
+}
+
+// List returns the running runs followed by the waiting runs in the order they will run
+func (q *RunQueue) List() []QueuedRun {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]QueuedRun, 0, len(q.running)+len(q.waiting))
+	for _, run := range q.running {
+		run.Running = true
+		list = append(list, run)
+	}
+	for i, entry := range q.waiting {
+		run := entry.run
+		run.Position = i + 1
+		if blocking := q.sameDisk(run); blocking != nil {
+			run.WaitingFor = blocking.Name
+		}
+		list = append(list, run)
+	}
+	return list
+}
+
+// Prioritize moves a waiting run to the front of the queue, returning false if no run with the id is waiting
+func (q *RunQueue) Prioritize(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, entry := range q.waiting {
+		if entry.run.ID != id {
+			continue
+		}
+		entry.run.Prioritized = true
+		copy(q.waiting[1:i+1], q.waiting[:i])
+		q.waiting[0] = entry
+		Infoln("moved", "'"+entry.run.Name+"'", "to the front of the queue")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func queued(id string, job int, disks ...uint64) *queueEntry {
+	return &queueEntry{run: QueuedRun{ID: id, Job: job, Name: id, disks: disks}, ready: make(chan struct{})}
+}
+
+func runIDs(runs []QueuedRun) []string {
+	ids := []string{}
+	for _, run := range runs {
+		ids = append(ids, run.ID)
+	}
+	return ids
+}
+
+func TestRunQueueDispatch(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	tests := []struct {
+		name     string
+		limit    int
+		sameDisk bool
+		running  []QueuedRun
+		waiting  []*queueEntry
+		started  []string
+		left     []string
+	}{
+		{"one at a time by default", 0, false, nil,
+			[]*queueEntry{queued("a", 0), queued("b", 1)}, []string{"a"}, []string{"b"}},
+		{"limit", 2, false, nil,
+			[]*queueEntry{queued("a", 0), queued("b", 1), queued("c", 2)}, []string{"a", "b"}, []string{"c"}},
+		{"full", 2, false, []QueuedRun{{ID: "x", Job: 5}, {ID: "y", Job: 6}},
+			[]*queueEntry{queued("a", 0)}, []string{"x", "y"}, []string{"a"}},
+		{"job never runs twice at once", 3, false, []QueuedRun{{ID: "x", Job: 0}},
+			[]*queueEntry{queued("a", 0), queued("b", 1)}, []string{"x", "b"}, []string{"a"}},
+		{"same job queued twice", 3, false, nil,
+			[]*queueEntry{queued("a", 0), queued("b", 0)}, []string{"a"}, []string{"b"}},
+		{"same disk waits", 3, false, []QueuedRun{{ID: "x", Job: 5, disks: []uint64{1}}},
+			[]*queueEntry{queued("a", 0, 2, 1), queued("b", 1, 2)}, []string{"x", "b"}, []string{"a"}},
+		{"same disk allowed", 3, true, []QueuedRun{{ID: "x", Job: 5, disks: []uint64{1}}},
+			[]*queueEntry{queued("a", 0, 1)}, []string{"x", "a"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Workers.SameDisk = tt.sameDisk
+			q := &RunQueue{limit: tt.limit, running: tt.running, waiting: tt.waiting}
+			waiting := append([]*queueEntry{}, tt.waiting...)
+			q.dispatch()
+			if got := runIDs(q.running); !reflect.DeepEqual(got, tt.started) {
+				t.Errorf("running = %v, want %v", got, tt.started)
+			}
+			left := []string{}
+			for _, entry := range q.waiting {
+				left = append(left, entry.run.ID)
+			}
+			if !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("waiting = %v, want %v", left, tt.left)
+			}
+			for _, entry := range waiting {
+				started := false
+				select {
+				case <-entry.ready:
+					started = true
+				default:
+				}
+				if want := slices.Contains(tt.started, entry.run.ID); started != want {
+					t.Errorf("%s started = %v, want %v", entry.run.ID, started, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunQueueFinish(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.Workers.SameDisk = false
+	q := &RunQueue{waiting: []*queueEntry{queued("a", 0), queued("b", 0), queued("c", 1)}}
+	q.dispatch()
+	q.finish("a")
+	// b is the same job as a, it starts once a has finished
+	if got := runIDs(q.running); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("running = %v, want [b]", got)
+	}
+	q.finish("b")
+	if got := runIDs(q.running); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("running = %v, want [c]", got)
+	}
+}
+
+func TestRunQueuePrioritize(t *testing.T) {
+	q := &RunQueue{running: []QueuedRun{{ID: "x", Job: 5}}, waiting: []*queueEntry{queued("a", 0), queued("b", 1), queued("c", 2)}}
+	if !q.Prioritize("c") {
+		t.Fatalf("Prioritize(c) = false")
+	}
+	if q.Prioritize("x") || q.Prioritize("missing") {
+		t.Errorf("Prioritize() of a run that isn't waiting = true")
+	}
+	list := q.List()
+	if got := runIDs(list); !reflect.DeepEqual(got, []string{"x", "c", "a", "b"}) {
+		t.Errorf("list = %v, want [x c a b]", got)
+	}
+	if !list[0].Running || list[1].Position != 1 || !list[1].Prioritized || list[3].Position != 3 {
+		t.Errorf("list = %+v", list)
+	}
+}
+
+func TestRunQueueClose(t *testing.T) {
+	q := &RunQueue{running: []QueuedRun{{ID: "x", Job: 0}}}
+	entry := queued("a", 1)
+	q.waiting = []*queueEntry{entry}
+	q.Close()
+	select {
+	case <-entry.ready:
+	default:
+		t.Fatalf("waiting run wasn't released")
+	}
+	if !entry.dropped || len(q.waiting) != 0 {
+		t.Errorf("dropped = %v, waiting = %d", entry.dropped, len(q.waiting))
+	}
+	ran := false
+	q.Run(JobConfig{Index: 2}, func(job JobConfig) { ran = true })
+	if ran {
+		t.Errorf("run was started after the queue was closed")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosimple/slug"
+)
+
+const (
+	DefaultQuotaSchedule  = "0 * * * *"
+	DefaultQuotaThreshold = 90
+)
+
+type QuotaConfig struct {
+	Enabled   bool
+	Schedule  string
+	Threshold float64 // percent used before notifying
+}
+
+// RemoteQuota is the storage usage of a remote as reported by rclone about
+type RemoteQuota struct {
+	Remote  string    `json:"remote"`
+	Total   *int64    `json:"total,omitempty"`
+	Used    *int64    `json:"used,omitempty"`
+	Free    *int64    `json:"free,omitempty"`
+	Percent *float64  `json:"percent,omitempty"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type QuotaEventData struct {
+	Remote    string  `json:"remote"`
+	Percent   float64 `json:"percent"`
+	Threshold float64 `json:"threshold"`
+	Used      int64   `json:"used"`
+	Total     int64   `json:"total"`
+}
+
+var (
+	quotaMu sync.Mutex
+	quotas  = make(map[string]RemoteQuota)
+)
+
+// GetQuotas returns the last known quota of each remote
+func GetQuotas() []RemoteQuota {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	list := make([]RemoteQuota, 0, len(quotas))
+	for _, remote := range GetRcloneInfo().Remotes {
+		if quota, ok := quotas[remote]; ok {
+			list = append(list, quota)
+		}
+	}
+	return list
+}
+
+// CheckQuotas runs rclone about on every remote, publishing sensors and firing
+// an event when a remote crosses the threshold
+func CheckQuotas() {
+	threshold := config.Quota.Threshold
+	if threshold <= 0 {
+		threshold = DefaultQuotaThreshold
+	}
+	for _, remote := range GetRcloneInfo().Remotes {
+		quota := AboutRemote(remote)
+
+		quotaMu.Lock()
+		previous, checked := quotas[remote]
+		quotas[remote] = quota
+		quotaMu.Unlock()
+
+		if quota.Error != "" {
+			Debugln("failed to get quota for", remote, quota.Error)
+			continue
+		}
+		if quota.Percent == nil {
+			continue
+		}
+
+		PublishQuotaSensor(quota)
+
+		wasOver := checked && previous.Percent != nil && *previous.Percent >= threshold
+		if *quota.Percent >= threshold && !wasOver {
+			Warnln("remote", remote, "is", boldCyan(FormatPercent(*quota.Percent)+"%"), "full")
+			FireEvent(EventQuotaExceeded, QuotaEventData{
+				Remote: remote, Percent: *quota.Percent, Threshold: threshold, Used: *quota.Used, Total: *quota.Total,
+			})
+		}
+	}
+}
+
+// AboutRemote returns the usage of a remote, many backends only report some fields
+func AboutRemote(remote string) RemoteQuota {
+	quota := RemoteQuota{Remote: remote, Checked: time.Now()}
+	out, err := exec.Command(RcloneBinary(), "about", "--json", remote).Output()
+	if err != nil {
+		quota.Error = err.Error()
+		return quota
+	}
+	var about struct {
+		Total *int64 `json:"total"`
+		Used  *int64 `json:"used"`
+		Free  *int64 `json:"free"`
+	}
+	if err := json.Unmarshal(out, &about); err != nil {
+		quota.Error = err.Error()
+		return quota
+	}
+	quota.Total, quota.Used, quota.Free = about.Total, about.Used, about.Free
+	if quota.Total != nil && *quota.Total > 0 {
+		used := int64(0)
+		if quota.Used != nil {
+			used = *quota.Used
+		} else if quota.Free != nil {
+			used = *quota.Total - *quota.Free
+			quota.Used = &used
+		}
+		percent := float64(used) / float64(*quota.Total) * 100
+		quota.Percent = &percent
+	}
+	return quota
+}
+
+func PublishQuotaSensor(quota RemoteQuota) {
+	name := strings.TrimSuffix(quota.Remote, ":")
+	entityID := "sensor.rclone_backup_" + strings.ToLower(strings.ReplaceAll(slug.Make(name), "-", "_")) + "_usage"
+	attributes := map[string]interface{}{
+		"friendly_name":       "Rclone " + name + " usage",
+		"unit_of_measurement": "%",
+		"state_class":         "measurement",
+		"icon":                "mdi:cloud-percent",
+		"remote":              quota.Remote,
+		"total":               quota.Total,
+		"used":                quota.Used,
+		"free":                quota.Free,
+	}
+	err := SetSensorState(entityID, FormatPercent(*quota.Percent), attributes)
+	if err != nil {
+		Debugln("failed to publish sensor", entityID, err)
+	}
+}
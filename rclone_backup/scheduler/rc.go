@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EngineExec = "exec"
+	EngineRC   = "rc"
+)
+
+// rcCommands maps the rclone commands that can run through the rc api to their method
+var rcCommands = map[string]string{
+	"sync": "sync/sync",
+	"copy": "sync/copy",
+	"move": "sync/move",
+}
+
+// RcloneDaemon is an rclone rcd process used to run transfers through the rc api,
+// giving direct access to stats, errors and cancellation
+type RcloneDaemon struct {
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	exited    chan struct{} // closed once rcd exits
+	addr      string
+	password  string
+	inProcess bool // librclone was initialized
+}
+
+var daemon = &RcloneDaemon{}
+
+// Linked rclone, set by the librclone build tag. Transfers then run in the scheduler itself instead of in rcd.
+var (
+	librcloneStart func(configPath string) error
+	librcloneRPC   func(method string, input string) (string, int)
+	librcloneStop  func()
+)
+
+// UseRC reports whether the transfer can run through the rc api, flags can only
+// be passed to the rclone command so jobs using them are run with exec
+func UseRC(job JobConfig) bool {
+	if JobEngine(job) != EngineRC {
+		return false
+	}
+	if _, ok := rcCommands[job.Command]; !ok {
+		return false
+	}
+	return len(config.Flags) == 0 && len(config.ExtraFlags) == 0 && len(job.Flags) == 0 && len(job.ExtraFlags) == 0 && !HasRemoteConfig(job) && job.Bind == "" && len(S3Flags(job)) == 0
+}
+
+// CheckEngine validates the engine option
+func CheckEngine() error {
+	if config.Engine != "" && config.Engine != EngineExec && config.Engine != EngineRC {
+		return errors.New("engine must be 'exec' or 'rc'")
+	}
+	return nil
+}
+
+// running reports whether rcd was started and hasn't exited, d.mu must be held
+func (d *RcloneDaemon) running() bool {
+	if d.cmd == nil {
+		return false
+	}
+	select {
+	case <-d.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// start initializes the linked rclone, or launches rcd on a free local port if it is not already running
+func (d *RcloneDaemon) start() error {
+	if librcloneRPC != nil {
+		if !d.inProcess {
+			if err := librcloneStart(config.ConfigPath); err != nil {
+				return err
+			}
+			d.inProcess = true
+			Infoln("running rc transfers with the rclone linked into the scheduler")
+		}
+		return nil
+	}
+	if d.running() {
+		return nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	d.addr = listener.Addr().String()
+	_ = listener.Close()
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	d.password = hex.EncodeToString(buf)
+
+	d.cmd = exec.Command(RcloneBinary(), "rcd", "--rc-addr", d.addr, "--rc-user", "rclone_backup", "--rc-pass", d.password)
+	d.cmd.Stdout = os.Stdout
+	d.cmd.Stderr = os.Stdout
+	if err := d.cmd.Start(); err != nil {
+		d.cmd = nil
+		return err
+	}
+	exited := make(chan struct{})
+	d.exited = exited
+	go func(cmd *exec.Cmd) {
+		_ = cmd.Wait()
+		close(exited)
+		Debugln("rclone rcd exited")
+	}(d.cmd)
+
+	// wait for the api to come up
+	for i := 0; i < 50; i++ {
+		if _, err := d.call(context.Background(), "rc/noop", map[string]interface{}{}); err == nil {
+			Debugln("rclone rcd listening on", d.addr)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("rclone rcd did not start")
+}
+
+// Call runs an rc method, starting rcd if needed
+func (d *RcloneDaemon) Call(ctx context.Context, method string, params map[string]interface{}) (map[string]interface{}, error) {
+	d.mu.Lock()
+	err := d.start()
+	d.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start rclone rcd: %w", err)
+	}
+	return d.call(ctx, method, params)
+}
+
+func (d *RcloneDaemon) call(ctx context.Context, method string, params map[string]interface{}) (map[string]interface{}, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	if librcloneRPC != nil {
+		return callLinked(ctx, method, body)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+d.addr+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("rclone_backup", d.password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if msg, ok := result["error"].(string); ok {
+			return result, errors.New(msg)
+		}
+		return result, fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	return result, nil
+}
+
+// callLinked runs an rc method with the linked rclone, which answers with the same json as rcd
+func callLinked(ctx context.Context, method string, body []byte) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out, status := librcloneRPC(method, string(body))
+	result := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		if msg, ok := result["error"].(string); ok {
+			return result, errors.New(msg)
+		}
+		return result, fmt.Errorf("bad status code %d", status)
+	}
+	return result, nil
+}
+
+// Stop shuts down rcd if it was started, or the linked rclone
+func (d *RcloneDaemon) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inProcess {
+		librcloneStop()
+		d.inProcess = false
+		return
+	}
+	if !d.running() {
+		return
+	}
+	if _, err := d.call(context.Background(), "core/quit", map[string]interface{}{}); err != nil {
+		_ = d.cmd.Process.Kill()
+	}
+}
+
+// RunRC runs a sync, copy or move through the rc api, polling its stats until it finishes
+func RunRC(ctx context.Context, job JobConfig, source string, destination string, dryRun bool) error {
+	group := "job/" + strconv.Itoa(job.Index) + "/" + NewRunID()
+	rcConfig := map[string]interface{}{"DryRun": dryRun}
+	if job.ServerSideAcrossConfigs {
+		rcConfig["ServerSideAcrossConfigs"] = true
+	}
+	if tps := AdaptiveTPSLimit(source, destination); tps > 0 {
+		rcConfig["TPSLimit"] = tps
+	}
+	if job.MaxTransfer > 0 {
+		rcConfig["MaxTransfer"] = job.MaxTransfer
+	}
+	if job.Versioning.Enabled && destination != "" {
+		rcConfig["BackupDir"] = VersionsPath(job, destination) + "/" + time.Now().Format(DefaultDateLayout)
+	}
+	exclude := job.Exclude
+	if config.RemoteLock.Enabled {
+		exclude = append(append([]string{}, job.Exclude...), "*"+LockSuffix)
+	}
+	params := map[string]interface{}{
+		"srcFs":   source,
+		"dstFs":   destination,
+		"_async":  true,
+		"_group":  group,
+		"_config": rcConfig,
+		"_filter": map[string]interface{}{"IncludeRule": job.Include, "ExcludeRule": exclude},
+	}
+	if job.Command == "sync" {
+		params["createEmptySrcDirs"] = false
+	}
+	result, err := daemon.Call(ctx, rcCommands[job.Command], params)
+	if err != nil {
+		return err
+	}
+	jobID, ok := result["jobid"].(float64)
+	if !ok {
+		return errors.New("rclone rcd did not return a job id")
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	errorCount := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := daemon.Call(context.Background(), "job/stop", map[string]interface{}{"jobid": jobID}); err != nil {
+				Errorln("failed to stop rclone job:", err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		stats, err := daemon.Call(ctx, "core/stats", map[string]interface{}{"group": group})
+		if err == nil {
+			statuses.SetProgress(job.Index, rcProgress(stats))
+			transferred, _ := stats["bytes"].(float64)
+			speed, _ := stats["speed"].(float64)
+			count, _ := stats["errors"].(float64)
+			lastError, _ := stats["lastError"].(string)
+			throttled := count > errorCount && IsThrottled(lastError)
+			errorCount = count
+			statuses.AddSpeedSample(job.Index, SpeedSample{Bytes: int64(transferred), Speed: speed, Throttled: throttled})
+		}
+		status, err := daemon.Call(ctx, "job/status", map[string]interface{}{"jobid": jobID})
+		if err != nil {
+			return err
+		}
+		if finished, _ := status["finished"].(bool); !finished {
+			continue
+		}
+		if stats != nil {
+			transferred, _ := stats["bytes"].(float64)
+			files, _ := stats["transfers"].(float64)
+			statuses.AddTransferred(job.Index, int64(transferred), int64(files))
+			var serverSide ServerSideStats
+			for _, kind := range [][2]string{{"serverSideCopies", "serverSideCopyBytes"}, {"serverSideMoves", "serverSideMoveBytes"}} {
+				count, _ := stats[kind[0]].(float64)
+				size, _ := stats[kind[1]].(float64)
+				serverSide.Files += int64(count)
+				serverSide.Bytes += int64(size)
+			}
+			if serverSide.Files > 0 {
+				statuses.AddServerSide(job.Index, serverSide)
+				logServerSide(serverSide, int64(transferred))
+			}
+			if !dryRun {
+				traffic.Add(source, destination, int64(transferred), int64(files))
+			}
+			Infoln("transferred", FormatBytes(int64(transferred))+",", int64(files), "files")
+			throttled := 0
+			if lastError, _ := stats["lastError"].(string); IsThrottled(lastError) {
+				throttled = 1
+			}
+			pacing.Record(job, source, destination, throttled)
+		}
+		if msg, _ := status["error"].(string); msg != "" {
+			return errors.New(msg)
+		}
+		return nil
+	}
+}
+
+// rcProgress formats core/stats like rclone's own progress line
+func rcProgress(stats map[string]interface{}) string {
+	transferred, _ := stats["bytes"].(float64)
+	total, _ := stats["totalBytes"].(float64)
+	speed, _ := stats["speed"].(float64)
+	progress := FormatBytes(int64(transferred)) + " / " + FormatBytes(int64(total))
+	if total > 0 {
+		progress += ", " + FormatPercent(transferred/total*100) + "%"
+	}
+	return progress + ", " + FormatBytes(int64(speed)) + "/s"
+}
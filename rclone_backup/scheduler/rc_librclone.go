@@ -0,0 +1,34 @@
+//go:build librclone
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	_ "github.com/rclone/rclone/backend/all"   // the backends of the remotes
+	_ "github.com/rclone/rclone/fs/operations" // operations/* rc methods
+	_ "github.com/rclone/rclone/fs/rc/jobs"    // job/status and job/stop of async transfers
+	_ "github.com/rclone/rclone/fs/sync"       // sync/sync, sync/copy and sync/move
+	"github.com/rclone/rclone/librclone/librclone"
+)
+
+func init() {
+	librcloneStart = startLibrclone
+	librcloneRPC = librclone.RPC
+	librcloneStop = librclone.Finalize
+}
+
+// startLibrclone initializes the linked rclone and points it at the rclone config of the addon
+func startLibrclone(configPath string) error {
+	librclone.Initialize()
+	input, err := json.Marshal(map[string]string{"path": configPath})
+	if err != nil {
+		return err
+	}
+	if out, status := librclone.RPC("config/setpath", string(input)); status != http.StatusOK {
+		return fmt.Errorf("failed to set the rclone config: %s", out)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReadyPath is created once the scheduler is ready and removed when it shuts down
+var ReadyPath = "/run/scheduler.ready"
+
+// livenessTimeout is how long the stores of the scheduler may take to answer before it is considered hung
+const livenessTimeout = 10 * time.Second
+
+// maxTickAge is how long the clock check may not have ticked before the scheduler is considered hung
+const maxTickAge = 4 * healthTickInterval
+
+const (
+	ProbeOK       = "ok"
+	ProbeStarting = "starting"
+	ProbeStopping = "stopping"
+	ProbeHung     = "hung"
+)
+
+// Probe is the status returned by the liveness and readiness endpoints
+type Probe struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	Since  string `json:"since,omitempty"` // how long the scheduler has been in this state
+}
+
+var (
+	readyMu    sync.Mutex
+	readySince time.Time
+	stopping   bool
+)
+
+// SignalReady marks the scheduler as ready once its config is loaded and the schedulers are started. It tells s6
+// through the notification fd in NOTIFICATION_FD, set by the run script of the service, and creates the ready file.
+func SignalReady() {
+	readyMu.Lock()
+	readySince = time.Now()
+	readyMu.Unlock()
+	Infoln("scheduler is ready")
+
+	if value := os.Getenv("NOTIFICATION_FD"); value != "" {
+		fd, err := strconv.Atoi(value)
+		if err != nil {
+			Warnln("invalid NOTIFICATION_FD", "'"+value+"'")
+		} else {
+			// s6 reads a newline from the pipe, which is then closed so it isn't inherited by rclone. Without the
+			// pipe the fd may be one the go runtime opened itself, which mustn't be closed.
+			file := os.NewFile(uintptr(fd), "notification-fd")
+			if info, err := file.Stat(); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+				Warnln("NOTIFICATION_FD", value, "is not the notification pipe of s6")
+			} else {
+				if _, err := file.Write([]byte("\n")); err != nil {
+					Warnln("failed to notify s6 of readiness", err)
+				}
+				_ = file.Close()
+			}
+		}
+		_ = os.Unsetenv("NOTIFICATION_FD")
+	}
+
+	if err := os.WriteFile(ReadyPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		Debugln("failed to create ready file", err)
+	}
+}
+
+// SignalStopping marks the scheduler as no longer ready while it shuts down
+func SignalStopping() {
+	readyMu.Lock()
+	stopping = true
+	readyMu.Unlock()
+	if err := os.Remove(ReadyPath); err != nil && !os.IsNotExist(err) {
+		Debugln("failed to remove ready file", err)
+	}
+}
+
+// Readiness reports whether the scheduler has started and isn't shutting down
+func Readiness() Probe {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	if stopping {
+		return Probe{Status: ProbeStopping, Reason: "shutting down"}
+	}
+	if readySince.IsZero() {
+		return Probe{Status: ProbeStarting, Reason: "loading the config and running the jobs without a schedule", Since: FormatDuration(time.Since(health.started))}
+	}
+	return Probe{Status: ProbeOK, Since: FormatDuration(time.Since(readySince))}
+}
+
+// Liveness reports whether the scheduler still responds, a scheduler that is starting or shutting down is alive.
+// It is hung when the clock check stopped ticking or the job statuses can't be read in time, e.g. after a deadlock.
+func Liveness() Probe {
+	answered := make(chan struct{})
+	var lastTick time.Time
+	go func() {
+		statuses.AnyRunning()
+		health.mu.Lock()
+		lastTick = health.lastTick
+		health.mu.Unlock()
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-time.After(livenessTimeout):
+		return Probe{Status: ProbeHung, Reason: "the job statuses didn't answer within " + FormatDuration(livenessTimeout)}
+	}
+	// the monotonic clock doesn't advance while the host is suspended, so a resumed host isn't hung
+	if !lastTick.IsZero() {
+		if age := time.Since(lastTick); age > maxTickAge {
+			return Probe{Status: ProbeHung, Reason: "the clock check didn't tick for " + FormatDuration(age)}
+		}
+	}
+	return Probe{Status: ProbeOK, Since: FormatDuration(time.Since(health.started))}
+}
+
+// HandleProbe serves a liveness or readiness probe, with 503 when the probe fails. Probes don't need a token so the
+// Supervisor watchdog and docker can call them.
+func HandleProbe(probe func() Probe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		result := probe()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if result.Status != ProbeOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	}
+}
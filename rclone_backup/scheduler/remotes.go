@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RemoteConfig are the rate limits and backend options applied to every job using a remote
+type RemoteConfig struct {
+	Name          string
+	Preset        string  // tuning for a provider, see RemotePresets, detected from the rclone config when empty
+	TPSLimit      float64 `yaml:"tpslimit"` // api transactions per second
+	TPSLimitBurst int     `yaml:"tpslimit_burst"`
+	UserAgent     string  `yaml:"user_agent"`
+	PacerMinSleep string  `yaml:"pacer_min_sleep"` // e.g. Google Drive and Google Photos
+	PacerBurst    int     `yaml:"pacer_burst"`
+	ChunkSize     string  `yaml:"chunk_size"`
+	UploadCutoff  string  `yaml:"upload_cutoff"`
+	Options       Flags   // other backend options, decoded the same way as flags
+	Pricing       PricingConfig
+	Drive         DriveConfig  // Google Drive shared drive and service accounts
+	Server        ServerConfig // SFTP and FTP connection checks and reconnects
+}
+
+// remoteName returns the name of a remote with its trailing colon, e.g. "google:"
+func remoteName(name string) string {
+	return strings.TrimSuffix(name, ":") + ":"
+}
+
+// CheckRemoteConfigs validates the per-remote options
+func CheckRemoteConfigs() error {
+	seen := make(map[string]bool)
+	for _, remote := range config.Remotes {
+		if remote.Name == "" {
+			return errors.New("remotes: every remote requires a name")
+		}
+		name := remoteName(remote.Name)
+		if seen[name] {
+			return fmt.Errorf("remotes: '%s' is configured more than once", name)
+		}
+		seen[name] = true
+		if !ArrayContains(remotes, name) {
+			Warnln("remotes:", "'"+name+"'", "is not a configured rclone remote")
+		}
+		if remote.TPSLimit < 0 || remote.TPSLimitBurst < 0 || remote.PacerBurst < 0 {
+			return fmt.Errorf("remotes: '%s' limits can't be negative", name)
+		}
+		if err := checkDriveConfig(remote); err != nil {
+			return err
+		}
+		if err := checkServerConfig(remote); err != nil {
+			return err
+		}
+		if _, ok := RemotePresets[remote.Preset]; remote.Preset != "" && remote.Preset != RemotePresetNone && !ok {
+			return fmt.Errorf("remotes: '%s' unknown preset '%s', must be one of %s or %s", name, remote.Preset, strings.Join(RemotePresetNames(), ", "), RemotePresetNone)
+		}
+	}
+	return nil
+}
+
+// RemoteConfigOf returns the options of the remote a path is on
+func RemoteConfigOf(path string) *RemoteConfig {
+	i := strings.Index(path, ":")
+	if i <= 0 {
+		return nil
+	}
+	// connection strings are matched by their remote, e.g. "google,chunk_size=64M:"
+	name := path[:i]
+	if j := strings.Index(name, ","); j >= 0 {
+		name = name[:j]
+	}
+	for k := range config.Remotes {
+		if remoteName(config.Remotes[k].Name) == name+":" {
+			return &config.Remotes[k]
+		}
+	}
+	return nil
+}
+
+// backendOptions returns the backend options of a remote, sorted so they form the same connection string every run
+func (r *RemoteConfig) backendOptions() []string {
+	options := make(map[string]string)
+	if preset := r.remotePreset(); preset != nil {
+		for key, value := range preset.Options {
+			options[key] = value
+		}
+	}
+	for key, value := range r.Options {
+		options[strings.ReplaceAll(strings.TrimPrefix(key, "--"), "-", "_")] = value
+	}
+	if r.PacerMinSleep != "" {
+		options["pacer_min_sleep"] = r.PacerMinSleep
+	}
+	if r.PacerBurst > 0 {
+		options["pacer_burst"] = strconv.Itoa(r.PacerBurst)
+	}
+	if r.ChunkSize != "" {
+		options["chunk_size"] = r.ChunkSize
+	}
+	if r.UploadCutoff != "" {
+		options["upload_cutoff"] = r.UploadCutoff
+	}
+	driveBackendOptions(r, options)
+	serverBackendOptions(r, options)
+	list := make([]string, 0, len(options))
+	for key, value := range options {
+		if value == "True" || value == "False" {
+			value = strings.ToLower(value)
+		} else if strings.ContainsAny(value, ",:\"'") {
+			value = "'" + strings.ReplaceAll(value, "'", "''") + "'"
+		}
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// ApplyRemoteOptions adds the backend options of the path's remote as an rclone connection string,
+// e.g. "google:/Backup" becomes "google,chunk_size=64M:/Backup"
+func ApplyRemoteOptions(path string) string {
+	remote := RemoteConfigOf(path)
+	if remote == nil {
+		return path
+	}
+	options := remote.backendOptions()
+	if len(options) == 0 {
+		return path
+	}
+	i := strings.Index(path, ":")
+	return path[:i] + "," + strings.Join(options, ",") + path[i:]
+}
+
+// RemoteFlags returns the global rclone flags of the remotes used by a command, the last path takes precedence
+func RemoteFlags(paths ...string) []string {
+	var flags []string
+	for _, path := range paths {
+		remote := RemoteConfigOf(path)
+		if remote == nil {
+			continue
+		}
+		tpsLimit := remote.TPSLimit
+		if preset := remote.remotePreset(); preset != nil {
+			flags = append(flags, preset.Flags...)
+			if tpsLimit == 0 {
+				tpsLimit = preset.TPSLimit
+			}
+		}
+		if tpsLimit > 0 {
+			flags = append(flags, "--tpslimit="+strconv.FormatFloat(tpsLimit, 'f', -1, 64))
+		}
+		if remote.TPSLimitBurst > 0 {
+			flags = append(flags, "--tpslimit-burst="+strconv.Itoa(remote.TPSLimitBurst))
+		}
+		if remote.UserAgent != "" {
+			flags = append(flags, "--user-agent="+remote.UserAgent)
+		}
+		if remote.Server.Timeout != "" {
+			flags = append(flags, "--timeout="+remote.Server.Timeout)
+		}
+	}
+	// a remote that throttled recently runs slower than its configured tpslimit
+	if tps := AdaptiveTPSLimit(paths...); tps > 0 {
+		flags = append(flags, "--tpslimit="+strconv.FormatFloat(tps, 'f', -1, 64))
+	}
+	return flags
+}
+
+// HasRemoteConfig reports whether any remote of the job has options, which are only passed to the rclone command
+func HasRemoteConfig(job JobConfig) bool {
+	for _, remote := range JobRemotes(job) {
+		if RemoteConfigOf(remote) != nil {
+			return true
+		}
+	}
+	return false
+}
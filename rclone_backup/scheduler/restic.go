@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcwillox/emerald"
+)
+
+const EngineRestic = "restic"
+
+// resticRepositoryMissing is the exit code of restic when the repository does not exist
+const resticRepositoryMissing = 10
+
+type ResticConfig struct {
+	Repository   string // restic repository, defaults to the destination through rclone
+	Password     string
+	PasswordFile string `yaml:"password_file"`
+	Tags         []string
+	Keep         KeepConfig
+	Prune        bool
+	Check        bool
+	CheckSubset  string `yaml:"check_subset"` // e.g. "5%" to also read part of the data
+}
+
+// KeepConfig is the retention policy passed to restic forget and borg prune
+type KeepConfig struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	Within  string
+}
+
+// Args returns the restic forget flags of the policy
+func (k KeepConfig) Args() []string {
+	var args []string
+	for _, keep := range []struct {
+		flag  string
+		count int
+	}{{"--keep-last", k.Last}, {"--keep-hourly", k.Hourly}, {"--keep-daily", k.Daily}, {"--keep-weekly", k.Weekly}, {"--keep-monthly", k.Monthly}, {"--keep-yearly", k.Yearly}} {
+		if keep.count > 0 {
+			args = append(args, keep.flag, strconv.Itoa(keep.count))
+		}
+	}
+	if k.Within != "" {
+		args = append(args, "--keep-within", k.Within)
+	}
+	return args
+}
+
+// JobEngine returns the engine used to run the job's transfers
+func JobEngine(job JobConfig) string {
+	if job.Engine != "" {
+		return job.Engine
+	}
+	return config.Engine
+}
+
+// CheckRestic validates the restic options of a job
+func CheckRestic(job JobConfig) ([]string, error) {
+	var warnings []string
+	if _, err := exec.LookPath("restic"); err != nil {
+		return nil, errors.New("restic is not installed")
+	}
+	if job.Restic.Password == "" && job.Restic.PasswordFile == "" {
+		return nil, errors.New("restic requires a password or password_file to encrypt the repository")
+	}
+	if job.Restic.Repository == "" && len(job.Destinations) == 0 {
+		return nil, errors.New("restic requires a destination or repository to back up to")
+	}
+	if len(job.Include) > 0 {
+		warnings = append(warnings, "include is not supported by restic and is ignored")
+	}
+	return warnings, nil
+}
+
+// ResticRepository returns the restic repository of a destination, rclone remotes are accessed using restic's rclone backend
+func ResticRepository(job JobConfig, destination string) string {
+	if job.Restic.Repository != "" {
+		return job.Restic.Repository
+	}
+	if strings.Contains(destination, ":") && !strings.HasPrefix(destination, "rclone:") {
+		return "rclone:" + destination
+	}
+	return destination
+}
+
+// resticCommand creates a restic command for the repository of the job
+func resticCommand(ctx context.Context, job JobConfig, repository string, args ...string) *exec.Cmd {
+	args = append([]string{"-o", "rclone.program=" + RcloneBinary()}, args...)
+	cmd := exec.CommandContext(ctx, "restic", args...)
+	cmd.Env = append(os.Environ(), "RESTIC_REPOSITORY="+repository)
+	if job.Restic.PasswordFile != "" {
+		cmd.Env = append(cmd.Env, "RESTIC_PASSWORD_FILE="+job.Restic.PasswordFile)
+	} else {
+		cmd.Env = append(cmd.Env, "RESTIC_PASSWORD="+job.Restic.Password)
+	}
+	return cmd
+}
+
+// runRestic runs a restic command, logging its output and returning the last error lines
+func runRestic(ctx context.Context, job JobConfig, repository string, args ...string) ([]string, error) {
+	Debugln("restic", args)
+	cmd := resticCommand(ctx, job, repository, args...)
+	cmd.Stdout = JobLog(os.Stdout, job.Index)
+	var stderr tailWriter
+	cmd.Stderr = io.MultiWriter(JobLog(os.Stdout, job.Index), &stderr)
+	emerald.Print(emerald.Blue)
+	err := cmd.Run()
+	emerald.Print(emerald.Reset)
+	return stderr.lines, err
+}
+
+// RunRestic backs up the source into a restic repository, then applies the retention policy and checks the repository
+func RunRestic(ctx context.Context, job JobConfig, source string, destination string) error {
+	repository := ResticRepository(job, destination)
+	dryRun := IsDryRun(job)
+	start := time.Now()
+	Infoln("running", JobInfo(job, "job", source, repository), "with restic")
+	fail := func(msg string, logged []string) error {
+		resticErr := NewRcloneError(msg, logged)
+		Errorln(resticErr.Message, "("+resticErr.Class+")")
+		FireJobEvent(EventJobFailed, job, source, destination, start, resticErr.Message)
+		return resticErr
+	}
+
+	if err := CheckSourceSize(ctx, job, source); err != nil {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+		return err
+	}
+
+	// create the repository the first time it is used
+	if !dryRun {
+		err := resticCommand(ctx, job, repository, "cat", "config").Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == resticRepositoryMissing {
+			Infoln("initializing restic repository", HighlightRemote(destination))
+			if logged, err := runRestic(ctx, job, repository, "init"); err != nil {
+				return fail(fmt.Sprintf("failed to initialize restic repository: %s", err), logged)
+			}
+		}
+	}
+
+	args := []string{"backup", source, "--json", "--tag", "rclone_backup"}
+	if job.Name != "" {
+		args = append(args, "--tag", job.Name)
+	}
+	for _, tag := range job.Restic.Tags {
+		args = append(args, "--tag", tag)
+	}
+	for _, exclusion := range job.Exclude {
+		args = append(args, "--exclude", exclusion)
+	}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	args = append(args, job.ExtraFlags...)
+	Debugln("restic", args)
+	cmd := resticCommand(ctx, job, repository, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fail(err.Error(), nil)
+	}
+	var stderr tailWriter
+	cmd.Stderr = io.MultiWriter(JobLog(os.Stdout, job.Index), &stderr)
+	if err := cmd.Start(); err != nil {
+		return fail(fmt.Sprintf("failed to run restic: %s", err), nil)
+	}
+	summary := readResticBackup(job, stdout)
+	if err := cmd.Wait(); err != nil {
+		return fail(fmt.Sprintf("failed to run restic backup: %s", err), stderr.lines)
+	}
+	if summary != nil {
+		statuses.AddTransferred(job.Index, summary.DataAdded, summary.FilesNew+summary.FilesChanged)
+		Infoln("snapshot", summary.SnapshotID, "added", FormatBytes(summary.DataAdded), "of", FormatBytes(summary.TotalBytesProcessed), "in",
+			summary.FilesNew, "new and", summary.FilesChanged, "changed files")
+	}
+
+	if keep := job.Restic.Keep.Args(); len(keep) > 0 {
+		// only forget snapshots of this job, other jobs may share the repository
+		tag := "rclone_backup"
+		if job.Name != "" {
+			tag = job.Name
+		}
+		forget := append([]string{"forget", "--tag", tag, "--group-by", "host,paths"}, keep...)
+		if job.Restic.Prune {
+			forget = append(forget, "--prune")
+		}
+		if dryRun {
+			forget = append(forget, "--dry-run")
+		}
+		if logged, err := runRestic(ctx, job, repository, forget...); err != nil {
+			return fail(fmt.Sprintf("failed to forget restic snapshots: %s", err), logged)
+		}
+	}
+
+	if job.Restic.Check && !dryRun {
+		check := []string{"check"}
+		if job.Restic.CheckSubset != "" {
+			check = append(check, "--read-data-subset", job.Restic.CheckSubset)
+		}
+		if logged, err := runRestic(ctx, job, repository, check...); err != nil {
+			return fail(fmt.Sprintf("restic repository check failed: %s", err), logged)
+		}
+	}
+
+	Infoln("finished in", boldCyan(FormatDuration(time.Since(start))))
+	FireJobEvent(EventJobSuccessful, job, source, destination, start, "")
+	return nil
+}
+
+// resticSummary is the last message of restic backup --json
+type resticSummary struct {
+	FilesNew            int64  `json:"files_new"`
+	FilesChanged        int64  `json:"files_changed"`
+	DataAdded           int64  `json:"data_added"`
+	TotalBytesProcessed int64  `json:"total_bytes_processed"`
+	SnapshotID          string `json:"snapshot_id"`
+}
+
+// readResticBackup reports the progress of restic backup --json and returns its summary
+func readResticBackup(job JobConfig, r io.Reader) *resticSummary {
+	var summary *resticSummary
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg struct {
+			MessageType string                    `json:"message_type"`
+			PercentDone float64                   `json:"percent_done"`
+			BytesDone   int64                     `json:"bytes_done"`
+			TotalBytes  int64                     `json:"total_bytes"`
+			SecondsLeft int64                     `json:"seconds_remaining"`
+			Error       *struct{ Message string } `json:"error"`
+			Item        string                    `json:"item"`
+			resticSummary
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			Debugln(scanner.Text())
+			continue
+		}
+		switch msg.MessageType {
+		case "status":
+			progress := FormatBytes(msg.BytesDone) + " / " + FormatBytes(msg.TotalBytes) + ", " + FormatPercent(msg.PercentDone*100) + "%"
+			if msg.SecondsLeft > 0 {
+				progress += ", ETA " + (time.Duration(msg.SecondsLeft) * time.Second).String()
+			}
+			statuses.SetProgress(job.Index, progress)
+		case "error":
+			if msg.Error != nil {
+				Warnln("restic:", msg.Item+":", msg.Error.Message)
+			}
+		case "summary":
+			s := msg.resticSummary
+			summary = &s
+		}
+	}
+	return summary
+}
+
+// tailWriter keeps the last lines written to it
+type tailWriter struct {
+	buf   []byte
+	lines []string
+}
+
+func (t *tailWriter) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	for {
+		i := strings.IndexByte(string(t.buf), '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(t.buf[:i])); line != "" {
+			t.lines = append(t.lines, line)
+			if len(t.lines) > maxErrorLines {
+				t.lines = t.lines[1:]
+			}
+		}
+		t.buf = t.buf[i+1:]
+	}
+	return len(b), nil
+}
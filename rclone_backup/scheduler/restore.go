@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommandRestoreTest is the job command that downloads and verifies a backup
+const CommandRestoreTest = "restore_test"
+
+// DefaultRestoreRecent is how many of the newest backups a restore test picks from
+const DefaultRestoreRecent = 5
+
+// backupMetadata is the backup.json included in Home Assistant backups
+type backupMetadata struct {
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	Date      string `json:"date"`
+	Protected bool   `json:"protected"`
+	// content of the backup, each is stored as a separate archive
+	HomeAssistant json.RawMessage `json:"homeassistant"`
+	Addons        []struct {
+		Slug string `json:"slug"`
+	} `json:"addons"`
+	Folders []string `json:"folders"`
+}
+
+// archives returns the number of archives the backup should contain
+func (m *backupMetadata) archives() int {
+	count := len(m.Addons) + len(m.Folders)
+	if len(m.HomeAssistant) > 0 && string(m.HomeAssistant) != "null" {
+		count++
+	}
+	return count
+}
+
+type remoteFile struct {
+	Path    string    `json:"Path"`
+	Size    int64     `json:"Size"`
+	ModTime time.Time `json:"ModTime"`
+	Tier    string    `json:"Tier"` // storage class of S3 objects
+}
+
+// RunRestoreTest downloads a random recent backup from each source to a temporary
+// folder, verifies the archive can be read and deletes it again
+func RunRestoreTest(ctx context.Context, job JobConfig) error {
+	var lastErr error
+	for _, source := range job.Sources {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		Infoln("testing restore from", HighlightRemote(source))
+		detail, err := restoreTest(ctx, job, source)
+		if err != nil {
+			msg := fmt.Sprintf("restore test failed: %s", err)
+			Errorln(msg)
+			Notify(fmt.Sprintf("restore_test_%d", job.Index), "Rclone Backup: restore test failed", JobName(job)+": "+msg)
+			FireJobEvent(EventJobFailed, job, source, "", start, msg)
+			lastErr = errors.New(msg)
+			continue
+		}
+		statuses.SetDetail(job.Index, detail)
+		Infoln("verified", detail, "in", boldCyan(FormatDuration(time.Since(start))))
+		FireJobEvent(EventJobSuccessful, job, source, "", start, "")
+	}
+	return lastErr
+}
+
+func restoreTest(ctx context.Context, job JobConfig, source string) (string, error) {
+	args := []string{"lsjson", "--files-only", source}
+	for _, inclusion := range job.Include {
+		args = append(args, "--include", inclusion)
+	}
+	for _, exclusion := range job.Exclude {
+		args = append(args, "--exclude", exclusion)
+	}
+	out, err := exec.CommandContext(ctx, RcloneBinary(), args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups: %w", err)
+	}
+	var files []remoteFile
+	if err := json.Unmarshal(out, &files); err != nil {
+		return "", fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(files) == 0 {
+		return "", errors.New("no backups found in " + source)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	recent := job.RestoreRecent
+	if recent <= 0 {
+		recent = DefaultRestoreRecent
+	}
+	if recent > len(files) {
+		recent = len(files)
+	}
+	file := files[rand.Intn(recent)]
+
+	// the destination of the job can set where backups are downloaded to
+	dir, err := os.MkdirTemp(job.Destination, "rclone-restore-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			Errorln("failed to remove restore test folder", err)
+		}
+	}()
+
+	local := filepath.Join(dir, path.Base(file.Path))
+	remote := strings.TrimSuffix(source, "/") + "/" + file.Path
+	if strings.HasSuffix(source, ":") {
+		remote = source + file.Path
+	}
+	// archived objects have to be restored before they can be downloaded
+	if IsArchivedClass(file.Tier) {
+		Infoln(HighlightRemote(remote), "is in", file.Tier+", restoring it first")
+		if err := ThawObject(ctx, job, remote); err != nil {
+			return "", err
+		}
+	}
+	Infoln("downloading", HighlightRemote(remote), "("+FormatBytes(file.Size)+")")
+	output := NewProgressWriter(JobLog(os.Stdout, job.Index), job.Index)
+	args = []string{"copyto", remote, local, "--verbose"}
+	if bind, err := BindAddress(job.Bind); err != nil {
+		return "", err
+	} else if bind != "" {
+		args = append(args, "--bind="+bind)
+	}
+	cmd := exec.CommandContext(ctx, RcloneBinary(), append(args, job.ExtraFlags...)...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Run()
+	output.Done()
+	traffic.Add(remote, local, output.Bytes(), output.Files())
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", file.Path, err)
+	}
+
+	stat, err := os.Stat(local)
+	if err != nil {
+		return "", err
+	}
+	if stat.Size() != file.Size {
+		return "", fmt.Errorf("%s is %s but the remote reported %s", file.Path, FormatBytes(stat.Size()), FormatBytes(file.Size))
+	}
+	detail, err := VerifyArchive(local)
+	if err != nil {
+		return "", fmt.Errorf("%s is corrupt: %w", file.Path, err)
+	}
+	return file.Path + ": " + detail, nil
+}
+
+// VerifyArchive reads an entire archive, returning a short description of its contents
+func VerifyArchive(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	name := strings.ToLower(file)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return verifyTar(f)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		return verifyTar(gz)
+	case strings.HasSuffix(name, ".gz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		n, err := io.Copy(io.Discard, gz)
+		if err != nil {
+			return "", err
+		}
+		return "gzip file, " + FormatBytes(n) + " uncompressed", nil
+	case strings.HasSuffix(name, ".zip"):
+		return verifyZip(file)
+	}
+	return "size matches, archive format not verified", nil
+}
+
+func verifyTar(r io.Reader) (string, error) {
+	tr := tar.NewReader(r)
+	var metadata *backupMetadata
+	var archives []string
+	count := 0
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		count++
+		entry := strings.TrimPrefix(header.Name, "./")
+		switch {
+		case entry == "backup.json":
+			metadata = &backupMetadata{}
+			if err := json.NewDecoder(tr).Decode(metadata); err != nil {
+				return "", fmt.Errorf("invalid backup.json: %w", err)
+			}
+		case strings.HasSuffix(entry, ".tar.gz") || strings.HasSuffix(entry, ".tar"):
+			archives = append(archives, entry)
+			// encrypted backups can only be read with the password, check them after reading backup.json
+			if metadata != nil && metadata.Protected {
+				break
+			}
+			if err := verifyNested(tr, entry); err != nil {
+				return "", fmt.Errorf("%s: %w", entry, err)
+			}
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return "", err
+		}
+	}
+	if metadata == nil {
+		return fmt.Sprintf("tar archive with %d files", count), nil
+	}
+	// a truncated backup can still end on a file boundary
+	if expected := metadata.archives(); len(archives) < expected {
+		return "", fmt.Errorf("backup.json lists %d archives but only %d were found", expected, len(archives))
+	}
+	detail := fmt.Sprintf("backup \"%s\" from %s with %d archives", metadata.Name, metadata.Date, len(archives))
+	if metadata.Protected {
+		detail += ", encrypted archives not verified"
+	}
+	return detail, nil
+}
+
+// verifyNested reads the archive of an addon or folder inside a Home Assistant backup
+func verifyNested(r io.Reader, name string) error {
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		_, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func verifyZip(file string) (string, error) {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		// the checksum is verified once the file has been read
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return fmt.Sprintf("zip archive with %d files", len(zr.File)), nil
+}
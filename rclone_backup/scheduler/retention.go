@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrNoRetention = errors.New("job has no retention rules")
+
+// RetentionOverrides are retention rules to preview instead of the configured ones, to tune them before they are enabled
+type RetentionOverrides struct {
+	Retention   string      `json:"retention"`    // versioning retention
+	TrashExpiry string      `json:"trash_expiry"` // trash expiry
+	Keep        *KeepConfig `json:"keep"`         // restic, borg or snapshot keep rules
+}
+
+// RetentionPreview is what one retention rule would delete from one destination
+type RetentionPreview struct {
+	Policy string   `json:"policy"` // "versioning", "trash", "restic", "borg" or "snapshot"
+	Target string   `json:"target"` // the folder or repository the rule applies to
+	Rule   string   `json:"rule"`
+	Delete []string `json:"delete"` // version, trash or snapshot folders, restic snapshots or borg archives
+	Keep   []string `json:"keep"`
+	Files  []string `json:"files,omitempty"` // every file in the deleted folders
+}
+
+// Apply returns the job with the retention rules replaced by the overrides
+func (o RetentionOverrides) Apply(job JobConfig) (JobConfig, error) {
+	if o.Retention != "" {
+		if _, err := ParseAge(o.Retention); err != nil {
+			return job, fmt.Errorf("retention: %w", err)
+		}
+		job.Versioning.Enabled = true
+		job.Versioning.Retention = o.Retention
+	}
+	if o.TrashExpiry != "" {
+		if _, err := ParseAge(o.TrashExpiry); err != nil {
+			return job, fmt.Errorf("trash_expiry: %w", err)
+		}
+		job.Trash.Enabled = true
+		job.Trash.Expiry = o.TrashExpiry
+	}
+	if o.Keep != nil {
+		job.Restic.Keep = *o.Keep
+		job.Borg.Keep = *o.Keep
+		job.Snapshot.Keep = *o.Keep
+	}
+	return job, nil
+}
+
+// PreviewRetention evaluates the retention rules of a job against the destinations and lists what
+// would be deleted, without deleting anything
+func PreviewRetention(ctx context.Context, job JobConfig) ([]RetentionPreview, error) {
+	previews := make([]RetentionPreview, 0)
+	for _, destination := range JobDestinations(job) {
+		switch {
+		case JobEngine(job) == EngineRestic && len(job.Restic.Keep.Args()) > 0:
+			preview, err := previewRestic(ctx, job, destination)
+			if err != nil {
+				return nil, err
+			}
+			previews = append(previews, preview)
+		case JobEngine(job) == EngineBorg && len(job.Borg.Keep.Args()) > 0:
+			preview, err := previewBorg(ctx, job, destination)
+			if err != nil {
+				return nil, err
+			}
+			previews = append(previews, preview)
+		case JobEngine(job) == EngineSnapshot:
+			preview, err := previewSnapshots(ctx, job, destination)
+			if err != nil {
+				return nil, err
+			}
+			previews = append(previews, preview)
+		}
+		if job.Versioning.Enabled && job.Versioning.Retention != "" {
+			preview, err := previewVersions(ctx, job, destination)
+			if err != nil {
+				return nil, err
+			}
+			previews = append(previews, preview)
+		}
+		if job.Trash.Enabled {
+			preview, err := previewTrash(ctx, job, destination)
+			if err != nil {
+				return nil, err
+			}
+			previews = append(previews, preview)
+		}
+	}
+	if len(previews) == 0 {
+		return nil, ErrNoRetention
+	}
+	return previews, nil
+}
+
+// previewFolders lists the files in the folders that would be deleted
+func previewFolders(ctx context.Context, preview *RetentionPreview) {
+	for _, dir := range preview.Delete {
+		files, err := listFiles(ctx, preview.Target+"/"+dir)
+		if err != nil {
+			Warnln("failed to list", preview.Target+"/"+dir+":", err)
+			continue
+		}
+		for _, file := range files {
+			preview.Files = append(preview.Files, dir+"/"+file)
+		}
+	}
+}
+
+func previewVersions(ctx context.Context, job JobConfig, destination string) (RetentionPreview, error) {
+	base := VersionsPath(job, destination)
+	preview := RetentionPreview{Policy: "versioning", Target: base, Rule: "retention " + job.Versioning.Retention, Delete: []string{}, Keep: []string{}}
+	retention, _ := ParseAge(job.Versioning.Retention)
+	cutoff := time.Now().Add(-retention)
+	folders, err := listDatedFolders(ctx, base)
+	if err != nil {
+		return preview, fmt.Errorf("failed to list versions at %s: %w", base, err)
+	}
+	for _, folder := range folders {
+		if folder.created.After(cutoff) {
+			preview.Keep = append(preview.Keep, folder.name)
+		} else {
+			preview.Delete = append(preview.Delete, folder.name)
+		}
+	}
+	previewFolders(ctx, &preview)
+	return preview, nil
+}
+
+func previewTrash(ctx context.Context, job JobConfig, destination string) (RetentionPreview, error) {
+	expiry := job.Trash.Expiry
+	if expiry == "" {
+		expiry = DefaultTrashExpiry
+	}
+	preview := RetentionPreview{Policy: "trash", Target: TrashPath(job, destination), Rule: "expiry " + expiry, Delete: []string{}, Keep: []string{}}
+	entries, err := ListTrash(ctx, job, destination)
+	if err != nil {
+		return preview, fmt.Errorf("failed to list trash at %s: %w", preview.Target, err)
+	}
+	for _, entry := range entries {
+		if entry.Expires.After(time.Now()) {
+			preview.Keep = append(preview.Keep, entry.Entry)
+		} else {
+			preview.Delete = append(preview.Delete, entry.Entry)
+		}
+	}
+	previewFolders(ctx, &preview)
+	return preview, nil
+}
+
+func previewRestic(ctx context.Context, job JobConfig, destination string) (RetentionPreview, error) {
+	repository := ResticRepository(job, destination)
+	keep := job.Restic.Keep.Args()
+	preview := RetentionPreview{Policy: "restic", Target: repository, Rule: strings.Join(keep, " "), Delete: []string{}, Keep: []string{}}
+	// the same snapshots the job forgets after each backup
+	tag := "rclone_backup"
+	if job.Name != "" {
+		tag = job.Name
+	}
+	args := append([]string{"forget", "--tag", tag, "--group-by", "host,paths", "--dry-run", "--json"}, keep...)
+	out, err := resticCommand(ctx, job, repository, args...).Output()
+	if err != nil {
+		return preview, fmt.Errorf("failed to preview restic forget: %w", err)
+	}
+	var groups []struct {
+		Keep   []resticSnapshot `json:"keep"`
+		Remove []resticSnapshot `json:"remove"`
+	}
+	if err := json.Unmarshal(out, &groups); err != nil {
+		return preview, fmt.Errorf("failed to read restic forget: %w", err)
+	}
+	for _, group := range groups {
+		for _, snapshot := range group.Keep {
+			preview.Keep = append(preview.Keep, snapshot.String())
+		}
+		for _, snapshot := range group.Remove {
+			preview.Delete = append(preview.Delete, snapshot.String())
+		}
+	}
+	return preview, nil
+}
+
+type resticSnapshot struct {
+	ShortID string    `json:"short_id"`
+	Time    time.Time `json:"time"`
+	Paths   []string  `json:"paths"`
+}
+
+func (s resticSnapshot) String() string {
+	return s.ShortID + " " + s.Time.Local().Format(DefaultDateLayout) + " " + strings.Join(s.Paths, ",")
+}
+
+func previewBorg(ctx context.Context, job JobConfig, destination string) (RetentionPreview, error) {
+	repository := destination
+	if job.Borg.Repository != "" {
+		repository = job.Borg.Repository
+	}
+	keep := job.Borg.Keep.Args()
+	preview := RetentionPreview{Policy: "borg", Target: repository, Rule: strings.Join(keep, " "), Delete: []string{}, Keep: []string{}}
+	args := append([]string{"prune", "--dry-run", "--list", "--glob-archives", BorgArchivePrefix(job) + "*"}, keep...)
+	out, err := borgCommand(ctx, job, append(args, repository)...).CombinedOutput()
+	if err != nil {
+		return preview, fmt.Errorf("failed to preview borg prune: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	// "Would prune:     <archive> ..." and "Keeping archive (rule: daily #1): <archive> ..."
+	for _, line := range strings.Split(string(out), "\n") {
+		if archive, ok := strings.CutPrefix(line, "Would prune:"); ok {
+			preview.Delete = append(preview.Delete, strings.TrimSpace(archive))
+		} else if strings.HasPrefix(line, "Keeping archive") {
+			if _, archive, ok := strings.Cut(line, "):"); ok {
+				preview.Keep = append(preview.Keep, strings.TrimSpace(archive))
+			}
+		}
+	}
+	return preview, nil
+}
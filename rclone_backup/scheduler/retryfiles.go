@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// MaxFailedFiles is the number of failed files kept for each target of a run
+const MaxFailedFiles = 1000
+
+// failedFilePattern matches the object of rclone errors for a single file, e.g. "dir/file.tar: Failed to copy: ..."
+var failedFilePattern = regexp.MustCompile(`^(.+?): (Failed to (copy|move|transfer|upload)|corrupted on transfer)`)
+
+// FailedTarget are files that failed to transfer from a source to a destination
+type FailedTarget struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Files       []string `json:"files"`
+}
+
+// FailedFile returns the file an rclone error message is about, if any
+func FailedFile(msg string) (string, bool) {
+	// the summary after each attempt repeats the last error
+	if strings.HasPrefix(msg, "Attempt ") {
+		return "", false
+	}
+	match := failedFilePattern.FindStringSubmatch(msg)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// RetryFilesSupported reports whether the failed files of a job can be retried on their own
+func RetryFilesSupported(job JobConfig) bool {
+	return job.Run == "" && len(job.Steps) == 0 && job.Command != CommandRestoreTest && job.Command != CommandCompress && JobEngine(job) != EngineRestic && JobEngine(job) != EngineBorg && JobEngine(job) != EngineSnapshot
+}
+
+// runFailedFiles transfers only the given files of each target using --files-from
+func runFailedFiles(ctx context.Context, job JobConfig) error {
+	var lastErr error
+	for _, target := range job.RetryFiles {
+		if ctx.Err() != nil {
+			break
+		}
+		list, err := os.CreateTemp("", "rclone-retry-")
+		if err != nil {
+			return err
+		}
+		_, err = list.WriteString(strings.Join(target.Files, "\n") + "\n")
+		list.Close()
+		if err != nil {
+			os.Remove(list.Name())
+			return err
+		}
+
+		retry := job
+		// only copy the listed files, a sync would have nothing to delete
+		if retry.Command == "sync" {
+			retry.Command = "copy"
+		}
+		retry.Include = nil
+		retry.Exclude = nil
+		retry.ExtraFlags = append(append([]string{}, job.ExtraFlags...), "--files-from", list.Name())
+		Infoln("retrying", len(target.Files), "failed files")
+		if err := RunJob(ctx, retry, target.Source, target.Destination); err != nil {
+			lastErr = err
+		}
+		os.Remove(list.Name())
+	}
+	return lastErr
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultGlacierRestoreDays    = 1
+	DefaultGlacierRestoreTimeout = "48h"
+	// glacierPollInterval is how often a restore from Glacier is checked, restores take minutes to hours
+	glacierPollInterval = time.Minute
+)
+
+// S3StorageClasses are the storage classes of S3 objects
+var S3StorageClasses = []string{
+	"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER", "GLACIER_IR", "DEEP_ARCHIVE",
+}
+
+// glacierPriorities are the retrieval tiers of a restore from Glacier
+var glacierPriorities = []string{"Expedited", "Standard", "Bulk"}
+
+var s3TagName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// S3Config sets the storage class and tags of the objects a job uploads to S3-compatible remotes, and how
+// archived objects are restored before they are downloaded
+type S3Config struct {
+	StorageClass    string `yaml:"storage_class"` // e.g. STANDARD_IA or DEEP_ARCHIVE
+	Tags            Flags  // key value pairs stored with every uploaded object
+	RestoreDays     int    `yaml:"restore_days"`     // days a restored copy of an archived object is kept
+	RestorePriority string `yaml:"restore_priority"` // Expedited, Standard or Bulk
+	RestoreTimeout  string `yaml:"restore_timeout"`  // how long a restore test waits for an archived object
+}
+
+// GlacierObject is the restore status of an archived object
+type GlacierObject struct {
+	Remote       string     `json:"remote"`
+	StorageClass string     `json:"storage_class"`
+	Restoring    bool       `json:"restoring"`
+	RestoredTill *time.Time `json:"restored_till,omitempty"`
+}
+
+// GlacierRestore asks for archived objects to be restored
+type GlacierRestore struct {
+	Path     string `json:"path"`
+	File     bool   `json:"file"` // path is a single object instead of a folder
+	Days     int    `json:"days"`
+	Priority string `json:"priority"`
+}
+
+func CheckS3(job JobConfig) error {
+	s3 := job.S3
+	if s3.StorageClass != "" && !ArrayContains(S3StorageClasses, s3.StorageClass) {
+		return fmt.Errorf("s3: unknown storage_class '%s', must be one of %s", s3.StorageClass, strings.Join(S3StorageClasses, ", "))
+	}
+	for key := range s3.Tags {
+		if !s3TagName.MatchString(key) {
+			return fmt.Errorf("s3: invalid tag name '%s'", key)
+		}
+	}
+	if s3.RestoreDays < 0 {
+		return errors.New("s3: restore_days can't be negative")
+	}
+	if s3.RestorePriority != "" && !ArrayContains(glacierPriorities, s3.RestorePriority) {
+		return fmt.Errorf("s3: restore_priority must be one of %s", strings.Join(glacierPriorities, ", "))
+	}
+	if s3.RestoreTimeout != "" {
+		if d, err := time.ParseDuration(s3.RestoreTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("s3: invalid restore_timeout '%s'", s3.RestoreTimeout)
+		}
+	}
+	return nil
+}
+
+// S3Flags returns the rclone flags setting the storage class and tags of uploaded objects, other backends
+// ignore them
+func S3Flags(job JobConfig) []string {
+	var flags []string
+	if job.S3.StorageClass != "" {
+		flags = append(flags, "--s3-storage-class="+job.S3.StorageClass)
+	}
+	if len(job.S3.Tags) > 0 {
+		keys := make([]string, 0, len(job.S3.Tags))
+		for key := range job.S3.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		flags = append(flags, "--metadata")
+		for _, key := range keys {
+			flags = append(flags, "--metadata-set="+key+"="+job.S3.Tags[key])
+		}
+	}
+	return flags
+}
+
+// IsArchivedClass reports whether objects of a storage class have to be restored before they can be downloaded
+func IsArchivedClass(class string) bool {
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
+
+// globEscape escapes a file name for an rclone filter
+func globEscape(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[]{}\`, r) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// glacierArgs returns the folder and filter an rclone backend command needs for an object or a folder
+func glacierArgs(target string, file bool) []string {
+	if !file {
+		return []string{ApplyRemoteOptions(target)}
+	}
+	dir, name := path.Split(target)
+	if dir == "" {
+		// an object in the root of a remote, "b2:a.tar"
+		remote, rest, _ := strings.Cut(target, ":")
+		dir, name = remote+":", rest
+	}
+	return []string{ApplyRemoteOptions(dir), "--include", "/" + globEscape(name)}
+}
+
+// StartGlacierRestore asks for the archived objects of a folder, or a single object, to be restored for days
+func StartGlacierRestore(ctx context.Context, target string, file bool, days int, priority string) error {
+	if days <= 0 {
+		days = DefaultGlacierRestoreDays
+	}
+	if priority == "" {
+		priority = "Standard"
+	}
+	args := append([]string{"backend", "restore"}, glacierArgs(target, file)...)
+	args = append(args, "-o", "priority="+priority, "-o", "lifetime="+strconv.Itoa(days))
+	out, err := exec.CommandContext(ctx, RcloneBinary(), args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("failed to restore %s: %s", target, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("failed to restore %s: %w", target, err)
+	}
+	var results []struct {
+		Status string
+		Remote string
+	}
+	if err := json.Unmarshal(out, &results); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", target, err)
+	}
+	for _, result := range results {
+		// a restore that was already asked for is not an error
+		if result.Status != "OK" && !strings.Contains(result.Status, "RestoreAlreadyInProgress") {
+			return fmt.Errorf("failed to restore %s: %s", result.Remote, result.Status)
+		}
+	}
+	Infoln("asked for", len(results), "archived objects in", HighlightRemote(target), "to be restored for", days, "days,", strings.ToLower(priority), "retrieval")
+	return nil
+}
+
+// GlacierStatus returns the restore status of the archived objects of a folder, or a single object
+func GlacierStatus(ctx context.Context, target string, file bool) ([]GlacierObject, error) {
+	args := append([]string{"backend", "restore-status"}, glacierArgs(target, file)...)
+	out, err := exec.CommandContext(ctx, RcloneBinary(), append(args, "-o", "all")...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to read restore status of %s: %s", target, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("failed to read restore status of %s: %w", target, err)
+	}
+	var list []struct {
+		Remote        string
+		StorageClass  string
+		RestoreStatus *struct {
+			IsRestoreInProgress bool
+			RestoreExpiryDate   *time.Time
+		}
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to read restore status of %s: %w", target, err)
+	}
+	objects := make([]GlacierObject, 0, len(list))
+	for _, status := range list {
+		object := GlacierObject{Remote: status.Remote, StorageClass: status.StorageClass}
+		if status.RestoreStatus != nil {
+			object.Restoring = status.RestoreStatus.IsRestoreInProgress
+			object.RestoredTill = status.RestoreStatus.RestoreExpiryDate
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// ThawObject restores an archived object and waits until it can be downloaded, checking every minute
+func ThawObject(ctx context.Context, job JobConfig, remote string) error {
+	timeout, err := time.ParseDuration(job.S3.RestoreTimeout)
+	if err != nil || job.S3.RestoreTimeout == "" {
+		timeout, _ = time.ParseDuration(DefaultGlacierRestoreTimeout)
+	}
+	objects, err := GlacierStatus(ctx, remote, true)
+	if err == nil && len(objects) == 1 && !objects[0].Restoring && objects[0].RestoredTill != nil {
+		// restored earlier and still available
+		return nil
+	}
+	if err := StartGlacierRestore(ctx, remote, true, job.S3.RestoreDays, job.S3.RestorePriority); err != nil {
+		return err
+	}
+	statuses.SetProgress(job.Index, "waiting for the restore from glacier")
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(glacierPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		objects, err := GlacierStatus(ctx, remote, true)
+		if err != nil {
+			Warnln(err)
+		} else if len(objects) == 1 && !objects[0].Restoring && objects[0].RestoredTill != nil {
+			Infoln("restored", HighlightRemote(remote), "until", objects[0].RestoredTill.Local().Format("2006-01-02 15:04"))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was not restored from glacier within %s", remote, FormatDuration(timeout))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownRemote = errors.New("unknown remote")
+
+// RcloneInfo describes the rclone installation in use
+type RcloneInfo struct {
+	Path             string   `json:"path"`
+	Version          string   `json:"version"`
+	Remotes          []string `json:"remotes"`
+	AvailableVersion string   `json:"available_version,omitempty"`
+	UpdatePending    bool     `json:"update_pending,omitempty"`
+}
+
+var (
+	rcloneMu   sync.RWMutex
+	rcloneInfo RcloneInfo
+)
+
+// RcloneBinary returns the path of the rclone binary to run
+func RcloneBinary() string {
+	rcloneMu.RLock()
+	defer rcloneMu.RUnlock()
+	if rcloneInfo.Path == "" {
+		return "rclone"
+	}
+	return rcloneInfo.Path
+}
+
+// GetRcloneInfo returns a copy of the current rclone info
+func GetRcloneInfo() RcloneInfo {
+	rcloneMu.RLock()
+	defer rcloneMu.RUnlock()
+	info := rcloneInfo
+	info.Remotes = append([]string{}, rcloneInfo.Remotes...)
+	return info
+}
+
+// CheckRclone verifies the rclone binary exists and records its version, a
+// binary installed by the updater is used while it is newer than the bundled one
+func CheckRclone() error {
+	path, err := exec.LookPath("rclone")
+	version := ""
+	if err == nil {
+		path, version, err = RcloneVersion(path)
+	}
+	if updatedPath, updatedVersion, updatedErr := RcloneVersion(UpdatedRclonePath); updatedErr == nil {
+		if err != nil || CompareVersions(updatedVersion, version) > 0 {
+			path, version, err = updatedPath, updatedVersion, nil
+		} else {
+			Infoln("ignoring rclone", updatedVersion, "installed by the updater, the bundled rclone is", version)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	rcloneMu.Lock()
+	defer rcloneMu.Unlock()
+	rcloneInfo.Path = path
+	rcloneInfo.Version = version
+	return nil
+}
+
+// RcloneVersion runs the binary at path and returns its version, e.g. "v1.72.1"
+func RcloneVersion(path string) (string, string, error) {
+	out, err := exec.Command(path, "version").Output()
+	if err != nil {
+		return path, "", err
+	}
+	// first line is e.g. "rclone v1.72.1"
+	line := strings.SplitN(string(out), "\n", 2)[0]
+	return path, strings.TrimSpace(strings.TrimPrefix(line, "rclone")), nil
+}
+
+// checkTarget checks a source or destination, unknown remotes are recorded as
+// warnings rather than failing the job
+func checkTarget(path string, warnings *[]string) error {
+	err := CheckRemote(path)
+	if errors.Is(err, ErrUnknownRemote) {
+		*warnings = append(*warnings, err.Error())
+		return nil
+	}
+	return err
+}
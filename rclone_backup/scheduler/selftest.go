@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSelfTestSchedule = "0 4 * * 1"
+	DefaultSelfTestTitle    = "Rclone Backup: {{.Name}}"
+	DefaultSelfTestMessage  = "{{.Detail}}"
+	EventSelfTestFailed     = "rclone_backup.self_test_failed"
+)
+
+var SelfTestPath = filepath.Join(DataPath, "selftest.json")
+
+// selfTestSize is the size of the random file uploaded to each remote
+const selfTestSize = 64 * 1024
+
+// selfTestTimeout is how long the whole test of one remote may take
+const selfTestTimeout = 5 * time.Minute
+
+var (
+	ErrSelfTestRunning = errors.New("a self-test is already running")
+	// errNoChecksum skips the checksum step on remotes without hashes, e.g. crypt remotes
+	errNoChecksum = errors.New("the remote supports neither md5 nor sha1")
+)
+
+// Steps of the self-test, in the order they run
+const (
+	StepWrite    = "write"
+	StepUpload   = "upload"
+	StepChecksum = "checksum"
+	StepDownload = "download"
+	StepCompare  = "compare"
+	StepDelete   = "delete"
+)
+
+// SelfTestConfig runs the self-test of the remotes on a schedule
+type SelfTestConfig struct {
+	Enabled   bool
+	Schedule  string
+	Paths     []string // remote folders to test, defaults to every remote in the folder of the first job using it
+	Notifiers []string // failures are sent as a persistent notification when empty
+}
+
+// SelfTestStep is the outcome of one step of the self-test of a remote
+type SelfTestStep struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// SelfTestResult is the self-test of one remote folder
+type SelfTestResult struct {
+	Remote string         `json:"remote"`
+	Path   string         `json:"path"`
+	Passed bool           `json:"passed"`
+	Steps  []SelfTestStep `json:"steps"`
+}
+
+// SelfTestReport is the last self-test of the remotes
+type SelfTestReport struct {
+	Running  bool             `json:"running"`
+	Started  *time.Time       `json:"started,omitempty"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Passed   bool             `json:"passed"`
+	Remotes  []SelfTestResult `json:"remotes"`
+}
+
+type SelfTests struct {
+	mu     sync.Mutex
+	report SelfTestReport
+}
+
+var selfTests = &SelfTests{report: SelfTestReport{Remotes: []SelfTestResult{}}}
+
+// CheckSelfTest validates the self-test options
+func CheckSelfTest() error {
+	for _, path := range config.SelfTest.Paths {
+		if !strings.Contains(path, ":") {
+			return fmt.Errorf("self_test: '%s' is not on a remote, expected e.g. b2:bucket/backups", path)
+		}
+	}
+	for _, name := range config.SelfTest.Notifiers {
+		if FindNotifier(name) == nil {
+			return fmt.Errorf("self_test: unknown notifier '%s'", name)
+		}
+	}
+	return nil
+}
+
+// Load reads the last self-test from disk
+func (s *SelfTests) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(SelfTestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.report); err != nil {
+		return err
+	}
+	// the addon stopped while a test was running
+	s.report.Running = false
+	return nil
+}
+
+func (s *SelfTests) save() {
+	s.mu.Lock()
+	data, err := json.Marshal(s.report)
+	s.mu.Unlock()
+	if err == nil {
+		err = os.WriteFile(SelfTestPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save self-test:", err)
+	}
+}
+
+// Report returns the last or running self-test
+func (s *SelfTests) Report() SelfTestReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := s.report
+	report.Remotes = append([]SelfTestResult{}, s.report.Remotes...)
+	return report
+}
+
+// Start runs the self-test of the given remote folders in the background, only one test runs at a time
+func (s *SelfTests) Start(paths []string) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	go s.run(context.Background(), paths)
+	return nil
+}
+
+// Run tests the given remote folders and returns the report once done
+func (s *SelfTests) Run(ctx context.Context, paths []string) (SelfTestReport, error) {
+	if err := s.begin(); err != nil {
+		return SelfTestReport{}, err
+	}
+	s.run(ctx, paths)
+	return s.Report(), nil
+}
+
+// Scheduled runs the self-test of every remote folder, skipping it while a test started from the UI runs
+func (s *SelfTests) Scheduled() {
+	paths, err := SelfTestPaths()
+	if err != nil {
+		Errorln("failed to list remotes for the self-test:", err)
+		return
+	}
+	if _, err := s.Run(context.Background(), paths); err != nil {
+		Debugln(err)
+	}
+}
+
+func (s *SelfTests) begin() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report.Running {
+		return ErrSelfTestRunning
+	}
+	now := time.Now()
+	s.report = SelfTestReport{Running: true, Started: &now, Remotes: []SelfTestResult{}}
+	return nil
+}
+
+func (s *SelfTests) run(ctx context.Context, paths []string) {
+	Infoln("running self-test of", len(paths), "remotes")
+	var failed []SelfTestResult
+	for _, path := range paths {
+		result := SelfTestRemote(ctx, path)
+		if result.Passed {
+			Infoln("self-test of", HighlightRemote(path), "passed")
+		} else {
+			Warnln("self-test of", HighlightRemote(path), "failed:", result.Failure())
+			failed = append(failed, result)
+		}
+		s.mu.Lock()
+		s.report.Remotes = append(s.report.Remotes, result)
+		s.mu.Unlock()
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.report.Running = false
+	s.report.Finished = &now
+	s.report.Passed = len(failed) == 0
+	start := *s.report.Started
+	s.mu.Unlock()
+	s.save()
+	if len(failed) > 0 {
+		reportSelfTestFailure(failed, start, now)
+	}
+}
+
+// reportSelfTestFailure fires an event and notifies about the remotes that failed the self-test
+func reportSelfTestFailure(failed []SelfTestResult, start time.Time, end time.Time) {
+	paths := make([]string, 0, len(failed))
+	lines := make([]string, 0, len(failed))
+	for _, result := range failed {
+		paths = append(paths, result.Path)
+		lines = append(lines, result.Path+": "+result.Failure())
+	}
+	FireEvent(EventSelfTestFailed, map[string]interface{}{"remotes": paths, "errors": lines})
+	name := fmt.Sprintf("self-test failed on %d remotes", len(failed))
+	message := strings.Join(lines, "\n")
+	if len(config.SelfTest.Notifiers) == 0 {
+		Notify("self_test", "Rclone Backup: "+name, message)
+		return
+	}
+	if config.NoNotifications {
+		return
+	}
+	result := RunResult{Name: name, Detail: message, Start: start, End: end}
+	SendNotification(config.SelfTest.Notifiers, DefaultSelfTestTitle, DefaultSelfTestMessage, result)
+}
+
+// Failure describes the first step of the self-test that failed
+func (r SelfTestResult) Failure() string {
+	for _, step := range r.Steps {
+		if !step.OK {
+			return step.Name + " failed: " + step.Error
+		}
+	}
+	return ""
+}
+
+// SelfTestPaths returns the remote folders to test, the configured paths or every remote in the folder of the
+// first job backing up to it, buckets can't hold files at their root
+func SelfTestPaths() ([]string, error) {
+	if len(config.SelfTest.Paths) > 0 {
+		return config.SelfTest.Paths, nil
+	}
+	list, err := GetRcloneRemotes()
+	if err != nil {
+		return nil, err
+	}
+	folders, _ := CatalogPaths()
+	paths := make([]string, 0, len(list))
+	for _, remote := range list {
+		path := remote
+		for _, folder := range folders {
+			if strings.HasPrefix(folder, remote) {
+				path = folder
+				break
+			}
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// SelfTestPathOf returns the folder the self-test uses on a remote
+func SelfTestPathOf(remote string) (string, error) {
+	paths, err := SelfTestPaths()
+	if err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		if strings.HasPrefix(path, remoteName(remote)) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w '%s'", ErrUnknownRemote, remote)
+}
+
+// SelfTestRemote writes a random file, uploads it to the remote folder, compares its checksum on the remote,
+// downloads it back and compares it byte by byte, then deletes it from the remote. A step that fails skips the
+// steps after it, but the uploaded file is always deleted.
+func SelfTestRemote(ctx context.Context, path string) SelfTestResult {
+	result := SelfTestResult{Remote: path[:strings.Index(path, ":")+1], Path: path, Steps: []SelfTestStep{}}
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	step := func(name string, run func() error) bool {
+		start := time.Now()
+		err := run()
+		s := SelfTestStep{Name: name, OK: err == nil || errors.Is(err, errNoChecksum), Duration: FormatDuration(time.Since(start))}
+		if err != nil {
+			s.Skipped = errors.Is(err, errNoChecksum)
+			s.Error = err.Error()
+		}
+		result.Steps = append(result.Steps, s)
+		return s.OK
+	}
+
+	dir, err := os.MkdirTemp("", "rclone-backup-self-test-")
+	if err != nil {
+		step(StepWrite, func() error { return err })
+		return result
+	}
+	defer os.RemoveAll(dir)
+	suffix := make([]byte, 6)
+	_, _ = rand.Read(suffix)
+	name := ".rclone-backup-self-test-" + hex.EncodeToString(suffix)
+	local := filepath.Join(dir, name)
+	remote := strings.TrimSuffix(path, "/") + "/" + name
+	if strings.HasSuffix(path, ":") {
+		remote = path + name
+	}
+	content := make([]byte, selfTestSize)
+
+	rclone := func(args ...string) ([]byte, error) {
+		args = append(RemoteFlags(path), args...)
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, RcloneBinary(), args...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil && stderr.Len() > 0 {
+			err = fmt.Errorf("%w: %s", err, lastLine(stderr.String()))
+		}
+		return out, err
+	}
+
+	if !step(StepWrite, func() error {
+		if _, err := rand.Read(content); err != nil {
+			return err
+		}
+		return os.WriteFile(local, content, 0644)
+	}) {
+		return result
+	}
+	if !step(StepUpload, func() error {
+		_, err := rclone("copyto", local, ApplyRemoteOptions(remote))
+		return err
+	}) {
+		return result
+	}
+	passed := step(StepChecksum, func() error { return compareChecksum(content, rclone, ApplyRemoteOptions(remote)) }) &&
+		step(StepDownload, func() error {
+			_, err := rclone("copyto", ApplyRemoteOptions(remote), local+".download")
+			return err
+		}) &&
+		step(StepCompare, func() error {
+			downloaded, err := os.ReadFile(local + ".download")
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(downloaded, content) {
+				return fmt.Errorf("the downloaded file differs, %d bytes instead of %d", len(downloaded), len(content))
+			}
+			return nil
+		})
+	// delete the test file even when a step failed, with a fresh timeout if the test ran out of time
+	deleted := step(StepDelete, func() error {
+		if ctx.Err() != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+		}
+		_, err := rclone("deletefile", ApplyRemoteOptions(remote))
+		return err
+	})
+	result.Passed = passed && deleted
+	return result
+}
+
+// compareChecksum compares the md5 or sha1 hash the remote reports for the test file with the hash of its
+// content, the step is skipped on remotes that support neither
+func compareChecksum(content []byte, rclone func(args ...string) ([]byte, error), remote string) error {
+	hashes := []struct {
+		name string
+		new  func() hash.Hash
+	}{{"md5", md5.New}, {"sha1", sha1.New}}
+	for _, h := range hashes {
+		out, err := rclone("hashsum", h.name, remote)
+		if err != nil {
+			if strings.Contains(strings.ToLower(err.Error()), "not supported") {
+				continue
+			}
+			return err
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 || strings.EqualFold(fields[0], "UNSUPPORTED") {
+			continue
+		}
+		sum := h.new()
+		sum.Write(content)
+		expected := hex.EncodeToString(sum.Sum(nil))
+		if !strings.EqualFold(fields[0], expected) {
+			return fmt.Errorf("%s of the uploaded file is %s, expected %s", h.name, fields[0], expected)
+		}
+		return nil
+	}
+	return errNoChecksum
+}
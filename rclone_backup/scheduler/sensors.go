@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/gosimple/slug"
+)
+
+// sensorName returns the part of the entity id and mqtt topic of a job's sensors
+func sensorName(job JobConfig) string {
+	return strings.ToLower(strings.ReplaceAll(slug.Make(JobName(job)), "-", "_"))
+}
+
+// lastRun returns the last finished run of a job, if any
+func lastRun(index int) *RunRecord {
+	runs := history.Runs(index)
+	if len(runs) == 0 {
+		return nil
+	}
+	return &runs[0]
+}
+
+// RunSensorAttributes returns the attributes of the last run sensor of a job, so template sensors and automations
+// can use the results of a run without reading the logs
+func RunSensorAttributes(job JobConfig, record *RunRecord) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"friendly_name": "Rclone " + JobName(job) + " last run",
+		"icon":          "mdi:cloud-sync",
+		"job":           job.Index,
+		"next_run":      NextRun(job.Index),
+		"last_success":  lastSuccess(job.Index),
+		"paused":        pauses.Get(job.Index) != nil,
+	}
+	if record == nil {
+		return attributes
+	}
+	errors := 0
+	for _, target := range record.FailedFiles {
+		errors += len(target.Files)
+	}
+	if errors == 0 && record.Error != "" {
+		errors = 1
+	}
+	attributes["trigger"] = record.Trigger
+	attributes["note"] = record.Note
+	attributes["start"] = record.Start
+	attributes["end"] = record.End
+	attributes["duration"] = record.Duration
+	attributes["duration_seconds"] = math.Round(record.End.Sub(record.Start).Seconds())
+	attributes["bytes"] = record.Bytes
+	attributes["files_transferred"] = record.Files
+	attributes["errors"] = errors
+	attributes["error"] = record.Error
+	attributes["error_class"] = record.ErrorClass
+	attributes["warnings"] = len(record.Warnings)
+	attributes["detail"] = record.Detail
+	return attributes
+}
+
+// PublishRunSensor sets the last run sensor of a job in Home Assistant and publishes it on the mqtt state topic
+func PublishRunSensor(job JobConfig, record *RunRecord) {
+	entityID := "sensor.rclone_backup_" + sensorName(job) + "_last_run"
+	state := StateIdle
+	if record != nil {
+		state = record.State
+	}
+	if err := SetSensorState(entityID, state, RunSensorAttributes(job, record)); err != nil {
+		Debugln("failed to publish sensor", entityID, err)
+	}
+	if config.MQTT.StateTopic != "" {
+		publishRunState(job, record)
+	}
+}
+
+// publishRunState publishes the state and attributes of the last run of a job as retained json on the mqtt state
+// topic, at <state_topic>/<job>
+func publishRunState(job JobConfig, record *RunRecord) {
+	attributes := RunSensorAttributes(job, record)
+	attributes["state"] = StateIdle
+	if record != nil {
+		attributes["state"] = record.State
+	}
+	delete(attributes, "friendly_name")
+	delete(attributes, "icon")
+	payload, err := json.Marshal(attributes)
+	if err == nil {
+		err = PublishMQTT(config.MQTT.StateTopic+"/"+sensorName(job), payload)
+	}
+	if err != nil {
+		Debugln("failed to publish the state of", "'"+job.Name+"'", "on mqtt:", err)
+	}
+}
+
+// PublishRunSensors publishes the last run of every job, the states set through the api are lost when Home
+// Assistant restarts
+func PublishRunSensors() {
+	for _, job := range config.Jobs {
+		PublishRunSensor(job, lastRun(job.Index))
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultServerReconnects = 3
+	// serverReconnectDelay is how long to wait before resuming after a dropped session, longer on each attempt
+	serverReconnectDelay = 10 * time.Second
+)
+
+var KnownHostsPath = filepath.Join(DataPath, "known_hosts")
+
+// knownHostsMu guards the pinned host keys against concurrent pins
+var knownHostsMu sync.Mutex
+
+// ServerConfig checks the connection to an SFTP or FTP server before each run and resumes runs that lost it
+type ServerConfig struct {
+	Precheck   bool   // connect to the server before a run and fail straight away when it's down
+	Timeout    string // how long a stalled connection is waited on before it is dropped, rclone's --timeout
+	Reconnects *int   // times a run whose connection dropped is resumed, defaults to 3
+	PinHostKey bool   `yaml:"pin_host_key"` // only accept the sftp host key pinned through the api
+}
+
+// HostKey is a host key pinned for an SFTP remote
+type HostKey struct {
+	Remote      string `json:"remote"`
+	Host        string `json:"host"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// RcloneConfigDump returns the rclone config of every remote by its name without the colon
+func RcloneConfigDump(ctx context.Context) (map[string]map[string]string, error) {
+	out, err := exec.CommandContext(ctx, RcloneBinary(), "config", "dump").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rclone config: %w", err)
+	}
+	var dump map[string]map[string]string
+	if err := json.Unmarshal(out, &dump); err != nil {
+		return nil, fmt.Errorf("failed to read rclone config: %w", err)
+	}
+	return dump, nil
+}
+
+// RemoteSettings returns the rclone config of a remote, such as its type and host
+func RemoteSettings(ctx context.Context, remote string) (map[string]string, error) {
+	dump, err := RcloneConfigDump(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings, ok := dump[strings.TrimSuffix(remote, ":")]
+	if !ok {
+		return nil, fmt.Errorf("remote %s is not configured", remote)
+	}
+	return settings, nil
+}
+
+// serverAddress returns the host and port of an SFTP or FTP remote, as written in known_hosts
+func serverAddress(settings map[string]string) (string, string, error) {
+	host, port := settings["host"], settings["port"]
+	switch settings["type"] {
+	case "sftp":
+		if port == "" {
+			port = "22"
+		}
+	case "ftp":
+		if port == "" {
+			port = "21"
+		}
+	default:
+		return "", "", fmt.Errorf("not an sftp or ftp remote but %s", settings["type"])
+	}
+	if host == "" {
+		return "", "", errors.New("remote has no host")
+	}
+	return host, port, nil
+}
+
+// knownHostsName is how ssh writes a host in known_hosts, with the port only when it isn't 22
+func knownHostsName(host string, port string) string {
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+func checkServerConfig(remote RemoteConfig) error {
+	name := remoteName(remote.Name)
+	if remote.Server.Timeout != "" {
+		if _, err := time.ParseDuration(remote.Server.Timeout); err != nil {
+			return fmt.Errorf("remotes: '%s' invalid server timeout '%s'", name, remote.Server.Timeout)
+		}
+	}
+	if remote.Server.Reconnects != nil && *remote.Server.Reconnects < 0 {
+		return fmt.Errorf("remotes: '%s' server reconnects can't be negative", name)
+	}
+	return nil
+}
+
+func serverReconnects(server ServerConfig) int {
+	if server.Reconnects != nil {
+		return *server.Reconnects
+	}
+	return DefaultServerReconnects
+}
+
+// serverBackendOptions points sftp remotes with a pinned host key at the known_hosts of the addon
+func serverBackendOptions(r *RemoteConfig, options map[string]string) {
+	if r.Server.PinHostKey {
+		options["known_hosts_file"] = KnownHostsPath
+	}
+}
+
+// fingerprint returns the SHA256 fingerprint of a base64 encoded public key, as shown by ssh-keygen -l
+func fingerprint(key string) string {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// readKnownHosts returns the lines of the pinned host keys
+func readKnownHosts() ([]string, error) {
+	data, err := os.ReadFile(KnownHostsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func writeKnownHosts(lines []string) error {
+	return os.WriteFile(KnownHostsPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// hostKeysOf returns the pinned keys of a host from the lines of known_hosts
+func hostKeysOf(lines []string, name string) []string {
+	var keys []string
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == name {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// ScanHostKeys returns the host keys an ssh server presents, in known_hosts format
+func ScanHostKeys(ctx context.Context, host string, port string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ssh-keyscan", "-T", "10", "-p", port, host).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan host keys of %s: %w", host, err)
+	}
+	var keys []string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(strings.Fields(line)) >= 3 && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s presented no host keys", host)
+	}
+	return keys, nil
+}
+
+// hostKeysFor converts lines of known_hosts into the host keys of a remote
+func hostKeysFor(remote string, lines []string) []HostKey {
+	keys := make([]HostKey, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		keys = append(keys, HostKey{Remote: remote, Host: fields[0], Type: fields[1], Fingerprint: fingerprint(fields[2])})
+	}
+	return keys
+}
+
+// PinHostKeys replaces the pinned host keys of an SFTP remote with the keys its server presents now
+func PinHostKeys(ctx context.Context, remote string) ([]HostKey, error) {
+	settings, err := RemoteSettings(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	if settings["type"] != "sftp" {
+		return nil, fmt.Errorf("%s is not an sftp remote", remote)
+	}
+	host, port, err := serverAddress(settings)
+	if err != nil {
+		return nil, err
+	}
+	scanned, err := ScanHostKeys(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	lines, err := readKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+	name := knownHostsName(host, port)
+	kept := make([]string, 0, len(lines)+len(scanned))
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 0 || fields[0] != name {
+			kept = append(kept, line)
+		}
+	}
+	if err := writeKnownHosts(append(kept, scanned...)); err != nil {
+		return nil, err
+	}
+	keys := hostKeysFor(remoteName(remote), scanned)
+	for _, key := range keys {
+		Infoln("pinned", key.Type, "host key", key.Fingerprint, "of", HighlightRemote(remoteName(remote)))
+	}
+	return keys, nil
+}
+
+// UnpinHostKeys removes the pinned host keys of an SFTP remote, returning false if it had none
+func UnpinHostKeys(ctx context.Context, remote string) (bool, error) {
+	settings, err := RemoteSettings(ctx, remote)
+	if err != nil {
+		return false, err
+	}
+	host, port, err := serverAddress(settings)
+	if err != nil {
+		return false, err
+	}
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	lines, err := readKnownHosts()
+	if err != nil {
+		return false, err
+	}
+	name := knownHostsName(host, port)
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 0 || fields[0] != name {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return false, nil
+	}
+	return true, writeKnownHosts(kept)
+}
+
+// ListHostKeys returns the pinned host keys of the remotes with pin_host_key
+func ListHostKeys(ctx context.Context) ([]HostKey, error) {
+	knownHostsMu.Lock()
+	lines, err := readKnownHosts()
+	knownHostsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	keys := []HostKey{}
+	for _, remote := range config.Remotes {
+		if !remote.Server.PinHostKey {
+			continue
+		}
+		settings, err := RemoteSettings(ctx, remote.Name)
+		if err != nil {
+			return nil, err
+		}
+		host, port, err := serverAddress(settings)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, hostKeysFor(remoteName(remote.Name), hostKeysOf(lines, knownHostsName(host, port)))...)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Remote < keys[j].Remote })
+	return keys, nil
+}
+
+// CheckServer connects to the server of an SFTP or FTP remote, and for pinned sftp host keys checks that the
+// server still presents one of them
+func CheckServer(ctx context.Context, remote RemoteConfig) error {
+	name := remoteName(remote.Name)
+	settings, err := RemoteSettings(ctx, name)
+	if err != nil {
+		return err
+	}
+	host, port, err := serverAddress(settings)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := CheckHost(ctx, net.JoinHostPort(host, port)); err != nil {
+		return err
+	}
+	if !remote.Server.PinHostKey || settings["type"] != "sftp" {
+		return nil
+	}
+	knownHostsMu.Lock()
+	lines, err := readKnownHosts()
+	knownHostsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	pinned := hostKeysOf(lines, knownHostsName(host, port))
+	if len(pinned) == 0 {
+		return fmt.Errorf("no host key is pinned for %s, pin it with POST /api/hostkeys/%s/pin", name, strings.TrimSuffix(name, ":"))
+	}
+	scanned, err := ScanHostKeys(ctx, host, port)
+	if err != nil {
+		return err
+	}
+	for _, key := range scanned {
+		if ArrayContains(pinned, key) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the host key of %s has changed, %s no longer matches the pinned key", name, hostKeysFor(name, scanned[:1])[0].Fingerprint)
+}
+
+// CheckServers checks the servers of the job's SFTP and FTP remotes with precheck before a run
+func CheckServers(ctx context.Context, job JobConfig) error {
+	for _, remote := range JobRemotes(job) {
+		r := RemoteConfigOf(remote)
+		if r == nil || !r.Server.Precheck {
+			continue
+		}
+		if err := CheckServer(ctx, *r); err != nil {
+			return err
+		}
+		Debugln("server of", remote, "is reachable")
+	}
+	return nil
+}
+
+// ResumeDropped waits a little and reports whether a run whose connection to an SFTP or FTP server dropped
+// should be resumed
+func ResumeDropped(ctx context.Context, job JobConfig, source string, destination string, err error, attempt int) bool {
+	if ErrorClass(err) != ErrorClassNetwork || IsDryRun(job) {
+		return false
+	}
+	var server *RemoteConfig
+	for _, path := range []string{destination, source} {
+		if r := RemoteConfigOf(path); r != nil && r.Server != (ServerConfig{}) {
+			server = r
+			break
+		}
+	}
+	if server == nil || attempt >= serverReconnects(server.Server) {
+		return false
+	}
+	delay := serverReconnectDelay * time.Duration(attempt+1)
+	Warnln("the connection to", remoteName(server.Name), "dropped, resuming", "'"+job.Name+"'", "in", FormatDuration(delay))
+	statuses.SetProgress(job.Index, "connection dropped, resuming")
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	}
+	if server.Server.Precheck {
+		if err := CheckServer(ctx, *server); err != nil {
+			Errorln(err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// ServerSideStats is what a remote copied or moved itself, e.g. between two folders of a Drive, without the data
+// passing through the addon
+type ServerSideStats struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// CanCopyServerSide reports whether rclone can copy between two remotes server-side: within one remote, or
+// between remotes of the same backend with server_side_across_configs
+func CanCopyServerSide(ctx context.Context, job JobConfig, source string, destination string) bool {
+	from, to := trafficRemote(source), trafficRemote(destination)
+	if from == "" || to == "" {
+		return false
+	}
+	if from == to {
+		return true
+	}
+	if !job.ServerSideAcrossConfigs {
+		return false
+	}
+	dump, err := RcloneConfigDump(ctx)
+	if err != nil {
+		return false
+	}
+	fromType := dump[strings.TrimSuffix(from, ":")]["type"]
+	return fromType != "" && fromType == dump[strings.TrimSuffix(to, ":")]["type"]
+}
+
+// logDataPath tells before a transfer between two remotes whether the data will pass through the addon
+func logDataPath(ctx context.Context, job JobConfig, source string, destination string) {
+	if trafficRemote(source) == "" || trafficRemote(destination) == "" {
+		return
+	}
+	if CanCopyServerSide(ctx, job, source, destination) {
+		Infoln("files can be copied server-side from", HighlightRemote(trafficRemote(source)), "to", HighlightRemote(trafficRemote(destination)))
+	} else {
+		Infoln("files are downloaded from", HighlightRemote(trafficRemote(source)), "and uploaded to", HighlightRemote(trafficRemote(destination)), "through this device")
+	}
+}
+
+// logServerSide reports how much of a transfer between two remotes was done server-side
+func logServerSide(stats ServerSideStats, transferred int64) {
+	if stats.Files == 0 {
+		return
+	}
+	Infoln("copied", FormatBytes(stats.Bytes), "in", stats.Files, "files server-side,", FormatBytes(transferred), "passed through this device")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shardCommands are the commands a job can split into one rclone process per top-level folder
+var shardCommands = map[string]bool{"sync": true, "copy": true, "move": true}
+
+func CheckShards(job JobConfig) error {
+	if job.Shards < 0 {
+		return errors.New("shards can't be negative")
+	}
+	if job.Shards == 0 {
+		return nil
+	}
+	if !shardCommands[job.Command] || JobEngine(job) == EngineRestic || JobEngine(job) == EngineBorg || JobEngine(job) == EngineSnapshot {
+		return errors.New("shards only apply to sync, copy and move jobs")
+	}
+	return nil
+}
+
+// ShardDirs returns the top-level folders of a local folder or remote, a missing folder has none
+func ShardDirs(ctx context.Context, target string) ([]string, error) {
+	var dirs []string
+	if !strings.Contains(target, ":") {
+		entries, err := os.ReadDir(target)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		for _, entry := range entries {
+			// symlinks are not followed, the same as rclone
+			if entry.IsDir() {
+				dirs = append(dirs, entry.Name())
+			}
+		}
+		return dirs, err
+	}
+	out, err := exec.CommandContext(ctx, RcloneBinary(), "lsf", "--dirs-only", ApplyRemoteOptions(target)).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && strings.Contains(strings.ToLower(string(exitErr.Stderr)), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, dir := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if dir = strings.TrimSuffix(dir, "/"); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// shardFilter rewrites a filter pattern of the job for the run of a top-level folder, returning false when
+// it can't match anything inside the folder
+func shardFilter(pattern string, dir string) (string, bool) {
+	rooted, ok := strings.CutPrefix(pattern, "/")
+	if !ok {
+		return pattern, true
+	}
+	first, rest, _ := strings.Cut(rooted, "/")
+	if first == "**" {
+		return pattern, true
+	}
+	if ok, _ := path.Match(first, dir); !ok {
+		return "", false
+	}
+	if rest == "" {
+		// "/dir/" matches the folder itself and so everything in it, "/dir" only a file
+		if strings.HasSuffix(pattern, "/") {
+			return "/**", true
+		}
+		return "", false
+	}
+	return "/" + rest, true
+}
+
+// shardFilters rewrites the filters of the job for the run of a top-level folder, unrooted patterns apply
+// at every depth and so also to the folder itself
+func shardFilters(patterns []string, dir string) []string {
+	var filters []string
+	for _, pattern := range patterns {
+		if filter, ok := shardFilter(pattern, dir); ok {
+			filters = append(filters, filter)
+		}
+		if !strings.HasPrefix(pattern, "/") {
+			if filter, ok := shardFilter("/"+pattern, dir); ok && filter != "/"+pattern {
+				filters = append(filters, filter)
+			}
+		}
+	}
+	return filters
+}
+
+// RunSharded runs the job with one rclone process per top-level folder of the source, at most shards at once,
+// which is a lot faster than a single run for trees with millions of small files. The files at the top of
+// the source are transferred by a run of their own and the totals of every run are added to the job run.
+func RunSharded(ctx context.Context, job JobConfig, source string, destination string) error {
+	start := time.Now()
+	fail := func(err error) error {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+		return err
+	}
+	// the renamed backups are shared, so they are not uploaded by several processes at once
+	if strings.HasPrefix(source, BackupPath) {
+		return RunJob(ctx, job, source, destination)
+	}
+	if err := CheckSourceSize(ctx, job, source); err != nil {
+		return fail(err)
+	}
+	dirs, err := ShardDirs(ctx, source)
+	if err != nil {
+		return fail(fmt.Errorf("failed to list folders of %s: %w", source, err))
+	}
+	// folders only left in the destination are synced from an empty folder, so they are deleted like any other file
+	var removed []string
+	if job.Command == "sync" {
+		existing, err := ShardDirs(ctx, destination)
+		if err != nil {
+			return fail(fmt.Errorf("failed to list folders of %s: %w", destination, err))
+		}
+		for _, dir := range existing {
+			if !slices.Contains(dirs, dir) {
+				removed = append(removed, dir)
+			}
+		}
+	}
+	if len(dirs)+len(removed) < 2 {
+		return RunJob(ctx, job, source, destination)
+	}
+
+	dryRun := IsDryRun(job)
+	if config.RemoteLock.Enabled && strings.Contains(destination, ":") && !dryRun {
+		// the lock of each folder would be a file in the destination, so the whole run takes a single lock
+		release, err := AcquireLease(ctx, job, destination)
+		if err != nil {
+			return fail(err)
+		}
+		defer release()
+	}
+	empty := ""
+	if len(removed) > 0 {
+		if empty, err = os.MkdirTemp("", "rclone_backup_shard"); err != nil {
+			return fail(err)
+		}
+		defer os.Remove(empty)
+	}
+
+	// every run moves replaced files into the same version of the destination
+	backupDir := ""
+	if job.Versioning.Enabled {
+		backupDir = VersionsPath(job, destination) + "/" + start.Format(DefaultDateLayout)
+	} else if job.Trash.Enabled {
+		backupDir = TrashPath(job, destination) + "/" + start.Format(DefaultDateLayout)
+	}
+	shard := func(dir string) (JobConfig, bool) {
+		run := job
+		run.Sharded = true
+		run.MinSourceSize = ""
+		run.MinSourceFiles = 0
+		run.Versioning.Enabled = false
+		run.Trash.Enabled = false
+		run.ExtraFlags = slices.Clone(job.ExtraFlags)
+		if dir == "" {
+			run.ExtraFlags = append(run.ExtraFlags, "--max-depth", "1")
+		} else {
+			run.Include = shardFilters(job.Include, dir)
+			run.Exclude = shardFilters(job.Exclude, dir)
+			if slices.Contains(run.Exclude, "/**") || len(job.Include) > 0 && len(run.Include) == 0 {
+				return run, false
+			}
+		}
+		if backupDir != "" {
+			target := backupDir
+			if dir != "" {
+				target += "/" + dir
+			}
+			run.ExtraFlags = append(run.ExtraFlags, "--backup-dir", ApplyRemoteOptions(target))
+		}
+		return run, true
+	}
+
+	Infoln("running", JobInfo(job, "job", source, destination), "in", len(dirs)+len(removed)+1, "shards,", job.Shards, "at once")
+	var mu sync.Mutex
+	var lastErr error
+	ran, failed := 0, 0
+	limit := make(chan struct{}, job.Shards)
+	var wg sync.WaitGroup
+	runShard := func(dir string, from string) {
+		defer wg.Done()
+		run, ok := shard(dir)
+		if !ok {
+			Debugln("skipping", JoinRemote(source, dir)+",", "it is excluded")
+			return
+		}
+		limit <- struct{}{}
+		defer func() { <-limit }()
+		if ctx.Err() != nil {
+			return
+		}
+		to := destination
+		if dir != "" {
+			to = JoinRemote(destination, dir)
+		}
+		err := RunJob(ctx, run, from, to)
+		mu.Lock()
+		defer mu.Unlock()
+		ran++
+		if err != nil {
+			lastErr = err
+			failed++
+		}
+	}
+	wg.Add(1)
+	go runShard("", source)
+	for _, dir := range dirs {
+		wg.Add(1)
+		go runShard(dir, JoinRemote(source, dir))
+	}
+	for _, dir := range removed {
+		wg.Add(1)
+		go runShard(dir, empty)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		statuses.SetDetail(job.Index, fmt.Sprintf("%d of %d shards failed", failed, ran))
+		return lastErr
+	}
+	statuses.SetDetail(job.Index, fmt.Sprintf("transferred in %d shards", ran))
+	if job.Versioning.Enabled && !dryRun {
+		PruneVersions(ctx, job, destination)
+	}
+	if job.Trash.Enabled && !dryRun {
+		PruneTrash(ctx, job, destination)
+	}
+	return nil
+}
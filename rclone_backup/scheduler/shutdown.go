@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownGrace is how long running jobs may finish when the addon is stopped
+const DefaultShutdownGrace = "2m"
+
+// maxShutdownGrace leaves time to interrupt the runs before the supervisor kills the addon,
+// its timeout is set in config.yaml
+const maxShutdownGrace = 270 * time.Second
+
+// interruptTimeout is how long interrupted runs have to record their result
+const interruptTimeout = 15 * time.Second
+
+var ErrInterrupted = errors.New("run was interrupted by a shutdown")
+
+var (
+	runsMu       sync.Mutex
+	shuttingDown bool
+	activeRuns   sync.WaitGroup
+)
+
+// beginRun counts a run as running until it calls activeRuns.Done, returning false while shutting down
+func beginRun() bool {
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	if shuttingDown {
+		return false
+	}
+	activeRuns.Add(1)
+	return true
+}
+
+func CheckShutdownGrace() error {
+	if config.ShutdownGrace == "" {
+		return nil
+	}
+	grace, err := time.ParseDuration(config.ShutdownGrace)
+	if err != nil || grace < 0 {
+		return fmt.Errorf("invalid shutdown_grace '%s'", config.ShutdownGrace)
+	}
+	if grace > maxShutdownGrace {
+		return fmt.Errorf("shutdown_grace can be at most %s", maxShutdownGrace)
+	}
+	return nil
+}
+
+func shutdownGrace() time.Duration {
+	grace, err := time.ParseDuration(config.ShutdownGrace)
+	if err != nil || config.ShutdownGrace == "" {
+		grace, _ = time.ParseDuration(DefaultShutdownGrace)
+	}
+	return grace
+}
+
+// waitForRuns waits until every running job finished, returning false on timeout
+func waitForRuns(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		activeRuns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Shutdown stops new runs from starting and gives running jobs the grace period to finish, e.g. while the
+// host reboots for an update. Jobs still running after it are stopped and their runs marked interrupted
+func Shutdown() {
+	runsMu.Lock()
+	shuttingDown = true
+	runsMu.Unlock()
+	runQueue.Close()
+	if !statuses.AnyRunning() {
+		return
+	}
+	grace := shutdownGrace()
+	Infoln("waiting up to", FormatDuration(grace), "for running jobs to finish")
+	if waitForRuns(grace) {
+		return
+	}
+	for _, name := range statuses.Interrupt() {
+		Warnln("interrupting job", "'"+name+"'")
+	}
+	if !waitForRuns(interruptTimeout) {
+		Errorln("interrupted jobs did not stop in time")
+	}
+}
+
+// ResumeInterrupted queues a new run of the jobs with resume_interrupted whose last scheduled run was interrupted,
+// a run that was itself resuming is not resumed again so a job that crashes the addon doesn't loop
+func ResumeInterrupted() {
+	for _, job := range config.Jobs {
+		if !job.ResumeInterrupted || job.Schedule == "" {
+			continue
+		}
+		runs := history.Runs(job.Index)
+		if len(runs) == 0 || runs[0].State != StateInterrupted {
+			continue
+		}
+		if runs[0].Trigger != TriggerSchedule && runs[0].Trigger != TriggerOnce {
+			continue
+		}
+		Infoln("resuming interrupted run of", "'"+JobName(job)+"'", "started", runs[0].Start.Local().Format("2006-01-02 15:04"))
+		job.Trigger = TriggerResume
+		job.Note = "resumes run " + runs[0].ID
+		go runQueue.Run(job, RunTracked)
+	}
+}
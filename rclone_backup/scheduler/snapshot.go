@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const EngineSnapshot = "snapshot"
+
+const (
+	// DefaultSnapshotKeep is how many snapshots are kept when a snapshot job has no keep rules
+	DefaultSnapshotKeep = 7
+	// snapshotLatest is the symlink to the newest snapshot
+	snapshotLatest = "latest"
+	// snapshotPartial is the suffix of a snapshot that is still being written
+	snapshotPartial = ".partial"
+)
+
+// SnapshotConfig keeps point-in-time mirrors of the sources in a local folder, unchanged files are hard links to
+// the previous snapshot so each one only takes the space of the files that changed
+type SnapshotConfig struct {
+	Keep KeepConfig
+}
+
+// CheckSnapshot validates the snapshot options of a job
+func CheckSnapshot(job JobConfig) ([]string, error) {
+	var warnings []string
+	if len(job.Destinations) == 0 {
+		return nil, errors.New("snapshot requires a local destination folder to keep the snapshots in, e.g. /media/usb/snapshots")
+	}
+	for _, destination := range job.Destinations {
+		if strings.Contains(destination, ":") {
+			return nil, fmt.Errorf("snapshot can only keep snapshots in a local folder, not '%s'", destination)
+		}
+	}
+	if job.Command != "" && job.Command != "sync" {
+		return nil, fmt.Errorf("snapshot jobs always sync, command '%s' can't be used", job.Command)
+	}
+	// rclone has to replace changed files instead of writing into them, or the older snapshots change too
+	if ArrayContains(job.ExtraFlags, "--inplace") || ArrayContains(config.ExtraFlags, "--inplace") {
+		return nil, errors.New("snapshot can't be used with --inplace")
+	}
+	if job.Snapshot.Keep.Within != "" {
+		if _, err := ParseAge(job.Snapshot.Keep.Within); err != nil {
+			return nil, fmt.Errorf("snapshot: keep within: %w", err)
+		}
+	}
+	if job.Versioning.Enabled || job.Trash.Enabled {
+		warnings = append(warnings, "versioning and trash are not used by snapshot jobs, older snapshots keep the previous versions")
+	}
+	return warnings, nil
+}
+
+// snapshotKeep returns the keep rules of a snapshot job
+func snapshotKeep(job JobConfig) KeepConfig {
+	if job.Snapshot.Keep == (KeepConfig{}) {
+		return KeepConfig{Last: DefaultSnapshotKeep}
+	}
+	return job.Snapshot.Keep
+}
+
+// ListSnapshots returns the finished snapshots in a folder, oldest first
+func ListSnapshots(dir string) ([]datedFolder, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []datedFolder
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		created, err := time.ParseInLocation(DefaultDateLayout, entry.Name(), time.Local)
+		if err != nil {
+			// partial snapshots and folders that aren't ours
+			continue
+		}
+		snapshots = append(snapshots, datedFolder{name: entry.Name(), created: created})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].created.Before(snapshots[j].created) })
+	return snapshots, nil
+}
+
+// linkTree recreates the folders of src in dst with every file hard linked, returning the number of files
+func linkTree(src string, dst string) (int, error) {
+	files := 0
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case entry.IsDir():
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case entry.Type().IsRegular():
+			if err := os.Link(path, target); err != nil {
+				return fmt.Errorf("the drive has to support hard links, e.g. ext4 instead of FAT or exFAT: %w", err)
+			}
+			files++
+		}
+		return nil
+	})
+	return files, err
+}
+
+// linkLatest points the latest symlink of a folder at a snapshot, relative so it still works when the drive is
+// mounted elsewhere
+func linkLatest(dir string, name string) error {
+	tmp := filepath.Join(dir, snapshotLatest+".tmp")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, snapshotLatest))
+}
+
+// removePartialSnapshots deletes the snapshots of runs that failed or were interrupted
+func removePartialSnapshots(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+snapshotPartial))
+	for _, partial := range matches {
+		if err := os.RemoveAll(partial); err != nil {
+			Warnln("failed to remove partial snapshot", partial+":", err)
+		}
+	}
+}
+
+// snapshotJob returns the job syncing a source into a snapshot
+func snapshotJob(job JobConfig) JobConfig {
+	job.Command = "sync"
+	job.Versioning.Enabled = false
+	job.Trash.Enabled = false
+	return job
+}
+
+// RunSnapshot hard links the newest snapshot in the destination folder into a new one, syncs the source into it so
+// only changed files are copied, then deletes the snapshots the keep rules don't keep
+func RunSnapshot(ctx context.Context, job JobConfig, source string, destination string) error {
+	dir := filepath.Clean(destination)
+	start := time.Now()
+	name := start.Format(DefaultDateLayout)
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots in %s: %w", dir, err)
+	}
+	if IsDryRun(job) {
+		// shows what the next snapshot would change compared to the newest one
+		target := filepath.Join(dir, name)
+		if len(snapshots) > 0 {
+			target = filepath.Join(dir, snapshots[len(snapshots)-1].name)
+		}
+		return RunJob(ctx, snapshotJob(job), source, target)
+	}
+	fail := func(err error) error {
+		Errorln(err)
+		FireJobEvent(EventJobFailed, job, source, destination, start, err.Error())
+		return err
+	}
+	// never create the folder, it would fill the data disk when the drive isn't mounted
+	if _, err := os.Stat(dir); err != nil {
+		return fail(fmt.Errorf("snapshot folder %s is missing, is the drive mounted? %w", dir, err))
+	}
+	removePartialSnapshots(dir)
+	partial := filepath.Join(dir, name+snapshotPartial)
+	linked := 0
+	if len(snapshots) > 0 {
+		newest := filepath.Join(dir, snapshots[len(snapshots)-1].name)
+		Infoln("linking", HighlightRemote(newest), "into the new snapshot")
+		statuses.SetProgress(job.Index, "linking the previous snapshot")
+		if linked, err = linkTree(newest, partial); err != nil {
+			removePartialSnapshots(dir)
+			return fail(fmt.Errorf("failed to link the previous snapshot: %w", err))
+		}
+	} else if err := os.Mkdir(partial, 0755); err != nil {
+		return fail(fmt.Errorf("failed to create snapshot: %w", err))
+	}
+	if err := RunJob(ctx, snapshotJob(job), source, partial); err != nil {
+		removePartialSnapshots(dir)
+		return err
+	}
+	if err := os.Rename(partial, filepath.Join(dir, name)); err != nil {
+		return fail(fmt.Errorf("failed to finish snapshot: %w", err))
+	}
+	if err := linkLatest(dir, name); err != nil {
+		Warnln("failed to link the latest snapshot:", err)
+	}
+	detail := fmt.Sprintf("snapshot %s, %d files linked from the previous one", name, linked)
+	if deleted := pruneSnapshots(job, dir); deleted > 0 {
+		detail += fmt.Sprintf(", %d old snapshots deleted", deleted)
+	}
+	Infoln("saved", detail)
+	statuses.SetDetail(job.Index, detail)
+	return nil
+}
+
+// keepSnapshots returns which snapshots, oldest first, the keep rules keep, in the same way as restic forget: the
+// newest snapshot of each hour, day, week, month or year is kept for as many as the rule says
+func keepSnapshots(snapshots []datedFolder, keep KeepConfig) []bool {
+	kept := make([]bool, len(snapshots))
+	if len(snapshots) == 0 {
+		return kept
+	}
+	newest := snapshots[len(snapshots)-1].created
+	within, _ := ParseAge(keep.Within)
+	for i, snapshot := range snapshots {
+		if keep.Last > 0 && len(snapshots)-i <= keep.Last {
+			kept[i] = true
+		}
+		if keep.Within != "" && newest.Sub(snapshot.created) <= within {
+			kept[i] = true
+		}
+	}
+	rules := []struct {
+		count  int
+		bucket func(time.Time) string
+	}{
+		{keep.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{keep.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{keep.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{keep.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{keep.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, rule := range rules {
+		last, count := "", 0
+		for i := len(snapshots) - 1; i >= 0 && count < rule.count; i-- {
+			if bucket := rule.bucket(snapshots[i].created); bucket != last {
+				kept[i] = true
+				last = bucket
+				count++
+			}
+		}
+	}
+	// the snapshot that was just made is never deleted
+	kept[len(kept)-1] = true
+	return kept
+}
+
+// pruneSnapshots deletes the snapshots in a folder the keep rules of the job don't keep, returning how many
+func pruneSnapshots(job JobConfig, dir string) int {
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		Warnln("failed to list snapshots in", dir+":", err)
+		return 0
+	}
+	deleted := 0
+	for i, keep := range keepSnapshots(snapshots, snapshotKeep(job)) {
+		if keep {
+			continue
+		}
+		Debugln("deleting snapshot", snapshots[i].name)
+		if err := os.RemoveAll(filepath.Join(dir, snapshots[i].name)); err != nil {
+			Warnln("failed to delete snapshot", snapshots[i].name+":", err)
+			continue
+		}
+		deleted++
+	}
+	return deleted
+}
+
+func previewSnapshots(ctx context.Context, job JobConfig, destination string) (RetentionPreview, error) {
+	dir := filepath.Clean(destination)
+	preview := RetentionPreview{Policy: "snapshot", Target: dir, Rule: strings.Join(snapshotKeep(job).Args(), " "), Delete: []string{}, Keep: []string{}}
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return preview, fmt.Errorf("failed to list snapshots in %s: %w", dir, err)
+	}
+	for i, keep := range keepSnapshots(snapshots, snapshotKeep(job)) {
+		if keep {
+			preview.Keep = append(preview.Keep, snapshots[i].name)
+		} else {
+			preview.Delete = append(preview.Delete, snapshots[i].name)
+		}
+	}
+	previewFolders(ctx, &preview)
+	return preview, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var SnoozesPath = filepath.Join(DataPath, "snoozed.json")
+
+var ErrNotScheduled = errors.New("job has no scheduled runs")
+
+// snoozeSlack is how early a scheduled run may start and still be the snoozed one
+const snoozeSlack = time.Minute
+
+// SnoozedRun is the next scheduled run of a job that is skipped, optionally postponed by a duration
+type SnoozedRun struct {
+	Job       int        `json:"job"`
+	Name      string     `json:"name"`
+	Skip      time.Time  `json:"skip"`                // the scheduled run that is skipped
+	Postponed *time.Time `json:"postponed,omitempty"` // when the run happens instead
+	PlannedID string     `json:"planned_id,omitempty"`
+	Since     time.Time  `json:"since"`
+}
+
+type SnoozeStore struct {
+	mu      sync.Mutex
+	snoozed map[int]SnoozedRun
+}
+
+var snoozes = &SnoozeStore{snoozed: make(map[int]SnoozedRun)}
+
+// Load reads the snoozed runs from disk, ignoring jobs that no longer exist and runs that already passed
+func (s *SnoozeStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(SnoozesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []SnoozedRun
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, snoozed := range list {
+		if snoozed.Job < len(config.Jobs) && config.Jobs[snoozed.Job].Name == snoozed.Name && snoozed.Skip.After(time.Now()) {
+			s.snoozed[snoozed.Job] = snoozed
+		}
+	}
+	return nil
+}
+
+func (s *SnoozeStore) save() {
+	list := make([]SnoozedRun, 0, len(s.snoozed))
+	for _, snoozed := range s.snoozed {
+		list = append(list, snoozed)
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = os.WriteFile(SnoozesPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save snoozed runs:", err)
+	}
+}
+
+// Get returns the snoozed run of the job at index, if any
+func (s *SnoozeStore) Get(index int) *SnoozedRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snoozed, ok := s.snoozed[index]
+	if !ok {
+		return nil
+	}
+	return &snoozed
+}
+
+// Snooze skips the next scheduled run of a job. With a duration the run is postponed by it instead,
+// unless that is after the following scheduled run
+func (s *SnoozeStore) Snooze(job JobConfig, duration time.Duration) (SnoozedRun, error) {
+	scheduled, ok := scheduledJobs[job.Index]
+	if !ok {
+		return SnoozedRun{}, ErrNotScheduled
+	}
+	next, err := scheduled.NextRuns(2)
+	if err != nil || len(next) == 0 {
+		return SnoozedRun{}, ErrNotScheduled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.snoozed[job.Index]; ok {
+		// snoozing again replaces the duration
+		s.cancelPostponed(current)
+	}
+	snoozed := SnoozedRun{Job: job.Index, Name: job.Name, Skip: next[0], Since: time.Now()}
+	if duration > 0 {
+		postponed := next[0].Add(duration)
+		if len(next) > 1 && !postponed.Before(next[1]) {
+			Warnln("postponing the run of", "'"+JobName(job)+"'", "by", FormatDuration(duration), "is after the next scheduled run, skipping it instead")
+		} else {
+			planned, err := onceRuns.Add(job, postponed, "snoozed")
+			if err != nil {
+				return SnoozedRun{}, err
+			}
+			snoozed.Postponed = &postponed
+			snoozed.PlannedID = planned.ID
+		}
+	}
+	s.snoozed[job.Index] = snoozed
+	s.save()
+	Infoln("snoozed the run of", "'"+JobName(job)+"'", "at", snoozed.Skip.Local().Format("2006-01-02 15:04"))
+	return snoozed, nil
+}
+
+// Unsnooze runs the snoozed run of a job as scheduled again, returning false if it was not snoozed
+func (s *SnoozeStore) Unsnooze(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snoozed, ok := s.snoozed[index]
+	if !ok {
+		return false
+	}
+	s.cancelPostponed(snoozed)
+	delete(s.snoozed, index)
+	s.save()
+	return true
+}
+
+func (s *SnoozeStore) cancelPostponed(snoozed SnoozedRun) {
+	if snoozed.PlannedID != "" {
+		onceRuns.Cancel(snoozed.Job, snoozed.PlannedID)
+	}
+}
+
+// take removes and returns the snoozed run of a job if it is due now
+func (s *SnoozeStore) take(index int) *SnoozedRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snoozed, ok := s.snoozed[index]
+	if !ok || time.Now().Before(snoozed.Skip.Add(-snoozeSlack)) {
+		return nil
+	}
+	delete(s.snoozed, index)
+	s.save()
+	return &snoozed
+}
+
+// SkipIfSnoozed wraps the task of a scheduled job to skip its snoozed run
+func SkipIfSnoozed(job JobConfig, task func()) func() {
+	return func() {
+		if snoozed := snoozes.take(job.Index); snoozed != nil {
+			if snoozed.Postponed != nil {
+				Infoln("job", "'"+job.Name+"'", "is snoozed, postponed to", snoozed.Postponed.Local().Format("2006-01-02 15:04"))
+			} else {
+				Infoln("job", "'"+job.Name+"'", "is snoozed, skipping this run")
+			}
+			return
+		}
+		task()
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"github.com/jcwillox/emerald"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ListenSocket listens on a unix socket at path, replacing a stale socket left by a previous run
+func ListenSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("'" + path + "' exists and is not a socket")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ServeSocket serves the handler on the configured unix socket in a goroutine
+func ServeSocket(path string, handler http.Handler) {
+	listener, err := ListenSocket(path)
+	if err != nil {
+		Errorln("failed to listen on api socket", emerald.HighlightPath(path)+":", err)
+		return
+	}
+	go func() {
+		Infoln("Jobs API listening on socket", emerald.HighlightPath(path))
+		if err := http.Serve(listener, handler); err != nil && !errors.Is(err, net.ErrClosed) {
+			Errorln("Jobs API socket error:", err)
+		}
+	}()
+}
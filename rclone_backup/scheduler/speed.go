@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// MaxSpeedSamples is the most speed samples kept for a run, longer runs are sampled less often
+const MaxSpeedSamples = 2000
+
+var ErrNoSpeedSamples = errors.New("run has no speed samples")
+
+// SpeedSample is the transfer speed of a run at a point in time, taken from the rclone stats
+type SpeedSample struct {
+	Time  time.Time `json:"time"`
+	Bytes int64     `json:"bytes"` // transferred so far by the current rclone command
+	Speed float64   `json:"speed"` // bytes per second
+	// the provider throttled requests since the previous sample
+	Throttled bool `json:"throttled,omitempty"`
+}
+
+// SpeedRecorder keeps the speed samples of a run, when it has too many every other one is dropped and samples
+// are taken half as often, so the samples still cover the whole run
+type SpeedRecorder struct {
+	samples   []SpeedSample
+	every     time.Duration
+	throttled bool
+}
+
+// Add records a sample unless the previous one is too recent
+func (s *SpeedRecorder) Add(sample SpeedSample) {
+	if n := len(s.samples); n > 0 && sample.Time.Sub(s.samples[n-1].Time) < s.every {
+		// throttling is kept for the next sample so it isn't lost
+		s.throttled = s.throttled || sample.Throttled
+		return
+	}
+	sample.Throttled = sample.Throttled || s.throttled
+	s.throttled = false
+	if len(s.samples) >= MaxSpeedSamples {
+		kept := s.samples[:0]
+		for i := 0; i < len(s.samples); i += 2 {
+			kept = append(kept, s.samples[i])
+		}
+		s.samples = kept
+		if len(kept) > 1 {
+			s.every = kept[1].Time.Sub(kept[0].Time)
+		}
+	}
+	s.samples = append(s.samples, sample)
+}
+
+// Samples returns a copy of the samples, oldest first
+func (s *SpeedRecorder) Samples() []SpeedSample {
+	return append([]SpeedSample{}, s.samples...)
+}
+
+// parseSpeed returns the speed of a stats line of rclone, e.g. the 10 MiB/s of
+// "1.2 GiB / 3.4 GiB, 35%, 10 MiB/s, ETA 3m"
+func parseSpeed(stats []string) (float64, bool) {
+	for i := 1; i < len(stats); i++ {
+		unit, ok := strings.CutSuffix(strings.TrimSuffix(stats[i], ","), "/s")
+		if !ok {
+			continue
+		}
+		speed, ok := ParseSize(stats[i-1], unit)
+		return float64(speed), ok
+	}
+	return 0, false
+}
+
+// SaveSpeedSamples stores the speed samples of a finished run as an artifact
+func SaveSpeedSamples(record *RunRecord) {
+	samples := statuses.SpeedSamples(record.Job)
+	if len(samples) == 0 {
+		return
+	}
+	data, err := json.Marshal(samples)
+	if err == nil {
+		err = WriteArtifact(record.Job, record.ID, ArtifactSpeed, data)
+	}
+	if err != nil {
+		Warnln("failed to save speed samples:", err)
+	}
+}
+
+// RunSpeed returns the speed samples of a run, those of the current run while it is running
+func RunSpeed(index int, run string) ([]SpeedSample, error) {
+	if status := statuses.Get(index); status.RunID == run && status.State == StateRunning {
+		return statuses.SpeedSamples(index), nil
+	}
+	path, err := ArtifactPath(index, run, ArtifactSpeed)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoSpeedSamples
+	}
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]SpeedSample, 0)
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jcwillox/emerald"
+)
+
+// DefaultStagingMinFree is the space left free on the disk of the staging area for Home Assistant
+const DefaultStagingMinFree = "1G"
+
+// tarOverhead is the most a tar adds to each file, its header and the padding of its last block
+const tarOverhead = 1024
+
+var (
+	ErrStagingFull    = errors.New("staging area is full")
+	ErrNoStagingSpace = errors.New("not enough space to stage the archive")
+)
+
+// StagingConfig is the folder archives are written to before they are uploaded, and how much it may hold
+type StagingConfig struct {
+	Path    string
+	MaxSize string `yaml:"max_size"` // all staged files together, e.g. "5G"
+	MinFree string `yaml:"min_free"` // space that has to stay free on the disk after staging an archive
+
+	StreamWhenFull bool `yaml:"stream_when_full"` // stream archives that don't fit instead of failing
+}
+
+// StagedFile is a file in the staging area of a running job
+type StagedFile struct {
+	Path    string    `json:"path"`
+	Job     string    `json:"job"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// StagingUsage is how much of the staging area is used by the running jobs
+type StagingUsage struct {
+	Path    string       `json:"path"`
+	Used    int64        `json:"used"`
+	MaxSize int64        `json:"max_size,omitempty"`
+	Files   []StagedFile `json:"files"`
+}
+
+type StagingArea struct {
+	mu    sync.Mutex
+	files map[string]*StagedFile
+}
+
+var staging = &StagingArea{files: make(map[string]*StagedFile)}
+
+func CheckStaging() error {
+	if config.Staging.MaxSize != "" {
+		if _, err := ParseSizeString(config.Staging.MaxSize); err != nil {
+			return fmt.Errorf("invalid staging max_size '%s'", config.Staging.MaxSize)
+		}
+	}
+	if config.Staging.MinFree != "" {
+		if _, err := ParseSizeString(config.Staging.MinFree); err != nil {
+			return fmt.Errorf("invalid staging min_free '%s'", config.Staging.MinFree)
+		}
+	}
+	return nil
+}
+
+// EstimateArchiveSize returns the most space the archive of the files can take, assuming they don't compress
+func EstimateArchiveSize(files map[string]FileState, filter func(string) bool) int64 {
+	size := int64(tarOverhead)
+	for rel, file := range files {
+		if filter == nil || filter(rel) {
+			size += file.Size + tarOverhead
+		}
+	}
+	return size
+}
+
+// CheckStagingSpace fails when staging a file of the given size would fill the disk of the staging folder
+// or the staging area, so a large archive doesn't take Home Assistant down with it
+func CheckStagingSpace(path string, needed int64) error {
+	minFree, _ := ParseSizeString(DefaultStagingMinFree)
+	if config.Staging.MinFree != "" {
+		minFree, _ = ParseSizeString(config.Staging.MinFree)
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return fmt.Errorf("failed to read free space of %s: %w", path, err)
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	if free-needed < minFree {
+		return fmt.Errorf("%w, the archive can take up to %s but %s is free on %s and %s has to stay free", ErrNoStagingSpace, FormatBytes(needed), FormatBytes(free), path, FormatBytes(minFree))
+	}
+	if maxSize := stagingMaxSize(); maxSize > 0 {
+		if used := staging.Usage().Used; used+needed > maxSize {
+			return fmt.Errorf("%w, the archive can take up to %s but %s of the %s staging area is used", ErrNoStagingSpace, FormatBytes(needed), FormatBytes(used), FormatBytes(maxSize))
+		}
+	}
+	return nil
+}
+
+// StagingPath returns the staging folder of a job, its own folder or the managed staging area
+func StagingPath(job JobConfig) string {
+	if job.Compress.Staging != "" {
+		return job.Compress.Staging
+	}
+	if config.Staging.Path != "" {
+		return config.Staging.Path
+	}
+	return DefaultStagingPath
+}
+
+func stagingMaxSize() int64 {
+	if config.Staging.MaxSize == "" {
+		return 0
+	}
+	size, _ := ParseSizeString(config.Staging.MaxSize)
+	return size
+}
+
+// CleanStaging removes the files left in the managed staging area by runs that never finished, e.g. when the
+// addon crashed, it is only called before any job runs
+func CleanStaging() {
+	path := config.Staging.Path
+	if path == "" {
+		path = DefaultStagingPath
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			Errorln("failed to read staging area:", err)
+		}
+		return
+	}
+	var freed int64
+	for _, entry := range entries {
+		file := filepath.Join(path, entry.Name())
+		size := folderSize(file)
+		if err := os.RemoveAll(file); err != nil {
+			Errorln("failed to remove", file+":", err)
+			continue
+		}
+		freed += size
+	}
+	if len(entries) > 0 {
+		Infoln("removed", boldCyan(strconv.Itoa(len(entries))), emerald.Green+"files left in the staging area by interrupted runs,", FormatBytes(freed), "freed")
+	}
+}
+
+// folderSize returns the size of a file or of every file in a folder
+func folderSize(path string) int64 {
+	var size int64
+	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Create creates a staged file of a job, writes to it fail with ErrStagingFull once the staging area is over its size
+func (s *StagingArea) Create(job JobConfig, path string) (*StagingWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	staged := &StagedFile{Path: path, Job: JobName(job), Created: time.Now()}
+	s.files[path] = staged
+	return &StagingWriter{File: file, staged: staged}, nil
+}
+
+// Remove deletes a staged file
+func (s *StagingArea) Remove(path string) {
+	s.mu.Lock()
+	delete(s.files, path)
+	s.mu.Unlock()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		Errorln("failed to remove staged file:", err)
+	}
+}
+
+// Usage returns the staged files of the running jobs, largest first
+func (s *StagingArea) Usage() StagingUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := config.Staging.Path
+	if path == "" {
+		path = DefaultStagingPath
+	}
+	usage := StagingUsage{Path: path, MaxSize: stagingMaxSize(), Files: make([]StagedFile, 0, len(s.files))}
+	for _, staged := range s.files {
+		usage.Used += staged.Size
+		usage.Files = append(usage.Files, *staged)
+	}
+	sort.Slice(usage.Files, func(i, j int) bool { return usage.Files[i].Size > usage.Files[j].Size })
+	return usage
+}
+
+// add counts bytes written to a staged file against the size of the staging area
+func (s *StagingArea) add(staged *StagedFile, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	staged.Size += int64(n)
+	maxSize := stagingMaxSize()
+	if maxSize == 0 {
+		return nil
+	}
+	var used int64
+	for _, file := range s.files {
+		used += file.Size
+	}
+	if used > maxSize {
+		return fmt.Errorf("%w, %s of %s used", ErrStagingFull, FormatBytes(used), FormatBytes(maxSize))
+	}
+	return nil
+}
+
+// StagingWriter writes a staged file, counting its size
+type StagingWriter struct {
+	*os.File
+	staged *StagedFile
+}
+
+func (w *StagingWriter) Write(b []byte) (int, error) {
+	n, err := w.File.Write(b)
+	if err == nil {
+		err = staging.add(w.staged, n)
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StandaloneConfigPath is the config loaded without the Supervisor when there are no addon options
+var StandaloneConfigPath = filepath.Join(DataPath, "config.yaml")
+
+// validating is set while a config is only checked, e.g. by the config page before it is saved
+var validating bool
+
+// ErrNoSupervisor is returned by the integrations with Home Assistant when the scheduler runs standalone
+var ErrNoSupervisor = errors.New("the home assistant supervisor is not available, running standalone")
+
+// Capabilities are the integrations available where the scheduler runs
+type Capabilities struct {
+	Standalone    bool   `json:"standalone"`     // not running as an addon of Home Assistant
+	Supervisor    bool   `json:"supervisor"`     // the options are checked and stored by the Supervisor, which can restart the addon
+	HomeAssistant bool   `json:"home_assistant"` // events, sensors, notify services and persistent notifications
+	ConfigFile    string `json:"config_file"`    // the config that was loaded
+	ConfigFormat  string `json:"config_format"`  // json or yaml, saved configs are written in the same format
+}
+
+// GetCapabilities returns the integrations available where the scheduler runs
+func GetCapabilities() Capabilities {
+	supervisor := HasSupervisor()
+	format := "json"
+	if configIsYAML() {
+		format = "yaml"
+	}
+	return Capabilities{Standalone: !supervisor, Supervisor: supervisor, HomeAssistant: supervisor, ConfigFile: configFile, ConfigFormat: format}
+}
+
+// DefaultConfigFile returns the config to load when none is given with --config: the file in RCLONE_BACKUP_CONFIG,
+// the addon options, or without the Supervisor a config.yaml in the data folder when there are no addon options
+func DefaultConfigFile() string {
+	if path := os.Getenv("RCLONE_BACKUP_CONFIG"); path != "" {
+		return path
+	}
+	if !HasSupervisor() {
+		if _, err := os.Stat(ConfigPath); errors.Is(err, os.ErrNotExist) {
+			if _, err := os.Stat(StandaloneConfigPath); err == nil {
+				return StandaloneConfigPath
+			}
+		}
+	}
+	return ConfigPath
+}
+
+// configIsYAML reports whether the loaded config is a yaml file, which is kept as yaml when it is saved
+func configIsYAML() bool {
+	ext := strings.ToLower(filepath.Ext(configFile))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// ConfigJSON returns the options of a json or yaml config as json
+func ConfigJSON(data []byte) ([]byte, error) {
+	if json.Valid(data) {
+		return data, nil
+	}
+	options := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &options); err != nil {
+		return nil, err
+	}
+	return json.Marshal(options)
+}
+
+// SetupStandalone does what the init script of the addon does before the scheduler starts, and warns about the
+// options that need Home Assistant
+func SetupStandalone() {
+	Infoln("running standalone without the home assistant supervisor, loaded", "\""+configFile+"\"")
+	Infoln("events, sensors, persistent notifications and notify services of home assistant are turned off")
+	// a config that is only validated mustn't replace the rclone config of the running scheduler
+	if config.RcloneConfig != "" && !validating {
+		err := os.MkdirAll(filepath.Dir(DefaultConfigPath), 0700)
+		if err == nil {
+			err = os.WriteFile(DefaultConfigPath, []byte(config.RcloneConfig), 0600)
+		}
+		if err != nil {
+			Fatalln("failed to write rclone_config", err)
+		}
+	}
+	// rclone finds its config in RCLONE_CONFIG, which the init script of the addon sets
+	if config.RcloneConfig != "" {
+		_ = os.Setenv("RCLONE_CONFIG", DefaultConfigPath)
+	} else if os.Getenv("RCLONE_CONFIG") == "" && config.ConfigPath != "" {
+		_ = os.Setenv("RCLONE_CONFIG", config.ConfigPath)
+	}
+	for _, notifier := range config.Notifiers {
+		if notifier.Service != "" {
+			Warnln("notifier", "'"+notifier.Name+"'", "calls a home assistant service, it can't send anything when running standalone")
+		}
+	}
+	if config.MQTT.Host == "" && (config.MQTT.StateTopic != "" || len(mqttJobs()) > 0) {
+		Warnln("mqtt: set host, the broker of the mosquitto addon can only be found through the supervisor")
+	}
+}
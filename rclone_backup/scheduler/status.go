@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateIdle        = "idle"
+	StateRunning     = "running"
+	StateSuccess     = "success"
+	StateFailed      = "failed"
+	StateCancelled   = "cancelled"
+	StateSuspicious  = "suspicious"
+	StateDegraded    = "degraded"    // succeeded but ran longer than expected
+	StateWarning     = "warning"     // completed with warnings, e.g. failed files tolerated by the success rules
+	StateInterrupted = "interrupted" // stopped because the addon was shut down
+)
+
+// What started a run
+const (
+	TriggerSchedule = "schedule"
+	TriggerStartup  = "startup"
+	TriggerManual   = "manual"
+	TriggerRetry    = "retry"
+	TriggerCLI      = "cli"
+	TriggerOnce     = "once"    // a single planned run, see OnceScheduler
+	TriggerResume   = "resume"  // repeats a run that was interrupted, see ResumeInterrupted
+	TriggerHotplug  = "hotplug" // a usb drive was plugged in, see HotplugWatcher
+	TriggerWatch    = "watch"   // files changed in a watched folder, see JobWatcher
+	TriggerMQTT     = "mqtt"    // a message was published on the job's topic, see StartMQTT
+	TriggerStdin    = "stdin"   // an automation called the hassio.addon_stdin action, see ListenStdin
+	TriggerGRPC     = "grpc"    // started with RunJob of the gRPC interface, see HandleGRPC
+)
+
+// manualTriggers are runs someone asked for, the circuit breaker and the data budget let them through so a remote
+// can be tested while its circuit is open
+var manualTriggers = []string{TriggerManual, TriggerRetry, TriggerCLI, TriggerGRPC}
+
+// IsAutomatedTrigger reports whether a run was started without someone asking for it, e.g. by its schedule, a usb
+// drive, mqtt or an automation
+func IsAutomatedTrigger(trigger string) bool {
+	return !slices.Contains(manualTriggers, trigger)
+}
+
+var ErrCancelled = errors.New("job was cancelled")
+
+// JobStatus is the current and last known state of a job
+type JobStatus struct {
+	State       string          `json:"state"`
+	RunID       string          `json:"run_id,omitempty"`
+	Trigger     string          `json:"trigger,omitempty"`
+	Note        string          `json:"note,omitempty"`
+	LastStart   *time.Time      `json:"last_start,omitempty"`
+	LastEnd     *time.Time      `json:"last_end,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	ErrorClass  string          `json:"error_class,omitempty"`
+	Progress    string          `json:"progress,omitempty"`
+	Bytes       int64           `json:"bytes"`
+	Files       int64           `json:"files"`
+	ServerSide  ServerSideStats `json:"server_side,omitzero"` // copied or moved by the remote without passing through the addon
+	Steps       []StepResult    `json:"steps,omitempty"`
+	Detail      string          `json:"detail,omitempty"`
+	FailedFiles []FailedTarget  `json:"failed_files,omitempty"`
+	Paused      *PausedJob      `json:"paused,omitempty"`
+	SLABreached *SLABreach      `json:"sla_breached,omitempty"`
+	Warnings    []string        `json:"run_warnings,omitempty"` // problems of the last run that did not fail it
+
+	cancel  context.CancelFunc
+	lastJob JobConfig
+	// the run was stopped by a shutdown
+	interrupted bool
+	manifest    []ManifestTarget
+	overdue     bool
+	speed       SpeedRecorder
+}
+
+type StatusTracker struct {
+	mu       sync.Mutex
+	statuses map[int]*JobStatus
+}
+
+var statuses = &StatusTracker{statuses: make(map[int]*JobStatus)}
+
+func (t *StatusTracker) get(index int) *JobStatus {
+	status, ok := t.statuses[index]
+	if !ok {
+		status = &JobStatus{State: StateIdle}
+		t.statuses[index] = status
+	}
+	return status
+}
+
+// Get returns a copy of the status of the job at index
+func (t *StatusTracker) Get(index int) JobStatus {
+	t.mu.Lock()
+	status := *t.get(index)
+	t.mu.Unlock()
+	status.Paused = pauses.Get(index)
+	status.SLABreached = freshness.Breach(index)
+	return status
+}
+
+// Start marks the job as running, returning false if it is already running
+func (t *StatusTracker) Start(job JobConfig, cancel context.CancelFunc) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	status := t.get(job.Index)
+	if status.State == StateRunning {
+		return false
+	}
+	status.RunID = job.RunID
+	if status.RunID == "" {
+		status.RunID = NewRunID()
+	}
+	// a retry of the run gets a new id
+	job.RunID = ""
+	status.cancel = cancel
+	status.lastJob = job
+	status.interrupted = false
+	status.State = StateRunning
+	status.Trigger = job.Trigger
+	status.Note = job.Note
+	status.LastStart = &now
+	status.LastEnd = nil
+	status.Progress = ""
+	status.Bytes = 0
+	status.Files = 0
+	status.ServerSide = ServerSideStats{}
+	status.Steps = nil
+	status.Detail = ""
+	status.FailedFiles = nil
+	status.Warnings = nil
+	status.manifest = nil
+	status.overdue = false
+	status.speed = SpeedRecorder{}
+	return true
+}
+
+// Finish records the outcome of the current run and returns it as a history record
+func (t *StatusTracker) Finish(index int, err error) RunRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	status := t.get(index)
+	status.LastEnd = &now
+	status.Progress = ""
+	status.cancel = nil
+	status.ErrorClass = ErrorClass(err)
+	if errors.Is(err, ErrCancelled) {
+		status.State = StateCancelled
+		status.LastError = err.Error()
+	} else if errors.Is(err, ErrInterrupted) {
+		status.State = StateInterrupted
+		status.LastError = err.Error()
+	} else if errors.Is(err, ErrSourceSuspicious) {
+		status.State = StateSuspicious
+		status.LastError = err.Error()
+	} else if err != nil {
+		status.State = StateFailed
+		status.LastError = err.Error()
+	} else if len(status.Warnings) > 0 {
+		status.State = StateWarning
+		status.LastError = ""
+	} else if status.overdue {
+		status.State = StateDegraded
+		status.LastError = ""
+	} else {
+		status.State = StateSuccess
+		status.LastError = ""
+	}
+	record := RunRecord{
+		ID:          status.RunID,
+		Job:         index,
+		Name:        status.lastJob.Name,
+		Trigger:     status.Trigger,
+		Note:        status.Note,
+		State:       status.State,
+		Error:       status.LastError,
+		ErrorClass:  status.ErrorClass,
+		Start:       *status.LastStart,
+		End:         now,
+		Bytes:       status.Bytes,
+		Files:       status.Files,
+		ServerSide:  status.ServerSide,
+		Steps:       append([]StepResult{}, status.Steps...),
+		Detail:      status.Detail,
+		FailedFiles: status.FailedFiles,
+		Warnings:    status.Warnings,
+	}
+	record.Duration = FormatDuration(record.End.Sub(record.Start))
+	return record
+}
+
+// Restore sets the last known state of a job from a history record
+func (t *StatusTracker) Restore(record RunRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(record.Job)
+	if record.Job < len(config.Jobs) {
+		status.lastJob = config.Jobs[record.Job]
+	}
+	status.State = record.State
+	status.RunID = record.ID
+	status.Trigger = record.Trigger
+	status.Note = record.Note
+	status.LastStart = &record.Start
+	status.LastEnd = &record.End
+	status.LastError = record.Error
+	status.ErrorClass = record.ErrorClass
+	status.Bytes = record.Bytes
+	status.Files = record.Files
+	status.ServerSide = record.ServerSide
+	status.Steps = record.Steps
+	status.Detail = record.Detail
+	status.FailedFiles = record.FailedFiles
+	status.Warnings = record.Warnings
+}
+
+// AddWarning records a problem of the current run that does not fail it, the run finishes with the warning state
+func (t *StatusTracker) AddWarning(index int, warning string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	status.Warnings = append(status.Warnings, warning)
+}
+
+// SetOverdue marks the current run as taking longer than expected
+func (t *StatusTracker) SetOverdue(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(index).overdue = true
+}
+
+// Cancel stops the job if it is running
+func (t *StatusTracker) Cancel(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	if status.State != StateRunning || status.cancel == nil {
+		return false
+	}
+	status.cancel()
+	return true
+}
+
+// Interrupt stops every running job because the addon is shutting down, returning their names
+func (t *StatusTracker) Interrupt() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var names []string
+	for _, status := range t.statuses {
+		if status.State != StateRunning || status.cancel == nil {
+			continue
+		}
+		status.interrupted = true
+		status.cancel()
+		names = append(names, status.lastJob.Name)
+	}
+	return names
+}
+
+// Interrupted reports whether the current run of the job was stopped by a shutdown
+func (t *StatusTracker) Interrupted(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.get(index).interrupted
+}
+
+// RetryJob returns the config of the last run if it failed, was cancelled or interrupted
+func (t *StatusTracker) RetryJob(index int) (JobConfig, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	if status.State != StateFailed && status.State != StateCancelled && status.State != StateSuspicious && status.State != StateInterrupted {
+		return JobConfig{}, false
+	}
+	return status.lastJob, true
+}
+
+// RetryFailedFilesJob returns the config of the last run limited to the files that failed
+func (t *StatusTracker) RetryFailedFilesJob(index int) (JobConfig, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	if (status.State != StateFailed && status.State != StateWarning) || len(status.FailedFiles) == 0 || !RetryFilesSupported(status.lastJob) {
+		return JobConfig{}, false
+	}
+	job := status.lastJob
+	job.RetryFiles = status.FailedFiles
+	return job, true
+}
+
+// AddFailedFiles records the files of a target that failed to transfer
+func (t *StatusTracker) AddFailedFiles(index int, source string, destination string, files []string) {
+	if len(files) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	status.FailedFiles = append(status.FailedFiles, FailedTarget{Source: source, Destination: destination, Files: files})
+}
+
+// AddManifest adds the listing of a destination to the manifest of the current run
+func (t *StatusTracker) AddManifest(index int, target ManifestTarget) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	status.manifest = append(status.manifest, target)
+}
+
+// Manifest returns the destinations listed during the last run
+func (t *StatusTracker) Manifest(index int) []ManifestTarget {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.get(index).manifest
+}
+
+// AnyRunning reports whether any job is currently running
+func (t *StatusTracker) AnyRunning() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, status := range t.statuses {
+		if status.State == StateRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// LastFinished returns when the most recent run of any job finished
+func (t *StatusTracker) LastFinished() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var last time.Time
+	for _, status := range t.statuses {
+		if status.LastEnd != nil && status.LastEnd.After(last) {
+			last = *status.LastEnd
+		}
+	}
+	return last
+}
+
+// SetSteps records a copy of the pipeline step results
+func (t *StatusTracker) SetSteps(index int, steps []StepResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(index).Steps = append([]StepResult{}, steps...)
+}
+
+// SetDetail records a summary of the result of the current run
+func (t *StatusTracker) SetDetail(index int, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(index).Detail = detail
+}
+
+func (t *StatusTracker) SetProgress(index int, progress string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(index).Progress = progress
+}
+
+// AddSpeedSample records the transfer speed of a running job
+func (t *StatusTracker) AddSpeedSample(index int, sample SpeedSample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	if status.State == StateRunning {
+		sample.Time = time.Now()
+		status.speed.Add(sample)
+	}
+}
+
+// SpeedSamples returns the speed samples of the current or last run of a job
+func (t *StatusTracker) SpeedSamples(index int) []SpeedSample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.get(index).speed.Samples()
+}
+
+// AddTransferred adds the totals of a finished rclone command to the current run
+func (t *StatusTracker) AddTransferred(index int, bytes int64, files int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	status.Bytes += bytes
+	status.Files += files
+}
+
+// AddServerSide adds the files rclone copied or moved server-side to the current run
+func (t *StatusTracker) AddServerSide(index int, stats ServerSideStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.get(index)
+	status.ServerSide.Bytes += stats.Bytes
+	status.ServerSide.Files += stats.Files
+}
+
+func NewRunID() string {
+	buf := make([]byte, 6)
+	_, _ = rand.Read(buf)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(buf)
+}
+
+// ProgressWriter passes output through while recording rclone's latest transfer stats
+type ProgressWriter struct {
+	out        io.Writer
+	index      int
+	buf        []byte
+	bytes      int64
+	files      int64
+	errors     []string                   // last error lines logged by rclone
+	failed     []string                   // files that failed to transfer
+	dryRun     []string                   // changes a dry run would have made
+	serverSide map[string]ServerSideStats // "Copies" and "Moves" done server-side
+	// requests the provider throttled and the longest it asked to wait
+	throttled  int
+	retryAfter time.Duration
+	// throttled requests when the last speed sample was taken
+	sampledThrottled int
+}
+
+// maxErrorLines is the number of rclone error lines kept for classifying a failure
+const maxErrorLines = 10
+
+func NewProgressWriter(out io.Writer, index int) *ProgressWriter {
+	return &ProgressWriter{out: out, index: index}
+}
+
+func (p *ProgressWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+		p.parseLine(line)
+	}
+	return p.out.Write(b)
+}
+
+func (p *ProgressWriter) parseLine(line string) {
+	if msg, ok := parseErrorLine(line); ok {
+		p.countThrottled(msg)
+		if file, ok := FailedFile(msg); ok && len(p.failed) < MaxFailedFiles && !ArrayContains(p.failed, file) {
+			p.failed = append(p.failed, file)
+		}
+		p.errors = append(p.errors, msg)
+		if len(p.errors) > maxErrorLines {
+			p.errors = p.errors[1:]
+		}
+		return
+	}
+	// "Too many requests. Trying again in 23 seconds." is logged while rclone waits on its own
+	if strings.Contains(line, "Trying again in") || strings.Contains(line, "pacer: Rate limited") {
+		p.countThrottled(line)
+		return
+	}
+	// "NOTICE: a.tar: Skipped copy as --dry-run is set (size 1.2Mi)"
+	if i := strings.Index(line, "NOTICE: "); i >= 0 && strings.Contains(line, "as --dry-run is set") {
+		if len(p.dryRun) < MaxDryRunChanges {
+			p.dryRun = append(p.dryRun, line[i+len("NOTICE: "):])
+		}
+		return
+	}
+	// "Server Side Copies:     5 @ 1.234 GiB", cumulative like the other stats
+	if idx := strings.Index(line, "Server Side "); idx >= 0 {
+		kind, value, ok := strings.Cut(line[idx+len("Server Side "):], ":")
+		if stats := strings.Fields(value); ok && len(stats) == 4 && stats[1] == "@" {
+			files, _ := strconv.ParseInt(stats[0], 10, 64)
+			size, _ := ParseSize(stats[2], stats[3])
+			if p.serverSide == nil {
+				p.serverSide = make(map[string]ServerSideStats)
+			}
+			p.serverSide[kind] = ServerSideStats{Bytes: size, Files: files}
+		}
+		return
+	}
+	idx := strings.Index(line, "Transferred:")
+	if idx < 0 {
+		return
+	}
+	stats := strings.Fields(line[idx+len("Transferred:"):])
+	if len(stats) < 2 {
+		return
+	}
+	// "Transferred:   1.2 GiB / 3.4 GiB, 35%, 10 MiB/s, ETA 3m" or "Transferred: 5 / 10, 50%"
+	if stats[1] == "/" {
+		if files, err := strconv.ParseInt(stats[0], 10, 64); err == nil {
+			p.files = files
+		}
+		return
+	}
+	if size, ok := ParseSize(stats[0], stats[1]); ok {
+		p.bytes = size
+		if speed, ok := parseSpeed(stats); ok {
+			statuses.AddSpeedSample(p.index, SpeedSample{Bytes: size, Speed: speed, Throttled: p.throttled > p.sampledThrottled})
+			p.sampledThrottled = p.throttled
+		}
+	}
+	if strings.Contains(line, "%") {
+		statuses.SetProgress(p.index, strings.Join(stats, " "))
+	}
+}
+
+func (p *ProgressWriter) countThrottled(line string) {
+	if !IsThrottled(line) {
+		return
+	}
+	p.throttled++
+	if wait := ParseRetryAfter(line); wait > p.retryAfter {
+		p.retryAfter = wait
+	}
+}
+
+// Throttled returns how many times the provider throttled requests and the longest it asked to wait
+func (p *ProgressWriter) Throttled() (int, time.Duration) {
+	return p.throttled, p.retryAfter
+}
+
+// Errors returns the last error lines logged by rclone
+func (p *ProgressWriter) Errors() []string {
+	return p.errors
+}
+
+// FailedFiles returns the files rclone reported as failed
+func (p *ProgressWriter) FailedFiles() []string {
+	return p.failed
+}
+
+// Bytes returns the bytes rclone reported as transferred
+func (p *ProgressWriter) Bytes() int64 {
+	return p.bytes
+}
+
+// Files returns the number of files rclone reported as transferred
+func (p *ProgressWriter) Files() int64 {
+	return p.files
+}
+
+// DryRunChanges returns the changes rclone reported it skipped because of --dry-run
+func (p *ProgressWriter) DryRunChanges() []string {
+	return p.dryRun
+}
+
+// Done adds the final totals to the status of the job
+func (p *ProgressWriter) Done() {
+	statuses.AddTransferred(p.index, p.bytes, p.files)
+	if stats := p.ServerSide(); stats.Files > 0 {
+		statuses.AddServerSide(p.index, stats)
+	}
+}
+
+// ServerSide returns what rclone copied or moved server-side
+func (p *ProgressWriter) ServerSide() ServerSideStats {
+	var total ServerSideStats
+	for _, stats := range p.serverSide {
+		total.Bytes += stats.Bytes
+		total.Files += stats.Files
+	}
+	return total
+}
+
+var sizeUnits = map[string]float64{
+	"B": 1, "Bytes": 1, "Byte": 1,
+	"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40, "PiB": 1 << 50,
+	"k": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40,
+	"KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12, "PB": 1e15,
+}
+
+// ParseSize parses a size printed by rclone such as "1.234 MiB"
+func ParseSize(value string, unit string) (int64, bool) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	multiplier, ok := sizeUnits[strings.TrimSuffix(unit, ",")]
+	if !ok {
+		return 0, false
+	}
+	return int64(n * multiplier), true
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestIsAutomatedTrigger(t *testing.T) {
+	tests := []struct {
+		trigger string
+		want    bool
+	}{
+		{TriggerManual, false},
+		{TriggerRetry, false},
+		{TriggerCLI, false},
+		{TriggerGRPC, false},
+		{TriggerSchedule, true},
+		{TriggerStartup, true},
+		{TriggerOnce, true},
+		{TriggerResume, true},
+		{TriggerHotplug, true},
+		{TriggerWatch, true},
+		{TriggerMQTT, true},
+		{TriggerStdin, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.trigger, func(t *testing.T) {
+			if got := IsAutomatedTrigger(tt.trigger); got != tt.want {
+				t.Errorf("IsAutomatedTrigger(%q) = %v, want %v", tt.trigger, got, tt.want)
+			}
+		})
+	}
+}
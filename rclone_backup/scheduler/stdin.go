@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// containerStdin is the stdin of the container, which the hassio.addon_stdin action writes to, services started by
+// s6 have their own stdin
+const containerStdin = "/proc/1/fd/0"
+
+// StdinCommand is a command sent with the hassio.addon_stdin action, either the name or index of a job to run or an
+// object with the job, the action and the overrides of the run
+type StdinCommand struct {
+	RunOverrides
+	Job    json.RawMessage `json:"job"`
+	Action string          `json:"action"` // run (the default) or cancel
+}
+
+// UnmarshalJSON accepts the name or index of a job on its own
+func (c *StdinCommand) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] != '{' {
+		c.Job = data
+		return nil
+	}
+	type command StdinCommand
+	return json.Unmarshal(data, (*command)(c))
+}
+
+// job returns the job a command refers to
+func (c *StdinCommand) job() (JobConfig, error) {
+	var ref string
+	if err := json.Unmarshal(c.Job, &ref); err != nil {
+		var index int
+		if err := json.Unmarshal(c.Job, &index); err != nil {
+			return JobConfig{}, errors.New("job must be the name or index of a job")
+		}
+		ref = strconv.Itoa(index)
+	}
+	job, ok := FindJob(ref)
+	if !ok {
+		return JobConfig{}, fmt.Errorf("job '%s' not found", ref)
+	}
+	return job, nil
+}
+
+// ListenStdin runs the jobs named in the commands written to the addon's stdin, so automations can run a job with
+// the hassio.addon_stdin action
+func ListenStdin() {
+	stdin := os.Stdin
+	if os.Getpid() != 1 {
+		file, err := os.Open(containerStdin)
+		if err != nil {
+			Debugln("not reading commands from stdin:", err)
+			return
+		}
+		stdin = file
+	}
+	go func() {
+		decoder := json.NewDecoder(stdin)
+		for {
+			var command StdinCommand
+			err := decoder.Decode(&command)
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) {
+				// skip the rest of the invalid input
+				Warnln("invalid command on stdin:", err)
+				decoder = json.NewDecoder(stdin)
+				continue
+			} else if errors.As(err, &typeErr) {
+				Warnln("invalid command on stdin:", err)
+				continue
+			} else if err != nil {
+				Errorln("stopped reading commands from stdin:", err)
+				return
+			}
+			if err := RunStdinCommand(command); err != nil {
+				Warnln("stdin:", err)
+			}
+		}
+	}()
+}
+
+// RunStdinCommand runs or cancels the job of a command
+func RunStdinCommand(command StdinCommand) error {
+	job, err := command.job()
+	if err != nil {
+		return err
+	}
+	switch command.Action {
+	case "", "run":
+		job, err = command.RunOverrides.Apply(job)
+		if err != nil {
+			return err
+		}
+		Infoln("running", "'"+job.Name+"'", "requested by an automation")
+		job.Trigger = TriggerStdin
+		// queued like scheduled runs, so it waits for jobs using the same destination and the worker limits
+		go SkipIfPaused(job, runQueue.Task(job, RunTracked))()
+	case "cancel":
+		if !statuses.Cancel(job.Index) {
+			return fmt.Errorf("'%s' is not running", job.Name)
+		}
+		Infoln("cancelled", "'"+job.Name+"'", "as requested by an automation")
+	default:
+		return fmt.Errorf("unknown action '%s', must be run or cancel", command.Action)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+)
+
+// rcloneFatalExitCodes are rclone exit codes that are never tolerated by max_errors, they can still be listed in exit_codes
+var rcloneFatalExitCodes = []int{2, 7, 8} // syntax or usage error, fatal error, transfer limit reached
+
+// SuccessConfig are the rules for when a failed rclone run still counts as a success
+type SuccessConfig struct {
+	ExitCodes []int `yaml:"exit_codes"` // rclone exit codes treated as success, e.g. 9 for no files transferred
+	MaxErrors int   `yaml:"max_errors"` // number of files that may fail before the run fails
+}
+
+// CheckSuccess validates the success rules of a job
+func CheckSuccess(job JobConfig) error {
+	for _, code := range job.Success.ExitCodes {
+		if code < 1 || code > 255 {
+			return fmt.Errorf("invalid success exit code %d", code)
+		}
+	}
+	if job.Success.MaxErrors < 0 {
+		return fmt.Errorf("success max_errors must not be negative")
+	}
+	// failed files are only kept up to this number, so more could not be counted
+	if job.Success.MaxErrors >= MaxFailedFiles {
+		return fmt.Errorf("success max_errors must be less than %d", MaxFailedFiles)
+	}
+	return nil
+}
+
+// ToleratedFailure reports whether a failed rclone run counts as a success under the success rules of the job,
+// a run with more failed files than max_errors always fails
+func ToleratedFailure(job JobConfig, err error, failed []string) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || len(failed) > job.Success.MaxErrors {
+		return false
+	}
+	code := exitErr.ExitCode()
+	if slices.Contains(job.Success.ExitCodes, code) {
+		return true
+	}
+	return len(failed) > 0 && !slices.Contains(rcloneFatalExitCodes, code)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var paramPattern = regexp.MustCompile(`\{\{\s*param\.([A-Za-z0-9_]+)\s*\}\}`)
+
+// ResolveTemplate merges the job's template into the job, job values take precedence
+// and "{{param.name}}" placeholders are replaced with the job's params
+func ResolveTemplate(job JobConfig, templates []JobConfig) (JobConfig, error) {
+	if job.Template == "" {
+		return job, nil
+	}
+	var tmpl *JobConfig
+	for i := range templates {
+		if templates[i].Name == job.Template {
+			tmpl = &templates[i]
+			break
+		}
+	}
+	if tmpl == nil {
+		return job, fmt.Errorf("template '%s' does not exist", job.Template)
+	}
+
+	return SubstituteParams(MergeJob(job, *tmpl))
+}
+
+// MergeJob fills the options not set on the job from base, flags are merged and
+// extra_flags of the job are appended to those of base
+func MergeJob(job JobConfig, base JobConfig) JobConfig {
+	if job.Schedule == "" {
+		job.Schedule = base.Schedule
+	}
+	if job.Command == "" {
+		job.Command = base.Command
+	}
+	if job.Run == "" {
+		job.Run = base.Run
+	}
+	if job.Source == "" && len(job.Sources) == 0 {
+		job.Source = base.Source
+		job.Sources = base.Sources
+	}
+	if job.Destination == "" && len(job.Destinations) == 0 {
+		job.Destination = base.Destination
+		job.Destinations = base.Destinations
+	}
+	if len(job.Steps) == 0 {
+		job.Steps = base.Steps
+	}
+	if !job.Versioning.Enabled {
+		job.Versioning = base.Versioning
+	}
+	if !job.Trash.Enabled {
+		job.Trash = base.Trash
+	}
+	if len(job.Dumps) == 0 {
+		job.Dumps = base.Dumps
+	}
+	if job.Engine == "" {
+		job.Engine = base.Engine
+		job.Restic = base.Restic
+		job.Borg = base.Borg
+		job.Snapshot = base.Snapshot
+	}
+	if job.Compress == (CompressConfig{}) {
+		job.Compress = base.Compress
+	}
+	if job.S3.StorageClass == "" && len(job.S3.Tags) == 0 && job.S3.RestoreDays == 0 && job.S3.RestorePriority == "" && job.S3.RestoreTimeout == "" {
+		job.S3 = base.S3
+	}
+	if job.Notify == nil {
+		job.Notify = base.Notify
+	}
+	if len(job.Include) == 0 {
+		job.Include = base.Include
+	}
+	if len(job.Exclude) == 0 {
+		job.Exclude = base.Exclude
+	}
+	job.NoVolatileExcludes = job.NoVolatileExcludes || base.NoVolatileExcludes
+	job.Manifest = job.Manifest || base.Manifest
+	job.ServerSideAcrossConfigs = job.ServerSideAcrossConfigs || base.ServerSideAcrossConfigs
+	job.ResumeInterrupted = job.ResumeInterrupted || base.ResumeInterrupted
+	if job.Shards == 0 {
+		job.Shards = base.Shards
+	}
+	if job.Bind == "" {
+		job.Bind = base.Bind
+	}
+	if job.VPN == (VPNConfig{}) {
+		job.VPN = base.VPN
+	}
+	if job.Wake == (WakeConfig{}) {
+		job.Wake = base.Wake
+	}
+	if !job.Watch.Enabled {
+		job.Watch = base.Watch
+	}
+	if job.MQTT == (MQTTTrigger{}) {
+		job.MQTT = base.MQTT
+	}
+	if job.MaxAge == "" {
+		job.MaxAge = base.MaxAge
+	}
+	if job.MaxDelete == "" {
+		job.MaxDelete = base.MaxDelete
+	}
+	if len(job.Success.ExitCodes) == 0 && job.Success.MaxErrors == 0 {
+		job.Success = base.Success
+	}
+	if job.ExpectedDuration == "" {
+		job.ExpectedDuration = base.ExpectedDuration
+		job.OverdueFactor = base.OverdueFactor
+	}
+	if job.SizeAnomaly == 0 {
+		job.SizeAnomaly = base.SizeAnomaly
+	}
+	if job.MinSourceSize == "" {
+		job.MinSourceSize = base.MinSourceSize
+	}
+	if job.MinSourceFiles == 0 {
+		job.MinSourceFiles = base.MinSourceFiles
+	}
+	if job.RestoreRecent == 0 {
+		job.RestoreRecent = base.RestoreRecent
+	}
+	// params of the template are defaults for the params of its jobs
+	if len(base.Params) > 0 {
+		params := Flags{}
+		for key, value := range base.Params {
+			params[key] = value
+		}
+		for key, value := range job.Params {
+			params[key] = value
+		}
+		job.Params = params
+	}
+	flags := Flags{}
+	for key, value := range base.Flags {
+		flags[key] = value
+	}
+	for key, value := range job.Flags {
+		flags[key] = value
+	}
+	job.Flags = flags
+	job.ExtraFlags = append(append([]string{}, base.ExtraFlags...), job.ExtraFlags...)
+
+	return job
+}
+
+// SubstituteParams replaces param placeholders in every string field of the job
+func SubstituteParams(job JobConfig) (JobConfig, error) {
+	var err error
+	job = MapJobStrings(job, func(s string) string {
+		return paramPattern.ReplaceAllStringFunc(s, func(m string) string {
+			name := paramPattern.FindStringSubmatch(m)[1]
+			value, ok := job.Params[name]
+			if !ok {
+				if err == nil {
+					err = fmt.Errorf("template '%s' references undefined param '%s'", job.Template, name)
+				}
+				return m
+			}
+			return value
+		})
+	})
+	return job, err
+}
+
+// MapJobStrings applies fn to every user-defined string field of the job
+func MapJobStrings(job JobConfig, fn func(string) string) JobConfig {
+	mapAll := func(list []string) []string {
+		if list == nil {
+			return nil
+		}
+		out := make([]string, len(list))
+		for i, s := range list {
+			out[i] = fn(s)
+		}
+		return out
+	}
+
+	job.Name = fn(job.Name)
+	job.Schedule = fn(job.Schedule)
+	job.Command = fn(job.Command)
+	job.Run = fn(job.Run)
+	job.Source = fn(job.Source)
+	job.Sources = mapAll(job.Sources)
+	job.Destination = fn(job.Destination)
+	job.Bind = fn(job.Bind)
+	job.Destinations = mapAll(job.Destinations)
+	job.Include = mapAll(job.Include)
+	job.Exclude = mapAll(job.Exclude)
+	job.ExtraFlags = mapAll(job.ExtraFlags)
+	job.Versioning.Path = fn(job.Versioning.Path)
+	job.Trash.Path = fn(job.Trash.Path)
+	if job.Dumps != nil {
+		dumps := make([]DumpConfig, len(job.Dumps))
+		for i, dump := range job.Dumps {
+			dump.Host = fn(dump.Host)
+			dump.User = fn(dump.User)
+			dump.Password = fn(dump.Password)
+			dump.Token = fn(dump.Token)
+			dump.Path = fn(dump.Path)
+			dump.Databases = mapAll(dump.Databases)
+			dumps[i] = dump
+		}
+		job.Dumps = dumps
+	}
+	job.Compress.Name = fn(job.Compress.Name)
+	job.Compress.Staging = fn(job.Compress.Staging)
+	job.Flags = mapFlags(job.Flags, fn)
+	job.S3.Tags = mapFlags(job.S3.Tags, fn)
+	job.Restic.Repository = fn(job.Restic.Repository)
+	job.Restic.Password = fn(job.Restic.Password)
+	job.Restic.PasswordFile = fn(job.Restic.PasswordFile)
+	job.Restic.Tags = mapAll(job.Restic.Tags)
+	job.Borg.Repository = fn(job.Borg.Repository)
+	job.Borg.Passphrase = fn(job.Borg.Passphrase)
+	job.Borg.PassphraseFile = fn(job.Borg.PassphraseFile)
+	job.Borg.SSHKey = fn(job.Borg.SSHKey)
+	job.Borg.Borgmatic = fn(job.Borg.Borgmatic)
+	job.VPN.Interface = fn(job.VPN.Interface)
+	job.VPN.Host = fn(job.VPN.Host)
+	job.VPN.Entity = fn(job.VPN.Entity)
+	job.VPN.Up = fn(job.VPN.Up)
+	job.VPN.Down = fn(job.VPN.Down)
+	job.Wake.MAC = fn(job.Wake.MAC)
+	job.Wake.Broadcast = fn(job.Wake.Broadcast)
+	job.Wake.Host = fn(job.Wake.Host)
+	job.Wake.Remote = fn(job.Wake.Remote)
+	job.Wake.Shutdown = fn(job.Wake.Shutdown)
+	job.Watch.Paths = mapAll(job.Watch.Paths)
+	job.MQTT.Topic = fn(job.MQTT.Topic)
+	if job.Steps != nil {
+		steps := make([]StepConfig, len(job.Steps))
+		for i, step := range job.Steps {
+			step.Name = fn(step.Name)
+			step.Command = fn(step.Command)
+			step.Run = fn(step.Run)
+			step.Source = fn(step.Source)
+			step.Destination = fn(step.Destination)
+			step.Include = mapAll(step.Include)
+			step.Exclude = mapAll(step.Exclude)
+			step.ExtraFlags = mapAll(step.ExtraFlags)
+			step.Flags = mapFlags(step.Flags, fn)
+			step.Compress.Name = fn(step.Compress.Name)
+			step.Compress.Staging = fn(step.Compress.Staging)
+			steps[i] = step
+		}
+		job.Steps = steps
+	}
+	return job
+}
+
+func mapFlags(flags Flags, fn func(string) string) Flags {
+	out := make(Flags, len(flags))
+	for key, value := range flags {
+		out[key] = fn(value)
+	}
+	return out
+}
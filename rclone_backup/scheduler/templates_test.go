@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeJob(t *testing.T) {
+	base := JobConfig{
+		Name:           "base",
+		Schedule:       "0 3 * * *",
+		Command:        "sync",
+		Source:         "/backup",
+		Flags:          Flags{"transfers": "4", "checkers": "8"},
+		ExtraFlags:     []string{"--fast-list"},
+		Dumps:          []DumpConfig{{Type: "sqlite", Path: "/config/home-assistant_v2.db"}},
+		Notify:         &NotifyConfig{Notifiers: []string{"phone"}},
+		SizeAnomaly:    50,
+		MinSourceSize:  "1G",
+		MinSourceFiles: 10,
+		RestoreRecent:  3,
+		Params:         Flags{"bucket": "default", "folder": "backups"},
+	}
+	tests := []struct {
+		name  string
+		job   JobConfig
+		check func(t *testing.T, job JobConfig)
+	}{
+		{"fills unset options", JobConfig{Name: "job"}, func(t *testing.T, job JobConfig) {
+			if job.Schedule != base.Schedule || job.Command != base.Command || job.Source != base.Source {
+				t.Errorf("schedule, command or source not taken from base: %+v", job)
+			}
+			if len(job.Dumps) != 1 || job.Notify != base.Notify {
+				t.Errorf("dumps or notify not taken from base")
+			}
+			if job.SizeAnomaly != 50 || job.MinSourceSize != "1G" || job.MinSourceFiles != 10 || job.RestoreRecent != 3 {
+				t.Errorf("source checks not taken from base: %+v", job)
+			}
+		}},
+		{"job values take precedence", JobConfig{Name: "job", Schedule: "@hourly", Source: "/share", SizeAnomaly: 20, RestoreRecent: 1}, func(t *testing.T, job JobConfig) {
+			if job.Schedule != "@hourly" || job.Source != "/share" || job.SizeAnomaly != 20 || job.RestoreRecent != 1 {
+				t.Errorf("job values were replaced: %+v", job)
+			}
+		}},
+		{"sources replace source", JobConfig{Name: "job", Sources: []string{"/a", "/b"}}, func(t *testing.T, job JobConfig) {
+			if job.Source != "" || !reflect.DeepEqual(job.Sources, []string{"/a", "/b"}) {
+				t.Errorf("source = %q, sources = %v", job.Source, job.Sources)
+			}
+		}},
+		{"flags are merged", JobConfig{Name: "job", Flags: Flags{"transfers": "1"}, ExtraFlags: []string{"-v"}}, func(t *testing.T, job JobConfig) {
+			if !reflect.DeepEqual(job.Flags, Flags{"transfers": "1", "checkers": "8"}) {
+				t.Errorf("flags = %v", job.Flags)
+			}
+			if !reflect.DeepEqual(job.ExtraFlags, []string{"--fast-list", "-v"}) {
+				t.Errorf("extra flags = %v", job.ExtraFlags)
+			}
+		}},
+		{"params are defaults", JobConfig{Name: "job", Params: Flags{"bucket": "mine"}}, func(t *testing.T, job JobConfig) {
+			if !reflect.DeepEqual(job.Params, Flags{"bucket": "mine", "folder": "backups"}) {
+				t.Errorf("params = %v", job.Params)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.check(t, MergeJob(tt.job, base))
+		})
+	}
+	if base.Params["bucket"] != "default" || base.Flags["transfers"] != "4" {
+		t.Errorf("base was modified: %+v", base)
+	}
+}
+
+func TestSubstituteParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		job     JobConfig
+		want    JobConfig
+		wantErr bool
+	}{
+		{
+			name: "replaces params",
+			job:  JobConfig{Destination: "b2:{{param.bucket}}/{{ param.folder }}", Flags: Flags{"bwlimit": "{{param.limit}}"}, Params: Flags{"bucket": "mine", "folder": "ha", "limit": "1M"}},
+			want: JobConfig{Destination: "b2:mine/ha", Flags: Flags{"bwlimit": "1M"}, Params: Flags{"bucket": "mine", "folder": "ha", "limit": "1M"}},
+		},
+		{
+			name: "leaves other placeholders",
+			job:  JobConfig{Run: "docker ps --format '{{.Names}}'", Destination: "{{var.remote}}:backups"},
+			want: JobConfig{Run: "docker ps --format '{{.Names}}'", Destination: "{{var.remote}}:backups"},
+		},
+		{
+			name:    "undefined param",
+			job:     JobConfig{Template: "cloud", Destination: "b2:{{param.bucket}}"},
+			want:    JobConfig{Template: "cloud", Destination: "b2:{{param.bucket}}"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SubstituteParams(tt.job)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got.Destination != tt.want.Destination || got.Run != tt.want.Run {
+				t.Errorf("destination = %q, run = %q, want %q and %q", got.Destination, got.Run, tt.want.Destination, tt.want.Run)
+			}
+			if len(got.Flags) != len(tt.want.Flags) || (len(got.Flags) > 0 && !reflect.DeepEqual(got.Flags, tt.want.Flags)) {
+				t.Errorf("flags = %v, want %v", got.Flags, tt.want.Flags)
+			}
+		})
+	}
+}
+
+func TestSubstituteParamsOptions(t *testing.T) {
+	job := JobConfig{
+		Template: "cloud",
+		Params:   Flags{"repo": "b2:restic", "host": "nas"},
+		Restic:   ResticConfig{Repository: "rclone:{{param.repo}}", PasswordFile: "/ssl/{{param.host}}.pass"},
+		Borg:     BorgConfig{Repository: "ssh://{{param.host}}/borg", Borgmatic: "/config/{{param.host}}.yaml"},
+		Watch:    WatchConfig{Paths: []string{"/share/{{param.host}}"}},
+		MQTT:     MQTTTrigger{Topic: "backup/{{param.host}}/run"},
+		S3:       S3Config{Tags: Flags{"host": "{{param.host}}"}},
+		VPN:      VPNConfig{Up: "wg-quick up {{param.host}}", Down: "wg-quick down {{param.host}}"},
+		Wake:     WakeConfig{Host: "{{param.host}}:445", Shutdown: "ssh {{param.host}} poweroff"},
+	}
+	got, err := SubstituteParams(job)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	fields := map[string][2]string{
+		"restic.repository":    {got.Restic.Repository, "rclone:b2:restic"},
+		"restic.password_file": {got.Restic.PasswordFile, "/ssl/nas.pass"},
+		"borg.repository":      {got.Borg.Repository, "ssh://nas/borg"},
+		"borg.borgmatic":       {got.Borg.Borgmatic, "/config/nas.yaml"},
+		"watch.paths":          {strings.Join(got.Watch.Paths, ","), "/share/nas"},
+		"mqtt.topic":           {got.MQTT.Topic, "backup/nas/run"},
+		"s3.tags":              {got.S3.Tags["host"], "nas"},
+		"vpn.up":               {got.VPN.Up, "wg-quick up nas"},
+		"vpn.down":             {got.VPN.Down, "wg-quick down nas"},
+		"wake.host":            {got.Wake.Host, "nas:445"},
+		"wake.shutdown":        {got.Wake.Shutdown, "ssh nas poweroff"},
+	}
+	for name, field := range fields {
+		if field[0] != field[1] {
+			t.Errorf("%s = %q, want %q", name, field[0], field[1])
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultThrottleMinTPSLimit   = 1
+	DefaultThrottleStartTPSLimit = 10
+	DefaultThrottleRetries       = 2
+	DefaultThrottleMaxWait       = "15m"
+	// throttleCleanRuns is how many runs in a row have to pass without throttling before the pace is raised again
+	throttleCleanRuns = 3
+	// throttleRetryDelay is how long to wait before retrying when the provider didn't say, doubled on each retry
+	throttleRetryDelay = time.Minute
+)
+
+var PacingPath = filepath.Join(DataPath, "pacing.json")
+
+// throttlePatterns are the responses of providers slowing clients down, OneDrive and SharePoint answer with
+// 429 or 503 and a Retry-After header, Google with rate limit errors
+var throttlePatterns = []string{
+	"too many requests", "503 service unavailable", "serviceunavailable", "activitylimitreached",
+	"throttledrequest", "throttled", "rate limit", "ratelimitexceeded", "retry-after", "trying again in",
+}
+
+// retryAfter matches how long a provider asked to wait, "Retry-After: 120" or "Trying again in 23 seconds"
+var retryAfter = regexp.MustCompile(`(?i)(?:retry-after"?:?\s*"?|trying again in\s+)(\d+)`)
+
+// ThrottleConfig retries runs the provider throttled and lowers the pace of remotes that keep throttling
+type ThrottleConfig struct {
+	Enabled       bool
+	MinTPSLimit   float64 `yaml:"min_tpslimit"`   // the pace is never lowered below this
+	StartTPSLimit float64 `yaml:"start_tpslimit"` // the pace of a throttled remote without a tpslimit, halved from here
+	Retries       int     // retries of a run that failed because of throttling
+	MaxWait       string  `yaml:"max_wait"` // longest Retry-After waited for before a retry
+}
+
+// RemotePace is the transactions per second a throttled remote is limited to
+type RemotePace struct {
+	Remote    string    `json:"remote"`
+	TPSLimit  float64   `json:"tpslimit"`
+	Throttled int       `json:"throttled"`  // runs throttled in a row
+	CleanRuns int       `json:"clean_runs"` // runs without throttling since the pace was last changed
+	Updated   time.Time `json:"updated"`
+}
+
+// Pacing keeps the adaptive pace of each remote, so a remote that throttled last night starts slower tonight
+type Pacing struct {
+	mu      sync.Mutex
+	remotes map[string]*RemotePace
+}
+
+var pacing = &Pacing{remotes: make(map[string]*RemotePace)}
+
+func CheckThrottle() error {
+	t := config.Throttle
+	if t.MinTPSLimit < 0 || t.StartTPSLimit < 0 || t.Retries < 0 {
+		return errors.New("throttle: limits can't be negative")
+	}
+	if t.MaxWait != "" {
+		if _, err := time.ParseDuration(t.MaxWait); err != nil {
+			return fmt.Errorf("throttle: invalid max_wait '%s'", t.MaxWait)
+		}
+	}
+	return nil
+}
+
+func throttleMinTPSLimit() float64 {
+	if config.Throttle.MinTPSLimit > 0 {
+		return config.Throttle.MinTPSLimit
+	}
+	return DefaultThrottleMinTPSLimit
+}
+
+func throttleStartTPSLimit() float64 {
+	if config.Throttle.StartTPSLimit > 0 {
+		return config.Throttle.StartTPSLimit
+	}
+	return DefaultThrottleStartTPSLimit
+}
+
+func throttleRetries() int {
+	if config.Throttle.Retries > 0 {
+		return config.Throttle.Retries
+	}
+	return DefaultThrottleRetries
+}
+
+func throttleMaxWait() time.Duration {
+	if wait, err := time.ParseDuration(config.Throttle.MaxWait); err == nil && wait > 0 {
+		return wait
+	}
+	wait, _ := time.ParseDuration(DefaultThrottleMaxWait)
+	return wait
+}
+
+// IsThrottled reports whether an rclone log line is a provider throttling requests
+func IsThrottled(line string) bool {
+	line = strings.ToLower(line)
+	for _, pattern := range throttlePatterns {
+		if strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRetryAfter returns how long a throttled log line asks to wait, or 0 if it doesn't say
+func ParseRetryAfter(line string) time.Duration {
+	match := retryAfter.FindStringSubmatch(line)
+	if match == nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Load reads the pace of the remotes from disk
+func (p *Pacing) Load() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, err := os.ReadFile(PacingPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &p.remotes)
+}
+
+func (p *Pacing) save() {
+	data, err := json.Marshal(p.remotes)
+	if err == nil {
+		err = os.WriteFile(PacingPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save remote pacing:", err)
+	}
+}
+
+// TPSLimit returns the adaptive pace of a remote, or 0 when it isn't limited
+func (p *Pacing) TPSLimit(remote string) float64 {
+	if !config.Throttle.Enabled || remote == "" {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pace, ok := p.remotes[remote]; ok {
+		return pace.TPSLimit
+	}
+	return 0
+}
+
+// AdaptiveTPSLimit returns the lowest adaptive pace of the remotes of a command, or 0 when none is limited
+func AdaptiveTPSLimit(paths ...string) float64 {
+	lowest := 0.0
+	for _, path := range paths {
+		if tps := pacing.TPSLimit(trafficRemote(path)); tps > 0 && (lowest == 0 || tps < lowest) {
+			lowest = tps
+		}
+	}
+	return lowest
+}
+
+// configuredTPSLimit returns the tpslimit of a remote from the remotes option
+func configuredTPSLimit(remote string) float64 {
+	if r := RemoteConfigOf(remote); r != nil {
+		return r.TPSLimit
+	}
+	return 0
+}
+
+// Record lowers the pace of the remotes of a run that was throttled, and raises it again after a few runs that
+// weren't until the remote is back to its configured tpslimit
+func (p *Pacing) Record(job JobConfig, source string, destination string, throttled int) {
+	if !config.Throttle.Enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	for _, remote := range []string{trafficRemote(source), trafficRemote(destination)} {
+		if remote == "" {
+			continue
+		}
+		pace, ok := p.remotes[remote]
+		configured := configuredTPSLimit(remote)
+		if throttled > 0 {
+			if !ok {
+				pace = &RemotePace{Remote: remote, TPSLimit: configured}
+				if pace.TPSLimit <= 0 {
+					pace.TPSLimit = throttleStartTPSLimit()
+				}
+				p.remotes[remote] = pace
+			}
+			pace.TPSLimit = math.Max(throttleMinTPSLimit(), pace.TPSLimit/2)
+			pace.Throttled++
+			pace.CleanRuns = 0
+			pace.Updated = time.Now()
+			msg := fmt.Sprintf("%s was throttled %d times, lowering its pace to %s transactions per second", remote, throttled, strconv.FormatFloat(pace.TPSLimit, 'f', -1, 64))
+			Warnln(msg)
+			statuses.AddWarning(job.Index, msg)
+			changed = true
+			continue
+		}
+		if !ok {
+			continue
+		}
+		pace.Throttled = 0
+		pace.CleanRuns++
+		changed = true
+		if pace.CleanRuns < throttleCleanRuns {
+			continue
+		}
+		pace.TPSLimit *= 1.5
+		pace.CleanRuns = 0
+		pace.Updated = time.Now()
+		limit := configured
+		if limit <= 0 {
+			limit = throttleStartTPSLimit()
+		}
+		if pace.TPSLimit >= limit {
+			Infoln(remote, "hasn't throttled for", throttleCleanRuns, "runs, back to its normal pace")
+			delete(p.remotes, remote)
+		} else {
+			Infoln(remote, "hasn't throttled for", throttleCleanRuns, "runs, raising its pace to", strconv.FormatFloat(pace.TPSLimit, 'f', 2, 64), "transactions per second")
+		}
+	}
+	if changed {
+		p.save()
+	}
+}
+
+// List returns the pace of every throttled remote
+func (p *Pacing) List() []RemotePace {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]RemotePace, 0, len(p.remotes))
+	for _, pace := range p.remotes {
+		list = append(list, *pace)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Remote < list[j].Remote })
+	return list
+}
+
+// Reset removes the adaptive pace of a remote, returning false if it isn't limited
+func (p *Pacing) Reset(remote string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.remotes[remote]; !ok {
+		return false
+	}
+	delete(p.remotes, remote)
+	p.save()
+	return true
+}
+
+// WaitForThrottle waits for as long as the provider asked before a throttled run is retried, reporting false when
+// the run shouldn't be retried
+func WaitForThrottle(ctx context.Context, job JobConfig, err error, attempt int) bool {
+	if !config.Throttle.Enabled || ErrorClass(err) != ErrorClassRateLimit || IsDriveUploadLimit(err) || attempt >= throttleRetries() {
+		return false
+	}
+	wait := throttleRetryDelay << attempt
+	var rcloneErr *RcloneError
+	if errors.As(err, &rcloneErr) && rcloneErr.RetryAfter > 0 {
+		wait = rcloneErr.RetryAfter
+	}
+	if wait > throttleMaxWait() {
+		Warnln("the provider asked to wait", FormatDuration(wait)+",", "longer than max_wait, not retrying", "'"+job.Name+"'")
+		return false
+	}
+	at := time.Now().Add(wait)
+	Warnln("'"+job.Name+"'", "was throttled, retrying at", at.Local().Format("15:04:05"))
+	statuses.SetProgress(job.Index, "throttled, retrying at "+at.Local().Format("15:04:05"))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
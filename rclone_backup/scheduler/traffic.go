@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxTrafficDays is how long the daily traffic of remotes is kept, long enough to compare a year of invoices
+const MaxTrafficDays = 400
+
+var TrafficPath = filepath.Join(DataPath, "traffic.json")
+
+// RemoteTraffic is the data uploaded to and downloaded from a remote in a day or a month
+type RemoteTraffic struct {
+	Remote          string `json:"remote"`
+	Period          string `json:"period"` // "2006-01-02" or "2006-01"
+	Uploaded        int64  `json:"uploaded"`
+	Downloaded      int64  `json:"downloaded"`
+	UploadedFiles   int64  `json:"uploaded_files"`
+	DownloadedFiles int64  `json:"downloaded_files"`
+}
+
+type dailyTraffic struct {
+	Uploaded        int64 `json:"uploaded"`
+	Downloaded      int64 `json:"downloaded"`
+	UploadedFiles   int64 `json:"uploaded_files,omitempty"`
+	DownloadedFiles int64 `json:"downloaded_files,omitempty"`
+}
+
+// TrafficStore counts the bytes rclone transferred from and to each remote per day
+type TrafficStore struct {
+	mu   sync.Mutex
+	days map[string]map[string]*dailyTraffic // remote, then local day
+}
+
+var traffic = &TrafficStore{days: make(map[string]map[string]*dailyTraffic)}
+
+// trafficRemote returns the remote of a path or connection string, or "" for a local path
+func trafficRemote(path string) string {
+	i := strings.Index(path, ":")
+	if i <= 0 || strings.HasPrefix(path, "/") {
+		return ""
+	}
+	name := path[:i]
+	if j := strings.Index(name, ","); j >= 0 {
+		name = name[:j]
+	}
+	return name + ":"
+}
+
+// Load reads the traffic of the remotes from disk
+func (s *TrafficStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(TrafficPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.days)
+}
+
+func (s *TrafficStore) save() {
+	cutoff := time.Now().AddDate(0, 0, -MaxTrafficDays).Format(time.DateOnly)
+	for _, days := range s.days {
+		for day := range days {
+			if day < cutoff {
+				delete(days, day)
+			}
+		}
+	}
+	data, err := json.Marshal(s.days)
+	if err == nil {
+		err = os.WriteFile(TrafficPath, data, 0644)
+	}
+	if err != nil {
+		Errorln("failed to save remote traffic:", err)
+	}
+}
+
+// Add counts the bytes of a finished transfer as downloaded from the remote of the source and uploaded to the
+// remote of the destination, a transfer between two remotes counts for both
+func (s *TrafficStore) Add(source string, destination string, bytes int64, files int64) {
+	from, to := trafficRemote(source), trafficRemote(destination)
+	if bytes <= 0 || (from == "" && to == "") {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := time.Now().Format(time.DateOnly)
+	get := func(remote string) *dailyTraffic {
+		if s.days[remote] == nil {
+			s.days[remote] = make(map[string]*dailyTraffic)
+		}
+		if s.days[remote][day] == nil {
+			s.days[remote][day] = &dailyTraffic{}
+		}
+		return s.days[remote][day]
+	}
+	if from != "" {
+		get(from).Downloaded += bytes
+		get(from).DownloadedFiles += files
+	}
+	if to != "" {
+		get(to).Uploaded += bytes
+		get(to).UploadedFiles += files
+	}
+	s.save()
+}
+
+// List returns the traffic of each remote per day, or per month when monthly, newest first
+func (s *TrafficStore) List(remote string, monthly bool) []RemoteTraffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if remote != "" && !strings.HasSuffix(remote, ":") {
+		remote += ":"
+	}
+	totals := make(map[[2]string]*RemoteTraffic)
+	for name, days := range s.days {
+		if remote != "" && name != remote {
+			continue
+		}
+		for day, counted := range days {
+			period := day
+			if monthly {
+				period = day[:len("2006-01")]
+			}
+			key := [2]string{name, period}
+			if totals[key] == nil {
+				totals[key] = &RemoteTraffic{Remote: name, Period: period}
+			}
+			totals[key].Uploaded += counted.Uploaded
+			totals[key].Downloaded += counted.Downloaded
+			totals[key].UploadedFiles += counted.UploadedFiles
+			totals[key].DownloadedFiles += counted.DownloadedFiles
+		}
+	}
+	list := make([]RemoteTraffic, 0, len(totals))
+	for _, total := range totals {
+		list = append(list, *total)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Remote != list[j].Remote {
+			return list[i].Remote < list[j].Remote
+		}
+		return list[i].Period > list[j].Period
+	})
+	return list
+}
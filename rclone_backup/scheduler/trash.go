@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcwillox/emerald"
+)
+
+// DefaultTrashExpiry is how long trashed files are kept when the job doesn't set an expiry
+const DefaultTrashExpiry = "30d"
+
+var ErrNotInTrash = errors.New("not in the trash")
+
+// TrashConfig moves files a sync deletes, and versions pruned by the retention, into a timestamped
+// folder on the remote instead of deleting them, until they expire
+type TrashConfig struct {
+	Enabled bool
+	Path    string
+	Expiry  string
+}
+
+// TrashEntry is a folder of files trashed by one run, laid out like the destination they were removed from
+type TrashEntry struct {
+	Destination string    `json:"destination"`
+	Entry       string    `json:"entry"`
+	Trashed     time.Time `json:"trashed"`
+	Expires     time.Time `json:"expires"`
+	Files       []string  `json:"files,omitempty"`
+}
+
+// TrashRestore is the body of a request to restore files from the trash
+type TrashRestore struct {
+	Destination string `json:"destination"` // defaults to the only destination of the job
+	Entry       string `json:"entry"`
+	Path        string `json:"path"` // a file or folder in the entry, the whole entry when empty
+}
+
+func CheckTrash(job JobConfig) error {
+	if !job.Trash.Enabled {
+		return nil
+	}
+	if len(job.Destinations) == 0 {
+		return fmt.Errorf("trash requires a destination")
+	}
+	if job.Trash.Expiry != "" {
+		if _, err := ParseAge(job.Trash.Expiry); err != nil {
+			return fmt.Errorf("trash expiry: %w", err)
+		}
+	}
+	return nil
+}
+
+// TrashPath returns the trash of a destination, by default a sibling of the destination so the two don't overlap
+func TrashPath(job JobConfig, destination string) string {
+	if job.Trash.Path != "" {
+		return strings.TrimSuffix(job.Trash.Path, "/")
+	}
+	return strings.TrimSuffix(destination, "/") + ".trash"
+}
+
+func trashExpiry(job JobConfig) time.Duration {
+	if job.Trash.Expiry != "" {
+		if expiry, err := ParseAge(job.Trash.Expiry); err == nil {
+			return expiry
+		}
+	}
+	expiry, _ := ParseAge(DefaultTrashExpiry)
+	return expiry
+}
+
+// JobDestinations returns every destination the runs of a job write to, in the same layout as runTargets
+func JobDestinations(job JobConfig) []string {
+	job, err := ExpandJob(job, time.Now())
+	if err != nil {
+		return job.Destinations
+	}
+	if len(job.Sources) <= 1 {
+		return job.Destinations
+	}
+	var destinations []string
+	for _, destination := range job.Destinations {
+		for _, source := range job.Sources {
+			destinations = append(destinations, destination+source)
+		}
+	}
+	return destinations
+}
+
+// TrashVersion moves a version folder pruned by the retention into the trash of the destination
+func TrashVersion(ctx context.Context, job JobConfig, destination string, version string) error {
+	trash := TrashPath(job, destination) + "/" + time.Now().Format(DefaultDateLayout)
+	if out, err := exec.CommandContext(ctx, RcloneBinary(), "move", version, trash).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	// only removes the folders the move left empty
+	return exec.CommandContext(ctx, RcloneBinary(), "rmdirs", version).Run()
+}
+
+// PruneTrash purges the folders in the trash of a destination that are older than the expiry
+func PruneTrash(ctx context.Context, job JobConfig, destination string) {
+	entries, err := ListTrash(ctx, job, destination)
+	if err != nil {
+		Errorln("failed to list trash at", TrashPath(job, destination)+":", err)
+		return
+	}
+	pruned := 0
+	for _, entry := range entries {
+		if entry.Expires.After(time.Now()) {
+			continue
+		}
+		dir := TrashPath(job, destination) + "/" + entry.Entry
+		if err := exec.CommandContext(ctx, RcloneBinary(), "purge", dir).Run(); err != nil {
+			Errorln("failed to empty trash", dir+":", err)
+			continue
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		expiry := job.Trash.Expiry
+		if expiry == "" {
+			expiry = DefaultTrashExpiry
+		}
+		Infoln("emptied", boldCyan(strconv.Itoa(pruned)), emerald.Green+"trash folders", "older than", expiry)
+	}
+}
+
+type datedFolder struct {
+	name    string
+	created time.Time
+}
+
+// listDatedFolders returns the timestamped folders at a path, such as versions or trash folders, oldest first
+func listDatedFolders(ctx context.Context, base string) ([]datedFolder, error) {
+	out, err := exec.CommandContext(ctx, RcloneBinary(), "lsf", "--dirs-only", base).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		// nothing has been moved there yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var folders []datedFolder
+	for _, dir := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		dir = strings.TrimSuffix(dir, "/")
+		created, err := time.ParseInLocation(DefaultDateLayout, dir, time.Local)
+		if err != nil {
+			// not one of ours
+			continue
+		}
+		folders = append(folders, datedFolder{name: dir, created: created})
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].created.Before(folders[j].created) })
+	return folders, nil
+}
+
+// ListTrash returns the folders in the trash of a destination, oldest first
+func ListTrash(ctx context.Context, job JobConfig, destination string) ([]TrashEntry, error) {
+	folders, err := listDatedFolders(ctx, TrashPath(job, destination))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TrashEntry, 0, len(folders))
+	for _, folder := range folders {
+		entries = append(entries, TrashEntry{Destination: destination, Entry: folder.name, Trashed: folder.created, Expires: folder.created.Add(trashExpiry(job))})
+	}
+	return entries, nil
+}
+
+// ListTrashFiles returns the files in a folder of the trash
+func ListTrashFiles(ctx context.Context, job JobConfig, destination string, entry string) ([]string, error) {
+	return listFiles(ctx, TrashPath(job, destination)+"/"+entry)
+}
+
+// listFiles returns the paths of every file in a folder
+func listFiles(ctx context.Context, dir string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, RcloneBinary(), "lsf", "-R", "--files-only", dir).Output()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0)
+	for _, file := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// RestoreTrash moves a file or folder of the trash back to where it was in the destination
+func RestoreTrash(ctx context.Context, job JobConfig, restore TrashRestore) error {
+	destinations := JobDestinations(job)
+	if restore.Destination == "" && len(destinations) == 1 {
+		restore.Destination = destinations[0]
+	}
+	if !ArrayContains(destinations, restore.Destination) {
+		return fmt.Errorf("'%s' is not a destination of the job", restore.Destination)
+	}
+	if _, err := time.Parse(DefaultDateLayout, restore.Entry); err != nil {
+		return fmt.Errorf("invalid trash entry '%s'", restore.Entry)
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+restore.Path), "/")
+	from := TrashPath(job, restore.Destination) + "/" + restore.Entry
+	to := strings.TrimSuffix(restore.Destination, "/")
+	if rel != "" {
+		from += "/" + rel
+		to += "/" + rel
+	}
+	if err := exec.CommandContext(ctx, RcloneBinary(), "lsf", from).Run(); err != nil {
+		return fmt.Errorf("%w: %s", ErrNotInTrash, from)
+	}
+	Infoln("restoring", from, "to", to)
+	if out, err := exec.CommandContext(ctx, RcloneBinary(), "moveto", from, to).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore from trash: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	_ = exec.CommandContext(ctx, RcloneBinary(), "rmdirs", TrashPath(job, restore.Destination)+"/"+restore.Entry).Run()
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	RcloneDownloadURL     = "https://downloads.rclone.org"
+	DefaultUpdateSchedule = "30 4 * * 0"
+)
+
+var UpdatedRclonePath = filepath.Join(DataPath, "rclone", "rclone")
+
+type UpdateConfig struct {
+	Enabled  bool
+	Schedule string
+}
+
+// RcloneArch returns the rclone release architecture for this build
+func RcloneArch() string {
+	if runtime.GOARCH != "arm" {
+		return runtime.GOARCH
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "GOARM" && strings.HasPrefix(setting.Value, "7") {
+				return "arm-v7"
+			}
+		}
+	}
+	return "arm"
+}
+
+// LatestRcloneVersion fetches the version of the latest rclone release
+func LatestRcloneVersion() (string, error) {
+	data, err := httpGet(RcloneDownloadURL + "/version.txt")
+	if err != nil {
+		return "", err
+	}
+	// e.g. "rclone v1.72.1"
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(data)), "rclone")), nil
+}
+
+// UpdateRclone checks for a new rclone release and installs it to /data once no jobs are running
+func UpdateRclone() {
+	latest, err := LatestRcloneVersion()
+	if err != nil {
+		Errorln("failed to check for rclone updates:", err)
+		return
+	}
+
+	rcloneMu.Lock()
+	current := rcloneInfo.Version
+	rcloneInfo.AvailableVersion = latest
+	rcloneMu.Unlock()
+
+	if latest == current || CompareVersions(latest, current) <= 0 {
+		Debugln("rclone", current, "is up to date")
+		return
+	}
+
+	Infoln("downloading rclone", boldCyan(latest), "(currently "+current+")")
+	staged, err := DownloadRclone(latest)
+	if err != nil {
+		Errorln("failed to download rclone", latest+":", err)
+		return
+	}
+
+	rcloneMu.Lock()
+	rcloneInfo.UpdatePending = true
+	rcloneMu.Unlock()
+
+	// wait for a quiet window so a running job doesn't have its binary replaced
+	for statuses.AnyRunning() {
+		time.Sleep(30 * time.Second)
+	}
+
+	err = os.Rename(staged, UpdatedRclonePath)
+	if err != nil {
+		Errorln("failed to install rclone", latest+":", err)
+		return
+	}
+	path, version, err := RcloneVersion(UpdatedRclonePath)
+	if err != nil {
+		Errorln("installed rclone", latest, "is not working:", err)
+		_ = os.Remove(UpdatedRclonePath)
+		return
+	}
+
+	rcloneMu.Lock()
+	rcloneInfo.Path = path
+	rcloneInfo.Version = version
+	rcloneInfo.UpdatePending = false
+	rcloneMu.Unlock()
+	Infoln("switched to rclone", boldCyan(version))
+}
+
+// DownloadRclone downloads and verifies the release zip, returning the path to the staged binary
+func DownloadRclone(version string) (string, error) {
+	name := fmt.Sprintf("rclone-%s-linux-%s", version, RcloneArch())
+	base := RcloneDownloadURL + "/" + version + "/"
+
+	sums, err := httpGet(base + "SHA256SUMS")
+	if err != nil {
+		return "", err
+	}
+	expected := ""
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == name+".zip" {
+			expected = fields[0]
+		}
+	}
+	if expected == "" {
+		return "", errors.New("no checksum found for " + name + ".zip")
+	}
+
+	archive, err := httpGet(base + name + ".zip")
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(archive)
+	if hex.EncodeToString(sum[:]) != expected {
+		return "", errors.New("checksum mismatch for " + name + ".zip")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return "", err
+	}
+	for _, file := range zr.File {
+		if file.Name != name+"/rclone" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(UpdatedRclonePath), 0755); err != nil {
+			return "", err
+		}
+		staged := UpdatedRclonePath + ".new"
+		src, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(staged, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(dst, src)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		return staged, err
+	}
+	return "", errors.New("rclone binary not found in " + name + ".zip")
+}
+
+// CompareVersions compares two "v1.2.3" versions, returning -1, 0 or 1
+func CompareVersions(a string, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			_, _ = fmt.Sscanf(pa[i], "%d", &na)
+		}
+		if i < len(pb) {
+			_, _ = fmt.Sscanf(pb[i], "%d", &nb)
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// updateClient gives up on the release server after a while, a download of rclone takes a minute over slow connections
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code %d from %s", resp.StatusCode, url)
+	}
+	return io.ReadAll(resp.Body)
+}
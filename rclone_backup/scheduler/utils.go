@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/jcwillox/emerald"
 	"os/exec"
 	"strconv"
@@ -16,10 +17,7 @@ func PrintJobs(jobs []JobConfig) {
 		if len(job.Schedule) > lSchedule {
 			lSchedule = len(job.Schedule)
 		}
-		cmdLabel := job.Command
-		if job.Run != "" {
-			cmdLabel = "run"
-		}
+		cmdLabel := JobCommandLabel(job)
 		if len(cmdLabel) > lCommand {
 			lCommand = len(cmdLabel)
 		}
@@ -28,16 +26,17 @@ func PrintJobs(jobs []JobConfig) {
 	Infoln("scheduled jobs:")
 
 	for _, job := range config.Jobs {
-		if job.Schedule == "" {
+		if HotplugOnly(job) {
+			job.Schedule = "@hotplug"
+		} else if job.Schedule == "" {
 			job.Schedule = "@startup"
 		}
 		emerald.Print(job.Schedule, strings.Repeat(" ", lSchedule-len(job.Schedule)), " ")
-		cmdLabel := job.Command
-		if job.Run != "" {
-			cmdLabel = "run"
-		}
+		cmdLabel := JobCommandLabel(job)
 		emerald.Print(emerald.Yellow, cmdLabel, emerald.Reset, strings.Repeat(" ", lCommand-len(cmdLabel)), " ")
-		if job.Run != "" {
+		if len(job.Steps) > 0 {
+			emerald.Println(JobInfoSteps(job))
+		} else if job.Run != "" {
 			emerald.Println(JobInfoShell(job))
 		} else {
 			emerald.Println(JobInfo(job, ""))
@@ -45,6 +44,24 @@ func PrintJobs(jobs []JobConfig) {
 	}
 }
 
+// JobName returns the name of the job, or its index if it has no name
+func JobName(job JobConfig) string {
+	if job.Name == "" {
+		return fmt.Sprintf("job %d", job.Index)
+	}
+	return job.Name
+}
+
+// JobCommandLabel returns the command column shown for a job
+func JobCommandLabel(job JobConfig) string {
+	if len(job.Steps) > 0 {
+		return "steps"
+	} else if job.Run != "" {
+		return "run"
+	}
+	return job.Command
+}
+
 func FormatDuration(d time.Duration) string {
 	scale := 100 * time.Second
 	for scale > d {
@@ -53,6 +70,35 @@ func FormatDuration(d time.Duration) string {
 	return d.Round(scale / 100).String()
 }
 
+// FormatBytes formats a size using binary units like rclone, e.g. "1.5 GiB"
+func FormatBytes(b int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	size := float64(b)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatInt(b, 10) + " B"
+	}
+	return strconv.FormatFloat(size, 'f', 2, 64) + " " + units[i]
+}
+
+// FormatPercent formats a percentage with one decimal place
+func FormatPercent(p float64) string {
+	return strconv.FormatFloat(p, 'f', 1, 64)
+}
+
+// JoinRemote appends a name to a remote or local folder, e.g. "b2:" and "a.tar" becomes "b2:a.tar"
+func JoinRemote(folder string, name string) string {
+	folder = strings.TrimSuffix(folder, "/")
+	if folder == "" || strings.HasSuffix(folder, ":") {
+		return folder + name
+	}
+	return folder + "/" + name
+}
+
 func ArrayContains(arr []string, s string) bool {
 	for _, s2 := range arr {
 		if s == s2 {
@@ -84,7 +130,7 @@ func FlagMapToList(flags map[string]string) []string {
 }
 
 func GetRcloneRemotes() ([]string, error) {
-	cmd := exec.Command("rclone", "listremotes")
+	cmd := exec.Command(RcloneBinary(), "listremotes")
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, nil
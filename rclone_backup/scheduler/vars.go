@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDateLayout is used when a time is interpolated without a date filter
+const DefaultDateLayout = "2006-01-02_15-04-05"
+
+var exprPattern = regexp.MustCompile(`\{\{(.*?)\}\}`)
+
+// Interpolate evaluates "{{...}}" expressions in s, e.g. {{var.bucket}} or
+// {{now | date "2006-01"}}. Expressions that don't start with a value it knows, such as
+// the {{.Names}} of a docker format in a run command, are left as written.
+func Interpolate(s string, vars map[string]string, now time.Time) (string, error) {
+	var err error
+	out := exprPattern.ReplaceAllStringFunc(s, func(m string) string {
+		expr := exprPattern.FindStringSubmatch(m)[1]
+		if err != nil || !isExpr(expr) {
+			return m
+		}
+		var value string
+		value, err = evalExpr(expr, vars, now)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", strings.TrimSpace(m), err)
+		}
+		return value
+	})
+	return out, err
+}
+
+// ExpandJob interpolates variables into every string field of the job
+func ExpandJob(job JobConfig, now time.Time) (JobConfig, error) {
+	var err error
+	job = MapJobStrings(job, func(s string) string {
+		out, e := Interpolate(s, config.Variables, now)
+		if e != nil && err == nil {
+			err = e
+		}
+		return out
+	})
+	return job, err
+}
+
+// isExpr reports whether expr starts with a value evalExpr knows
+func isExpr(expr string) bool {
+	expr = strings.TrimSpace(expr)
+	head := expr
+	if end := strings.IndexAny(expr, " \t|"); end >= 0 {
+		head = expr[:end]
+	}
+	return head == "now" || strings.HasPrefix(head, "var.") || strings.HasPrefix(head, "env.") || strings.HasPrefix(head, `"`)
+}
+
+func evalExpr(expr string, vars map[string]string, now time.Time) (string, error) {
+	tokens, err := tokenizeExpr(expr)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("empty expression")
+	}
+
+	// evaluate the initial value, a time is kept until formatted by a filter
+	var value string
+	var t *time.Time
+	defined := true
+	head := tokens[0]
+	switch {
+	case head == "now":
+		t = &now
+	case strings.HasPrefix(head, "var."):
+		value, defined = vars[strings.TrimPrefix(head, "var.")]
+	case strings.HasPrefix(head, "env."):
+		value, defined = os.LookupEnv(strings.TrimPrefix(head, "env."))
+	case strings.HasPrefix(head, `"`):
+		value = head[1 : len(head)-1]
+	default:
+		return "", fmt.Errorf("unknown value '%s'", head)
+	}
+
+	// apply filters, each filter is "| name [arg]"
+	rest := tokens[1:]
+	for len(rest) > 0 {
+		if rest[0] != "|" || len(rest) < 2 {
+			return "", fmt.Errorf("expected '| filter' but got '%s'", strings.Join(rest, " "))
+		}
+		name := rest[1]
+		rest = rest[2:]
+		var arg string
+		if len(rest) > 0 && strings.HasPrefix(rest[0], `"`) {
+			arg = rest[0][1 : len(rest[0])-1]
+			rest = rest[1:]
+		}
+		switch name {
+		case "default":
+			if !defined || value == "" {
+				value, defined = arg, true
+			}
+		case "date":
+			if t == nil {
+				return "", fmt.Errorf("date filter can only be applied to now")
+			}
+			if arg == "" {
+				arg = DefaultDateLayout
+			}
+			value, t = t.Format(arg), nil
+		case "lower":
+			value = strings.ToLower(value)
+		case "upper":
+			value = strings.ToUpper(value)
+		case "trim":
+			value = strings.TrimSpace(value)
+		default:
+			return "", fmt.Errorf("unknown filter '%s'", name)
+		}
+	}
+
+	if !defined {
+		return "", fmt.Errorf("undefined variable '%s'", head)
+	}
+	if t != nil {
+		value = t.Format(DefaultDateLayout)
+	}
+	return value, nil
+}
+
+func tokenizeExpr(expr string) ([]string, error) {
+	var tokens []string
+	expr = strings.TrimSpace(expr)
+	for expr != "" {
+		switch {
+		case expr[0] == '|':
+			tokens = append(tokens, "|")
+			expr = expr[1:]
+		case expr[0] == '"':
+			quoted, err := strconv.QuotedPrefix(expr)
+			if err != nil {
+				return nil, fmt.Errorf("unterminated string in '%s'", expr)
+			}
+			unquoted, _ := strconv.Unquote(quoted)
+			tokens = append(tokens, `"`+unquoted+`"`)
+			expr = expr[len(quoted):]
+		default:
+			end := strings.IndexAny(expr, " \t|\"")
+			if end < 0 {
+				end = len(expr)
+			}
+			tokens = append(tokens, expr[:end])
+			expr = expr[end:]
+		}
+		expr = strings.TrimLeft(expr, " \t")
+	}
+	return tokens, nil
+}
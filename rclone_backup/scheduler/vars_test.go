@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInterpolate(t *testing.T) {
+	now := time.Date(2024, 7, 1, 2, 0, 0, 0, time.UTC)
+	vars := map[string]string{"bucket": "my-backups", "name": " Config ", "empty": ""}
+	t.Setenv("RCLONE_BACKUP_TEST", "from-env")
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "b2:backups", "b2:backups", false},
+		{"variable", "b2:{{var.bucket}}/config", "b2:my-backups/config", false},
+		{"spaces", "{{ var.bucket }}", "my-backups", false},
+		{"env", "{{env.RCLONE_BACKUP_TEST}}", "from-env", false},
+		{"now", "{{now}}", "2024-07-01_02-00-00", false},
+		{"date", `{{now | date "2006-01"}}`, "2024-07", false},
+		{"default", `{{var.missing | default "backups"}}`, "backups", false},
+		{"default of empty", `{{var.empty | default "backups"}}`, "backups", false},
+		{"filters", "{{var.name | trim | lower}}", "config", false},
+		{"quoted", `{{"literal" | upper}}`, "LITERAL", false},
+		{"several", `{{var.bucket}}/{{now | date "2006"}}`, "my-backups/2024", false},
+		{"docker format", "docker ps --format '{{.Names}}'", "docker ps --format '{{.Names}}'", false},
+		{"go template", "{{ .State.Status }} {{json .Config}}", "{{ .State.Status }} {{json .Config}}", false},
+		{"unknown head next to variable", "{{.ID}} {{var.bucket}}", "{{.ID}} my-backups", false},
+		{"param left for templates", "{{param.bucket}}", "{{param.bucket}}", false},
+		{"undefined variable", "{{var.missing}}", "", true},
+		{"unknown filter", "{{var.bucket | reverse}}", "", true},
+		{"date of variable", `{{var.bucket | date "2006"}}`, "", true},
+		{"unterminated string", `{{var.missing | default "x}}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Interpolate(tt.in, vars, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Interpolate(%q) err = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Interpolate(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandJob(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.Variables = map[string]string{"bucket": "my-backups"}
+	now := time.Date(2024, 7, 1, 2, 0, 0, 0, time.UTC)
+
+	job := JobConfig{
+		Name:        "Containers",
+		Run:         "docker ps --format '{{.Names}}' > /share/containers.txt",
+		Destination: "b2:{{var.bucket}}/{{now | date \"2006-01\"}}",
+		Flags:       Flags{"header-upload": "X-Bucket: {{var.bucket}}"},
+		ExtraFlags:  []string{"--template={{.Name}}"},
+	}
+	got, err := ExpandJob(job, now)
+	if err != nil {
+		t.Fatalf("ExpandJob() err = %v", err)
+	}
+	if got.Run != job.Run {
+		t.Errorf("run = %q, want it unchanged", got.Run)
+	}
+	if got.Destination != "b2:my-backups/2024-07" {
+		t.Errorf("destination = %q", got.Destination)
+	}
+	if got.Flags["header-upload"] != "X-Bucket: my-backups" {
+		t.Errorf("flags = %v", got.Flags)
+	}
+	if got.ExtraFlags[0] != "--template={{.Name}}" {
+		t.Errorf("extra flags = %v", got.ExtraFlags)
+	}
+
+	engines, err := ExpandJob(JobConfig{
+		Restic: ResticConfig{Repository: "rclone:b2:{{var.bucket}}/repo-{{now | date \"2006\"}}"},
+		Borg:   BorgConfig{Repository: "/backup/borg-{{now | date \"2006-01\"}}"},
+		Watch:  WatchConfig{Paths: []string{"/share/{{var.bucket}}"}},
+		MQTT:   MQTTTrigger{Topic: "backup/{{var.bucket}}"},
+	}, now)
+	if err != nil {
+		t.Fatalf("ExpandJob() err = %v", err)
+	}
+	if engines.Restic.Repository != "rclone:b2:my-backups/repo-2024" || engines.Borg.Repository != "/backup/borg-2024-07" {
+		t.Errorf("restic repository = %q, borg repository = %q", engines.Restic.Repository, engines.Borg.Repository)
+	}
+	if engines.Watch.Paths[0] != "/share/my-backups" || engines.MQTT.Topic != "backup/my-backups" {
+		t.Errorf("watch paths = %v, mqtt topic = %q", engines.Watch.Paths, engines.MQTT.Topic)
+	}
+
+	if _, err := ExpandJob(JobConfig{Destination: "{{var.missing}}"}, now); err == nil {
+		t.Errorf("ExpandJob() with an undefined variable didn't fail")
+	}
+}
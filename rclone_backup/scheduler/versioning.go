@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jcwillox/emerald"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersioningConfig keeps files deleted or overwritten by a run under a timestamped --backup-dir
+type VersioningConfig struct {
+	Enabled   bool
+	Path      string
+	Retention string
+}
+
+// ParseAge parses a duration that also accepts days and weeks, e.g. "30d" or "2w"
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration '%s'", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// VersionsPath returns the directory holding the versions of a destination,
+// by default a sibling of the destination so the two don't overlap
+func VersionsPath(job JobConfig, destination string) string {
+	if job.Versioning.Path != "" {
+		return strings.TrimSuffix(job.Versioning.Path, "/")
+	}
+	return strings.TrimSuffix(destination, "/") + ".versions"
+}
+
+func CheckVersioning(job JobConfig) error {
+	if !job.Versioning.Enabled {
+		return nil
+	}
+	if len(job.Destinations) == 0 {
+		return fmt.Errorf("versioning requires a destination")
+	}
+	if job.Versioning.Retention != "" {
+		if _, err := ParseAge(job.Versioning.Retention); err != nil {
+			return fmt.Errorf("versioning retention: %w", err)
+		}
+	}
+	return nil
+}
+
+// PruneVersions purges timestamped version directories older than the retention
+func PruneVersions(ctx context.Context, job JobConfig, destination string) {
+	if job.Versioning.Retention == "" {
+		return
+	}
+	retention, _ := ParseAge(job.Versioning.Retention)
+	base := VersionsPath(job, destination)
+	out, err := exec.CommandContext(ctx, RcloneBinary(), "lsf", "--dirs-only", base).Output()
+	if err != nil {
+		Errorln("failed to list versions at", base+":", err)
+		return
+	}
+	cutoff := time.Now().Add(-retention)
+	pruned := 0
+	for _, dir := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		dir = strings.TrimSuffix(dir, "/")
+		created, err := time.ParseInLocation(DefaultDateLayout, dir, time.Local)
+		if err != nil || created.After(cutoff) {
+			// not one of ours or still within retention
+			continue
+		}
+		if job.Trash.Enabled {
+			err = TrashVersion(ctx, job, destination, base+"/"+dir)
+		} else {
+			err = exec.CommandContext(ctx, RcloneBinary(), "purge", base+"/"+dir).Run()
+		}
+		if err != nil {
+			Errorln("failed to prune version", base+"/"+dir+":", err)
+			continue
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		Infoln("pruned", boldCyan(strconv.Itoa(pruned)), emerald.Green+"versions", "older than", job.Versioning.Retention)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ConfigFolders are the locations of the Home Assistant config folder, /config is used by older installs
+var ConfigFolders = []string{"/homeassistant", "/config"}
+
+// configVolatile are files in the Home Assistant config folder that are rewritten while it is running,
+// a copy of the recorder database with its journal taken mid-write can't be opened after a restore
+var configVolatile = append([]string{
+	"home-assistant_v2.db-wal", "home-assistant_v2.db-shm", "home-assistant.log*",
+	"tts/**", "ozwcache_*.xml", ".storage/*.tmp",
+}, excludeVolatile...)
+
+// InConfigFolder reports whether a path is inside the Home Assistant config folder
+func InConfigFolder(path string) bool {
+	path = filepath.Clean(path)
+	for _, folder := range ConfigFolders {
+		if path == folder || strings.HasPrefix(path, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AddVolatileExcludes adds the volatile files to the excludes of jobs that back up the Home Assistant config folder
+func AddVolatileExcludes(job JobConfig) JobConfig {
+	// include rules already select exactly what is backed up
+	if config.NoVolatileExcludes || job.NoVolatileExcludes || job.Run != "" || len(job.Include) > 0 {
+		return job
+	}
+	found := false
+	for _, source := range job.Sources {
+		found = found || InConfigFolder(source)
+	}
+	if !found {
+		return job
+	}
+	exclude := append([]string{}, job.Exclude...)
+	for _, pattern := range configVolatile {
+		if !slices.Contains(exclude, pattern) {
+			exclude = append(exclude, pattern)
+		}
+	}
+	job.Exclude = exclude
+	return job
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/jcwillox/emerald"
+)
+
+const DefaultVPNTimeout = 30 * time.Second
+
+// vpnPollInterval is how often the tunnel is checked while waiting for it to come up
+const vpnPollInterval = 2 * time.Second
+
+// VPNConfig holds a job back until the tunnel its remotes are reached through is up
+type VPNConfig struct {
+	Interface string // network interface that must be up, e.g. wg0
+	Host      string // host that must answer a ping, or host:port that must accept a connection
+	Entity    string // Home Assistant entity that must be in state
+	State     string // expected state of the entity, defaults to "on"
+	Up        string // shell command bringing the tunnel up when it is down
+	Down      string // shell command run after the job when the tunnel was brought up by up
+	Timeout   string // how long to wait for the tunnel after running up
+}
+
+// VPNEnabled reports whether the job depends on a tunnel
+func VPNEnabled(job JobConfig) bool {
+	return job.VPN.Interface != "" || job.VPN.Host != "" || job.VPN.Entity != ""
+}
+
+// CheckVPNConfig validates the vpn option of a job
+func CheckVPNConfig(job JobConfig) error {
+	if !VPNEnabled(job) {
+		if job.VPN.Up != "" || job.VPN.Down != "" {
+			return errors.New("vpn: up and down require an interface, host or entity to check")
+		}
+		return nil
+	}
+	if job.VPN.Timeout != "" {
+		if _, err := time.ParseDuration(job.VPN.Timeout); err != nil {
+			return fmt.Errorf("vpn: invalid timeout '%s'", job.VPN.Timeout)
+		}
+	}
+	return nil
+}
+
+// checkTunnel returns why the tunnel of the job is not usable, or nil when it is up
+func checkTunnel(ctx context.Context, vpn VPNConfig) error {
+	if vpn.Interface != "" {
+		iface, err := net.InterfaceByName(vpn.Interface)
+		if err != nil {
+			return fmt.Errorf("interface %s does not exist", vpn.Interface)
+		}
+		addresses, _ := iface.Addrs()
+		if iface.Flags&net.FlagUp == 0 || len(addresses) == 0 {
+			return fmt.Errorf("interface %s is down", vpn.Interface)
+		}
+	}
+	if vpn.Host != "" {
+		if err := CheckHost(ctx, vpn.Host); err != nil {
+			return err
+		}
+	}
+	if vpn.Entity != "" {
+		expected := vpn.State
+		if expected == "" {
+			expected = "on"
+		}
+		var state struct{ State string }
+		if err := CoreAPIGet("/states/"+url.PathEscape(vpn.Entity), &state); err != nil {
+			return fmt.Errorf("failed to get state of %s: %w", vpn.Entity, err)
+		}
+		if state.State != expected {
+			return fmt.Errorf("%s is %s, not %s", vpn.Entity, state.State, expected)
+		}
+	}
+	return nil
+}
+
+// CheckHost pings a host, or when a port is given connects to it
+func CheckHost(ctx context.Context, host string) error {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		dialer := net.Dialer{Timeout: 5 * time.Second}
+		conn, err := dialer.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return fmt.Errorf("%s is not reachable: %w", host, err)
+		}
+		return conn.Close()
+	}
+	if err := exec.CommandContext(ctx, "ping", "-c", "1", "-W", "3", host).Run(); err != nil {
+		return fmt.Errorf("%s does not answer ping", host)
+	}
+	return nil
+}
+
+// runHook runs a shell command before or after a job, logging its output with the job
+func runHook(ctx context.Context, job JobConfig, command string) error {
+	Debugln("running hook", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	output := JobLog(os.Stdout, job.Index)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	emerald.Print(emerald.Blue)
+	err := cmd.Run()
+	emerald.Print(emerald.Reset)
+	return err
+}
+
+// WaitForVPN checks the tunnel of the job is up, bringing it up with the up command when it isn't,
+// the returned function runs the down command and must be called when the job finishes
+func WaitForVPN(ctx context.Context, job JobConfig) (func(), error) {
+	if !VPNEnabled(job) {
+		return func() {}, nil
+	}
+	err := checkTunnel(ctx, job.VPN)
+	if err == nil {
+		Debugln("vpn is up")
+		return func() {}, nil
+	}
+	if job.VPN.Up == "" {
+		return nil, fmt.Errorf("vpn is not up, %s", err)
+	}
+
+	Infoln("vpn is not up,", err.Error()+", bringing it up")
+	if err := runHook(ctx, job, job.VPN.Up); err != nil {
+		return nil, fmt.Errorf("failed to bring vpn up: %w", err)
+	}
+	down := func() {
+		if job.VPN.Down == "" {
+			return
+		}
+		Infoln("bringing vpn down")
+		// the job's context may be cancelled, the tunnel still has to be closed
+		if err := runHook(context.Background(), job, job.VPN.Down); err != nil {
+			Errorln("failed to bring vpn down:", err)
+		}
+	}
+
+	timeout := DefaultVPNTimeout
+	if job.VPN.Timeout != "" {
+		timeout, _ = time.ParseDuration(job.VPN.Timeout)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if err = checkTunnel(ctx, job.VPN); err == nil {
+			Infoln("vpn is up")
+			return down, nil
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			down()
+			return nil, fmt.Errorf("vpn did not come up within %s, %s", FormatDuration(timeout), err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(vpnPollInterval):
+		}
+	}
+}
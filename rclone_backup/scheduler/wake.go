@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const DefaultWakeBroadcast = "255.255.255.255:9"
+
+const DefaultWakeTimeout = 5 * time.Minute
+
+const WakeViaHomeAssistant = "homeassistant"
+
+// wakeResendInterval is how often the magic packet is sent again while waiting, in case one was lost
+const wakeResendInterval = time.Minute
+
+// WakeConfig wakes the target of a job with a Wake-on-LAN packet before it runs
+type WakeConfig struct {
+	MAC       string `yaml:"mac"`
+	Broadcast string // address the magic packet is sent to, defaults to 255.255.255.255:9
+	Via       string // "homeassistant" sends the packet with the wake_on_lan integration, which is on the host network
+	Host      string // host that must answer a ping, or host:port that must accept a connection, e.g. nas:445
+	Remote    string // rclone remote that must be listable, e.g. nas:
+	Timeout   string // how long to wait for the target to wake up
+	Shutdown  string // shell command run after the job when the target was woken up
+}
+
+// CheckWake validates the wake option of a job
+func CheckWake(job JobConfig) error {
+	if job.Wake.MAC == "" {
+		if job.Wake != (WakeConfig{}) {
+			return errors.New("wake: requires the mac address of the target")
+		}
+		return nil
+	}
+	if _, err := net.ParseMAC(job.Wake.MAC); err != nil {
+		return fmt.Errorf("wake: invalid mac address '%s'", job.Wake.MAC)
+	}
+	if job.Wake.Via != "" && job.Wake.Via != WakeViaHomeAssistant {
+		return fmt.Errorf("wake: via must be '%s' or empty to send the packet from the addon", WakeViaHomeAssistant)
+	}
+	if job.Wake.Host == "" && job.Wake.Remote == "" {
+		return errors.New("wake: requires a host or remote to wait for")
+	}
+	if job.Wake.Broadcast != "" {
+		if _, _, err := net.SplitHostPort(job.Wake.Broadcast); err != nil {
+			return fmt.Errorf("wake: invalid broadcast address '%s', must be host:port", job.Wake.Broadcast)
+		}
+	}
+	if job.Wake.Timeout != "" {
+		if _, err := time.ParseDuration(job.Wake.Timeout); err != nil {
+			return fmt.Errorf("wake: invalid timeout '%s'", job.Wake.Timeout)
+		}
+	}
+	return nil
+}
+
+// SendMagicPacket broadcasts a Wake-on-LAN packet, 6 bytes of 0xff followed by the mac address 16 times
+func SendMagicPacket(mac string, broadcast string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if broadcast == "" {
+		broadcast = DefaultWakeBroadcast
+	}
+	packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hw, 16)...)
+	addr, err := net.ResolveUDPAddr("udp4", broadcast)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+// sendWake sends the magic packet of the job from the addon or through Home Assistant
+func sendWake(wake WakeConfig) error {
+	if wake.Via != WakeViaHomeAssistant {
+		return SendMagicPacket(wake.MAC, wake.Broadcast)
+	}
+	data := map[string]interface{}{"mac": wake.MAC}
+	if wake.Broadcast != "" {
+		host, port, _ := net.SplitHostPort(wake.Broadcast)
+		data["broadcast_address"] = host
+		if number, err := strconv.Atoi(port); err == nil {
+			data["broadcast_port"] = number
+		}
+	}
+	return CoreAPIRequest(http.MethodPost, "/services/wake_on_lan/send_magic_packet", data)
+}
+
+// checkAwake returns why the target of the job isn't responding, or nil when it is
+func checkAwake(ctx context.Context, wake WakeConfig) error {
+	if wake.Host != "" {
+		if err := CheckHost(ctx, wake.Host); err != nil {
+			return err
+		}
+	}
+	if wake.Remote != "" {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if err := exec.CommandContext(ctx, RcloneBinary(), "lsf", "--max-depth", "1", wake.Remote).Run(); err != nil {
+			return fmt.Errorf("remote %s is not responding", wake.Remote)
+		}
+	}
+	return nil
+}
+
+// WakeTarget wakes the target of the job and waits for it to respond, the returned function
+// runs the shutdown command and must be called when the job finishes
+func WakeTarget(ctx context.Context, job JobConfig) (func(), error) {
+	if job.Wake.MAC == "" {
+		return func() {}, nil
+	}
+	if checkAwake(ctx, job.Wake) == nil {
+		Debugln("wake target is already awake")
+		return func() {}, nil
+	}
+
+	timeout := DefaultWakeTimeout
+	if job.Wake.Timeout != "" {
+		timeout, _ = time.ParseDuration(job.Wake.Timeout)
+	}
+	Infoln("waking", job.Wake.MAC, "and waiting up to", FormatDuration(timeout))
+	start := time.Now()
+	var sent time.Time
+	for {
+		if time.Since(sent) >= wakeResendInterval {
+			if err := sendWake(job.Wake); err != nil {
+				return nil, fmt.Errorf("failed to send wake-on-lan packet: %w", err)
+			}
+			sent = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+		err := checkAwake(ctx, job.Wake)
+		if err == nil {
+			break
+		}
+		if time.Since(start) > timeout {
+			return nil, fmt.Errorf("target did not wake up within %s, %s", FormatDuration(timeout), err)
+		}
+	}
+	Infoln("target woke up in", boldCyan(FormatDuration(time.Since(start))))
+
+	return func() {
+		if job.Wake.Shutdown == "" {
+			return
+		}
+		Infoln("shutting down wake target")
+		// the job's context may be cancelled, the target should still be shut down
+		if err := runHook(context.Background(), job, job.Wake.Shutdown); err != nil {
+			Errorln("failed to shut down wake target:", err)
+		}
+	}, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultWatchQuiet   = "30s"
+	DefaultWatchMaxWait = "5m"
+	// watchMask are the changes that trigger a run, files are only counted once they have been written
+	watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+)
+
+// WatchConfig runs a job when files in its local sources change, after the changes have stopped for the quiet
+// period so a burst of files is uploaded in one run
+type WatchConfig struct {
+	Enabled bool
+	Paths   []string // folders to watch, defaults to the local sources of the job
+	Quiet   string   // how long no files may change before the job runs
+	MaxWait string   `yaml:"max_wait"` // longest a run is delayed by files that keep changing
+}
+
+// JobWatcher watches the folders of one job using inotify
+type JobWatcher struct {
+	job     JobConfig
+	fd      int
+	mu      sync.Mutex
+	folders map[int]string // watched folder of each watch descriptor
+	changed chan struct{}
+}
+
+// WatchPaths returns the folders watched for a job
+func WatchPaths(job JobConfig) []string {
+	if len(job.Watch.Paths) > 0 {
+		return job.Watch.Paths
+	}
+	var paths []string
+	for _, source := range job.Sources {
+		if !strings.Contains(source, ":") {
+			paths = append(paths, filepath.Clean(source))
+		}
+	}
+	for _, step := range job.Steps {
+		if step.Source != "" && !strings.Contains(step.Source, ":") {
+			paths = append(paths, filepath.Clean(step.Source))
+		}
+	}
+	return paths
+}
+
+// CheckWatch validates the watch options of a job
+func CheckWatch(job JobConfig) error {
+	if !job.Watch.Enabled {
+		return nil
+	}
+	for _, option := range []struct{ name, value string }{{"quiet", job.Watch.Quiet}, {"max_wait", job.Watch.MaxWait}} {
+		if option.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(option.value); err != nil || d <= 0 {
+			return fmt.Errorf("watch: invalid %s '%s'", option.name, option.value)
+		}
+	}
+	paths := WatchPaths(job)
+	if len(paths) == 0 {
+		return errors.New("watch requires a local source or paths to watch")
+	}
+	for _, path := range paths {
+		if strings.Contains(path, ":") {
+			return fmt.Errorf("watch can only watch local folders, not '%s'", path)
+		}
+		// a run writing into a watched folder would trigger itself
+		for _, destination := range JobDestinations(job) {
+			destination = filepath.Clean(destination)
+			if destination == path || strings.HasPrefix(destination, path+"/") {
+				return fmt.Errorf("watch: destination '%s' is inside the watched folder '%s'", destination, path)
+			}
+		}
+	}
+	return nil
+}
+
+func watchDuration(value string, fallback string) time.Duration {
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+	d, _ := time.ParseDuration(fallback)
+	return d
+}
+
+// StartWatchers starts watching the folders of every job with watch enabled
+func StartWatchers() {
+	for _, job := range config.Jobs {
+		if !job.Watch.Enabled {
+			continue
+		}
+		watcher, err := NewJobWatcher(job)
+		if err != nil {
+			Errorln("failed to watch the folders of", "'"+job.Name+"':", err)
+			continue
+		}
+		go watcher.read()
+		go watcher.debounce()
+	}
+}
+
+// NewJobWatcher watches the folders of a job and every folder in them
+func NewJobWatcher(job JobConfig) (*JobWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &JobWatcher{job: job, fd: fd, folders: make(map[int]string), changed: make(chan struct{}, 1)}
+	for _, path := range WatchPaths(job) {
+		if err := w.addTree(path); err != nil {
+			_ = syscall.Close(fd)
+			return nil, err
+		}
+	}
+	Infoln("watching", len(w.folders), "folders of", "'"+job.Name+"'", "for changes")
+	return w, nil
+}
+
+// addTree watches a folder and the folders in it
+func (w *JobWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path != root && errors.Is(err, fs.ErrNotExist) {
+				// removed while walking
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if errors.Is(err, syscall.ENOSPC) {
+			return fmt.Errorf("too many folders to watch, raise fs.inotify.max_user_watches on the host: %w", err)
+		}
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		w.folders[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// read reads the inotify events, watching new folders as they are created
+func (w *JobWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || n <= 0 {
+			Errorln("stopped watching the folders of", "'"+w.job.Name+"':", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			wd := int(int32(binary.NativeEndian.Uint32(buf[offset:])))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			name := string(bytes.TrimRight(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+length], "\x00"))
+			offset += syscall.SizeofInotifyEvent + length
+			w.mu.Lock()
+			folder := w.folders[wd]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.folders, wd)
+			}
+			w.mu.Unlock()
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				Warnln("too many changes in the folders of", "'"+w.job.Name+"',", "some were missed")
+			}
+			if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && folder != "" {
+				if err := w.addTree(filepath.Join(folder, name)); err != nil {
+					Warnln("failed to watch", filepath.Join(folder, name)+":", err)
+				}
+			}
+			if mask&(watchMask|syscall.IN_Q_OVERFLOW) != 0 {
+				Debugln("changed:", filepath.Join(folder, name))
+				select {
+				case w.changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// debounce runs the job once no files have changed for the quiet period, or max_wait after the first change
+func (w *JobWatcher) debounce() {
+	quiet := watchDuration(w.job.Watch.Quiet, DefaultWatchQuiet)
+	maxWait := watchDuration(w.job.Watch.MaxWait, DefaultWatchMaxWait)
+	job := w.job
+	job.Trigger = TriggerWatch
+	run := SkipIfPaused(job, runQueue.Task(job, RunTracked))
+	for range w.changed {
+		deadline := time.After(maxWait)
+		timer := time.NewTimer(quiet)
+	wait:
+		for {
+			select {
+			case <-w.changed:
+				timer.Reset(quiet)
+			case <-timer.C:
+				break wait
+			case <-deadline:
+				timer.Stop()
+				break wait
+			}
+		}
+		Infoln("files changed in the folders of", "'"+job.Name+"',", "running it")
+		// changes made while the job runs start the next run
+		run()
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+)
+
+// wizardSources are the folders of Home Assistant mapped into the addon, the setup wizard offers those that exist
+var wizardSources = []string{"/backup", "/homeassistant", "/config", "/share", "/media", "/addon_configs", "/addons", "/ssl"}
+
+// exampleJobName is the job of the default options of the addon, it is replaced by the first job of the wizard
+const exampleJobName = "Sync Daily Backups"
+
+// WizardInfo is what the setup wizard offers to choose from
+type WizardInfo struct {
+	Needed    bool     `json:"needed"` // there are no jobs yet, or only the example job
+	Remotes   []string `json:"remotes"`
+	Sources   []string `json:"sources"`
+	Services  []string `json:"services"`  // notify services of Home Assistant
+	Notifiers []string `json:"notifiers"` // configured notifiers
+	Restart   bool     `json:"restart"`   // the addon can restart itself to run the new job
+}
+
+// WizardJob is the job the setup wizard creates
+type WizardJob struct {
+	Name      string   `json:"name"`
+	Sources   []string `json:"sources"`
+	Remote    string   `json:"remote"`
+	Path      string   `json:"path"`    // on the remote
+	Command   string   `json:"command"` // copy or sync
+	Schedule  string   `json:"schedule"`
+	Retention string   `json:"retention"` // how long deleted and changed files are kept on the remote, if set
+	Service   string   `json:"service"`   // notify service of Home Assistant, added as a notifier
+	Notifier  string   `json:"notifier"`  // or a configured notifier
+	NotifyAll bool     `json:"notify_all"`
+}
+
+// SetupNeeded reports whether no backup has been set up yet, the addon only has the example job of its default
+// options or no jobs at all
+func SetupNeeded() bool {
+	return len(config.Jobs) == 0 || (len(config.Jobs) == 1 && config.Jobs[0].Name == exampleJobName && config.DryRun)
+}
+
+// GetWizardInfo returns the remotes, sources and notifiers the setup wizard offers
+func GetWizardInfo() WizardInfo {
+	info := WizardInfo{Needed: SetupNeeded(), Remotes: []string{}, Sources: []string{}, Services: []string{}, Notifiers: []string{}, Restart: HasSupervisor()}
+	// remotes may have been added since the addon started
+	if list, err := GetRcloneRemotes(); err == nil {
+		info.Remotes = append(info.Remotes, list...)
+	} else {
+		Warnln("failed to retrieve list of rclone remotes:", err)
+		info.Remotes = append(info.Remotes, remotes...)
+	}
+	for _, source := range wizardSources {
+		if stat, err := os.Stat(source); err == nil && stat.IsDir() {
+			info.Sources = append(info.Sources, source)
+		}
+	}
+	if HasSupervisor() {
+		var services []struct {
+			Domain   string                 `json:"domain"`
+			Services map[string]interface{} `json:"services"`
+		}
+		if err := CoreAPIGet("/services", &services); err != nil {
+			Debugln("failed to list notify services:", err)
+		}
+		for _, domain := range services {
+			if domain.Domain != "notify" {
+				continue
+			}
+			for name := range domain.Services {
+				info.Services = append(info.Services, "notify."+name)
+			}
+		}
+		slices.Sort(info.Services)
+	}
+	for _, notifier := range config.Notifiers {
+		info.Notifiers = append(info.Notifiers, notifier.Name)
+	}
+	return info
+}
+
+// Check validates the choices of the wizard before they are added to the options
+func (w WizardJob) Check() error {
+	if strings.TrimSpace(w.Name) == "" {
+		return errors.New("the job needs a name")
+	}
+	if len(w.Sources) == 0 {
+		return errors.New("pick at least one folder to back up")
+	}
+	if w.Command != "copy" && w.Command != "sync" {
+		return fmt.Errorf("invalid command '%s', expected copy or sync", w.Command)
+	}
+	remotes, err := GetRcloneRemotes()
+	if err != nil {
+		return err
+	}
+	if !ArrayContains(remotes, w.Remote) {
+		return fmt.Errorf("remote '%s' does not exist", w.Remote)
+	}
+	if _, err := cron.ParseStandard(w.Schedule); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	if w.Retention != "" {
+		if _, err := ParseAge(w.Retention); err != nil {
+			return fmt.Errorf("invalid retention: %w", err)
+		}
+	}
+	if w.Notifier != "" && FindNotifier(w.Notifier) == nil {
+		return fmt.Errorf("unknown notifier '%s'", w.Notifier)
+	}
+	if w.Service != "" && !strings.HasPrefix(w.Service, "notify.") {
+		return fmt.Errorf("invalid service '%s', expected e.g. notify.mobile_app_phone", w.Service)
+	}
+	return nil
+}
+
+// job returns the job of the wizard as options, sending its notifications to notifier if set
+func (w WizardJob) job(notifier string) map[string]interface{} {
+	job := map[string]interface{}{
+		"name":        strings.TrimSpace(w.Name),
+		"schedule":    w.Schedule,
+		"command":     w.Command,
+		"sources":     w.Sources,
+		"destination": w.Remote + strings.TrimPrefix(w.Path, "/"),
+	}
+	if w.Retention != "" {
+		job["versioning"] = map[string]interface{}{"enabled": true, "retention": w.Retention}
+	}
+	if notifier != "" {
+		notify := map[string]interface{}{"notifiers": []string{notifier}}
+		if w.NotifyAll {
+			notify["states"] = []string{StateSuccess, StateWarning, StateFailed, StateSuspicious}
+		}
+		job["notify"] = notify
+	}
+	return job
+}
+
+// AddWizardJob adds a checked job of the setup wizard to the options and saves them, replacing the example job of
+// the default options and leaving dry run mode so the job really backs up
+func AddWizardJob(w WizardJob, token string) (ConfigValidation, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ConfigValidation{}, err
+	}
+	if len(data) > 0 {
+		if data, err = ConfigJSON(data); err != nil {
+			return ConfigValidation{}, err
+		}
+	}
+	options := make(map[string]interface{})
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &options); err != nil {
+			return ConfigValidation{}, err
+		}
+	}
+	jobs, _ := options["jobs"].([]interface{})
+	if SetupNeeded() {
+		jobs = nil
+		delete(options, "dry_run")
+	}
+
+	notifier := w.Notifier
+	if w.Service != "" {
+		notifiers, _ := options["notifiers"].([]interface{})
+		notifier = ""
+		names := make([]string, 0, len(notifiers))
+		for _, n := range notifiers {
+			n, _ := n.(map[string]interface{})
+			name, _ := n["name"].(string)
+			names = append(names, name)
+			if n["service"] == w.Service {
+				notifier = name
+			}
+		}
+		if notifier == "" {
+			notifier = strings.TrimPrefix(w.Service, "notify.")
+			for i := 2; slices.Contains(names, notifier); i++ {
+				notifier = fmt.Sprintf("%s_%d", strings.TrimPrefix(w.Service, "notify."), i)
+			}
+			options["notifiers"] = append(notifiers, map[string]interface{}{"name": notifier, "service": w.Service})
+		}
+	}
+	options["jobs"] = append(jobs, w.job(notifier))
+
+	text, err := json.Marshal(options)
+	if err != nil {
+		return ConfigValidation{}, err
+	}
+	return SaveConfig(text, ConfigVersion{Source: VersionWizard, Token: token})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const DefaultWorkersInterval = "30s"
+
+// idleFactor is how far below the limits the load has to drop before another run is allowed
+const idleFactor = 0.75
+
+// WorkersConfig lets scheduled runs of different jobs run at the same time, with fewer of them
+// while the system or Home Assistant is busy
+type WorkersConfig struct {
+	Max        int     // scheduled runs at once
+	MaxLoad    float64 `yaml:"max_load"`     // 1 minute load average per cpu
+	MaxCoreCPU float64 `yaml:"max_core_cpu"` // cpu percent used by Home Assistant Core
+	Interval   string  // how often the load is checked
+	SameDisk   bool    `yaml:"same_disk"` // let runs reading from the same local disk run at once
+}
+
+func CheckWorkers() error {
+	workers := config.Workers
+	if workers.Max < 0 || workers.MaxLoad < 0 || workers.MaxCoreCPU < 0 {
+		return fmt.Errorf("workers: limits can't be negative")
+	}
+	if workers.Interval != "" {
+		if d, err := time.ParseDuration(workers.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid workers interval '%s'", workers.Interval)
+		}
+	}
+	if workers.Max > 1 {
+		Warnln("up to", workers.Max, "scheduled jobs may run at once, jobs using the same remote or files can conflict")
+	}
+	return nil
+}
+
+// SystemLoad returns the 1 minute load average per cpu
+func SystemLoad() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid /proc/loadavg")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
+
+// CoreCPU returns the cpu percent used by Home Assistant Core from the Supervisor stats
+func CoreCPU() (float64, error) {
+	var stats struct {
+		CPUPercent float64 `json:"cpu_percent"`
+	}
+	if err := SupervisorGet("/core/stats", &stats); err != nil {
+		return 0, err
+	}
+	return stats.CPUPercent, nil
+}
+
+// StartWorkers sets the number of runs allowed at once and, when load limits are set, adjusts it every interval
+func StartWorkers() {
+	workers := config.Workers
+	limit := max(workers.Max, 1)
+	runQueue.SetLimit(limit)
+	if limit == 1 || (workers.MaxLoad == 0 && workers.MaxCoreCPU == 0) {
+		return
+	}
+	interval, err := time.ParseDuration(workers.Interval)
+	if err != nil || interval <= 0 {
+		interval, _ = time.ParseDuration(DefaultWorkersInterval)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			busy, idle, reason := sampleLoad(workers)
+			current := runQueue.Limit()
+			if busy && current > 1 {
+				Infoln("system is busy ("+reason+"), running at most", current-1, "scheduled jobs at once")
+				runQueue.SetLimit(current - 1)
+			} else if idle && current < limit {
+				Debugln("system is idle ("+reason+"), running at most", current+1, "scheduled jobs at once")
+				runQueue.SetLimit(current + 1)
+			}
+		}
+	}()
+}
+
+// sampleLoad reports whether the load is over the limits, or far enough below them to allow another run
+func sampleLoad(workers WorkersConfig) (busy bool, idle bool, reason string) {
+	idle = true
+	var reasons []string
+	if workers.MaxLoad > 0 {
+		if load, err := SystemLoad(); err != nil {
+			Debugln("failed to read system load:", err)
+			idle = false
+		} else {
+			reasons = append(reasons, fmt.Sprintf("load %.2f per cpu", load))
+			busy = busy || load > workers.MaxLoad
+			idle = idle && load < workers.MaxLoad*idleFactor
+		}
+	}
+	if workers.MaxCoreCPU > 0 {
+		if cpu, err := CoreCPU(); err != nil {
+			Debugln("failed to read home assistant cpu usage:", err)
+			idle = false
+		} else {
+			reasons = append(reasons, fmt.Sprintf("home assistant cpu %.0f%%", cpu))
+			busy = busy || cpu > workers.MaxCoreCPU
+			idle = idle && cpu < workers.MaxCoreCPU*idleFactor
+		}
+	}
+	return busy, idle && !busy, strings.Join(reasons, ", ")
+}
+
+// SourceDisks returns the devices of the filesystems the local sources of a job are on
+func SourceDisks(job JobConfig) []uint64 {
+	job, err := ExpandJob(job, time.Now())
+	if err != nil {
+		return nil
+	}
+	var disks []uint64
+	for _, source := range job.Sources {
+		if strings.Contains(source, ":") {
+			continue
+		}
+		// the source may not exist yet or be a pattern, its closest existing parent is on the same disk
+		path := filepath.Clean(source)
+		for {
+			info, err := os.Stat(path)
+			if err == nil {
+				if stat, ok := info.Sys().(*syscall.Stat_t); ok && !slices.Contains(disks, uint64(stat.Dev)) {
+					disks = append(disks, uint64(stat.Dev))
+				}
+				break
+			}
+			if path == filepath.Dir(path) {
+				break
+			}
+			path = filepath.Dir(path)
+		}
+	}
+	return disks
+}